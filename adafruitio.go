@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Uploads readings to Adafruit IO feeds, a batch of data points to each feed
+// a metric is mapped to. Adafruit IO counts data points against a rate limit
+// per minute, so when there are more readings than fit, some get skipped,
+// spread out so the feeds still follow along. See
+// https://io.adafruit.com/api/docs/#create-multiple-data-records
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "adafruitio",
+		intervalKey: adafruitIOInterval,
+		enabled:     func() bool { return conf.GetString(adafruitIOUsername) != "" },
+		open:        openAdafruitIO,
+		addresses:   func() []string { return urlAddress(conf.GetString(adafruitIOURL), "") },
+	})
+	configChecks = append(configChecks, checkAdafruitIOSettings)
+}
+
+type adafruitIOData struct {
+	Value     string `json:"value"`
+	CreatedAt string `json:"created_at"`
+}
+
+type adafruitIOSink struct {
+	url     string
+	keyFile string
+	// The feed key for each metric
+	feeds  map[string]string
+	limit  int
+	client *http.Client
+
+	// Data points sent in the last minute, with when
+	sent []adafruitIOSent
+}
+
+type adafruitIOSent struct {
+	at     time.Time
+	points int
+}
+
+func openAdafruitIO() (sink, error) {
+	return &adafruitIOSink{
+		url:     strings.TrimSuffix(conf.GetString(adafruitIOURL), "/") + "/api/v2/" + url.PathEscape(conf.GetString(adafruitIOUsername)) + "/feeds/",
+		keyFile: conf.GetString(adafruitIOKeyFile),
+		feeds:   conf.GetStringMapString(adafruitIOFeeds),
+		limit:   conf.GetInt(adafruitIORateLimit),
+		client:  &http.Client{},
+	}, nil
+}
+
+// How many more data points can go this minute
+func (s *adafruitIOSink) budget(now time.Time) int {
+	n := 0
+	for len(s.sent) > 0 && now.Sub(s.sent[0].at) >= time.Minute {
+		s.sent = s.sent[1:]
+	}
+	for _, sent := range s.sent {
+		n += sent.points
+	}
+	return s.limit - n
+}
+
+func (s *adafruitIOSink) push(ctx context.Context, samples []sample) error {
+	// Only the readings with something to send
+	var kept []sample
+	points := 0
+	for _, smp := range samples {
+		n := 0
+		for _, v := range smp.values() {
+			if s.feeds[v.name] != "" {
+				n++
+			}
+		}
+		if n > 0 {
+			kept = append(kept, smp)
+			points = max(points, n)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+
+	budget := s.budget(time.Now())
+	fit := budget / points
+	if fit == 0 {
+		return errors.New("over Adafruit IO's rate limit, waiting until next time")
+	}
+	if fit < len(kept) {
+		// Every so many, ending with the latest
+		lg.Debugf("Skipping %d of %d readings to stay under Adafruit IO's rate limit", len(kept)-fit, len(kept))
+		thinned := make([]sample, fit)
+		for i := range thinned {
+			thinned[i] = kept[(i+1)*len(kept)/fit-1]
+		}
+		kept = thinned
+	}
+
+	data := make(map[string][]adafruitIOData)
+	for _, smp := range kept {
+		at := smp.Time.UTC().Format(time.RFC3339)
+		for _, v := range smp.values() {
+			if feed := s.feeds[v.name]; feed != "" {
+				data[feed] = append(data[feed], adafruitIOData{Value: strconv.FormatFloat(v.value, 'f', -1, 64), CreatedAt: at})
+			}
+		}
+	}
+	feeds := make([]string, 0, len(data))
+	for feed := range data {
+		feeds = append(feeds, feed)
+	}
+	sort.Strings(feeds)
+
+	// Read each time so a new key gets picked up
+	key, err := os.ReadFile(s.keyFile)
+	if err != nil {
+		return fmt.Errorf("AIO key: %w", err)
+	}
+	for _, feed := range feeds {
+		if err := s.send(ctx, strings.TrimSpace(string(key)), feed, data[feed]); err != nil {
+			return fmt.Errorf("feed %s: %w", feed, err)
+		}
+	}
+	return nil
+}
+
+func (s *adafruitIOSink) send(ctx context.Context, key, feed string, data []adafruitIOData) error {
+	body, err := json.Marshal(map[string][]adafruitIOData{"data": data})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+url.PathEscape(feed)+"/data/batch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	req.Header.Set("X-AIO-Key", key)
+
+	// Adafruit IO counts what it's sent, whether it takes it or not
+	s.sent = append(s.sent, adafruitIOSent{at: time.Now(), points: len(data)})
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		var e struct {
+			Error any `json:"error"`
+		}
+		if json.Unmarshal(msg, &e) == nil && e.Error != nil {
+			return fmt.Errorf("%s: %v", resp.Status, e.Error)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *adafruitIOSink) close() error {
+	return nil
+}
+
+// Feed keys, or group.feed for a feed in a group
+var adafruitIOFeedRe = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)?$`)
+
+func checkAdafruitIOSettings() []configProblem {
+	if conf.GetString(adafruitIOUsername) == "" {
+		return nil
+	}
+	var problems []configProblem
+	if f := conf.GetString(adafruitIOKeyFile); f == "" {
+		problems = append(problems, configError(adafruitIOKeyFile, "is needed to upload to Adafruit IO"))
+	} else if _, err := os.Stat(f); err != nil {
+		problems = append(problems, configError(adafruitIOKeyFile, "%v", err))
+	}
+	if u, err := url.Parse(conf.GetString(adafruitIOURL)); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		problems = append(problems, configError(adafruitIOURL, "invalid URL %q", conf.GetString(adafruitIOURL)))
+	}
+	feeds := conf.GetStringMapString(adafruitIOFeeds)
+	if len(feeds) == 0 {
+		problems = append(problems, configError(adafruitIOFeeds, "no metrics are mapped to feeds"))
+	}
+	for metric, feed := range feeds {
+		if metric != temperatureMetric && metric != pressureMetric && metric != humidityMetric {
+			problems = append(problems, configError(adafruitIOFeeds, "unknown metric %q, use temperature, pressure or humidity", metric))
+		}
+		if !adafruitIOFeedRe.MatchString(feed) {
+			problems = append(problems, configError(adafruitIOFeeds, "invalid feed key %q for %s, use lowercase letters, digits and dashes", feed, metric))
+		}
+	}
+	if limit := conf.GetInt(adafruitIORateLimit); limit < len(feeds) {
+		problems = append(problems, configError(adafruitIORateLimit, "%d data points a minute isn't enough for a reading to %d feeds", limit, len(feeds)))
+	}
+	return problems
+}
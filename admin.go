@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Runtime controls for deployments that can't easily be restarted. Changes
+// made here only last until the exporter restarts.
+
+type adminAPI struct {
+	poller *poller
+}
+
+type pollJSON struct {
+	Interval string `json:"interval"`
+}
+
+// Offsets to change, anything left out stays as it is
+type offsetsUpdate struct {
+	Temperature *float64 `json:"temperature"`
+	Pressure    *float64 `json:"pressure"`
+	Humidity    *float64 `json:"humidity"`
+}
+
+// Everything under /api/v1/admin/ needs a user from the web config
+func registerAdmin(mux *http.ServeMux, p *poller) {
+	a := &adminAPI{poller: p}
+	mux.Handle("/api/v1/admin/poll", requireAuth(http.HandlerFunc(a.poll)))
+	mux.Handle("/api/v1/admin/read", requireAuth(http.HandlerFunc(a.read)))
+	mux.Handle("/api/v1/admin/calibration", requireAuth(http.HandlerFunc(a.calibration)))
+	mux.Handle("/api/v1/admin/reinit", requireAuth(http.HandlerFunc(a.reinit)))
+}
+
+// GET the poll interval, or PUT a new one
+func (a *adminAPI) poll(w http.ResponseWriter, r *http.Request) {
+	if a.poller == nil {
+		http.Error(w, "The background poller isn't running, see --poll.interval", http.StatusConflict)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req pollJSON
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		interval, err := parsePollInterval(req.Interval)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.poller.setInterval(interval)
+		lg.Infof("%s set the poll interval to %s", adminUser(r), interval)
+	default:
+		methodNotAllowed(w, "GET, PUT")
+		return
+	}
+	writeJSON(w, pollJSON{Interval: a.poller.Interval().String()})
+}
+
+// POST to read the sensor right away. With the poller running the reading
+// goes everywhere a scheduled one would.
+func (a *adminAPI) read(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, "POST")
+		return
+	}
+
+	ctx, cancel := scrapeContext(r)
+	defer cancel()
+	var rd reading
+	var err error
+	if a.poller != nil {
+		rd, err = a.poller.pollNow(ctx)
+	} else {
+		rd, err = readSensorContext(ctx)
+	}
+	if err == context.DeadlineExceeded {
+		http.Error(w, "Timed out reading the sensor", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !rd.ok() {
+		http.Error(w, "Problem reading the sensor", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, newReadingJSON(rd))
+}
+
+// GET the calibration offsets, or PUT new ones
+func (a *adminAPI) calibration(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req offsetsUpdate
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		o := req.apply()
+		lg.Infof("%s set the calibration offsets to %+v", adminUser(r), o)
+	default:
+		methodNotAllowed(w, "GET, PUT")
+		return
+	}
+	writeJSON(w, currentCalibration())
+}
+
+// A new poll interval, if the poller can use it
+func parsePollInterval(s string) (time.Duration, error) {
+	interval, err := time.ParseDuration(s)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("Invalid interval %q", s)
+	}
+	// The watchdog heartbeats come from the poller
+	if wd := sdWatchdogInterval(); wd > 0 && interval > wd/2 {
+		return 0, fmt.Errorf("The interval can't be longer than %s with the systemd watchdog enabled", wd/2)
+	}
+	return interval, nil
+}
+
+// Change the offsets that were given, returning what they are now
+func (u offsetsUpdate) apply() offsets {
+	o := currentCalibration()
+	if u.Temperature != nil {
+		o.Temperature = *u.Temperature
+	}
+	if u.Pressure != nil {
+		o.Pressure = *u.Pressure
+	}
+	if u.Humidity != nil {
+		o.Humidity = *u.Humidity
+	}
+	setCalibration(o)
+	return o
+}
+
+// POST to reopen the sensor, e.g. after it's been swapped or lost power
+func (a *adminAPI) reinit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	lg.Infof("%s asked for the sensor to be reinitialized", adminUser(r))
+	if err := openSensor(); err != nil {
+		lg.Errorf("Problem reinitializing the sensor: %v", err)
+		http.Error(w, "Problem reinitializing the sensor: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, currentSensorJSON())
+}
+
+func adminUser(r *http.Request) string {
+	// requireAuth made sure the toolkit has checked this
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// Decode a small JSON request body, replying with an error if it's no good
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		lg.Errorf("Problem writing response: %v", err)
+	}
+}
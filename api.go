@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type valueJSON struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+type readingJSON struct {
+	Timestamp   time.Time  `json:"timestamp"`
+	Temperature *valueJSON `json:"temperature,omitempty"`
+	Pressure    *valueJSON `json:"pressure,omitempty"`
+	Humidity    *valueJSON `json:"humidity,omitempty"`
+}
+
+type sensorJSON struct {
+	Host    string `json:"host"`
+	Model   string `json:"model"`
+	Bus     int    `json:"bus"`
+	Address string `json:"address"`
+}
+
+type readingsJSON struct {
+	Sensor  sensorJSON    `json:"sensor"`
+	Reading readingJSON   `json:"reading"`
+	Recent  []readingJSON `json:"recent,omitempty"`
+}
+
+func jsonValue(v float64, unit string) *valueJSON {
+	if math.IsNaN(v) {
+		return nil
+	}
+	return &valueJSON{Value: v, Unit: unit}
+}
+
+func newReadingJSON(r reading) readingJSON {
+	return readingJSON{
+		Timestamp:   r.Time.UTC(),
+		Temperature: jsonValue(r.Temperature, "°C"),
+		Pressure:    jsonValue(r.Pressure, "Pa"),
+		Humidity:    jsonValue(r.Humidity, "%"),
+	}
+}
+
+func currentSensorJSON() sensorJSON {
+	bus, addr := currentAddress()
+	return sensorJSON{
+		Host:    hostname,
+		Model:   conf.GetString(modelName),
+		Bus:     bus,
+		Address: formatI2CAddress(addr),
+	}
+}
+
+// The poller's latest reading if it's fresh enough, otherwise a new one
+func currentReading(ctx context.Context, p *poller) (reading, error) {
+	if p != nil {
+		if latest := p.Latest(); time.Since(latest.Time) <= 2*p.Interval() {
+			return latest, nil
+		}
+	}
+	return readSensorContext(ctx)
+}
+
+// Serve the current reading as JSON, plus the recent ones from the poller with ?recent=true
+func readingsHandler(p *poller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		includeRecent := false
+		if v := r.URL.Query().Get("recent"); v != "" {
+			var err error
+			if includeRecent, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, "Invalid value for recent", http.StatusBadRequest)
+				return
+			}
+		}
+
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
+		current, err := currentReading(ctx, p)
+		if err != nil {
+			http.Error(w, "Timed out reading the sensor", http.StatusGatewayTimeout)
+			return
+		}
+		if !current.ok() {
+			http.Error(w, "Problem reading the sensor", http.StatusServiceUnavailable)
+			return
+		}
+
+		resp := readingsJSON{
+			Sensor:  currentSensorJSON(),
+			Reading: newReadingJSON(current),
+		}
+		if includeRecent && p != nil {
+			for _, rr := range p.Recent() {
+				if rr.ok() {
+					resp.Recent = append(resp.Recent, newReadingJSON(rr))
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(resp); err != nil {
+			lg.Errorf("Problem writing readings: %v", err)
+		}
+	}
+}
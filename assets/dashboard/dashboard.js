@@ -0,0 +1,184 @@
+// Live dashboard for the exporter, fed by the JSON API and the event stream
+(function () {
+  "use strict";
+
+  var maxPoints = 720;
+  var metrics = {
+    temperature: { scale: 1, digits: 1, points: [] },
+    humidity: { scale: 1, digits: 1, points: [] },
+    pressure: { scale: 0.01, digits: 1, points: [] },
+  };
+
+  function setStatus(text, cls) {
+    var el = document.getElementById("status");
+    el.textContent = text;
+    el.className = "status " + cls;
+  }
+
+  function addReading(r) {
+    Object.keys(metrics).forEach(function (name) {
+      var m = metrics[name];
+      if (!r[name]) {
+        return;
+      }
+      m.points.push({ t: new Date(r.timestamp), v: r[name].value * m.scale });
+      if (m.points.length > maxPoints) {
+        m.points.shift();
+      }
+    });
+    document.getElementById("updated").textContent = "Updated " + new Date(r.timestamp).toLocaleTimeString();
+  }
+
+  function draw() {
+    Object.keys(metrics).forEach(function (name) {
+      var m = metrics[name];
+      var card = document.getElementById(name);
+      if (m.points.length === 0) {
+        card.style.display = name === "humidity" ? "none" : "";
+        return;
+      }
+      card.style.display = "";
+
+      var values = m.points.map(function (p) { return p.v; });
+      var last = values[values.length - 1];
+      var min = Math.min.apply(null, values);
+      var max = Math.max.apply(null, values);
+      card.querySelector(".current").textContent = last.toFixed(m.digits);
+      card.querySelector(".range").textContent =
+        "min " + min.toFixed(m.digits) + " · max " + max.toFixed(m.digits);
+
+      var delta = last - values[0];
+      var trend = card.querySelector(".trend");
+      var threshold = Math.pow(10, -m.digits);
+      trend.textContent = delta > threshold ? "↗" : delta < -threshold ? "↘" : "→";
+
+      var canvas = card.querySelector(".spark");
+      var ratio = window.devicePixelRatio || 1;
+      canvas.width = canvas.clientWidth * ratio;
+      canvas.height = canvas.clientHeight * ratio;
+      var ctx = canvas.getContext("2d");
+      ctx.clearRect(0, 0, canvas.width, canvas.height);
+      if (values.length < 2) {
+        return;
+      }
+      var span = max - min || 1;
+      var pad = 4 * ratio;
+      ctx.strokeStyle = getComputedStyle(document.documentElement).getPropertyValue("--line");
+      ctx.lineWidth = 2 * ratio;
+      ctx.beginPath();
+      values.forEach(function (v, i) {
+        var x = (i / (values.length - 1)) * canvas.width;
+        var y = canvas.height - pad - ((v - min) / span) * (canvas.height - 2 * pad);
+        if (i === 0) {
+          ctx.moveTo(x, y);
+        } else {
+          ctx.lineTo(x, y);
+        }
+      });
+      ctx.stroke();
+    });
+  }
+
+  function checkReady() {
+    fetch("../-/ready").then(function (resp) {
+      if (resp.ok) {
+        setStatus("Sensor OK", "ok");
+      } else {
+        setStatus("Sensor not responding", "bad");
+      }
+    }).catch(function () {
+      setStatus("Exporter unreachable", "bad");
+    });
+  }
+
+  function loadEvents() {
+    fetch("../debug/events").then(function (resp) {
+      return resp.json();
+    }).then(function (events) {
+      var list = document.getElementById("events");
+      list.textContent = "";
+      events.slice(-20).reverse().forEach(function (e) {
+        var item = document.createElement("li");
+        var when = document.createElement("time");
+        when.dateTime = e.time;
+        when.textContent = new Date(e.time).toLocaleString();
+        item.appendChild(when);
+        item.appendChild(document.createTextNode(e.message));
+        list.appendChild(item);
+      });
+    }).catch(function () {});
+  }
+
+  // The trends cover the last day from /api/v1/history when the exporter keeps
+  // one, and only the poller's recent readings when it doesn't. Without a
+  // history that path gets the metrics, like everything else that isn't routed.
+  function loadTrends(data) {
+    var recent = data.recent || [data.reading];
+    var step = Math.ceil(24 * 60 / maxPoints) + "m";
+    return fetch("../api/v1/history?step=" + step + "&limit=" + maxPoints).then(function (resp) {
+      var type = resp.headers.get("Content-Type") || "";
+      if (!resp.ok || type.indexOf("application/json") < 0) {
+        throw new Error("no history");
+      }
+      return resp.json();
+    }).then(function (rows) {
+      if (rows.length === 0) {
+        return recent;
+      }
+      var readings = rows.map(function (row) { return row.reading; });
+      // The last step is still being averaged, so end on the latest reading
+      if (new Date(data.reading.timestamp) > new Date(readings[readings.length - 1].timestamp)) {
+        readings.push(data.reading);
+      }
+      return readings;
+    }).catch(function () {
+      return recent;
+    });
+  }
+
+  function load() {
+    fetch("../api/v1/readings?recent=true").then(function (resp) {
+      return resp.json();
+    }).then(function (data) {
+      document.getElementById("host").textContent = data.sensor.host;
+      document.title = data.sensor.host + " – BME280 Exporter";
+      document.getElementById("sensor").textContent =
+        data.sensor.model + " at " + data.sensor.address + " on bus " + data.sensor.bus;
+      return loadTrends(data);
+    }).then(function (readings) {
+      readings.forEach(addReading);
+      draw();
+      stream();
+    }).catch(function () {
+      setStatus("Exporter unreachable", "bad");
+      setTimeout(load, 10000);
+    });
+  }
+
+  function stream() {
+    if (!window.EventSource) {
+      setInterval(function () {
+        fetch("../api/v1/readings").then(function (resp) { return resp.json(); })
+          .then(function (data) { addReading(data.reading); draw(); });
+      }, 30000);
+      return;
+    }
+    var source = new EventSource("../api/v1/stream");
+    source.addEventListener("reading", function (e) {
+      addReading(JSON.parse(e.data));
+      draw();
+    });
+    source.onerror = function () {
+      checkReady();
+    };
+  }
+
+  window.addEventListener("resize", draw);
+  checkReady();
+  loadEvents();
+  setInterval(function () {
+    checkReady();
+    loadEvents();
+  }, 30000);
+  load();
+})();
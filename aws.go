@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What the AWS sinks share: the region, finding credentials, and signing
+// requests with them (Signature Version 4). See
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv.html
+
+func init() {
+	configChecks = append(configChecks, checkAWSSettings)
+}
+
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	// When temporary credentials run out, or zero if they don't
+	expires time.Time
+}
+
+// The region from the settings, or from the environment like the AWS CLI
+func awsRegionName() string {
+	for _, v := range []string{conf.GetString(awsRegion), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Finds credentials in the first place that has some: the AWS IoT credentials
+// provider if it's set up, as fleets of devices with certificates would, then
+// the environment, then the shared credentials file
+type awsCredentialSource struct {
+	profile string
+
+	// The AWS IoT credentials provider, which swaps the device's certificate
+	// for temporary credentials. See
+	// https://docs.aws.amazon.com/iot/latest/developerguide/authorizing-direct-aws.html
+	iotURL    string
+	iotThing  string
+	iotClient *http.Client
+
+	mu     sync.Mutex
+	cached awsCredentials
+}
+
+func newAWSCredentialSource() (*awsCredentialSource, error) {
+	s := &awsCredentialSource{profile: conf.GetString(awsProfile)}
+	if endpoint := conf.GetString(awsIoTCredentialsEndpoint); endpoint != "" {
+		cfg, err := clientTLSConfig(conf.GetString(awsIoTCAFile), conf.GetString(awsIoTCertFile), conf.GetString(awsIoTKeyFile), false)
+		if err != nil {
+			return nil, err
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = cfg
+		s.iotClient = &http.Client{Transport: t, Timeout: 30 * time.Second}
+		s.iotURL = "https://" + endpoint + "/role-aliases/" + url.PathEscape(conf.GetString(awsIoTRoleAlias)) + "/credentials"
+		s.iotThing = awsIoTThing()
+	}
+	return s, nil
+}
+
+func (s *awsCredentialSource) get(ctx context.Context) (awsCredentials, error) {
+	if s.iotURL != "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// Get new ones a little before the old ones run out
+		if s.cached.accessKeyID == "" || time.Until(s.cached.expires) < 5*time.Minute {
+			creds, err := s.fromIoT(ctx)
+			if err != nil {
+				return awsCredentials{}, fmt.Errorf("AWS IoT credentials provider: %w", err)
+			}
+			s.cached = creds
+		}
+		return s.cached, nil
+	}
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" && s.profile == "" {
+		return awsCredentials{accessKeyID: id, secretAccessKey: secret, sessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	// Read each time so rotated credentials get picked up
+	return awsSharedCredentials(s.profile)
+}
+
+func (s *awsCredentialSource) fromIoT(ctx context.Context) (awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.iotURL, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("x-amzn-iot-thingname", s.iotThing)
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	resp, err := s.iotClient.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return awsCredentials{}, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `json:"accessKeyId"`
+			SecretAccessKey string    `json:"secretAccessKey"`
+			SessionToken    string    `json:"sessionToken"`
+			Expiration      time.Time `json:"expiration"`
+		} `json:"credentials"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return awsCredentials{}, err
+	}
+	c := result.Credentials
+	if c.AccessKeyID == "" {
+		return awsCredentials{}, errors.New("no credentials in the response")
+	}
+	return awsCredentials{accessKeyID: c.AccessKeyID, secretAccessKey: c.SecretAccessKey, sessionToken: c.SessionToken, expires: c.Expiration}, nil
+}
+
+// A profile from ~/.aws/credentials, or wherever AWS_SHARED_CREDENTIALS_FILE
+// says it is
+func awsSharedCredentials(profile string) (awsCredentials, error) {
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	name := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, errors.New("no AWS credentials in the environment, and no home directory to find ~/.aws/credentials in")
+		}
+		name = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return awsCredentials{}, fmt.Errorf("no AWS credentials in the environment or %s", name)
+		}
+		return awsCredentials{}, err
+	}
+	defer f.Close()
+
+	var creds awsCredentials
+	var section string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "aws_access_key_id":
+			creds.accessKeyID = strings.TrimSpace(v)
+		case "aws_secret_access_key":
+			creds.secretAccessKey = strings.TrimSpace(v)
+		case "aws_session_token":
+			creds.sessionToken = strings.TrimSpace(v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, err
+	}
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("no credentials for profile %q in %s", profile, name)
+	}
+	return creds, nil
+}
+
+// Sign a request with Signature Version 4. The host, Content-Type and any
+// X-Amz-* headers are signed.
+func signAWS(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "content-type" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.Join(v, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, strings.Join(strings.Fields(headers[k]), " "))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// Spaces are %20 rather than +, and Encode sorts by key already
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	payload := sha256.Sum256(body)
+	canonical := strings.Join([]string{req.Method, path, query, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payload[:])}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + creds.secretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = awsHMAC(key, part)
+	}
+	signature := hex.EncodeToString(awsHMAC(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+func awsHMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// The thing name the device is registered in AWS IoT as
+func awsIoTThing() string {
+	if v := conf.GetString(awsIoTThingName); v != "" {
+		return v
+	}
+	return hostname
+}
+
+func checkAWSSettings() []configProblem {
+	var problems []configProblem
+	if conf.GetString(awsIoTCredentialsEndpoint) != "" {
+		if conf.GetString(awsIoTRoleAlias) == "" {
+			problems = append(problems, configError(awsIoTRoleAlias, "is needed for the AWS IoT credentials provider"))
+		}
+		if conf.GetString(awsProfile) != "" {
+			problems = append(problems, configWarning(awsProfile, "ignored, credentials come from %s", awsIoTCredentialsEndpoint))
+		}
+	}
+	if conf.GetString(awsIoTEndpoint) != "" || conf.GetString(awsIoTCredentialsEndpoint) != "" {
+		if conf.GetString(awsIoTCertFile) == "" || conf.GetString(awsIoTKeyFile) == "" {
+			problems = append(problems, configError(awsIoTCertFile, "AWS IoT needs the device's certificate and its key in --%s and --%s", awsIoTCertFile, awsIoTKeyFile))
+		}
+		for _, key := range []string{awsIoTCAFile, awsIoTCertFile, awsIoTKeyFile} {
+			if f := conf.GetString(key); f != "" {
+				if _, err := os.Stat(f); err != nil {
+					problems = append(problems, configError(key, "%v", err))
+				}
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// From the AWS Signature Version 4 test suite, and the IAM example in the
+// Signature Version 4 documentation
+func TestSignAWS(t *testing.T) {
+	creds := awsCredentials{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		method, url string
+		headers     map[string]string
+		body        string
+		service     string
+		want        string
+	}{
+		{
+			name:    "get-vanilla",
+			method:  "GET",
+			url:     "https://example.amazonaws.com/",
+			service: "service",
+			want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:    "get-vanilla-query-order-key-case",
+			method:  "GET",
+			url:     "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			service: "service",
+			want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:    "post-vanilla",
+			method:  "POST",
+			url:     "https://example.amazonaws.com/",
+			service: "service",
+			want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name:    "post-x-www-form-urlencoded",
+			method:  "POST",
+			url:     "https://example.amazonaws.com/",
+			headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			body:    "Param1=value1",
+			service: "service",
+			want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+		{
+			name:    "IAM ListUsers",
+			method:  "GET",
+			url:     "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08",
+			headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded; charset=utf-8"},
+			service: "iam",
+			want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			signAWS(req, []byte(tt.body), creds, "us-east-1", tt.service, now)
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("Authorization is\n%s\nwant\n%s", got, tt.want)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date is %q", got)
+			}
+		})
+	}
+}
+
+func TestSignAWSSessionToken(t *testing.T) {
+	creds := awsCredentials{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", sessionToken: "token"}
+	req, _ := http.NewRequest("POST", "https://example.amazonaws.com/", nil)
+	signAWS(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	if got := req.Header.Get("X-Amz-Security-Token"); got != "token" {
+		t.Errorf("X-Amz-Security-Token is %q", got)
+	}
+	if got := req.Header.Get("Authorization"); !strings.Contains(got, "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("the session token isn't signed: %s", got)
+	}
+}
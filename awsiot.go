@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+)
+
+// Publishes readings to AWS IoT Core over MQTT, logging in with the device's
+// X.509 certificate and using its thing name as the client ID, which is what
+// the usual IoT policies expect. Optionally the thing's shadow gets the latest
+// reading as its reported state too. See
+// https://docs.aws.amazon.com/iot/latest/developerguide/mqtt.html
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "aws-iot",
+		intervalKey: awsIoTInterval,
+		enabled:     func() bool { return conf.GetString(awsIoTEndpoint) != "" },
+		open:        openAWSIoT,
+		addresses:   func() []string { return hostAddress(conf.GetString(awsIoTEndpoint), "8883") },
+	})
+}
+
+type awsIoTSink struct {
+	address string
+	thing   string
+	topic   string
+	shadow  bool
+	opts    mqttOptions
+	client  *mqttClient
+}
+
+func openAWSIoT() (sink, error) {
+	cfg, err := clientTLSConfig(conf.GetString(awsIoTCAFile), conf.GetString(awsIoTCertFile), conf.GetString(awsIoTKeyFile), false)
+	if err != nil {
+		return nil, err
+	}
+	address := conf.GetString(awsIoTEndpoint)
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "8883")
+	}
+	thing := awsIoTThing()
+	return &awsIoTSink{
+		address: address,
+		thing:   thing,
+		topic:   strings.ReplaceAll(conf.GetString(awsIoTTopic), "{thing}", thing),
+		shadow:  conf.GetBool(awsIoTShadow),
+		opts:    mqttOptions{clientID: thing, keepAlive: time.Minute, tls: cfg},
+	}, nil
+}
+
+// The state reported to the thing's shadow
+type awsIoTShadowUpdate struct {
+	State struct {
+		Reported sampleJSON `json:"reported"`
+	} `json:"state"`
+}
+
+func (s *awsIoTSink) push(ctx context.Context, samples []sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	if s.client == nil || s.client.closed() {
+		c, err := dialMQTT(ctx, s.address, s.opts)
+		if err != nil {
+			return err
+		}
+		s.client = c
+	}
+	// IoT Core doesn't do QoS 2, and with 1 a reading's only gone from the
+	// spool once it's there
+	for _, smp := range samples {
+		payload, err := json.Marshal(smp.json())
+		if err != nil {
+			return err
+		}
+		if err := s.client.publish(ctx, s.topic, payload, 1, false); err != nil {
+			s.drop()
+			return err
+		}
+	}
+	if s.shadow {
+		var update awsIoTShadowUpdate
+		update.State.Reported = samples[len(samples)-1].json()
+		payload, err := json.Marshal(update)
+		if err != nil {
+			return err
+		}
+		if err := s.client.publish(ctx, "$aws/things/"+s.thing+"/shadow/update", payload, 1, false); err != nil {
+			s.drop()
+			return err
+		}
+	}
+	return nil
+}
+
+// Give up on the connection so the next push makes a new one
+func (s *awsIoTSink) drop() {
+	s.client.shutdown(errMQTTClosed)
+	s.client = nil
+}
+
+func (s *awsIoTSink) close() error {
+	if s.client == nil {
+		return nil
+	}
+	return s.client.disconnect()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Makes the exporter an Azure IoT Hub device. Readings are sent as
+// device-to-cloud messages over MQTT, logging in with a SAS token made from
+// the device's key or with its X.509 certificate, and the device twin's
+// reported properties say how it's set up. See
+// https://learn.microsoft.com/azure/iot/iot-mqtt-connect-to-iot-hub
+
+const azureAPIVersion = "2021-04-12"
+
+// How long a SAS token's good for. The hub drops the connection when it runs
+// out, so a new connection with a new token is made a little before that.
+const azureTokenLifetime = time.Hour
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "azure-iothub",
+		intervalKey: azureInterval,
+		enabled: func() bool {
+			return conf.GetString(azureConnectionStringFile) != "" || conf.GetString(azureHost) != ""
+		},
+		open:      openAzureIoT,
+		addresses: func() []string { return hostAddress(conf.GetString(azureHost), "8883") },
+	})
+	configChecks = append(configChecks, checkAzureSettings)
+}
+
+type azureIoTSink struct {
+	host     string
+	deviceID string
+	// The device's primary or secondary key, or nothing with a certificate
+	key  []byte
+	twin bool
+	opts mqttOptions
+
+	client *mqttClient
+	// When the SAS token the connection was made with runs out
+	expires time.Time
+	// The reported properties last sent, so they're only sent when they change
+	reported []byte
+	rid      int
+	p        *poller
+}
+
+func openAzureIoT() (sink, error) {
+	s := &azureIoTSink{
+		host:     conf.GetString(azureHost),
+		deviceID: conf.GetString(azureDeviceID),
+		twin:     conf.GetBool(azureTwin),
+	}
+	if name := conf.GetString(azureConnectionStringFile); name != "" {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := parseAzureConnectionString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, err
+		}
+		s.host, s.deviceID = cs["HostName"], cs["DeviceId"]
+		if key := cs["SharedAccessKey"]; key != "" {
+			if s.key, err = base64.StdEncoding.DecodeString(key); err != nil {
+				return nil, fmt.Errorf("SharedAccessKey: %w", err)
+			}
+		}
+	}
+	if s.deviceID == "" {
+		s.deviceID = hostname
+	}
+	cfg, err := clientTLSConfig(conf.GetString(azureCAFile), conf.GetString(azureCertFile), conf.GetString(azureKeyFile), false)
+	if err != nil {
+		return nil, err
+	}
+	s.opts = mqttOptions{
+		clientID:  s.deviceID,
+		keepAlive: time.Minute,
+		username:  s.host + "/" + s.deviceID + "/?api-version=" + azureAPIVersion,
+		tls:       cfg,
+		onMessage: azureTwinResponse,
+	}
+	return s, nil
+}
+
+// HostName=example.azure-devices.net;DeviceId=kitchen;SharedAccessKey=...
+func parseAzureConnectionString(v string) (map[string]string, error) {
+	cs := make(map[string]string)
+	for _, part := range strings.Split(v, ";") {
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid connection string part %q", part)
+		}
+		cs[k] = v
+	}
+	if cs["HostName"] == "" || cs["DeviceId"] == "" {
+		return nil, fmt.Errorf("the connection string needs a HostName and a DeviceId")
+	}
+	if cs["SharedAccessKey"] == "" && !strings.EqualFold(cs["x509"], "true") {
+		return nil, fmt.Errorf("the connection string needs a SharedAccessKey, or x509=true")
+	}
+	return cs, nil
+}
+
+// A SAS token for the device, signed with its key
+func azureSASToken(host, deviceID string, key []byte, expires time.Time) string {
+	resource := url.QueryEscape(host + "/devices/" + deviceID)
+	se := strconv.FormatInt(expires.Unix(), 10)
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(resource + "\n" + se))
+	sig := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return "SharedAccessSignature sr=" + resource + "&sig=" + url.QueryEscape(sig) + "&se=" + se
+}
+
+func (s *azureIoTSink) setPoller(p *poller) {
+	s.p = p
+}
+
+func (s *azureIoTSink) connect(ctx context.Context) error {
+	opts := s.opts
+	if s.key != nil {
+		s.expires = time.Now().Add(azureTokenLifetime)
+		opts.password = azureSASToken(s.host, s.deviceID, s.key, s.expires)
+	}
+	c, err := dialMQTT(ctx, s.host+":8883", opts)
+	if err != nil {
+		return err
+	}
+	if s.twin {
+		// The hub only answers twin updates once this is subscribed to
+		if err := c.subscribe(ctx, "$iothub/twin/res/#", 0); err != nil {
+			c.disconnect()
+			return err
+		}
+	}
+	s.client = c
+	s.reported = nil
+	return nil
+}
+
+func (s *azureIoTSink) push(ctx context.Context, samples []sample) error {
+	if s.client != nil && s.key != nil && time.Until(s.expires) < 5*time.Minute {
+		s.client.disconnect()
+		s.client = nil
+	}
+	if s.client == nil || s.client.closed() {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if s.twin {
+		if err := s.report(ctx); err != nil {
+			s.drop()
+			return err
+		}
+	}
+	// Marked as JSON so message routing queries can look at the body
+	topic := "devices/" + s.deviceID + "/messages/events/$.ct=application%2Fjson&$.ce=utf-8"
+	for _, smp := range samples {
+		payload, err := json.Marshal(smp.json())
+		if err != nil {
+			return err
+		}
+		if err := s.client.publish(ctx, topic, payload, 1, false); err != nil {
+			s.drop()
+			return err
+		}
+	}
+	return nil
+}
+
+// How the exporter's set up, as the device twin's reported properties
+type azureReported struct {
+	Version      string            `json:"version"`
+	Sensor       sensorJSON        `json:"sensor"`
+	PollInterval string            `json:"pollInterval,omitempty"`
+	Calibration  offsets           `json:"calibration"`
+	Labels       map[string]string `json:"labels"`
+}
+
+// Update the reported properties if they've changed since last time
+func (s *azureIoTSink) report(ctx context.Context) error {
+	r := azureReported{
+		Version:     version,
+		Sensor:      currentSensorJSON(),
+		Calibration: currentCalibration(),
+		Labels:      configuredLabels(),
+	}
+	if s.p != nil {
+		r.PollInterval = s.p.Interval().String()
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b, s.reported) {
+		return nil
+	}
+	s.rid++
+	if err := s.client.publish(ctx, "$iothub/twin/PATCH/properties/reported/?$rid="+strconv.Itoa(s.rid), b, 0, false); err != nil {
+		return err
+	}
+	s.reported = b
+	return nil
+}
+
+// The hub's answer to a twin update, on $iothub/twin/res/<status>/?$rid=<n>
+func azureTwinResponse(m mqttMessage) {
+	status, _, _ := strings.Cut(strings.TrimPrefix(m.topic, "$iothub/twin/res/"), "/")
+	if !strings.HasPrefix(status, "2") {
+		lg.Warnf("Azure IoT Hub turned down the device twin's reported properties with status %s: %s", status, m.payload)
+	}
+}
+
+// Give up on the connection so the next push makes a new one
+func (s *azureIoTSink) drop() {
+	s.client.shutdown(errMQTTClosed)
+	s.client = nil
+}
+
+func (s *azureIoTSink) close() error {
+	if s.client == nil {
+		return nil
+	}
+	return s.client.disconnect()
+}
+
+func checkAzureSettings() []configProblem {
+	csFile := conf.GetString(azureConnectionStringFile)
+	if csFile == "" && conf.GetString(azureHost) == "" {
+		return nil
+	}
+	var problems []configProblem
+	x509 := conf.GetString(azureCertFile) != ""
+	if csFile != "" {
+		if b, err := os.ReadFile(csFile); err != nil {
+			problems = append(problems, configError(azureConnectionStringFile, "%v", err))
+		} else if cs, err := parseAzureConnectionString(strings.TrimSpace(string(b))); err != nil {
+			problems = append(problems, configError(azureConnectionStringFile, "%v", err))
+		} else if cs["SharedAccessKey"] == "" && !x509 {
+			problems = append(problems, configError(azureCertFile, "is needed for a device using X.509 certificates"))
+		}
+		if conf.GetString(azureHost) != "" {
+			problems = append(problems, configWarning(azureHost, "ignored, the connection string has the host"))
+		}
+	} else if !x509 {
+		problems = append(problems, configError(azureConnectionStringFile, "is needed for a SAS key, or --%s for an X.509 certificate", azureCertFile))
+	}
+	if x509 && conf.GetString(azureKeyFile) == "" {
+		problems = append(problems, configError(azureKeyFile, "is needed with --%s", azureCertFile))
+	}
+	for _, key := range []string{azureCAFile, azureCertFile, azureKeyFile} {
+		if f := conf.GetString(key); f != "" {
+			if _, err := os.Stat(f); err != nil {
+				problems = append(problems, configError(key, "%v", err))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,1001 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A BACnet/IP device with the readings as analog inputs, for building
+// automation systems. It answers Who-Is, ReadProperty and
+// ReadPropertyMultiple, and sends change of value notifications to whoever
+// subscribes. Everything is read-only, and there's no segmentation or BBMD
+// registration, so it has to be on the same IP subnet as the BAS or behind
+// a BBMD that forwards to it. See ASHRAE 135, Annex J for BACnet/IP.
+
+func init() {
+	configChecks = append(configChecks, checkBACnetSettings)
+}
+
+// BVLC functions
+const (
+	bvlcForwardedNPDU         = 0x04
+	bvlcOriginalUnicastNPDU   = 0x0a
+	bvlcOriginalBroadcastNPDU = 0x0b
+)
+
+// APDU types and services
+const (
+	bacnetConfirmedRequest   = 0x00
+	bacnetUnconfirmedRequest = 0x10
+	bacnetSimpleACK          = 0x20
+	bacnetComplexACK         = 0x30
+	bacnetError              = 0x50
+	bacnetReject             = 0x60
+	bacnetAbort              = 0x70
+
+	bacnetConfirmedCOVNotification   = 1
+	bacnetSubscribeCOV               = 5
+	bacnetReadProperty               = 12
+	bacnetReadPropertyMultiple       = 14
+	bacnetIAm                        = 0
+	bacnetUnconfirmedCOVNotification = 2
+	bacnetWhoIs                      = 8
+
+	bacnetRejectUnrecognizedService    = 9
+	bacnetRejectMissingParameter       = 5
+	bacnetAbortSegmentationUnsupported = 4
+)
+
+// Object types, properties, units and the rest, all from ASHRAE 135
+const (
+	bacnetAnalogInput = 0
+	bacnetDevice      = 8
+
+	bacnetPropAPDUTimeout                  = 11
+	bacnetPropApplicationSoftwareVersion   = 12
+	bacnetPropAll                          = 8
+	bacnetPropCOVIncrement                 = 22
+	bacnetPropDescription                  = 28
+	bacnetPropDeviceAddressBinding         = 30
+	bacnetPropEventState                   = 36
+	bacnetPropFirmwareRevision             = 44
+	bacnetPropLocation                     = 58
+	bacnetPropMaxAPDULengthAccepted        = 62
+	bacnetPropModelName                    = 70
+	bacnetPropNumberOfAPDURetries          = 73
+	bacnetPropObjectIdentifier             = 75
+	bacnetPropObjectList                   = 76
+	bacnetPropObjectName                   = 77
+	bacnetPropObjectType                   = 79
+	bacnetPropOptional                     = 80
+	bacnetPropOutOfService                 = 81
+	bacnetPropPresentValue                 = 85
+	bacnetPropProtocolObjectTypesSupported = 96
+	bacnetPropProtocolServicesSupported    = 97
+	bacnetPropProtocolVersion              = 98
+	bacnetPropReliability                  = 103
+	bacnetPropRequired                     = 105
+	bacnetPropSegmentationSupported        = 107
+	bacnetPropStatusFlags                  = 111
+	bacnetPropSystemStatus                 = 112
+	bacnetPropUnits                        = 117
+	bacnetPropVendorIdentifier             = 120
+	bacnetPropVendorName                   = 121
+	bacnetPropProtocolRevision             = 139
+	bacnetPropDatabaseRevision             = 155
+	bacnetPropPropertyList                 = 371
+
+	bacnetUnitsPercentRelativeHumidity = 29
+	bacnetUnitsDegreesCelsius          = 62
+	bacnetUnitsHectopascals            = 133
+
+	bacnetReliabilityNoFault              = 0
+	bacnetReliabilityNoSensor             = 1
+	bacnetReliabilityCommunicationFailure = 12
+
+	bacnetNoSegmentation = 3
+	bacnetMaxAPDU        = 1476
+
+	// The highest device instance, which means any device in a request
+	bacnetWildcardInstance = 4194303
+)
+
+// Error classes and codes
+type bacnetErr struct {
+	class, code uint32
+}
+
+var (
+	bacnetUnknownObject         = &bacnetErr{1, 31}
+	bacnetUnknownProperty       = &bacnetErr{2, 32}
+	bacnetNotAnArray            = &bacnetErr{2, 50}
+	bacnetInvalidArrayIndex     = &bacnetErr{2, 42}
+	bacnetCOVNotSupported       = &bacnetErr{1, 45}
+	bacnetCOVSubscriptionFailed = &bacnetErr{5, 43}
+)
+
+// The most COV subscriptions at once
+const bacnetMaxSubscriptions = 64
+
+type bacnetProperty struct {
+	id       uint32
+	optional bool
+	value    func(r reading) []byte
+	// Set instead of value for arrays, which can be read an element at a time
+	array func() [][]byte
+}
+
+type bacnetObject struct {
+	id    uint32
+	name  string
+	props []bacnetProperty
+	// For analog inputs
+	value        func(reading) float64
+	covIncrement float64
+}
+
+// Where a request came from, and how to get back there through a router
+type bacnetPeer struct {
+	addr *net.UDPAddr
+	// The network and MAC address a router gave, if it came through one
+	snet uint16
+	sadr []byte
+}
+
+type bacnetSubscription struct {
+	peer      bacnetPeer
+	processID uint32
+	object    *bacnetObject
+	confirmed bool
+	// Zero for ones that don't expire
+	expires time.Time
+	// What was last sent, to tell when it's changed enough to send again
+	sent      bool
+	lastValue float64
+	lastFlags byte
+}
+
+type bacnetServer struct {
+	instance  uint32
+	objects   []*bacnetObject
+	poller    *poller
+	allowlist *allowlistHandler
+	conn      net.PacketConn
+	broadcast *net.UDPAddr
+
+	mu       sync.Mutex
+	subs     []*bacnetSubscription
+	invokeID byte
+	// The last value each analog input had, since a missing one still needs
+	// a present value
+	values map[uint32]float64
+}
+
+func bacnetObjectID(typ, instance uint32) uint32 {
+	return typ<<22 | instance
+}
+
+func newBACnetServer(p *poller) (*bacnetServer, error) {
+	s := &bacnetServer{
+		instance: uint32(conf.GetInt(bacnetDeviceID)),
+		poller:   p,
+		values:   make(map[uint32]float64),
+	}
+	var err error
+	if cidrs := getStringList(allowedCIDRs); len(cidrs) > 0 {
+		if s.allowlist, err = newAllowlistHandler(cidrs, nil); err != nil {
+			return nil, err
+		}
+	}
+	increments := conf.GetStringMapString(bacnetCOVIncrements)
+	increment := func(metric string, def float64) float64 {
+		if v, err := strconv.ParseFloat(increments[metric], 64); err == nil && v >= 0 {
+			return v
+		}
+		return def
+	}
+
+	inputs := []struct {
+		name  string
+		desc  string
+		units uint32
+		value func(reading) float64
+		cov   float64
+	}{
+		{temperatureMetric, "The temperature", bacnetUnitsDegreesCelsius, func(r reading) float64 { return r.Temperature }, increment(temperatureMetric, 0.1)},
+		{pressureMetric, "The atmospheric pressure", bacnetUnitsHectopascals, func(r reading) float64 { return r.Pressure / 100 }, increment(pressureMetric, 0.1)},
+		{humidityMetric, "The relative humidity", bacnetUnitsPercentRelativeHumidity, func(r reading) float64 { return r.Humidity }, increment(humidityMetric, 1)},
+	}
+	for i, in := range inputs {
+		obj := &bacnetObject{
+			id:           bacnetObjectID(bacnetAnalogInput, uint32(i+1)),
+			name:         in.name,
+			value:        in.value,
+			covIncrement: in.cov,
+		}
+		units := in.units
+		obj.props = []bacnetProperty{
+			{id: bacnetPropPresentValue, value: func(r reading) []byte { return bacnetReal(float32(s.presentValue(obj, r))) }},
+			{id: bacnetPropStatusFlags, value: func(r reading) []byte { return bacnetStatusFlags(obj.statusFlags(r)) }},
+			{id: bacnetPropEventState, value: func(reading) []byte { return bacnetEnumerated(0) }},
+			{id: bacnetPropOutOfService, value: func(reading) []byte { return bacnetBoolean(false) }},
+			{id: bacnetPropUnits, value: func(reading) []byte { return bacnetEnumerated(units) }},
+			{id: bacnetPropDescription, optional: true, value: bacnetConst(bacnetString(fmt.Sprintf("%s, from the %s", in.desc, conf.GetString(modelName))))},
+			{id: bacnetPropReliability, optional: true, value: func(r reading) []byte { return bacnetEnumerated(obj.reliability(r)) }},
+			{id: bacnetPropCOVIncrement, optional: true, value: bacnetConst(bacnetReal(float32(obj.covIncrement)))},
+		}
+		s.objects = append(s.objects, obj)
+	}
+
+	name := conf.GetString(bacnetDeviceName)
+	if name == "" {
+		name = hostname
+	}
+	device := &bacnetObject{id: bacnetObjectID(bacnetDevice, s.instance), name: name}
+	device.props = []bacnetProperty{
+		{id: bacnetPropSystemStatus, value: bacnetConst(bacnetEnumerated(0))},
+		{id: bacnetPropVendorName, value: bacnetConst(bacnetString("bme280-exporter"))},
+		// There's no vendor ID of our own
+		{id: bacnetPropVendorIdentifier, value: bacnetConst(bacnetUnsigned(0))},
+		{id: bacnetPropModelName, value: bacnetConst(bacnetString(conf.GetString(modelName)))},
+		{id: bacnetPropFirmwareRevision, value: bacnetConst(bacnetString(version))},
+		{id: bacnetPropApplicationSoftwareVersion, value: bacnetConst(bacnetString(version))},
+		{id: bacnetPropProtocolVersion, value: bacnetConst(bacnetUnsigned(1))},
+		{id: bacnetPropProtocolRevision, value: bacnetConst(bacnetUnsigned(14))},
+		{id: bacnetPropProtocolServicesSupported, value: bacnetConst(bacnetBitString(41, bacnetSubscribeCOV, bacnetReadProperty, bacnetReadPropertyMultiple, 34))},
+		{id: bacnetPropProtocolObjectTypesSupported, value: bacnetConst(bacnetBitString(56, bacnetAnalogInput, bacnetDevice))},
+		{id: bacnetPropObjectList, array: func() [][]byte {
+			var list [][]byte
+			for _, obj := range s.objects {
+				list = append(list, bacnetObjectIdentifier(obj.id))
+			}
+			return list
+		}},
+		{id: bacnetPropMaxAPDULengthAccepted, value: bacnetConst(bacnetUnsigned(bacnetMaxAPDU))},
+		{id: bacnetPropSegmentationSupported, value: bacnetConst(bacnetEnumerated(bacnetNoSegmentation))},
+		{id: bacnetPropAPDUTimeout, value: bacnetConst(bacnetUnsigned(3000))},
+		{id: bacnetPropNumberOfAPDURetries, value: bacnetConst(bacnetUnsigned(3))},
+		{id: bacnetPropDeviceAddressBinding, value: bacnetConst(nil)},
+		{id: bacnetPropDatabaseRevision, value: bacnetConst(bacnetUnsigned(0))},
+		{id: bacnetPropLocation, optional: true, value: bacnetConst(bacnetString(conf.GetString(bacnetLocation)))},
+		{id: bacnetPropDescription, optional: true, value: bacnetConst(bacnetString(fmt.Sprintf("bme280-exporter %s reading a %s", version, conf.GetString(modelName))))},
+	}
+	s.objects = append([]*bacnetObject{device}, s.objects...)
+
+	// Every object has these, and a list of the rest
+	for _, obj := range s.objects {
+		var list [][]byte
+		for _, prop := range obj.props {
+			list = append(list, bacnetEnumerated(prop.id))
+		}
+		typ := obj.id >> 22
+		obj.props = append([]bacnetProperty{
+			{id: bacnetPropObjectIdentifier, value: bacnetConst(bacnetObjectIdentifier(obj.id))},
+			{id: bacnetPropObjectName, value: bacnetConst(bacnetString(obj.name))},
+			{id: bacnetPropObjectType, value: bacnetConst(bacnetEnumerated(typ))},
+			{id: bacnetPropPropertyList, array: func() [][]byte { return list }},
+		}, obj.props...)
+	}
+	return s, nil
+}
+
+func bacnetConst(b []byte) func(reading) []byte {
+	return func(reading) []byte { return b }
+}
+
+func (s *bacnetServer) object(id uint32) *bacnetObject {
+	if id == bacnetObjectID(bacnetDevice, bacnetWildcardInstance) {
+		id = bacnetObjectID(bacnetDevice, s.instance)
+	}
+	for _, obj := range s.objects {
+		if obj.id == id {
+			return obj
+		}
+	}
+	return nil
+}
+
+// The value, or the last one there was if it's missing
+func (s *bacnetServer) presentValue(obj *bacnetObject, r reading) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v := obj.value(r); !math.IsNaN(v) {
+		s.values[obj.id] = v
+		return v
+	}
+	return s.values[obj.id]
+}
+
+// In alarm, fault, overridden and out of service, where only fault is ever set
+func (obj *bacnetObject) statusFlags(r reading) byte {
+	if math.IsNaN(obj.value(r)) {
+		return 0x4
+	}
+	return 0
+}
+
+func (obj *bacnetObject) reliability(r reading) uint32 {
+	switch {
+	case !r.ok():
+		return bacnetReliabilityCommunicationFailure
+	case math.IsNaN(obj.value(r)):
+		return bacnetReliabilityNoSensor
+	}
+	return bacnetReliabilityNoFault
+}
+
+// Serve BACnet/IP until the context is cancelled
+func serveBACnet(ctx context.Context, addr string, p *poller) error {
+	s, err := newBACnetServer(p)
+	if err != nil {
+		return err
+	}
+	if s.conn, err = net.ListenPacket("udp4", addr); err != nil {
+		return err
+	}
+	port := s.conn.LocalAddr().(*net.UDPAddr).Port
+	if s.broadcast, err = net.ResolveUDPAddr("udp4", net.JoinHostPort(conf.GetString(bacnetBroadcastAddress), strconv.Itoa(port))); err != nil {
+		s.conn.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		s.conn.Close()
+	}()
+	lg.Infof("Serving BACnet/IP on %s as device %d", s.conn.LocalAddr(), s.instance)
+
+	// Announce ourselves, like a device does when it starts up
+	s.sendIAm(bacnetPeer{addr: s.broadcast})
+	if p != nil {
+		go s.watchCOV(ctx, p.subscribe())
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if s.allowlist != nil && !s.allowlist.allowed(from.String()) {
+			continue
+		}
+		if err := s.handle(ctx, buf[:n], from.(*net.UDPAddr)); err != nil {
+			lg.Debugf("Ignoring BACnet message from %s: %v", from, err)
+		}
+	}
+}
+
+// Handle a BVLC message
+func (s *bacnetServer) handle(ctx context.Context, msg []byte, from *net.UDPAddr) error {
+	if len(msg) < 4 || msg[0] != 0x81 || int(binary.BigEndian.Uint16(msg[2:])) != len(msg) {
+		return errors.New("not a BACnet/IP message")
+	}
+	peer := bacnetPeer{addr: from}
+	npdu := msg[4:]
+	switch msg[1] {
+	case bvlcOriginalUnicastNPDU, bvlcOriginalBroadcastNPDU:
+	case bvlcForwardedNPDU:
+		// A BBMD passing on a broadcast, with where it came from first
+		if len(npdu) < 6 {
+			return errors.New("truncated forwarded NPDU")
+		}
+		peer.addr = &net.UDPAddr{IP: net.IP(append([]byte{}, npdu[:4]...)), Port: int(binary.BigEndian.Uint16(npdu[4:]))}
+		npdu = npdu[6:]
+	default:
+		// BBMD and foreign device management, which we don't do
+		return nil
+	}
+
+	// The NPDU: the version, control, and the addresses routers use
+	if len(npdu) < 2 || npdu[0] != 1 {
+		return errors.New("unsupported NPDU version")
+	}
+	control := npdu[1]
+	if control&0x80 != 0 {
+		// Network layer messages are for routers
+		return nil
+	}
+	rest := npdu[2:]
+	dnet := -1
+	if control&0x20 != 0 {
+		if len(rest) < 3 || len(rest) < 3+int(rest[2]) {
+			return errors.New("truncated NPDU")
+		}
+		dnet = int(binary.BigEndian.Uint16(rest))
+		rest = rest[3+int(rest[2]):]
+	}
+	if control&0x08 != 0 {
+		if len(rest) < 3 || len(rest) < 3+int(rest[2]) {
+			return errors.New("truncated NPDU")
+		}
+		peer.snet = binary.BigEndian.Uint16(rest)
+		peer.sadr = append([]byte{}, rest[3:3+int(rest[2])]...)
+		rest = rest[3+int(rest[2]):]
+	}
+	if dnet >= 0 {
+		// The hop count, and only global broadcasts are for us when we're not a router
+		if len(rest) < 1 {
+			return errors.New("truncated NPDU")
+		}
+		rest = rest[1:]
+		if dnet != 0xffff {
+			return nil
+		}
+	}
+	if len(rest) == 0 {
+		return errors.New("no APDU")
+	}
+
+	apdu := rest
+	switch apdu[0] & 0xf0 {
+	case bacnetUnconfirmedRequest:
+		if len(apdu) >= 2 && apdu[1] == bacnetWhoIs {
+			return s.whoIs(apdu[2:], peer)
+		}
+		return nil
+	case bacnetConfirmedRequest:
+	default:
+		// Acks for our confirmed notifications, which aren't resent anyway
+		return nil
+	}
+
+	if len(apdu) < 4 {
+		return errors.New("truncated confirmed request")
+	}
+	invokeID := apdu[2]
+	if apdu[0]&0x08 != 0 {
+		s.send(peer, false, []byte{bacnetAbort | 1, invokeID, bacnetAbortSegmentationUnsupported})
+		return nil
+	}
+	maxResponse := []int{50, 128, 206, 480, 1024, 1476}[min(int(apdu[1]&0x0f), 5)]
+	service, params := apdu[3], apdu[4:]
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	r, err := currentReading(ctx, s.poller)
+	if err != nil {
+		r = reading{Temperature: math.NaN(), Pressure: math.NaN(), Humidity: math.NaN()}
+	}
+
+	var resp []byte
+	switch service {
+	case bacnetReadProperty:
+		resp = s.readProperty(params, r)
+	case bacnetReadPropertyMultiple:
+		resp = s.readPropertyMultiple(params, r)
+	case bacnetSubscribeCOV:
+		resp = s.subscribeCOV(params, peer)
+	default:
+		s.send(peer, false, []byte{bacnetReject, invokeID, bacnetRejectUnrecognizedService})
+		return nil
+	}
+
+	switch {
+	case resp == nil:
+		s.send(peer, false, []byte{bacnetReject, invokeID, bacnetRejectMissingParameter})
+		return nil
+	case resp[0] == bacnetComplexACK:
+		resp = append([]byte{bacnetComplexACK, invokeID, service}, resp[1:]...)
+	case resp[0] == bacnetSimpleACK:
+		resp = []byte{bacnetSimpleACK, invokeID, service}
+	case resp[0] == bacnetError:
+		resp = append([]byte{bacnetError, invokeID, service}, resp[1:]...)
+	}
+	if len(resp) > maxResponse {
+		resp = []byte{bacnetAbort | 1, invokeID, bacnetAbortSegmentationUnsupported}
+	}
+	s.send(peer, false, resp)
+	// A new subscription gets the values straight away
+	if service == bacnetSubscribeCOV {
+		s.notifyCOV(r)
+	}
+	return nil
+}
+
+func (s *bacnetServer) whoIs(params []byte, peer bacnetPeer) error {
+	if len(params) > 0 {
+		low, rest, ok := bacnetContextTag(params, 0)
+		high, _, ok2 := bacnetContextTag(rest, 1)
+		if !ok || !ok2 {
+			return errors.New("invalid Who-Is range")
+		}
+		if s.instance < bacnetParseUnsigned(low) || s.instance > bacnetParseUnsigned(high) {
+			return nil
+		}
+	}
+	// I-Am is meant to be broadcast, but if that's not allowed, answering the
+	// one who asked is better than nothing
+	if err := s.sendIAm(bacnetPeer{addr: s.broadcast, snet: peer.snet, sadr: peer.sadr}); err != nil {
+		return s.sendIAm(peer)
+	}
+	return nil
+}
+
+func (s *bacnetServer) sendIAm(peer bacnetPeer) error {
+	apdu := []byte{bacnetUnconfirmedRequest, bacnetIAm}
+	apdu = append(apdu, bacnetObjectIdentifier(bacnetObjectID(bacnetDevice, s.instance))...)
+	apdu = append(apdu, bacnetUnsigned(bacnetMaxAPDU)...)
+	apdu = append(apdu, bacnetEnumerated(bacnetNoSegmentation)...)
+	apdu = append(apdu, bacnetUnsigned(0)...)
+	return s.send(peer, false, apdu)
+}
+
+// Send an APDU, through whatever router the peer's behind
+func (s *bacnetServer) send(peer bacnetPeer, expectReply bool, apdu []byte) error {
+	npdu := []byte{1, 0}
+	if expectReply {
+		npdu[1] |= 0x04
+	}
+	if len(peer.sadr) > 0 || peer.snet != 0 {
+		npdu[1] |= 0x20
+		npdu = binary.BigEndian.AppendUint16(npdu, peer.snet)
+		npdu = append(npdu, byte(len(peer.sadr)))
+		npdu = append(npdu, peer.sadr...)
+		npdu = append(npdu, 0xff)
+	}
+	function := byte(bvlcOriginalUnicastNPDU)
+	if peer.addr == s.broadcast {
+		function = bvlcOriginalBroadcastNPDU
+	}
+	msg := []byte{0x81, function, 0, 0}
+	msg = append(append(msg, npdu...), apdu...)
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	_, err := s.conn.WriteTo(msg, peer.addr)
+	if err != nil {
+		lg.Debugf("Problem sending BACnet message to %s: %v", peer.addr, err)
+	}
+	return err
+}
+
+// Read a property: the object, the property, then maybe an array index
+func (s *bacnetServer) readProperty(params []byte, r reading) []byte {
+	objID, rest, ok := bacnetContextTag(params, 0)
+	if !ok || len(objID) != 4 {
+		return nil
+	}
+	propID, rest, ok := bacnetContextTag(rest, 1)
+	if !ok {
+		return nil
+	}
+	var index *uint32
+	if i, _, ok := bacnetContextTag(rest, 2); ok {
+		v := bacnetParseUnsigned(i)
+		index = &v
+	}
+	id, prop := binary.BigEndian.Uint32(objID), bacnetParseUnsigned(propID)
+	obj := s.object(id)
+	var value []byte
+	var berr *bacnetErr
+	if obj == nil {
+		berr = bacnetUnknownObject
+	} else {
+		value, berr = obj.read(prop, index, r)
+	}
+	if berr != nil {
+		return bacnetErrorPDU(berr)
+	}
+	resp := []byte{bacnetComplexACK}
+	resp = append(resp, bacnetContext(0, bacnetObjectIDBytes(obj.id))...)
+	resp = append(resp, bacnetContext(1, bacnetUnsignedBytes(prop))...)
+	if index != nil {
+		resp = append(resp, bacnetContext(2, bacnetUnsignedBytes(*index))...)
+	}
+	resp = append(resp, bacnetOpening(3))
+	resp = append(resp, value...)
+	return append(resp, bacnetClosing(3))
+}
+
+func (obj *bacnetObject) read(id uint32, index *uint32, r reading) ([]byte, *bacnetErr) {
+	for _, prop := range obj.props {
+		if prop.id != id {
+			continue
+		}
+		if prop.array == nil {
+			if index != nil {
+				return nil, bacnetNotAnArray
+			}
+			return prop.value(r), nil
+		}
+		elems := prop.array()
+		switch {
+		case index == nil:
+			var all []byte
+			for _, e := range elems {
+				all = append(all, e...)
+			}
+			return all, nil
+		case *index == 0:
+			return bacnetUnsigned(uint32(len(elems))), nil
+		case int(*index) <= len(elems):
+			return elems[*index-1], nil
+		}
+		return nil, bacnetInvalidArrayIndex
+	}
+	return nil, bacnetUnknownProperty
+}
+
+// Read any number of properties of any number of objects, including all,
+// required or optional ones
+func (s *bacnetServer) readPropertyMultiple(params []byte, r reading) []byte {
+	resp := []byte{bacnetComplexACK}
+	if len(params) == 0 {
+		return nil
+	}
+	for len(params) > 0 {
+		objID, rest, ok := bacnetContextTag(params, 0)
+		if !ok || len(objID) != 4 || len(rest) == 0 || rest[0] != bacnetOpening(1) {
+			return nil
+		}
+		rest = rest[1:]
+		id := binary.BigEndian.Uint32(objID)
+		obj := s.object(id)
+		if obj != nil {
+			id = obj.id
+		}
+		resp = append(resp, bacnetContext(0, bacnetObjectIDBytes(id))...)
+		resp = append(resp, bacnetOpening(1))
+		for {
+			if len(rest) == 0 {
+				return nil
+			}
+			if rest[0] == bacnetClosing(1) {
+				rest = rest[1:]
+				break
+			}
+			var propID, i []byte
+			if propID, rest, ok = bacnetContextTag(rest, 0); !ok {
+				return nil
+			}
+			var index *uint32
+			if i, rest, ok = bacnetContextTag(rest, 1); ok {
+				v := bacnetParseUnsigned(i)
+				index = &v
+			}
+			prop := bacnetParseUnsigned(propID)
+
+			result := func(prop uint32, value []byte, berr *bacnetErr) {
+				resp = append(resp, bacnetContext(2, bacnetUnsignedBytes(prop))...)
+				if index != nil {
+					resp = append(resp, bacnetContext(3, bacnetUnsignedBytes(*index))...)
+				}
+				if berr != nil {
+					resp = append(resp, bacnetOpening(5))
+					resp = append(resp, bacnetEnumerated(berr.class)...)
+					resp = append(resp, bacnetEnumerated(berr.code)...)
+					resp = append(resp, bacnetClosing(5))
+					return
+				}
+				resp = append(resp, bacnetOpening(4))
+				resp = append(resp, value...)
+				resp = append(resp, bacnetClosing(4))
+			}
+			switch {
+			case obj == nil:
+				result(prop, nil, bacnetUnknownObject)
+			case prop == bacnetPropAll || prop == bacnetPropRequired || prop == bacnetPropOptional:
+				for _, p := range obj.props {
+					if prop == bacnetPropAll || (prop == bacnetPropOptional) == p.optional {
+						value, berr := obj.read(p.id, nil, r)
+						result(p.id, value, berr)
+					}
+				}
+			default:
+				value, berr := obj.read(prop, index, r)
+				result(prop, value, berr)
+			}
+		}
+		resp = append(resp, bacnetClosing(1))
+		params = rest
+	}
+	return resp
+}
+
+// Subscribe to, or with neither of the last two, cancel, the changes of an
+// analog input: the subscriber's process ID, the object, whether to confirm
+// the notifications, and how many seconds it lasts
+func (s *bacnetServer) subscribeCOV(params []byte, peer bacnetPeer) []byte {
+	processID, rest, ok := bacnetContextTag(params, 0)
+	if !ok {
+		return nil
+	}
+	objID, rest, ok := bacnetContextTag(rest, 1)
+	if !ok || len(objID) != 4 {
+		return nil
+	}
+	confirmed, rest, hasConfirmed := bacnetContextTag(rest, 2)
+	lifetime, _, hasLifetime := bacnetContextTag(rest, 3)
+
+	obj := s.object(binary.BigEndian.Uint32(objID))
+	if obj == nil {
+		return bacnetErrorPDU(bacnetUnknownObject)
+	}
+	if obj.value == nil {
+		return bacnetErrorPDU(bacnetCOVNotSupported)
+	}
+	sub := &bacnetSubscription{
+		peer:      peer,
+		processID: bacnetParseUnsigned(processID),
+		object:    obj,
+		confirmed: hasConfirmed && len(confirmed) == 1 && confirmed[0] != 0,
+	}
+	if hasLifetime {
+		if secs := bacnetParseUnsigned(lifetime); secs > 0 {
+			sub.expires = time.Now().Add(time.Duration(secs) * time.Second)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The same subscriber and object replace the old subscription
+	for i, old := range s.subs {
+		if old.processID == sub.processID && old.object == obj && old.peer.addr.String() == peer.addr.String() &&
+			old.peer.snet == peer.snet && string(old.peer.sadr) == string(peer.sadr) {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			break
+		}
+	}
+	if !hasConfirmed && !hasLifetime {
+		return []byte{bacnetSimpleACK}
+	}
+	if len(s.subs) >= bacnetMaxSubscriptions {
+		return bacnetErrorPDU(bacnetCOVSubscriptionFailed)
+	}
+	s.subs = append(s.subs, sub)
+	lg.Debugf("BACnet COV subscription from %s for %s", peer.addr, obj.name)
+	return []byte{bacnetSimpleACK}
+}
+
+// Notify subscribers of new readings as the poller takes them
+func (s *bacnetServer) watchCOV(ctx context.Context, readings chan reading) {
+	defer s.poller.unsubscribe(readings)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r, ok := <-readings:
+			if !ok {
+				return
+			}
+			s.notifyCOV(r)
+		}
+	}
+}
+
+// Send notifications to the subscribers whose objects have changed by at
+// least their COV increment, or whose status has changed, and to new ones
+func (s *bacnetServer) notifyCOV(r reading) {
+	now := time.Now()
+	type notification struct {
+		sub   bacnetSubscription
+		value float64
+		flags byte
+	}
+	var send []notification
+	s.mu.Lock()
+	subs := s.subs[:0]
+	for _, sub := range s.subs {
+		if !sub.expires.IsZero() && now.After(sub.expires) {
+			continue
+		}
+		subs = append(subs, sub)
+		obj := sub.object
+		value := obj.value(r)
+		if math.IsNaN(value) {
+			value = s.values[obj.id]
+		} else {
+			s.values[obj.id] = value
+		}
+		flags := obj.statusFlags(r)
+		if sub.sent && flags == sub.lastFlags && math.Abs(value-sub.lastValue) < obj.covIncrement {
+			continue
+		}
+		sub.sent, sub.lastValue, sub.lastFlags = true, value, flags
+		send = append(send, notification{*sub, value, flags})
+	}
+	s.subs = subs
+	s.mu.Unlock()
+
+	for _, n := range send {
+		params := bacnetContext(0, bacnetUnsignedBytes(n.sub.processID))
+		params = append(params, bacnetContext(1, bacnetObjectIDBytes(bacnetObjectID(bacnetDevice, s.instance)))...)
+		params = append(params, bacnetContext(2, bacnetObjectIDBytes(n.sub.object.id))...)
+		var remaining uint32
+		if !n.sub.expires.IsZero() {
+			remaining = uint32(math.Ceil(n.sub.expires.Sub(now).Seconds()))
+		}
+		params = append(params, bacnetContext(3, bacnetUnsignedBytes(remaining))...)
+		params = append(params, bacnetOpening(4))
+		params = append(params, bacnetContext(0, bacnetUnsignedBytes(bacnetPropPresentValue))...)
+		params = append(params, bacnetOpening(2))
+		params = append(params, bacnetReal(float32(n.value))...)
+		params = append(params, bacnetClosing(2))
+		params = append(params, bacnetContext(0, bacnetUnsignedBytes(bacnetPropStatusFlags))...)
+		params = append(params, bacnetOpening(2))
+		params = append(params, bacnetStatusFlags(n.flags)...)
+		params = append(params, bacnetClosing(2))
+		params = append(params, bacnetClosing(4))
+
+		if n.sub.confirmed {
+			// Confirmed ones aren't resent without an ack, the next change will do
+			s.mu.Lock()
+			s.invokeID++
+			invokeID := s.invokeID
+			s.mu.Unlock()
+			s.send(n.sub.peer, true, append([]byte{bacnetConfirmedRequest, 0x05, invokeID, bacnetConfirmedCOVNotification}, params...))
+		} else {
+			s.send(n.sub.peer, false, append([]byte{bacnetUnconfirmedRequest, bacnetUnconfirmedCOVNotification}, params...))
+		}
+	}
+}
+
+// An Error PDU without the invoke ID and service, which handle fills in
+func bacnetErrorPDU(e *bacnetErr) []byte {
+	resp := []byte{bacnetError}
+	resp = append(resp, bacnetEnumerated(e.class)...)
+	return append(resp, bacnetEnumerated(e.code)...)
+}
+
+// Tags, with the number, whether it's context specific rather than an
+// application tag, and the length, extended when it doesn't fit
+func bacnetTag(num byte, context bool, data []byte) []byte {
+	b := num << 4
+	if context {
+		b |= 0x08
+	}
+	switch n := len(data); {
+	case n < 5:
+		return append([]byte{b | byte(n)}, data...)
+	case n < 254:
+		return append([]byte{b | 5, byte(n)}, data...)
+	case n < 1<<16:
+		return append(binary.BigEndian.AppendUint16([]byte{b | 5, 254}, uint16(n)), data...)
+	}
+	return append(binary.BigEndian.AppendUint32([]byte{b | 5, 255}, uint32(len(data))), data...)
+}
+
+func bacnetContext(num byte, data []byte) []byte {
+	return bacnetTag(num, true, data)
+}
+
+func bacnetOpening(num byte) byte {
+	return num<<4 | 0x0e
+}
+
+func bacnetClosing(num byte) byte {
+	return num<<4 | 0x0f
+}
+
+func bacnetUnsignedBytes(v uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, v)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func bacnetObjectIDBytes(id uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, id)
+}
+
+// Application tagged values
+func bacnetBoolean(v bool) []byte {
+	if v {
+		return []byte{0x11}
+	}
+	return []byte{0x10}
+}
+
+func bacnetUnsigned(v uint32) []byte {
+	return bacnetTag(2, false, bacnetUnsignedBytes(v))
+}
+
+func bacnetReal(v float32) []byte {
+	return bacnetTag(4, false, binary.BigEndian.AppendUint32(nil, math.Float32bits(v)))
+}
+
+// UTF-8, which is character set 0
+func bacnetString(s string) []byte {
+	return bacnetTag(7, false, append([]byte{0}, s...))
+}
+
+// A bit string n bits long with the given bits set
+func bacnetBitString(n int, set ...int) []byte {
+	data := make([]byte, 1+(n+7)/8)
+	data[0] = byte(8*(len(data)-1) - n)
+	for _, i := range set {
+		data[1+i/8] |= 0x80 >> (i % 8)
+	}
+	return bacnetTag(8, false, data)
+}
+
+func bacnetStatusFlags(flags byte) []byte {
+	return bacnetTag(8, false, []byte{4, flags << 4})
+}
+
+func bacnetEnumerated(v uint32) []byte {
+	return bacnetTag(9, false, bacnetUnsignedBytes(v))
+}
+
+func bacnetObjectIdentifier(id uint32) []byte {
+	return bacnetTag(12, false, bacnetObjectIDBytes(id))
+}
+
+// The data of the context tag num if it's next, and what's after it
+func bacnetContextTag(b []byte, num byte) ([]byte, []byte, bool) {
+	if len(b) == 0 || b[0]&0x08 == 0 || b[0]>>4 != num {
+		return nil, b, false
+	}
+	n, rest := int(b[0]&0x07), b[1:]
+	switch n {
+	case 6, 7:
+		// Opening and closing tags
+		return nil, b, false
+	case 5:
+		if len(rest) == 0 {
+			return nil, b, false
+		}
+		n, rest = int(rest[0]), rest[1:]
+		switch n {
+		case 254:
+			if len(rest) < 2 {
+				return nil, b, false
+			}
+			n, rest = int(binary.BigEndian.Uint16(rest)), rest[2:]
+		case 255:
+			if len(rest) < 4 {
+				return nil, b, false
+			}
+			n, rest = int(binary.BigEndian.Uint32(rest)), rest[4:]
+		}
+	}
+	if len(rest) < n {
+		return nil, b, false
+	}
+	return rest[:n], rest[n:], true
+}
+
+func bacnetParseUnsigned(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+func checkBACnetSettings() []configProblem {
+	addr := conf.GetString(bacnetListenAddress)
+	if addr == "" {
+		return nil
+	}
+	var problems []configProblem
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		problems = append(problems, configError(bacnetListenAddress, "%v, use e.g. :47808", err))
+	}
+	if id := conf.GetInt(bacnetDeviceID); id < 0 || id >= bacnetWildcardInstance {
+		problems = append(problems, configError(bacnetDeviceID, "must be from 0 to %d", bacnetWildcardInstance-1))
+	}
+	if net.ParseIP(conf.GetString(bacnetBroadcastAddress)).To4() == nil {
+		problems = append(problems, configError(bacnetBroadcastAddress, "must be an IPv4 address"))
+	}
+	for metric, v := range conf.GetStringMapString(bacnetCOVIncrements) {
+		if metric != temperatureMetric && metric != pressureMetric && metric != humidityMetric {
+			problems = append(problems, configError(bacnetCOVIncrements, "unknown metric %q, use temperature, pressure or humidity", metric))
+		} else if f, err := strconv.ParseFloat(v, 64); err != nil || f < 0 {
+			problems = append(problems, configError(bacnetCOVIncrements, "invalid increment %q for %s", v, metric))
+		}
+	}
+	if configuredPollInterval() <= 0 {
+		problems = append(problems, configWarning(bacnetListenAddress, "COV notifications are only sent on changes with %s set", pollInterval))
+	}
+	return problems
+}
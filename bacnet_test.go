@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A PacketConn that keeps what's sent, for the server to answer into
+type bacnetRecorder struct {
+	net.PacketConn
+	sent []bacnetSent
+}
+
+type bacnetSent struct {
+	to  string
+	msg []byte
+}
+
+func (c *bacnetRecorder) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.sent = append(c.sent, bacnetSent{addr.String(), append([]byte{}, b...)})
+	return len(b), nil
+}
+
+func testBACnetServer(t testing.TB) (*bacnetServer, *bacnetRecorder) {
+	t.Helper()
+	s, err := newBACnetServer(testPoller(reading{Temperature: 21.37, Pressure: 101325, Humidity: 45.2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &bacnetRecorder{}
+	s.conn = c
+	s.broadcast = &net.UDPAddr{IP: net.IPv4bcast, Port: 47808}
+	return s, c
+}
+
+func TestBACnetServe(t *testing.T) {
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 47808}
+	tests := []struct {
+		name string
+		req  string
+		// Each message sent back, after where it went: peer, broadcast, or an address
+		want []string
+	}{
+		{
+			name: "Who-Is",
+			req:  "81 0b 0008 01 00  10 08",
+			want: []string{"broadcast 81 0b 0014 01 00  10 00 c4 02000118 22 05c4 91 03 21 00"},
+		},
+		{
+			name: "Who-Is for other devices",
+			req:  "81 0b 000c 01 00  10 08 09 00 19 64",
+		},
+		{
+			name: "Who-Is for a range with this device",
+			req:  "81 0b 000e 01 00  10 08 0a 00c8 1a 012c",
+			want: []string{"broadcast 81 0b 0014 01 00  10 00 c4 02000118 22 05c4 91 03 21 00"},
+		},
+		{
+			name: "Who-Is with half a range",
+			req:  "81 0b 000a 01 00  10 08 09 00",
+		},
+		{
+			name: "present value",
+			req:  "81 0a 0011 01 04  00 05 01 0c 0c 00000001 19 55",
+			want: []string{"peer 81 0a 0017 01 00  30 01 0c 0c 00000001 19 55 3e 44 41aaf5c3 3f"},
+		},
+		{
+			name: "object list of the wildcard device",
+			req:  "81 0a 0011 01 04  00 05 02 0c 0c 023fffff 19 4c",
+			want: []string{"peer 81 0a 0026 01 00  30 02 0c 0c 02000118 19 4c 3e c4 02000118 c4 00000001 c4 00000002 c4 00000003 3f"},
+		},
+		{
+			name: "object list length",
+			req:  "81 0a 0013 01 04  00 05 03 0c 0c 02000118 19 4c 29 00",
+			want: []string{"peer 81 0a 0016 01 00  30 03 0c 0c 02000118 19 4c 29 00 3e 21 04 3f"},
+		},
+		{
+			name: "object list element",
+			req:  "81 0a 0013 01 04  00 05 04 0c 0c 02000118 19 4c 29 02",
+			want: []string{"peer 81 0a 0019 01 00  30 04 0c 0c 02000118 19 4c 29 02 3e c4 00000001 3f"},
+		},
+		{
+			name: "object list element past the end",
+			req:  "81 0a 0013 01 04  00 05 05 0c 0c 02000118 19 4c 29 09",
+			want: []string{"peer 81 0a 000d 01 00  50 05 0c 91 02 91 2a"},
+		},
+		{
+			name: "unknown object",
+			req:  "81 0a 0011 01 04  00 05 06 0c 0c 00000009 19 55",
+			want: []string{"peer 81 0a 000d 01 00  50 06 0c 91 01 91 1f"},
+		},
+		{
+			name: "unknown property",
+			req:  "81 0a 0012 01 04  00 05 07 0c 0c 00000001 1a 03e7",
+			want: []string{"peer 81 0a 000d 01 00  50 07 0c 91 02 91 20"},
+		},
+		{
+			name: "array index of a property that isn't an array",
+			req:  "81 0a 0013 01 04  00 05 08 0c 0c 00000001 19 55 29 01",
+			want: []string{"peer 81 0a 000d 01 00  50 08 0c 91 02 91 32"},
+		},
+		{
+			name: "no property",
+			req:  "81 0a 000f 01 04  00 05 09 0c 0c 00000001",
+			want: []string{"peer 81 0a 0009 01 00  60 09 05"},
+		},
+		{
+			name: "WriteProperty",
+			req:  "81 0a 0011 01 04  00 05 0a 0f 0c 00000001 19 55",
+			want: []string{"peer 81 0a 0009 01 00  60 0a 09"},
+		},
+		{
+			name: "segmented request",
+			req:  "81 0a 0013 01 04  08 05 0b 00 01 0c 0c 00000001 19 55",
+			want: []string{"peer 81 0a 0009 01 00  71 0b 04"},
+		},
+		{
+			name: "answer that would need segmenting",
+			req:  "81 0a 0013 01 04  00 00 0c 0e 0c 02000118 1e 09 08 1f",
+			want: []string{"peer 81 0a 0009 01 00  71 0c 04"},
+		},
+		{
+			name: "ReadPropertyMultiple",
+			req:  "81 0a 0015 01 04  00 05 10 0e 0c 00000002 1e 09 55 09 75 1f",
+			want: []string{"peer 81 0a 001f 01 00  30 10 0e 0c 00000002 1e 29 55 4e 44 447d5000 4f 29 75 4e 91 85 4f 1f"},
+		},
+		{
+			name: "ReadPropertyMultiple without a closing tag",
+			req:  "81 0a 0014 01 04  00 05 11 0e 0c 00000002 1e 09 55 09 75",
+			want: []string{"peer 81 0a 0009 01 00  60 11 05"},
+		},
+		{
+			name: "through a router",
+			req:  "81 0a 0015 01 0c 0005 01 07  00 05 12 0c 0c 00000001 19 55",
+			want: []string{"peer 81 0a 001c 01 20 0005 01 07 ff  30 12 0c 0c 00000001 19 55 3e 44 41aaf5c3 3f"},
+		},
+		{
+			name: "for another network",
+			req:  "81 0a 0015 01 24 0009 00 ff  00 05 13 0c 0c 00000001 19 55",
+		},
+		{
+			name: "forwarded by a BBMD",
+			req:  "81 04 0017 c0a80105 bac0  01 04  00 05 14 0c 0c 00000001 19 55",
+			want: []string{"192.168.1.5:47808 81 0a 0017 01 00  30 14 0c 0c 00000001 19 55 3e 44 41aaf5c3 3f"},
+		},
+		{
+			name: "SubscribeCOV",
+			req:  "81 0a 0015 01 04  00 05 15 05 09 12 1c 00000001 29 00 39 00",
+			want: []string{
+				"peer 81 0a 0009 01 00  20 15 05",
+				"peer 81 0a 0028 01 00  10 02 09 12 1c 02000118 2c 00000001 39 00 4e 09 55 2e 44 41aaf5c3 2f 09 6f 2e 82 04 00 2f 4f",
+			},
+		},
+		{
+			name: "network layer message",
+			req:  "81 0b 0007 01 80 00",
+		},
+		{
+			name: "wrong length",
+			req:  "81 0a 0012 01 04  00 05 16 0c 0c 00000001 19 55",
+		},
+		{
+			name: "wrong NPDU version",
+			req:  "81 0a 0011 02 04  00 05 17 0c 0c 00000001 19 55",
+		},
+		{
+			name: "truncated confirmed request",
+			req:  "81 0a 0009 01 04  00 05 18",
+		},
+		{
+			name: "truncated NPDU",
+			req:  "81 0a 0008 01 20 0005",
+		},
+		{
+			name: "not BACnet",
+			req:  "47 45 54 20 2f",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, c := testBACnetServer(t)
+			s.handle(context.Background(), unhex(t, tt.req), from)
+			var got []string
+			for _, sent := range c.sent {
+				to := sent.to
+				switch to {
+				case from.String():
+					to = "peer"
+				case s.broadcast.String():
+					to = "broadcast"
+				}
+				got = append(got, fmt.Sprintf("%s % x", to, sent.msg))
+			}
+			var want []string
+			for _, w := range tt.want {
+				to, msg, _ := strings.Cut(w, " ")
+				want = append(want, fmt.Sprintf("%s % x", to, unhex(t, msg)))
+			}
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func FuzzBACnetFrames(f *testing.F) {
+	for _, s := range []string{
+		"81 0b 0008 01 00  10 08",
+		"81 0b 000e 01 00  10 08 0a 00c8 1a 012c",
+		"81 0a 0011 01 04  00 05 01 0c 0c 00000001 19 55",
+		"81 0a 0013 01 04  00 05 04 0c 0c 02000118 19 4c 29 02",
+		"81 0a 0015 01 04  00 05 10 0e 0c 00000002 1e 09 55 09 75 1f",
+		"81 0a 0015 01 0c 0005 01 07  00 05 12 0c 0c 00000001 19 55",
+		"81 04 0017 c0a80105 bac0  01 04  00 05 14 0c 0c 00000001 19 55",
+		"81 0a 0015 01 04  00 05 15 05 09 12 1c 00000001 29 00 39 00",
+	} {
+		f.Add(unhex(f, s))
+	}
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 47808}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		s, c := testBACnetServer(t)
+		s.handle(context.Background(), in, from)
+
+		// Whatever comes back is a whole BACnet/IP message with an APDU
+		for _, sent := range c.sent {
+			msg := sent.msg
+			if len(msg) < 7 || msg[0] != 0x81 || (msg[1] != bvlcOriginalUnicastNPDU && msg[1] != bvlcOriginalBroadcastNPDU) {
+				t.Fatalf("not a BACnet/IP message: % x", msg)
+			}
+			if int(binary.BigEndian.Uint16(msg[2:])) != len(msg) {
+				t.Fatalf("wrong length in % x", msg)
+			}
+			if msg[4] != 1 {
+				t.Fatalf("wrong NPDU version in % x", msg)
+			}
+			if len(msg) > 4+8+bacnetMaxAPDU {
+				t.Fatalf("message too long: % x", msg)
+			}
+			if bytes.Equal(in, msg) {
+				t.Fatalf("echoed % x", msg)
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/d2r2/go-bsbmp"
+	"github.com/d2r2/go-i2c"
+	"github.com/spf13/pflag"
+)
+
+var (
+	benchReads int
+	benchBuses []int
+)
+
+func benchFlags(fs *pflag.FlagSet) {
+	sensorFlags(fs)
+	fs.IntVar(&benchReads, "reads", 20, "How many reads to time at each accuracy level")
+	fs.IntSliceVar(&benchBuses, "bus", nil, "Compare these buses, for sensors wired to more than one (default is --i2cbus)")
+}
+
+// `bme280-exporter bench` times reads at every accuracy level, to help pick
+// settings that suit the hardware
+func runBench(args []string) int {
+	if benchReads < 1 {
+		fmt.Fprintln(os.Stderr, "There has to be at least one read")
+		return 2
+	}
+	bus, addr, err := configuredAddress()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	modelID, err := getSensorID(conf.GetString(modelName))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	buses := benchBuses
+	if len(buses) == 0 {
+		buses = []int{bus}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "BUS\tCLOCK\tACCURACY\tREADS\tERRORS\tMIN\tMEDIAN\tP95\tMAX\tREADS/S\t")
+	failed := 0
+	for _, bus := range buses {
+		if err := benchBus(tw, bus, addr, modelID); err != nil {
+			fmt.Fprintf(os.Stderr, "Problem with the sensor at %s on bus %d: %v\n", formatI2CAddress(addr), bus, err)
+			failed++
+		}
+	}
+	if failed == len(buses) {
+		return 1
+	}
+	tw.Flush()
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func benchBus(tw *tabwriter.Writer, bus int, addr uint8, modelID bsbmp.SensorType) error {
+	conn, err := i2c.NewI2C(addr, bus)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	s, err := bsbmp.NewBMP(modelID, conn)
+	if err != nil {
+		return err
+	}
+
+	clock := "unknown"
+	if hz, ok := busClock(bus); ok {
+		clock = fmt.Sprintf("%dkHz", hz/1000)
+	}
+	for _, level := range accuracyLevels(modelID) {
+		var took []time.Duration
+		failures := 0
+		start := time.Now()
+		for i := 0; i < benchReads; i++ {
+			t := time.Now()
+			if _, err := measureAt(s, level.mode); err != nil {
+				lg.Debugf("Read at %s accuracy failed: %v", level.name, err)
+				failures++
+				continue
+			}
+			took = append(took, time.Since(t))
+		}
+		elapsed := time.Since(start)
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t", bus, clock, level.name, benchReads, failures)
+		if len(took) == 0 {
+			fmt.Fprint(tw, "-\t-\t-\t-\t-\t\n")
+			continue
+		}
+		sort.Slice(took, func(i, j int) bool { return took[i] < took[j] })
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.1f\t\n",
+			formatLatency(took[0]),
+			formatLatency(percentile(took, 0.5)),
+			formatLatency(percentile(took, 0.95)),
+			formatLatency(took[len(took)-1]),
+			float64(len(took))/elapsed.Seconds())
+	}
+	return nil
+}
+
+// The p'th percentile of sorted durations, nearest rank
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
+
+// The bus clock from the device tree, if the platform has one. It can't be
+// changed at runtime, on a Raspberry Pi it's dtparam=i2c_arm_baudrate.
+func busClock(bus int) (int, bool) {
+	b, err := os.ReadFile(fmt.Sprintf("/sys/bus/i2c/devices/i2c-%d/of_node/clock-frequency", bus))
+	if err != nil || len(b) != 4 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint32(b)), true
+}
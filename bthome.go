@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Broadcasts readings as BTHome BLE advertisements with the Bluetooth
+// controller, so Home Assistant's Bluetooth integration and phone apps
+// nearby pick them up passively, network or no network. It's unencrypted,
+// non-connectable, legacy advertising. See https://bthome.io/format/
+
+func init() {
+	configChecks = append(configChecks, checkBTHomeSettings)
+}
+
+// HCI packets, events and the LE commands
+const (
+	hciCommandPacket   = 0x01
+	hciEventPacket     = 0x04
+	hciCommandComplete = 0x0e
+	hciCommandStatus   = 0x0f
+
+	hciOGFLE                     = 0x08
+	hciLESetAdvertisingParams    = 0x0006
+	hciLESetAdvertisingData      = 0x0008
+	hciLESetAdvertiseEnable      = 0x000a
+	hciAdvertisingNonConnectable = 0x03
+)
+
+// BTHome's service UUID, and v2 unencrypted in the device info byte
+const (
+	bthomeUUID       = 0xfcd2
+	bthomeDeviceInfo = 0x40
+)
+
+// The most advertising data there can be with legacy advertising
+const bleMaxAdvertisingData = 31
+
+func hciError(status byte) error {
+	switch status {
+	case 0x00:
+		return nil
+	case 0x0c:
+		return errors.New("the Bluetooth controller disallowed the command, is something else advertising with it?")
+	case 0x12:
+		return errors.New("the Bluetooth controller said the parameters are invalid")
+	}
+	return fmt.Errorf("the Bluetooth controller gave error 0x%02x", status)
+}
+
+// The advertising data: flags, the BTHome service data with its objects in
+// order of ID, and as much of the name as fits
+func bthomeAdvertisement(r reading, packetID byte, name string) []byte {
+	// LE general discoverable, BR/EDR not supported
+	data := []byte{0x02, 0x01, 0x06}
+
+	service := binary.LittleEndian.AppendUint16(nil, bthomeUUID)
+	service = append(service, bthomeDeviceInfo, 0x00, packetID)
+	if !math.IsNaN(r.Temperature) && math.Abs(r.Temperature) < 327 {
+		// 0.01 °C, signed
+		service = binary.LittleEndian.AppendUint16(append(service, 0x02), uint16(int16(math.Round(r.Temperature*100))))
+	}
+	if !math.IsNaN(r.Humidity) {
+		// 0.01 %
+		service = binary.LittleEndian.AppendUint16(append(service, 0x03), uint16(math.Round(r.Humidity*100)))
+	}
+	if !math.IsNaN(r.Pressure) {
+		// 0.01 hPa, which is pascals, in 3 bytes
+		pa := uint32(math.Round(r.Pressure))
+		service = append(service, 0x04, byte(pa), byte(pa>>8), byte(pa>>16))
+	}
+	data = append(data, byte(len(service)+1), 0x16)
+	data = append(data, service...)
+
+	if room := bleMaxAdvertisingData - len(data) - 2; room > 0 && name != "" {
+		// Complete local name, or shortened if it doesn't fit
+		typ := byte(0x09)
+		if len(name) > room {
+			name, typ = name[:room], 0x08
+		}
+		data = append(data, byte(len(name)+1), typ)
+		data = append(data, name...)
+	}
+	return data
+}
+
+// Advertise each reading the poller takes until the context is cancelled
+func runBTHome(ctx context.Context, p *poller) error {
+	if p == nil {
+		return fmt.Errorf("BTHome needs %s", pollInterval)
+	}
+	dev, err := openHCI(conf.GetInt(bthomeDevice))
+	if err != nil {
+		return err
+	}
+	defer dev.close()
+
+	// In units of 0.625ms
+	interval := uint16(min(max(conf.GetDuration(bthomeAdvertisingInterval)/(625*time.Microsecond), 0x20), 0x4000))
+	params := binary.LittleEndian.AppendUint16(nil, interval)
+	params = binary.LittleEndian.AppendUint16(params, interval)
+	// Non-connectable, from the public address, to anyone on all three
+	// channels, with no filter
+	params = append(params, hciAdvertisingNonConnectable, 0, 0, 0, 0, 0, 0, 0, 0, 0x07, 0)
+
+	// It can't change the parameters while it's advertising
+	dev.command(hciOGFLE, hciLESetAdvertiseEnable, []byte{0})
+	if err := dev.command(hciOGFLE, hciLESetAdvertisingParams, params); err != nil {
+		return fmt.Errorf("problem setting the advertising parameters: %w", err)
+	}
+
+	name := conf.GetString(bthomeName)
+	if name == "" {
+		name = hostname
+	}
+	var packetID byte
+	update := func(r reading) error {
+		packetID++
+		adv := bthomeAdvertisement(r, packetID, name)
+		data := append([]byte{byte(len(adv))}, adv...)
+		data = append(data, make([]byte, bleMaxAdvertisingData-len(adv))...)
+		return dev.command(hciOGFLE, hciLESetAdvertisingData, data)
+	}
+	if err := update(p.Latest()); err != nil {
+		return fmt.Errorf("problem setting the advertising data: %w", err)
+	}
+	if err := dev.command(hciOGFLE, hciLESetAdvertiseEnable, []byte{1}); err != nil {
+		return fmt.Errorf("problem starting advertising: %w", err)
+	}
+	defer dev.command(hciOGFLE, hciLESetAdvertiseEnable, []byte{0})
+	lg.Infof("Advertising readings as BTHome on hci%d", conf.GetInt(bthomeDevice))
+
+	readings := p.subscribe()
+	defer p.unsubscribe(readings)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case r, ok := <-readings:
+			if !ok {
+				return nil
+			}
+			if err := update(r); err != nil {
+				lg.Warnf("Problem updating the BTHome advertisement: %v", err)
+			}
+		}
+	}
+}
+
+func checkBTHomeSettings() []configProblem {
+	if !conf.GetBool(bthomeEnable) {
+		return nil
+	}
+	var problems []configProblem
+	if configuredPollInterval() <= 0 {
+		problems = append(problems, configError(bthomeEnable, "needs %s set", pollInterval))
+	}
+	if d := conf.GetInt(bthomeDevice); d < 0 {
+		problems = append(problems, configError(bthomeDevice, "can't be negative"))
+	}
+	if i := conf.GetDuration(bthomeAdvertisingInterval); i < 20*time.Millisecond || i > 10240*time.Millisecond {
+		problems = append(problems, configError(bthomeAdvertisingInterval, "must be from 20ms to 10.24s"))
+	}
+	return problems
+}
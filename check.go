@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/spf13/viper"
+)
+
+// Something wrong with the configuration. Warnings are for settings that
+// work but probably aren't what was meant.
+type configProblem struct {
+	key     string
+	message string
+	warning bool
+}
+
+func configError(key, format string, args ...interface{}) configProblem {
+	return configProblem{key: key, message: fmt.Sprintf(format, args...)}
+}
+
+func configWarning(key, format string, args ...interface{}) configProblem {
+	return configProblem{key: key, message: fmt.Sprintf(format, args...), warning: true}
+}
+
+// Everything check-config looks at. Anything with settings of its own can add to this.
+var configChecks = []func() []configProblem{
+	checkUnknownKeys,
+	checkSensorSettings,
+	checkWebSettings,
+	checkPollSettings,
+	checkMetricsSettings,
+}
+
+// `bme280-exporter check-config` looks for mistakes in the configuration
+// without starting anything
+func runCheckConfig(args []string) int {
+	var problems []configProblem
+	for _, check := range configChecks {
+		problems = append(problems, check()...)
+	}
+	if conf.GetBool(checkConnect) {
+		problems = append(problems, checkSinkConnections()...)
+	}
+
+	errors := 0
+	for _, p := range problems {
+		level := "warning"
+		if !p.warning {
+			level = "error"
+			errors++
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s: %s\n", level, p.key, p.message)
+	}
+	if errors > 0 {
+		fmt.Fprintf(os.Stderr, "%d error(s) found\n", errors)
+		return 1
+	}
+
+	if path := viper.ConfigFileUsed(); path != "" {
+		fmt.Printf("%s is valid\n", path)
+	} else {
+		fmt.Println("The configuration is valid")
+	}
+	return 0
+}
+
+// Settings that don't exist are usually typos
+func checkUnknownKeys() []configProblem {
+	known := func(k string) bool {
+		_, ok := configDefaults[k]
+		return ok || k == extraSensors || strings.HasPrefix(k, extraLabels+".")
+	}
+
+	var problems []configProblem
+	if path := viper.ConfigFileUsed(); path != "" {
+		v := viper.New()
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err == nil {
+			keys := v.AllKeys()
+			sort.Strings(keys)
+			for _, k := range keys {
+				if !known(k) {
+					problems = append(problems, configError(k, "unknown setting in %s%s", path, suggestKey(k)))
+				}
+			}
+		}
+	}
+
+	names := make(map[string]string)
+	for k := range configDefaults {
+		names[envName(k)] = k
+	}
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if !strings.HasPrefix(name, envPrefix+"_") || name == envPrefix+"_CONFIG" {
+			continue
+		}
+		if _, ok := names[name]; !ok {
+			problems = append(problems, configWarning(name, "environment variable doesn't match any setting"))
+		}
+	}
+	return problems
+}
+
+func envName(key string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// The closest real setting to a mistyped one, if there's one close enough
+func suggestKey(key string) string {
+	best, bestDistance := "", 4
+	for k := range configDefaults {
+		if d := editDistance(key, k); d < bestDistance || d == bestDistance && k < best {
+			best, bestDistance = k, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", best)
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func checkSensorSettings() []configProblem {
+	var problems []configProblem
+	if _, err := getSensorID(conf.GetString(modelName)); err != nil {
+		problems = append(problems, configError(modelName, "%v, use one of %s", err, strings.Join(sensorModels, ", ")))
+	}
+	if bus := conf.GetInt(i2cBus); bus < 0 {
+		problems = append(problems, configError(i2cBus, "the bus can't be negative"))
+	}
+	bus, addr, err := configuredAddress()
+	if err != nil {
+		problems = append(problems, configError(i2cAddress, "%v", err))
+	}
+	if h := conf.GetFloat64(humidityOffset); h <= -100 || h >= 100 {
+		problems = append(problems, configError(humidityOffset, "an offset of %g%% would always be out of range", h))
+	}
+
+	if _, err := parseLabels(conf.GetStringMapString(extraLabels)); err != nil {
+		problems = append(problems, configError(extraLabels, "%v", err))
+	}
+
+	sensors, err := conf.sensors()
+	if err != nil {
+		return append(problems, configError(extraSensors, "%v", err))
+	}
+	type location struct {
+		bus  int
+		addr uint8
+	}
+	seen := map[location]string{{bus, addr}: "the main sensor"}
+	for _, s := range sensors {
+		l := location{s.Bus, s.address}
+		if other, ok := seen[l]; ok {
+			problems = append(problems, configError(extraSensors, "%q is at %s on bus %d, the same as %s", s.Name, formatI2CAddress(s.address), s.Bus, other))
+		}
+		seen[l] = fmt.Sprintf("%q", s.Name)
+	}
+	return problems
+}
+
+func checkWebSettings() []configProblem {
+	var problems []configProblem
+	secured := false
+	if path := conf.GetString(webConfigFile); path != "" {
+		if err := web.Validate(path); err != nil {
+			problems = append(problems, configError(webConfigFile, "%v", err))
+		} else if c, err := readWebConfig(); err == nil {
+			secured = len(c.Users) > 0
+		}
+	}
+	if _, err := newAllowlistHandler(getStringList(allowedCIDRs), nil); err != nil {
+		problems = append(problems, configError(allowedCIDRs, "%v", err))
+	}
+
+	if conf.GetFloat64(rateLimit) > 0 && conf.GetInt(rateBurst) < 1 {
+		problems = append(problems, configError(rateBurst, "must be at least 1 with a rate limit, or every request is refused"))
+	}
+	for _, key := range []string{readHeaderTimeout, readTimeout, writeTimeout, shutdownTimeout} {
+		if conf.GetDuration(key) < 0 {
+			problems = append(problems, configError(key, "can't be negative"))
+		}
+	}
+
+	if addr := conf.GetString(grpcListenAddress); addr != "" {
+		_, port, err := net.SplitHostPort(addr)
+		switch {
+		case err != nil:
+			problems = append(problems, configError(grpcListenAddress, "%v", err))
+		case port == conf.GetString(metricsPort) && !conf.GetBool(systemdSocket):
+			problems = append(problems, configError(grpcListenAddress, "gRPC can't share port %s with the metrics", port))
+		}
+	}
+	if conf.GetBool(webDisable) {
+		if conf.GetBool(mdnsEnable) {
+			problems = append(problems, configWarning(mdnsEnable, "there's nothing to advertise with %s", webDisable))
+		}
+		if len(enabledSinks()) == 0 {
+			problems = append(problems, configWarning(webDisable, "there are no sinks either, so the readings don't go anywhere"))
+		}
+	}
+	if conf.GetBool(systemdSocket) && conf.GetBool(mdnsEnable) {
+		problems = append(problems, configWarning(mdnsEnable, "mDNS advertises --port, make sure it matches the systemd socket"))
+	}
+
+	if conf.GetBool(enablePprof) && !secured {
+		problems = append(problems, configWarning(enablePprof, "profiling is enabled without basic auth"))
+	}
+	if conf.GetBool(enableLifecycle) && !secured {
+		problems = append(problems, configWarning(enableLifecycle, "anyone who can reach the exporter can reload it"))
+	}
+	return problems
+}
+
+func checkPollSettings() []configProblem {
+	var problems []configProblem
+	if conf.GetDuration(pollInterval) < 0 {
+		problems = append(problems, configError(pollInterval, "can't be negative"))
+	}
+	if conf.GetInt(pollRecent) < 0 {
+		problems = append(problems, configError(pollRecent, "can't be negative"))
+	}
+	for _, key := range []string{pollHistory1m, pollHistory15m} {
+		if conf.GetDuration(key) < 0 {
+			problems = append(problems, configError(key, "can't be negative"))
+		} else if conf.GetDuration(key) > 0 && conf.GetDuration(pollHistory) <= 0 {
+			problems = append(problems, configWarning(key, "does nothing without %s", pollHistory))
+		}
+	}
+	switch h := conf.GetDuration(pollHistory); {
+	case h < 0:
+		problems = append(problems, configError(pollHistory, "can't be negative"))
+	case h > 0 && conf.GetDuration(pollInterval) <= 0:
+		problems = append(problems, configWarning(pollHistory, "does nothing without %s", pollInterval))
+	case h > 0 && conf.GetString(sqlitePath) != "":
+		problems = append(problems, configWarning(pollHistory, "isn't used, /api/v1/history comes from %s", sqlitePath))
+	}
+	if conf.GetInt(eventsMax) < 0 {
+		problems = append(problems, configError(eventsMax, "can't be negative"))
+	}
+	return problems
+}
+
+// Try connecting to every sink that's enabled, all at once so it doesn't take
+// a timeout for each one that's down
+func checkSinkConnections() []configProblem {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		problems []configProblem
+	)
+	d := net.Dialer{Timeout: conf.GetDuration(checkTimeout)}
+	for _, t := range sinkTypes {
+		if !t.enabled() || t.addresses == nil {
+			continue
+		}
+		for _, address := range t.addresses() {
+			wg.Add(1)
+			go func(name, address string) {
+				defer wg.Done()
+				conn, err := d.Dial("tcp", address)
+				if err != nil {
+					mu.Lock()
+					problems = append(problems, configError(name, "can't connect to %s: %v", address, err))
+					mu.Unlock()
+					return
+				}
+				conn.Close()
+			}(t.name, address)
+		}
+	}
+	wg.Wait()
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].key < problems[j].key || problems[i].key == problems[j].key && problems[i].message < problems[j].message
+	})
+	return problems
+}
+
+// A URL's host:port, with the port for http and https, or the one given, if
+// it doesn't have one. Nothing if it isn't a URL, which other checks report.
+func urlAddress(raw, port string) []string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return nil
+	}
+	switch {
+	case u.Port() != "":
+		port = u.Port()
+	case u.Scheme == "https" || u.Scheme == "wss":
+		port = "443"
+	case u.Scheme == "http" || u.Scheme == "ws":
+		port = "80"
+	}
+	if port == "" {
+		return nil
+	}
+	return []string{net.JoinHostPort(u.Hostname(), port)}
+}
+
+// A host:port, or a host on its own with the given port
+func hostAddress(s, port string) []string {
+	if _, _, err := net.SplitHostPort(s); err == nil {
+		return []string{s}
+	}
+	if s == "" || port == "" {
+		return nil
+	}
+	return []string{net.JoinHostPort(s, port)}
+}
+
+func checkMetricsSettings() []configProblem {
+	var problems []configProblem
+	// Dashboards and queries need names PromQL can take without quoting
+	if ns := conf.GetString(metricsNamespace); ns != "" && !model.LabelName(ns).IsValidLegacy() {
+		problems = append(problems, configError(metricsNamespace, "%q can't start a metric name, use letters, digits and underscores", ns))
+	}
+	enabled := getStringList(metricsEnabled)
+	for _, name := range enabled {
+		if name != temperatureMetric && name != pressureMetric && name != humidityMetric {
+			problems = append(problems, configError(metricsEnabled, "there's no %q metric, use temperature, pressure or humidity", name))
+		}
+	}
+	if len(enabled) == 0 {
+		problems = append(problems, configWarning(metricsEnabled, "only %s will be exported", metricName(upMetric)))
+	}
+	return problems
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestSinkAddresses(t *testing.T) {
+	tests := []struct {
+		got, want []string
+	}{
+		{urlAddress("http://influxdb:8086/api/v2", ""), []string{"influxdb:8086"}},
+		{urlAddress("https://splunk/services/collector", ""), []string{"splunk:443"}},
+		{urlAddress("http://[::1]/write", ""), []string{"[::1]:80"}},
+		{urlAddress("wss://signalk", ""), []string{"signalk:443"}},
+		{urlAddress("postgres://user@db/readings", "5432"), []string{"db:5432"}},
+		{urlAddress("rediss://cache:6380", "6379"), []string{"cache:6380"}},
+		{urlAddress("nats://nats", ""), nil},
+		{urlAddress("influxdb:8086", ""), nil},
+		{urlAddress("", "80"), nil},
+		{hostAddress("zabbix", "10051"), []string{"zabbix:10051"}},
+		{hostAddress("zabbix:10052", "10051"), []string{"zabbix:10052"}},
+		{hostAddress("graphite", ""), nil},
+		{hostAddress("", "8883"), nil},
+	}
+	for i, tt := range tests {
+		if !slices.Equal(tt.got, tt.want) {
+			t.Errorf("%d: got %q, want %q", i, tt.got, tt.want)
+		}
+	}
+}
+
+func TestCheckSinkConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// Nothing's listening once it's closed
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	for key, v := range map[string]interface{}{
+		webhookURL:   "http://" + l.Addr().String() + "/hook",
+		kafkaBrokers: []string{l.Addr().String(), closed.Addr().String()},
+		csvPath:      t.TempDir() + "/readings.csv",
+	} {
+		old := viper.Get(key)
+		viper.Set(key, v)
+		t.Cleanup(func() { viper.Set(key, old) })
+	}
+
+	problems := checkSinkConnections()
+	if len(problems) != 1 || problems[0].key != "kafka" || problems[0].warning {
+		t.Fatalf("got %+v, want an error for the closed Kafka broker", problems)
+	}
+}
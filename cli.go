@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Filled in at build time, goreleaser does this by default
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+var configFile string
+
+// A subcommand with its own flags. Running without one serves metrics, which
+// is all the exporter used to do.
+type command struct {
+	name    string
+	args    string
+	summary string
+	// One-shot commands keep the logging quiet so their own output is readable
+	logLevel slog.Level
+	flags    func(fs *pflag.FlagSet)
+	run      func(args []string) int
+}
+
+func commands() []*command {
+	return []*command{
+		{name: "serve", summary: "Serve metrics (the default)", logLevel: slog.LevelInfo, flags: serveFlags, run: runServe},
+		{name: "read", summary: "Read the sensor once and print the values", logLevel: slog.LevelWarn, flags: readFlags, run: runRead},
+		{name: "watch", summary: "Show live readings and trends in the terminal", logLevel: slog.LevelWarn, flags: watchFlags, run: runWatch},
+		{name: "scan", summary: "Look for sensors on the I2C buses", logLevel: slog.LevelWarn, flags: scanFlags, run: runScan},
+		{name: "test", summary: "Check that the sensor is wired up and working", logLevel: slog.LevelWarn, flags: sensorFlags, run: runSelfTest},
+		{name: "bench", summary: "Time sensor reads at each accuracy level", logLevel: slog.LevelWarn, flags: benchFlags, run: runBench},
+		{name: "collectd", summary: "Print readings for collectd's exec plugin", logLevel: slog.LevelWarn, flags: collectdFlags, run: runCollectd},
+		{name: "munin", args: "<graph> [config|autoconf|suggest]", summary: "Be a Munin plugin", logLevel: slog.LevelWarn, flags: sensorFlags, run: runMunin},
+		{name: "export", summary: "Write out the readings kept in SQLite", logLevel: slog.LevelWarn, flags: exportFlags, run: runExport},
+		{name: "healthcheck", summary: "Ask a running exporter whether it's ready", logLevel: slog.LevelWarn, flags: healthcheckFlags, run: runHealthcheck},
+		{name: "check-config", summary: "Check the configuration for mistakes", logLevel: slog.LevelWarn, flags: checkConfigFlags, run: runCheckConfig},
+		{name: "config-schema", summary: "Print a JSON Schema for the configuration file", logLevel: slog.LevelWarn, run: runConfigSchema},
+		{name: "print-config", summary: "Show the configuration the exporter would run with", logLevel: slog.LevelWarn, flags: allFlags, run: runPrintConfig},
+		{name: "version", summary: "Show the version", logLevel: slog.LevelWarn, run: runVersion},
+	}
+}
+
+// Pick the command from the arguments, parse its flags, and run it
+func runCLI(args []string) int {
+	// Symlinked into Munin's plugins directory, e.g. as bme280_temperature
+	if graph, ok := strings.CutPrefix(programName(), muninPrefix); ok {
+		if graph != "" {
+			args = append([]string{graph}, args...)
+		}
+		args = append([]string{"munin"}, args...)
+	}
+
+	code := 0
+	root := &cobra.Command{
+		Use:               programName(),
+		Short:             "Export readings from a BME280 or BMP280 sensor",
+		SilenceErrors:     true,
+		CompletionOptions: cobra.CompletionOptions{DisableDefaultCmd: true},
+	}
+	root.SetFlagErrorFunc(func(c *cobra.Command, err error) error {
+		return fmt.Errorf("%w\n\n%s", err, c.UsageString())
+	})
+	for _, c := range commands() {
+		root.AddCommand(c.cobraCommand(&code))
+		// Running with just flags serves metrics
+		if c.name == "serve" {
+			serve := c.cobraCommand(&code)
+			root.Flags().AddFlagSet(serve.Flags())
+			root.PreRunE, root.Run = serve.PreRunE, serve.Run
+		}
+	}
+	root.Flags().SortFlags = false
+
+	root.SetArgs(args)
+	if err := root.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		// Anything but a problem with the configuration file is a usage error
+		if code == 0 {
+			code = 2
+		}
+	}
+	return code
+}
+
+// The cobra command, which leaves what run returned in code
+func (c *command) cobraCommand(code *int) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   c.name,
+		Short: c.summary,
+		Args:  cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := loadConfigFile(configFile); err != nil {
+				*code = 1
+				return err
+			}
+			bindFlags(cmd.Flags())
+			setupLogging(c.logLevel)
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			*code = c.run(args)
+		},
+		SilenceUsage: true,
+	}
+	if c.args != "" {
+		cmd.Use += " " + c.args
+		cmd.Args = cobra.ArbitraryArgs
+	}
+	fs := cmd.Flags()
+	fs.BoolP(verbose, "v", conf.GetBool(verbose), "Log everything, the same as --log.level debug")
+	fs.String(logLevel, conf.GetString(logLevel), "The exporter's log level: debug, info, warn, or error (default depends on the command)")
+	fs.String(logLevelI2C, conf.GetString(logLevelI2C), "The I2C library's log level (default is quiet unless debugging)")
+	fs.String(logLevelSensor, conf.GetString(logLevelSensor), "The sensor driver's log level (default is quiet unless debugging)")
+	fs.String(logFormat, conf.GetString(logFormat), "Log as text or json")
+	fs.Duration(logDedupeWindow, conf.GetDuration(logDedupeWindow), "Log repeats of the same warning or error once per this long with a count, 0 to log them all")
+	fs.String(logOutput, conf.GetString(logOutput), "Where to log: stderr, syslog, journal, or file")
+	fs.String(logSyslogAddress, conf.GetString(logSyslogAddress), "A remote syslog server, e.g. udp://loghost:514 (default is the local one)")
+	fs.String(logFilePath, conf.GetString(logFilePath), "The file to log to with --log.output file")
+	fs.Int(logFileMaxSize, conf.GetInt(logFileMaxSize), "Start a new log file when it reaches this many megabytes, 0 for no limit")
+	fs.Duration(logFileMaxAge, conf.GetDuration(logFileMaxAge), "Start a new log file when it's this old, 0 for no limit")
+	fs.Int(logFileMaxBackups, conf.GetInt(logFileMaxBackups), "How many old log files to keep")
+	fs.StringVarP(&configFile, "config", "c", "", "Configuration file (default "+defaultConfigFile+" if it exists)")
+	if c.flags != nil {
+		c.flags(fs)
+	}
+	fs.SortFlags = false
+	return cmd
+}
+
+// Bind the flags to viper so they override the defaults. Flags that only
+// matter to their command, like scan's --bus, aren't configuration.
+func bindFlags(fs *pflag.FlagSet) {
+	fs.VisitAll(func(f *pflag.Flag) {
+		if _, ok := configDefaults[f.Name]; ok {
+			viper.BindPFlag(f.Name, f)
+		}
+	})
+}
+
+func programName() string {
+	return filepath.Base(os.Args[0])
+}
+
+// Every flag from every command, so print-config can show the effect of any of them
+func allFlags(fs *pflag.FlagSet) {
+	for _, c := range commands() {
+		if c.flags == nil || c.name == "print-config" || c.name == "check-config" {
+			continue
+		}
+		other := pflag.NewFlagSet(c.name, pflag.ContinueOnError)
+		c.flags(other)
+		other.VisitAll(func(f *pflag.Flag) {
+			if fs.Lookup(f.Name) == nil {
+				fs.AddFlag(f)
+			}
+		})
+	}
+}
+
+func runVersion(args []string) int {
+	fmt.Printf("%s %s\n", programName(), version)
+	rev, built := commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && rev == "":
+				rev = s.Value
+			case s.Key == "vcs.time" && built == "":
+				built = s.Value
+			}
+		}
+	}
+	if rev != "" {
+		fmt.Printf("  revision: %s\n", rev)
+	}
+	if built != "" {
+		fmt.Printf("  built:    %s\n", built)
+	}
+	fmt.Printf("  go:       %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Writes readings to Google Cloud Monitoring as custom metrics, each
+// sensor's on a generic_node resource with its host as the node ID. The
+// metric descriptors are made by Cloud Monitoring when the first points are
+// written. See
+// https://cloud.google.com/monitoring/custom-metrics/creating-metrics
+
+const gcpMonitoringScope = "https://www.googleapis.com/auth/monitoring.write"
+
+// Cloud Monitoring takes a point for a series at most every 5 seconds, one
+// for each series in a request, and at most 200 series a request
+const (
+	gcpMonitoringMinPeriod = 5 * time.Second
+	gcpMonitoringBatchSize = 200
+)
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "gcp-monitoring",
+		intervalKey: gcpMonitoringInterval,
+		enabled:     func() bool { return conf.GetString(gcpMonitoringProject) != "" },
+		open:        openGCPMonitoring,
+		addresses:   func() []string { return urlAddress(conf.GetString(gcpMonitoringEndpoint), "") },
+	})
+	configChecks = append(configChecks, checkGCPMonitoringSettings)
+}
+
+type gcpTimeSeries struct {
+	Metric struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels,omitempty"`
+	} `json:"metric"`
+	Resource struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels"`
+	} `json:"resource"`
+	Points []gcpPoint `json:"points"`
+}
+
+type gcpPoint struct {
+	Interval struct {
+		EndTime string `json:"endTime"`
+	} `json:"interval"`
+	Value struct {
+		DoubleValue float64 `json:"doubleValue"`
+	} `json:"value"`
+}
+
+type gcpMonitoringSink struct {
+	url       string
+	project   string
+	prefix    string
+	location  string
+	namespace string
+	tokens    *gcpTokenSource
+	client    *http.Client
+	// The time of the last point written to each series
+	last map[string]time.Time
+}
+
+func openGCPMonitoring() (sink, error) {
+	tokens, err := newGCPTokenSource(gcpMonitoringScope)
+	if err != nil {
+		return nil, err
+	}
+	project := conf.GetString(gcpMonitoringProject)
+	return &gcpMonitoringSink{
+		url:       strings.TrimSuffix(conf.GetString(gcpMonitoringEndpoint), "/") + "/v3/projects/" + url.PathEscape(project) + "/timeSeries",
+		project:   project,
+		prefix:    strings.TrimSuffix(conf.GetString(gcpMonitoringMetricPrefix), "/"),
+		location:  conf.GetString(gcpMonitoringLocation),
+		namespace: conf.GetString(gcpMonitoringNamespace),
+		tokens:    tokens,
+		client:    &http.Client{},
+		last:      make(map[string]time.Time),
+	}, nil
+}
+
+func (s *gcpMonitoringSink) series(smp sample, v sampleValue) gcpTimeSeries {
+	var ts gcpTimeSeries
+	ts.Metric.Type = s.prefix + "/" + v.name
+	ts.Metric.Labels = smp.tags()
+	// It's the resource's node ID already
+	delete(ts.Metric.Labels, "host")
+	ts.Resource.Type = "generic_node"
+	ts.Resource.Labels = map[string]string{
+		"project_id": s.project,
+		"location":   s.location,
+		"namespace":  s.namespace,
+		"node_id":    smp.Sensor.Host,
+	}
+	var p gcpPoint
+	p.Interval.EndTime = smp.Time.UTC().Format(time.RFC3339Nano)
+	p.Value.DoubleValue = v.value
+	ts.Points = []gcpPoint{p}
+	return ts
+}
+
+// What tells one series from another
+func gcpSeriesKey(ts gcpTimeSeries) string {
+	names := make([]string, 0, len(ts.Metric.Labels))
+	for k := range ts.Metric.Labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	key := ts.Metric.Type + "\xff" + ts.Resource.Labels["node_id"]
+	for _, k := range names {
+		key += "\xff" + k + "=" + ts.Metric.Labels[k]
+	}
+	return key
+}
+
+func (s *gcpMonitoringSink) push(ctx context.Context, samples []sample) error {
+	// A series can't come up twice in a request, so a request's sent as soon
+	// as one would, which keeps each series' points in order
+	var batch []gcpTimeSeries
+	inBatch := make(map[string]time.Time)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.write(ctx, batch); err != nil {
+			return err
+		}
+		for key, t := range inBatch {
+			s.last[key] = t
+		}
+		batch, inBatch = nil, make(map[string]time.Time)
+		return nil
+	}
+	for _, smp := range samples {
+		for _, v := range smp.values() {
+			ts := s.series(smp, v)
+			key := gcpSeriesKey(ts)
+			last, ok := inBatch[key]
+			if !ok {
+				last, ok = s.last[key]
+			}
+			if ok && smp.Time.Sub(last) < gcpMonitoringMinPeriod {
+				continue
+			}
+			if _, ok := inBatch[key]; ok || len(batch) == gcpMonitoringBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			batch = append(batch, ts)
+			inBatch[key] = smp.Time
+		}
+	}
+	return flush()
+}
+
+func (s *gcpMonitoringSink) write(ctx context.Context, batch []gcpTimeSeries) error {
+	token, err := s.tokens.get(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string][]gcpTimeSeries{"timeSeries": batch})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(msg, &e) == nil && e.Error.Message != "" {
+		msg = []byte(e.Error.Status + ": " + e.Error.Message)
+	}
+	// Points that are out of order or too old are turned down the same way
+	// every time, and the rest of the request is still written, so sending it
+	// again from the spool would never get anywhere
+	if resp.StatusCode == http.StatusBadRequest {
+		lg.Warnf("Cloud Monitoring turned down some readings: %s", strings.TrimSpace(string(msg)))
+		return nil
+	}
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (s *gcpMonitoringSink) close() error {
+	return nil
+}
+
+var gcpMetricPrefixRe = regexp.MustCompile(`^(custom|external)\.googleapis\.com(/[a-zA-Z0-9_]+)*$`)
+
+func checkGCPMonitoringSettings() []configProblem {
+	if conf.GetString(gcpMonitoringProject) == "" {
+		return nil
+	}
+	var problems []configProblem
+	if p := strings.TrimSuffix(conf.GetString(gcpMonitoringMetricPrefix), "/"); !gcpMetricPrefixRe.MatchString(p) {
+		problems = append(problems, configError(gcpMonitoringMetricPrefix, "invalid prefix %q, use custom.googleapis.com/ followed by a path", p))
+	}
+	if v := conf.GetString(gcpMonitoringEndpoint); v != "" {
+		if u, err := url.Parse(v); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, configError(gcpMonitoringEndpoint, "invalid URL %q", v))
+		}
+	}
+	if conf.GetString(gcpMonitoringLocation) == "" {
+		problems = append(problems, configError(gcpMonitoringLocation, "can't be empty, use global if nothing else fits"))
+	}
+	// The sensor type and labels are metric labels, of which there can be 30
+	if n := len(conf.GetStringMapString(extraLabels)); n > 29 {
+		problems = append(problems, configError(extraLabels, "Cloud Monitoring takes at most 30 metric labels, so 29 labels"))
+	}
+	if name := gcpCredentialsPath(); name != "" {
+		if _, err := os.Stat(name); err != nil {
+			problems = append(problems, configError(gcpCredentialsFileKey, "%v", err))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Puts readings in CloudWatch as custom metrics with PutMetricData, with the
+// host, sensor type and configured labels as dimensions. Each different set
+// of dimensions is a metric CloudWatch charges for. See
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/API_PutMetricData.html
+
+// The most values one PutMetricData can take
+const cloudwatchBatchSize = 1000
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "cloudwatch",
+		intervalKey: cloudwatchInterval,
+		enabled:     func() bool { return conf.GetString(cloudwatchNamespace) != "" },
+		open:        openCloudWatch,
+		addresses: func() []string {
+			if u := conf.GetString(cloudwatchEndpoint); u != "" {
+				return urlAddress(u, "")
+			}
+			return []string{"monitoring." + awsRegionName() + ".amazonaws.com:443"}
+		},
+	})
+	configChecks = append(configChecks, checkCloudWatchSettings)
+}
+
+// CloudWatch's units for each metric
+var cloudwatchUnits = map[string]string{
+	temperatureMetric: "None",
+	pressureMetric:    "None",
+	humidityMetric:    "Percent",
+}
+
+type cloudwatchSink struct {
+	url       string
+	region    string
+	namespace string
+	creds     *awsCredentialSource
+	client    *http.Client
+}
+
+type cloudwatchError struct {
+	Error struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+}
+
+func openCloudWatch() (sink, error) {
+	creds, err := newAWSCredentialSource()
+	if err != nil {
+		return nil, err
+	}
+	region := awsRegionName()
+	u := conf.GetString(cloudwatchEndpoint)
+	if u == "" {
+		u = "https://monitoring." + region + ".amazonaws.com/"
+	}
+	return &cloudwatchSink{
+		url:       u,
+		region:    region,
+		namespace: conf.GetString(cloudwatchNamespace),
+		creds:     creds,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (s *cloudwatchSink) push(ctx context.Context, samples []sample) error {
+	form := s.form()
+	n := 0
+	for _, smp := range samples {
+		dims := smp.tags()
+		names := make([]string, 0, len(dims))
+		for k := range dims {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		ts := smp.Time.UTC().Format("2006-01-02T15:04:05.000Z")
+		for _, v := range smp.values() {
+			n++
+			p := "MetricData.member." + strconv.Itoa(n) + "."
+			form.Set(p+"MetricName", v.name)
+			form.Set(p+"Value", strconv.FormatFloat(v.value, 'g', -1, 64))
+			form.Set(p+"Unit", cloudwatchUnits[v.name])
+			form.Set(p+"Timestamp", ts)
+			for i, name := range names {
+				d := p + "Dimensions.member." + strconv.Itoa(i+1) + "."
+				form.Set(d+"Name", name)
+				form.Set(d+"Value", dims[name])
+			}
+			if n == cloudwatchBatchSize {
+				if err := s.put(ctx, form); err != nil {
+					return err
+				}
+				form, n = s.form(), 0
+			}
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return s.put(ctx, form)
+}
+
+func (s *cloudwatchSink) form() url.Values {
+	return url.Values{"Action": {"PutMetricData"}, "Version": {"2010-08-01"}, "Namespace": {s.namespace}}
+}
+
+func (s *cloudwatchSink) put(ctx context.Context, form url.Values) error {
+	creds, err := s.creds.get(ctx)
+	if err != nil {
+		return err
+	}
+	body := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	signAWS(req, body, creds, s.region, "monitoring", time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var e cloudwatchError
+	if xml.Unmarshal(msg, &e) == nil && e.Error.Code != "" {
+		return fmt.Errorf("%s: %s", e.Error.Code, e.Error.Message)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (s *cloudwatchSink) close() error {
+	return nil
+}
+
+func checkCloudWatchSettings() []configProblem {
+	if conf.GetString(cloudwatchNamespace) == "" {
+		return nil
+	}
+	var problems []configProblem
+	if awsRegionName() == "" {
+		problems = append(problems, configError(awsRegion, "is needed for CloudWatch, or set AWS_REGION"))
+	}
+	if strings.HasPrefix(conf.GetString(cloudwatchNamespace), "AWS/") {
+		problems = append(problems, configError(cloudwatchNamespace, "namespaces starting AWS/ are AWS's own"))
+	}
+	if v := conf.GetString(cloudwatchEndpoint); v != "" {
+		if u, err := url.Parse(v); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, configError(cloudwatchEndpoint, "invalid URL %q", v))
+		}
+	}
+	// The host and sensor type take two of CloudWatch's 30
+	if n := len(conf.GetStringMapString(extraLabels)); n > 28 {
+		problems = append(problems, configError(extraLabels, "CloudWatch takes at most 30 dimensions, so 28 labels"))
+	}
+	return problems
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A CoAP server for constrained devices that don't do HTTP, with the
+// readings at /readings as JSON, CBOR or SenML, and Observe for having new
+// ones pushed as they're taken. There's no DTLS, so it's coap:// only. See
+// RFC 7252 for CoAP, RFC 7641 for Observe and RFC 8428 for SenML.
+
+func init() {
+	configChecks = append(configChecks, checkCoAPSettings)
+}
+
+// Message types
+const (
+	coapConfirmable    = 0
+	coapNonConfirmable = 1
+	coapAcknowledgment = 2
+	coapReset          = 3
+)
+
+// Codes, as class<<5 | detail
+const (
+	coapEmpty                = 0x00
+	coapGet                  = 0x01
+	coapContent              = 0x45
+	coapBadOption            = 0x82
+	coapNotFound             = 0x84
+	coapMethodNotAllowed     = 0x85
+	coapNotAcceptable        = 0x86
+	coapServiceUnavailable   = 0xa3
+	coapProxyingNotSupported = 0xa5
+)
+
+// Options
+const (
+	coapOptionObserve       = 6
+	coapOptionURIPath       = 11
+	coapOptionContentFormat = 12
+	coapOptionMaxAge        = 14
+	coapOptionURIQuery      = 15
+	coapOptionAccept        = 17
+	coapOptionProxyURI      = 35
+	coapOptionProxyScheme   = 39
+)
+
+// Content formats
+const (
+	coapLinkFormat = 40
+	coapJSON       = 50
+	coapCBOR       = 60
+	coapSenMLJSON  = 110
+	coapSenMLCBOR  = 112
+)
+
+var coapFormats = map[string]int{
+	"json":       coapJSON,
+	"cbor":       coapCBOR,
+	"senml+json": coapSenMLJSON,
+	"senml+cbor": coapSenMLCBOR,
+}
+
+// The most observers at once
+const coapMaxObservers = 64
+
+// Every so many notifications are confirmable, to find out if the observer's
+// still there
+const coapConfirmEvery = 20
+
+type coapOption struct {
+	num   int
+	value []byte
+}
+
+type coapMessage struct {
+	typ     byte
+	code    byte
+	id      uint16
+	token   []byte
+	options []coapOption
+	payload []byte
+}
+
+func parseCoAP(b []byte) (coapMessage, error) {
+	var m coapMessage
+	if len(b) < 4 || b[0]>>6 != 1 {
+		return m, errors.New("not a CoAP message")
+	}
+	m.typ, m.code, m.id = b[0]>>4&0x3, b[1], binary.BigEndian.Uint16(b[2:])
+	tkl := int(b[0] & 0xf)
+	if tkl > 8 || len(b) < 4+tkl {
+		return m, errors.New("invalid token")
+	}
+	m.token, b = b[4:4+tkl], b[4+tkl:]
+
+	num := 0
+	for len(b) > 0 {
+		if b[0] == 0xff {
+			if len(b) == 1 {
+				return m, errors.New("payload marker without a payload")
+			}
+			m.payload = b[1:]
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+		// 13 and 14 mean the rest is in one or two more bytes
+		var err error
+		if delta, b, err = coapExtended(delta, b); err != nil {
+			return m, err
+		}
+		if length, b, err = coapExtended(length, b); err != nil {
+			return m, err
+		}
+		if len(b) < length {
+			return m, errors.New("truncated option")
+		}
+		num += delta
+		m.options = append(m.options, coapOption{num, b[:length]})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+func coapExtended(n int, b []byte) (int, []byte, error) {
+	switch {
+	case n == 13 && len(b) >= 1:
+		return int(b[0]) + 13, b[1:], nil
+	case n == 14 && len(b) >= 2:
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case n < 13:
+		return n, b, nil
+	}
+	return 0, nil, errors.New("invalid option")
+}
+
+func (m coapMessage) marshal() []byte {
+	b := []byte{1<<6 | m.typ<<4 | byte(len(m.token)), m.code}
+	b = binary.BigEndian.AppendUint16(b, m.id)
+	b = append(b, m.token...)
+	sort.SliceStable(m.options, func(i, j int) bool { return m.options[i].num < m.options[j].num })
+	num := 0
+	for _, o := range m.options {
+		delta, length := o.num-num, len(o.value)
+		num = o.num
+		nibble := func(n int) (byte, []byte) {
+			switch {
+			case n < 13:
+				return byte(n), nil
+			case n < 269:
+				return 13, []byte{byte(n - 13)}
+			}
+			return 14, binary.BigEndian.AppendUint16(nil, uint16(n-269))
+		}
+		d, dext := nibble(delta)
+		l, lext := nibble(length)
+		b = append(b, d<<4|l)
+		b = append(append(append(b, dext...), lext...), o.value...)
+	}
+	if len(m.payload) > 0 {
+		b = append(append(b, 0xff), m.payload...)
+	}
+	return b
+}
+
+func (m coapMessage) option(num int) ([]byte, bool) {
+	for _, o := range m.options {
+		if o.num == num {
+			return o.value, true
+		}
+	}
+	return nil, false
+}
+
+// Options that are numbers are big-endian with no leading zeros
+func coapUint(v uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func coapParseUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+type coapObserver struct {
+	addr   net.Addr
+	token  []byte
+	format int
+	sent   int
+	// The message ID of the last confirmable notification, until it's acked
+	pending    uint16
+	hasPending bool
+	// Of the last notification, which a reset refers to
+	lastID uint16
+}
+
+type coapServer struct {
+	conn      net.PacketConn
+	poller    *poller
+	allowlist *allowlistHandler
+	format    int
+
+	mu        sync.Mutex
+	nextID    uint16
+	observers []*coapObserver
+	// The Observe sequence number, one more for each reading
+	seq uint32
+}
+
+// Serve CoAP until the context is cancelled
+func serveCoAP(ctx context.Context, addr string, p *poller) error {
+	s := &coapServer{
+		poller: p,
+		format: coapFormats[conf.GetString(coapFormat)],
+		nextID: uint16(rand.Intn(1 << 16)),
+	}
+	if s.format == 0 {
+		return fmt.Errorf("unknown CoAP format %q", conf.GetString(coapFormat))
+	}
+	var err error
+	if cidrs := getStringList(allowedCIDRs); len(cidrs) > 0 {
+		if s.allowlist, err = newAllowlistHandler(cidrs, nil); err != nil {
+			return err
+		}
+	}
+	if s.conn, err = net.ListenPacket("udp", addr); err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		s.conn.Close()
+	}()
+	lg.Infof("Serving CoAP on %s", s.conn.LocalAddr())
+	if p != nil {
+		go s.notifyObservers(ctx, p.subscribe())
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if s.allowlist != nil && !s.allowlist.allowed(from.String()) {
+			continue
+		}
+		m, err := parseCoAP(buf[:n])
+		if err != nil {
+			lg.Debugf("Ignoring CoAP message from %s: %v", from, err)
+			continue
+		}
+		if resp, ok := s.handle(ctx, m, from); ok {
+			s.send(from, resp)
+		}
+	}
+}
+
+func (s *coapServer) send(to net.Addr, m coapMessage) {
+	if _, err := s.conn.WriteTo(m.marshal(), to); err != nil {
+		lg.Debugf("Problem sending CoAP message to %s: %v", to, err)
+	}
+}
+
+func (s *coapServer) messageID() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	return s.nextID
+}
+
+// Answer a message, if it needs an answer
+func (s *coapServer) handle(ctx context.Context, m coapMessage, from net.Addr) (coapMessage, bool) {
+	switch {
+	case m.typ == coapAcknowledgment || m.typ == coapReset:
+		s.acknowledged(from, m.id, m.typ == coapReset)
+		return coapMessage{}, false
+	case m.code == coapEmpty:
+		// A ping, which gets a reset
+		if m.typ == coapConfirmable {
+			return coapMessage{typ: coapReset, id: m.id}, true
+		}
+		return coapMessage{}, false
+	case m.code>>5 != 0:
+		// A response, which isn't meant for a server
+		if m.typ == coapConfirmable {
+			return coapMessage{typ: coapReset, id: m.id}, true
+		}
+		return coapMessage{}, false
+	}
+
+	resp := coapMessage{typ: coapAcknowledgment, id: m.id, token: m.token}
+	if m.typ == coapNonConfirmable {
+		resp.typ, resp.id = coapNonConfirmable, s.messageID()
+	}
+	resp.code, resp.options, resp.payload = s.request(ctx, m, from)
+	return resp, true
+}
+
+func (s *coapServer) request(ctx context.Context, m coapMessage, from net.Addr) (byte, []coapOption, []byte) {
+	var path []string
+	for _, o := range m.options {
+		switch o.num {
+		case coapOptionURIPath:
+			path = append(path, string(o.value))
+		case coapOptionProxyURI, coapOptionProxyScheme:
+			return coapProxyingNotSupported, nil, nil
+		case coapOptionObserve, coapOptionAccept, coapOptionURIQuery:
+		default:
+			// Odd options are critical, and can't be ignored
+			if o.num%2 == 1 {
+				return coapBadOption, nil, []byte(fmt.Sprintf("Unsupported option %d", o.num))
+			}
+		}
+	}
+
+	switch strings.Join(path, "/") {
+	case ".well-known/core":
+		if m.code != coapGet {
+			return coapMethodNotAllowed, nil, nil
+		}
+		obs := ""
+		if s.poller != nil {
+			obs = ";obs"
+		}
+		links := fmt.Sprintf(`</readings>;rt="bme280.readings";ct="%d %d %d %d"%s`, coapJSON, coapCBOR, coapSenMLJSON, coapSenMLCBOR, obs)
+		return coapContent, []coapOption{{coapOptionContentFormat, coapUint(coapLinkFormat)}}, []byte(links)
+	case "readings":
+	default:
+		return coapNotFound, nil, nil
+	}
+	if m.code != coapGet {
+		return coapMethodNotAllowed, nil, nil
+	}
+
+	format := s.format
+	if v, ok := m.option(coapOptionAccept); ok {
+		format = int(coapParseUint(v))
+		if format != coapJSON && format != coapCBOR && format != coapSenMLJSON && format != coapSenMLCBOR {
+			return coapNotAcceptable, nil, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	r, err := currentReading(ctx, s.poller)
+	if err != nil {
+		return coapServiceUnavailable, nil, []byte("Timed out reading the sensor")
+	}
+	payload, err := coapPayload(r, format)
+	if err != nil {
+		return coapServiceUnavailable, nil, nil
+	}
+	options := []coapOption{{coapOptionContentFormat, coapUint(uint32(format))}}
+	if s.poller != nil {
+		options = append(options, coapOption{coapOptionMaxAge, coapUint(uint32(math.Ceil(s.poller.Interval().Seconds())))})
+	}
+
+	// Observe 0 registers, and 1 deregisters. Without the poller there's
+	// nothing to notify of, and leaving the option out of the response says
+	// so.
+	if v, ok := m.option(coapOptionObserve); ok && s.poller != nil {
+		if seq, ok := s.observe(from, m.token, format, coapParseUint(v) == 0); ok {
+			options = append(options, coapOption{coapOptionObserve, coapUint(seq)})
+		}
+	}
+	return coapContent, options, payload
+}
+
+// Add or remove an observer, giving the sequence number if it was added
+func (s *coapServer) observe(addr net.Addr, token []byte, format int, register bool) (uint32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.observers {
+		if o.addr.String() == addr.String() && string(o.token) == string(token) {
+			s.observers = append(s.observers[:i], s.observers[i+1:]...)
+			break
+		}
+	}
+	if !register || len(s.observers) >= coapMaxObservers {
+		return 0, false
+	}
+	s.observers = append(s.observers, &coapObserver{addr: addr, token: append([]byte{}, token...), format: format})
+	lg.Debugf("CoAP observer %s registered", addr)
+	return s.seq, true
+}
+
+// An ack clears a confirmable notification, and a reset means the observer
+// isn't interested any more
+func (s *coapServer) acknowledged(addr net.Addr, id uint16, reset bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.observers {
+		if o.addr.String() != addr.String() {
+			continue
+		}
+		if reset && (o.lastID == id || (o.hasPending && o.pending == id)) {
+			s.observers = append(s.observers[:i], s.observers[i+1:]...)
+			lg.Debugf("CoAP observer %s deregistered", addr)
+			return
+		}
+		if !reset && o.hasPending && o.pending == id {
+			o.hasPending = false
+			return
+		}
+	}
+}
+
+// Send observers each new reading as the poller takes them
+func (s *coapServer) notifyObservers(ctx context.Context, readings chan reading) {
+	defer s.poller.unsubscribe(readings)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r, ok := <-readings:
+			if !ok {
+				return
+			}
+			s.notify(r)
+		}
+	}
+}
+
+// Send a reading to the observers. Observers that haven't acked the last
+// confirmable notification by the time the next one's due are dropped,
+// rather than retransmitting.
+func (s *coapServer) notify(r reading) {
+	type notification struct {
+		addr net.Addr
+		m    coapMessage
+	}
+	var send []notification
+	payloads := make(map[int][]byte)
+	s.mu.Lock()
+	s.seq = (s.seq + 1) % (1 << 24)
+	observers := s.observers[:0]
+	for _, o := range s.observers {
+		o.sent++
+		confirm := o.sent%coapConfirmEvery == 0
+		if confirm && o.hasPending {
+			lg.Debugf("Dropping CoAP observer %s, which stopped answering", o.addr)
+			continue
+		}
+		observers = append(observers, o)
+		payload, ok := payloads[o.format]
+		if !ok {
+			var err error
+			if payload, err = coapPayload(r, o.format); err != nil {
+				continue
+			}
+			payloads[o.format] = payload
+		}
+		s.nextID++
+		m := coapMessage{typ: coapNonConfirmable, code: coapContent, id: s.nextID, token: o.token, payload: payload, options: []coapOption{
+			{coapOptionObserve, coapUint(s.seq)},
+			{coapOptionContentFormat, coapUint(uint32(o.format))},
+			{coapOptionMaxAge, coapUint(uint32(math.Ceil(s.poller.Interval().Seconds())))},
+		}}
+		if confirm {
+			m.typ = coapConfirmable
+			o.pending, o.hasPending = m.id, true
+		}
+		o.lastID = m.id
+		send = append(send, notification{o.addr, m})
+	}
+	s.observers = observers
+	s.mu.Unlock()
+
+	for _, n := range send {
+		s.send(n.addr, n.m)
+	}
+}
+
+// The reading in a content format
+func coapPayload(r reading, format int) ([]byte, error) {
+	switch format {
+	case coapSenMLJSON, coapSenMLCBOR:
+		// Base name and time in the first record, SenML's units, and
+		// integer labels in CBOR
+		type record struct {
+			BaseName string  `json:"bn,omitempty"`
+			BaseTime float64 `json:"bt,omitempty"`
+			Name     string  `json:"n"`
+			Unit     string  `json:"u"`
+			Value    float64 `json:"v"`
+		}
+		var records []record
+		for _, v := range []struct {
+			name, unit string
+			value      float64
+		}{
+			{"temperature", "Cel", r.Temperature},
+			{"pressure", "Pa", r.Pressure},
+			{"humidity", "%RH", r.Humidity},
+		} {
+			if !math.IsNaN(v.value) {
+				records = append(records, record{Name: v.name, Unit: v.unit, Value: v.value})
+			}
+		}
+		if len(records) > 0 {
+			records[0].BaseName = hostname + ":"
+			records[0].BaseTime = float64(r.Time.UnixMilli()) / 1000
+		}
+		if format == coapSenMLJSON {
+			if records == nil {
+				return []byte("[]"), nil
+			}
+			return json.Marshal(records)
+		}
+		list := []any{}
+		for _, rec := range records {
+			var m cborIntMap
+			if rec.BaseName != "" {
+				m = append(m, cborPair{-2, rec.BaseName}, cborPair{-3, rec.BaseTime})
+			}
+			list = append(list, append(m, cborPair{0, rec.Name}, cborPair{1, rec.Unit}, cborPair{2, rec.Value}))
+		}
+		return cborAppend(nil, list), nil
+	}
+
+	b, err := json.Marshal(readingsJSON{Sensor: currentSensorJSON(), Reading: newReadingJSON(r)})
+	if err != nil || format == coapJSON {
+		return b, err
+	}
+	// The same as the JSON, just smaller
+	d := json.NewDecoder(strings.NewReader(string(b)))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return cborAppend(nil, v), nil
+}
+
+// A CBOR map with integer keys, in order
+type cborPair struct {
+	key   int
+	value any
+}
+
+type cborIntMap []cborPair
+
+// Just enough CBOR (RFC 8949) for what comes out of encoding/json, plus
+// integer keyed maps
+func cborAppend(b []byte, v any) []byte {
+	head := func(major byte, n uint64) {
+		switch {
+		case n < 24:
+			b = append(b, major<<5|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, major<<5|24, byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, major<<5|25), uint16(n))
+		case n <= math.MaxUint32:
+			b = binary.BigEndian.AppendUint32(append(b, major<<5|26), uint32(n))
+		default:
+			b = binary.BigEndian.AppendUint64(append(b, major<<5|27), n)
+		}
+	}
+	switch v := v.(type) {
+	case nil:
+		b = append(b, 0xf6)
+	case bool:
+		if v {
+			b = append(b, 0xf5)
+		} else {
+			b = append(b, 0xf4)
+		}
+	case int:
+		if v >= 0 {
+			head(0, uint64(v))
+		} else {
+			head(1, uint64(-1-v))
+		}
+	case float64:
+		b = binary.BigEndian.AppendUint64(append(b, 0xfb), math.Float64bits(v))
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return cborAppend(b, int(i))
+		}
+		f, _ := v.Float64()
+		return cborAppend(b, f)
+	case string:
+		head(3, uint64(len(v)))
+		b = append(b, v...)
+	case []any:
+		head(4, uint64(len(v)))
+		for _, e := range v {
+			b = cborAppend(b, e)
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		head(5, uint64(len(v)))
+		for _, k := range keys {
+			b = cborAppend(cborAppend(b, k), v[k])
+		}
+	case cborIntMap:
+		head(5, uint64(len(v)))
+		for _, p := range v {
+			b = cborAppend(cborAppend(b, p.key), p.value)
+		}
+	}
+	return b
+}
+
+func checkCoAPSettings() []configProblem {
+	addr := conf.GetString(coapListenAddress)
+	if addr == "" {
+		return nil
+	}
+	var problems []configProblem
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		problems = append(problems, configError(coapListenAddress, "%v, use e.g. :5683", err))
+	}
+	if _, ok := coapFormats[conf.GetString(coapFormat)]; !ok {
+		problems = append(problems, configError(coapFormat, "unknown format %q, use json, cbor, senml+json or senml+cbor", conf.GetString(coapFormat)))
+	}
+	if configuredPollInterval() <= 0 {
+		problems = append(problems, configWarning(coapListenAddress, "Observe needs %s set", pollInterval))
+	}
+	return problems
+}
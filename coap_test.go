@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseCoAP(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		want    coapMessage
+		invalid bool
+	}{
+		{
+			name: "observe GET with Accept",
+			msg:  "42 01 1234 abcd 60 58 72656164696e6773 61 6e",
+			want: coapMessage{typ: coapConfirmable, code: coapGet, id: 0x1234, token: []byte{0xab, 0xcd}, options: []coapOption{
+				{coapOptionObserve, []byte{}},
+				{coapOptionURIPath, []byte("readings")},
+				{coapOptionAccept, []byte{110}},
+			}},
+		},
+		{
+			name: "one byte extended delta and length",
+			msg:  "50 01 0001 dd 16 00 " + "00010203 04050607 08090a0b 0c",
+			want: coapMessage{typ: coapNonConfirmable, code: coapGet, id: 1, token: []byte{}, options: []coapOption{
+				{coapOptionProxyURI, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}},
+			}},
+		},
+		{
+			name: "two byte extended delta",
+			msg:  "40 01 0001 e1 001f 2a ff 6869",
+			want: coapMessage{typ: coapConfirmable, code: coapGet, id: 1, token: []byte{}, options: []coapOption{
+				{300, []byte{42}},
+			}, payload: []byte("hi")},
+		},
+		{
+			name: "ping",
+			msg:  "40 00 0001",
+			want: coapMessage{typ: coapConfirmable, code: coapEmpty, id: 1, token: []byte{}},
+		},
+		{name: "too short", msg: "40 01 00", invalid: true},
+		{name: "version 2", msg: "80 01 0001", invalid: true},
+		{name: "token too long", msg: "49 01 0001 00010203040506070809", invalid: true},
+		{name: "truncated token", msg: "44 01 0001 0001", invalid: true},
+		{name: "payload marker without a payload", msg: "40 01 0001 ff", invalid: true},
+		{name: "truncated option", msg: "40 01 0001 b8 7265", invalid: true},
+		{name: "truncated extended delta", msg: "40 01 0001 e0 00", invalid: true},
+		{name: "reserved delta", msg: "40 01 0001 f0", invalid: true},
+		{name: "reserved length", msg: "40 01 0001 bf", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := unhex(t, tt.msg)
+			m, err := parseCoAP(b)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("parsed %+v", m)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fmt.Sprintf("%+v", m), fmt.Sprintf("%+v", tt.want); got != want {
+				t.Errorf("got  %s\nwant %s", got, want)
+			}
+			if got := m.marshal(); !bytes.Equal(got, b) {
+				t.Errorf("marshalled as % x", got)
+			}
+		})
+	}
+}
+
+// A server with a fresh reading, which sends into a recorder
+func testCoAPServer(r reading) (*coapServer, *bacnetRecorder) {
+	c := &bacnetRecorder{}
+	return &coapServer{conn: c, poller: testPoller(r), format: coapJSON, nextID: 0x1000}, c
+}
+
+func TestCoAPServe(t *testing.T) {
+	saved := hostname
+	hostname = "raspberrypi"
+	t.Cleanup(func() { hostname = saved })
+	now := time.Now().Truncate(time.Second)
+	senml := fmt.Sprintf(`[{"bn":"raspberrypi:","bt":%d,"n":"temperature","u":"Cel","v":21.37},{"n":"pressure","u":"Pa","v":101325},{"n":"humidity","u":"%%RH","v":48.12}]`, now.Unix())
+
+	tests := []struct {
+		name    string
+		req     string
+		want    string
+		payload string
+		noReply bool
+	}{
+		{
+			name:    "discovery",
+			req:     "42 01 1234 abcd bb 2e77656c6c2d6b6e6f776e 04 636f7265",
+			want:    "62 45 1234 abcd c1 28",
+			payload: `</readings>;rt="bme280.readings";ct="50 60 110 112";obs`,
+		},
+		{
+			name:    "readings as SenML",
+			req:     "42 01 1234 abcd b8 72656164696e6773 61 6e",
+			want:    "62 45 1234 abcd c1 6e 21 3c",
+			payload: senml,
+		},
+		{
+			name:    "non-confirmable",
+			req:     "52 01 1234 abcd b8 72656164696e6773 61 6e",
+			want:    "52 45 1001 abcd c1 6e 21 3c",
+			payload: senml,
+		},
+		{
+			name:    "elective option",
+			req:     "42 01 1234 abcd 21 00 98 72656164696e6773 61 6e",
+			want:    "62 45 1234 abcd c1 6e 21 3c",
+			payload: senml,
+		},
+		{
+			name: "not found",
+			req:  "42 01 1234 abcd b7 6d697373696e67",
+			want: "62 84 1234 abcd",
+		},
+		{
+			name: "POST",
+			req:  "42 02 1234 abcd b8 72656164696e6773",
+			want: "62 85 1234 abcd",
+		},
+		{
+			name: "unknown format",
+			req:  "42 01 1234 abcd b8 72656164696e6773 61 29",
+			want: "62 86 1234 abcd",
+		},
+		{
+			name:    "critical option",
+			req:     "42 01 1234 abcd 90 28 72656164696e6773",
+			want:    "62 82 1234 abcd",
+			payload: "Unsupported option 9",
+		},
+		{
+			name: "proxying",
+			req:  "42 01 1234 abcd d8 16 636f61703a2f2f78",
+			want: "62 a5 1234 abcd",
+		},
+		{
+			name: "ping",
+			req:  "40 00 1234",
+			want: "70 00 1234",
+		},
+		{
+			name: "response",
+			req:  "42 45 1234 abcd",
+			want: "70 00 1234",
+		},
+		{
+			name:    "non-confirmable response",
+			req:     "52 45 1234 abcd",
+			noReply: true,
+		},
+		{
+			name:    "acknowledgment",
+			req:     "60 00 1234",
+			noReply: true,
+		},
+		{
+			name:    "reset",
+			req:     "70 00 1234",
+			noReply: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := testCoAPServer(reading{Time: now, Temperature: 21.37, Pressure: 101325, Humidity: 48.12})
+			m, err := parseCoAP(unhex(t, tt.req))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, ok := s.handle(context.Background(), m, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 5683})
+			if tt.noReply {
+				if ok {
+					t.Errorf("answered with % x", resp.marshal())
+				}
+				return
+			}
+			want := unhex(t, tt.want)
+			if tt.payload != "" {
+				want = append(append(want, 0xff), tt.payload...)
+			}
+			if got := resp.marshal(); !ok || !bytes.Equal(got, want) {
+				t.Errorf("got  % x\nwant % x", got, want)
+			}
+		})
+	}
+}
+
+func TestCoAPObserve(t *testing.T) {
+	saved := hostname
+	hostname = "raspberrypi"
+	t.Cleanup(func() { hostname = saved })
+	r := reading{Time: time.UnixMilli(1792115603397), Temperature: 21.37, Pressure: 101325, Humidity: 48.12}
+	payload := `[{"bn":"raspberrypi:","bt":1792115603.397,"n":"temperature","u":"Cel","v":21.37},{"n":"pressure","u":"Pa","v":101325},{"n":"humidity","u":"%RH","v":48.12}]`
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 5683}
+
+	request := func(t *testing.T, s *coapServer, msg string) []byte {
+		t.Helper()
+		m, err := parseCoAP(unhex(t, msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, _ := s.handle(context.Background(), m, from)
+		return resp.marshal()
+	}
+	// A GET with Observe 0, and so registered, and what the observer's sent
+	register := func(t *testing.T) (*coapServer, *bacnetRecorder) {
+		t.Helper()
+		s, c := testCoAPServer(reading{Time: time.Now(), Temperature: 21.37, Pressure: 101325, Humidity: 48.12})
+		got := request(t, s, "42 01 0001 abcd 60 58 72656164696e6773 61 6e")
+		if want := unhex(t, "62 45 0001 abcd 60 61 6e 21 3c"); !bytes.HasPrefix(got, want) {
+			t.Fatalf("registering got % x", got)
+		}
+		return s, c
+	}
+	notification := func(typ byte, id uint16, seq byte) []byte {
+		b := append([]byte{1<<6 | typ<<4 | 2, coapContent, byte(id >> 8), byte(id), 0xab, 0xcd, 0x61, seq, 0x61, 0x6e, 0x21, 0x3c, 0xff}, payload...)
+		return b
+	}
+
+	t.Run("notifications", func(t *testing.T) {
+		s, c := register(t)
+		for i := 0; i < coapConfirmEvery; i++ {
+			s.notify(r)
+		}
+		if len(c.sent) != coapConfirmEvery {
+			t.Fatalf("sent %d notifications", len(c.sent))
+		}
+		if got, want := c.sent[0].msg, notification(coapNonConfirmable, 0x1001, 1); !bytes.Equal(got, want) {
+			t.Errorf("first notification\ngot  % x\nwant % x", got, want)
+		}
+		if got, want := c.sent[19].msg, notification(coapConfirmable, 0x1014, 20); !bytes.Equal(got, want) {
+			t.Errorf("20th notification\ngot  % x\nwant % x", got, want)
+		}
+		if c.sent[0].to != from.String() {
+			t.Errorf("sent to %s", c.sent[0].to)
+		}
+
+		// Acked, so the next confirmable one goes out too
+		request(t, s, "60 00 1014")
+		for i := 0; i < coapConfirmEvery; i++ {
+			s.notify(r)
+		}
+		if len(c.sent) != 2*coapConfirmEvery || c.sent[39].msg[0]>>4&3 != coapConfirmable {
+			t.Fatalf("sent %d notifications", len(c.sent))
+		}
+
+		// Not acked, so it's dropped when the next one's due
+		for i := 0; i < 2*coapConfirmEvery; i++ {
+			s.notify(r)
+		}
+		if len(c.sent) != 3*coapConfirmEvery-1 {
+			t.Errorf("sent %d notifications to an observer that stopped answering", len(c.sent))
+		}
+		if len(s.observers) != 0 {
+			t.Errorf("%d observers left", len(s.observers))
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		s, c := register(t)
+		s.notify(r)
+		// For some other message, and then for the notification
+		request(t, s, "70 00 0fff")
+		s.notify(r)
+		request(t, s, "70 00 1002")
+		s.notify(r)
+		if len(c.sent) != 2 {
+			t.Errorf("sent %d notifications", len(c.sent))
+		}
+	})
+
+	t.Run("deregister", func(t *testing.T) {
+		s, c := register(t)
+		got := request(t, s, "42 01 0002 abcd 61 01 58 72656164696e6773 61 6e")
+		if want := unhex(t, "62 45 0002 abcd c1 6e 21 3c"); !bytes.HasPrefix(got, want) {
+			t.Fatalf("deregistering got % x", got)
+		}
+		s.notify(r)
+		if len(c.sent) != 0 {
+			t.Errorf("sent %d notifications", len(c.sent))
+		}
+	})
+
+	t.Run("too many observers", func(t *testing.T) {
+		s, _ := register(t)
+		for i := 1; i < coapMaxObservers; i++ {
+			s.observe(&net.UDPAddr{IP: net.IPv4(192, 168, 2, byte(i)), Port: 5683}, nil, coapJSON, true)
+		}
+		got := request(t, s, "42 01 0003 abce 60 58 72656164696e6773 61 6e")
+		if want := unhex(t, "62 45 0003 abce c1 6e 21 3c"); !bytes.HasPrefix(got, want) {
+			t.Fatalf("registering one too many got % x", got)
+		}
+	})
+}
+
+func FuzzCoAPMessages(f *testing.F) {
+	for _, s := range []string{
+		"42 01 1234 abcd bb 2e77656c6c2d6b6e6f776e 04 636f7265",
+		"42 01 1234 abcd 60 58 72656164696e6773 61 6e",
+		"50 01 0001 dd 16 00 00010203 04050607 08090a0b 0c",
+		"40 01 0001 e1 001f 2a ff 6869",
+		"40 00 0001",
+		"60 00 1014",
+	} {
+		f.Add(unhex(f, s))
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		m, err := parseCoAP(in)
+		if err != nil {
+			return
+		}
+		// It marshals back to something that parses the same
+		again, err := parseCoAP(m.marshal())
+		if err != nil {
+			t.Fatalf("% x marshalled as % x, which doesn't parse: %v", in, m.marshal(), err)
+		}
+		if fmt.Sprintf("%+v", again) != fmt.Sprintf("%+v", m) {
+			t.Fatalf("% x parsed as %+v, then %+v", in, m, again)
+		}
+
+		s, _ := testCoAPServer(reading{Time: time.Now(), Temperature: 21.37, Pressure: 101325, Humidity: 48.12})
+		if resp, ok := s.handle(context.Background(), m, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 5683}); ok {
+			if _, err := parseCoAP(resp.marshal()); err != nil {
+				t.Fatalf("answered % x with % x, which doesn't parse: %v", in, resp.marshal(), err)
+			}
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	collectdInterval time.Duration
+	collectdInstance string
+)
+
+func collectdFlags(fs *pflag.FlagSet) {
+	sensorFlags(fs)
+	fs.DurationVar(&collectdInterval, "interval", 0, "How often to read the sensor (default is collectd's interval, or 10s)")
+	fs.StringVar(&collectdInstance, "instance", "", "The plugin instance, e.g. to tell sensors apart")
+}
+
+// `bme280-exporter collectd` is run by collectd's exec plugin, and prints
+// PUTVAL lines for it on stdout until collectd stops it. See
+// https://github.com/collectd/collectd/wiki/Plain-text-protocol#putval
+//
+//	<Plugin exec>
+//	  Exec "nobody:i2c" "/usr/local/bin/bme280-exporter" "collectd"
+//	</Plugin>
+func runCollectd(args []string) int {
+	interval := collectdInterval
+	if interval == 0 {
+		// collectd says how often it wants values
+		interval = 10 * time.Second
+		if s, err := strconv.ParseFloat(os.Getenv("COLLECTD_INTERVAL"), 64); err == nil && s > 0 {
+			interval = time.Duration(s * float64(time.Second))
+		}
+	}
+	if interval < time.Second {
+		fmt.Fprintln(os.Stderr, "The interval must be at least a second")
+		return 2
+	}
+	host := os.Getenv("COLLECTD_HOSTNAME")
+	if host == "" {
+		host = hostname
+	}
+
+	if err := openSensor(); err != nil {
+		fmt.Fprintf(os.Stderr, "Problem opening the sensor: %v\n", err)
+		return 1
+	}
+	defer closeSensor()
+	setCalibration(calibrationFromConfig())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	p := newPoller(interval, 0)
+	readings := p.subscribe()
+	p.start(ctx)
+
+	w := bufio.NewWriter(os.Stdout)
+	for r := range readings {
+		writePutval(w, host, collectdInstance, interval, r)
+		// collectd going away closes the pipe, which is as good as being stopped
+		if err := w.Flush(); err != nil {
+			stop()
+		}
+	}
+	p.wait()
+	return 0
+}
+
+// One PUTVAL line per value, with the types from collectd's types.db.
+// Pressure is in hPa like collectd's barometer plugin.
+func writePutval(w io.Writer, host, instance string, interval time.Duration, r reading) {
+	plugin := "bme280"
+	if instance != "" {
+		plugin += "-" + instance
+	}
+	for _, v := range []struct {
+		typ   string
+		value float64
+	}{
+		{"temperature", r.Temperature},
+		{"pressure", r.Pressure / 100},
+		{"humidity", r.Humidity},
+	} {
+		if math.IsNaN(v.value) {
+			continue
+		}
+		id := host + "/" + plugin + "/" + v.typ
+		fmt.Fprintf(w, "PUTVAL %s interval=%s %s:%s\n", quoteCollectd(id),
+			strconv.FormatFloat(interval.Seconds(), 'f', -1, 64),
+			strconv.FormatFloat(float64(r.Time.UnixMilli())/1000, 'f', -1, 64),
+			strconv.FormatFloat(v.value, 'f', -1, 64))
+	}
+}
+
+// Identifiers with spaces or quotes in them have to be quoted
+func quoteCollectd(s string) string {
+	if !strings.ContainsAny(s, " \t\"\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
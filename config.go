@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/d2r2/go-bsbmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// Where the configuration file is looked for when --config isn't given
+const defaultConfigFile = "/etc/bme280-exporter/config.yaml"
+
+// Every setting can come from an environment variable with this prefix, e.g.
+// BME280_EXPORTER_WEB_RATE_LIMIT for --web.rate-limit
+const envPrefix = "BME280_EXPORTER"
+
+func init() {
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	viper.AutomaticEnv()
+}
+
+// Settings that only make sense in the configuration file
+const (
+	extraLabels  = "labels"
+	extraSensors = "sensors"
+)
+
+// Another sensor to read on every scrape, alongside the main one
+type sensorConfig struct {
+	Name    string            `mapstructure:"name"`
+	Bus     int               `mapstructure:"bus"`
+	Address string            `mapstructure:"address"`
+	Model   string            `mapstructure:"model"`
+	Labels  map[string]string `mapstructure:"labels"`
+
+	address uint8
+	modelID bsbmp.SensorType
+}
+
+// Read the configuration file, if there is one. An explicitly named file has
+// to exist, the default one doesn't.
+func loadConfigFile(path string) error {
+	if path == "" {
+		path = os.Getenv(envPrefix + "_CONFIG")
+	}
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err != nil {
+			return nil
+		}
+		path = defaultConfigFile
+	}
+
+	// Check the whole file before any of it is used
+	if err := checkConfigFile(path); err != nil {
+		return err
+	}
+	viper.SetConfigFile(path)
+	return viper.ReadInConfig()
+}
+
+// A list setting. From the environment it's one string, which can be comma
+// or space separated.
+func getStringList(key string) []string {
+	var list []string
+	for _, s := range conf.GetStringSlice(key) {
+		list = append(list, strings.FieldsFunc(s, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})...)
+	}
+	return list
+}
+
+// Make sure a configuration file can be read and that the things flags
+// can't set are valid
+func checkConfigFile(path string) error {
+	v := viper.New()
+	v.SetDefault(modelName, conf.GetString(modelName))
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	if _, err := parseLabels(v.GetStringMapString(extraLabels)); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := parseSensors(v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// viper isn't safe to read while ReadInConfig is writing to it, so once
+// the exporter is running settings are read through conf, which a reload
+// locks while it re-reads the file
+var conf = &lockedConfig{}
+
+type lockedConfig struct {
+	mu sync.RWMutex
+}
+
+func readLocked[T any](c *lockedConfig, get func(string) T, key string) T {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return get(key)
+}
+
+func (c *lockedConfig) Get(key string) interface{} { return readLocked(c, viper.Get, key) }
+func (c *lockedConfig) GetBool(key string) bool    { return readLocked(c, viper.GetBool, key) }
+func (c *lockedConfig) GetInt(key string) int      { return readLocked(c, viper.GetInt, key) }
+func (c *lockedConfig) GetFloat64(key string) float64 {
+	return readLocked(c, viper.GetFloat64, key)
+}
+func (c *lockedConfig) GetString(key string) string { return readLocked(c, viper.GetString, key) }
+func (c *lockedConfig) GetDuration(key string) time.Duration {
+	return readLocked(c, viper.GetDuration, key)
+}
+func (c *lockedConfig) GetStringSlice(key string) []string {
+	return readLocked(c, viper.GetStringSlice, key)
+}
+func (c *lockedConfig) GetStringMapString(key string) map[string]string {
+	return readLocked(c, viper.GetStringMapString, key)
+}
+
+func (c *lockedConfig) AllKeys() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return viper.AllKeys()
+}
+
+func (c *lockedConfig) AllSettings() map[string]interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return viper.AllSettings()
+}
+
+func (c *lockedConfig) sensors() ([]sensorConfig, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return parseSensors(viper.GetViper())
+}
+
+// Re-read the configuration file the exporter started with, after checking
+// all of it
+func (c *lockedConfig) reload() error {
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return nil
+	}
+	if err := checkConfigFile(path); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return viper.ReadInConfig()
+}
+
+// Label names the exporter already uses itself
+var reservedLabels = map[string]bool{"host": true, "sensor_type": true, "sensor": true}
+
+func parseLabels(labels map[string]string) (prometheus.Labels, error) {
+	out := make(prometheus.Labels, len(labels))
+	for k, v := range labels {
+		if !model.LabelName(k).IsValid() || strings.HasPrefix(k, "__") {
+			return nil, fmt.Errorf("invalid label name %q", k)
+		}
+		if reservedLabels[k] {
+			return nil, fmt.Errorf("the label %q is set by the exporter", k)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// The extra labels for the exporter's metrics
+func configuredLabels() prometheus.Labels {
+	labels, err := parseLabels(conf.GetStringMapString(extraLabels))
+	if err != nil {
+		// Already checked when the file was loaded
+		lg.Errorf("Ignoring labels: %v", err)
+		return prometheus.Labels{}
+	}
+	return labels
+}
+
+func parseSensors(v *viper.Viper) ([]sensorConfig, error) {
+	var sensors []sensorConfig
+	if err := v.UnmarshalKey(extraSensors, &sensors); err != nil {
+		return nil, fmt.Errorf("sensors: %w", err)
+	}
+	names := make(map[string]bool)
+	for i := range sensors {
+		s := &sensors[i]
+		if s.Name == "" {
+			return nil, fmt.Errorf("sensor %d doesn't have a name", i+1)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("there's more than one sensor named %q", s.Name)
+		}
+		names[s.Name] = true
+
+		bus, addr, err := parseI2CAddress(s.Address)
+		if err != nil {
+			return nil, fmt.Errorf("sensor %q: %w", s.Name, err)
+		}
+		if bus >= 0 {
+			s.Bus = bus
+		}
+		s.address = addr
+		if s.Model == "" {
+			s.Model = v.GetString(modelName)
+		}
+		if s.modelID, err = getSensorID(s.Model); err != nil {
+			return nil, fmt.Errorf("sensor %q: %w", s.Name, err)
+		}
+		if _, err := parseLabels(s.Labels); err != nil {
+			return nil, fmt.Errorf("sensor %q: %w", s.Name, err)
+		}
+	}
+	return sensors, nil
+}
+
+// The extra sensors from the configuration file
+func configuredSensors() []sensorConfig {
+	sensors, err := conf.sensors()
+	if err != nil {
+		lg.Errorf("Ignoring sensors: %v", err)
+		return nil
+	}
+	return sensors
+}
+
+// Settings whose names look like this are never shown
+var secretKey = regexp.MustCompile(`(?i)(password|secret|token|api-?key|credentials)$`)
+
+// The effective configuration after defaults, flags, and everything else
+// have been applied, with secrets hidden
+func effectiveConfig() map[string]interface{} {
+	return redactSettings(conf.AllSettings())
+}
+
+func redactSettings(settings map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			out[k] = redactSettings(v)
+		case time.Duration:
+			out[k] = v.String()
+		default:
+			if secretKey.MatchString(k) && v != "" && v != nil {
+				out[k] = "<secret>"
+			} else {
+				out[k] = v
+			}
+		}
+	}
+	return out
+}
+
+func marshalEffectiveConfig() ([]byte, error) {
+	return yaml.Marshal(effectiveConfig())
+}
+
+// Serve the effective configuration as YAML
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := marshalEffectiveConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
+	w.Write(b)
+}
+
+// `bme280-exporter print-config` shows the configuration the exporter would run with
+func runPrintConfig(args []string) int {
+	b, err := marshalEffectiveConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(b)
+	return 0
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Writes readings to a CSV file that opens straight in a spreadsheet. The
+// file's moved aside at the start of each day, or when it gets too big, with
+// the date (and a number, if there's more than one that day) put in its name,
+// like readings-2024-01-01.csv, and optionally gzipped.
+
+// Times as spreadsheets understand them, in local time
+const csvTimeFormat = "2006-01-02 15:04:05"
+
+var csvHeader = []string{"time", "host", "sensor", "bus", "address", "temperature_celsius", "pressure_pascals", "humidity_percent"}
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "csv",
+		intervalKey: csvInterval,
+		enabled:     func() bool { return conf.GetString(csvPath) != "" },
+		open:        openCSV,
+	})
+	configChecks = append(configChecks, checkCSVSettings)
+}
+
+type csvSink struct {
+	path    string
+	daily   bool
+	maxSize int64
+	gzip    bool
+
+	f    *os.File
+	size int64
+	// The day the file's readings are from
+	day string
+}
+
+func openCSV() (sink, error) {
+	s := &csvSink{
+		path:    conf.GetString(csvPath),
+		daily:   conf.GetString(csvRotate) == "daily",
+		maxSize: int64(conf.GetInt(csvMaxSize)) << 20,
+		gzip:    conf.GetBool(csvGzip),
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Open the file to append to, carrying on with one that's already there
+func (s *csvSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size, s.day = f, fi.Size(), ""
+	if s.size > 0 {
+		s.day = fi.ModTime().Format("2006-01-02")
+	}
+	return nil
+}
+
+func (s *csvSink) push(ctx context.Context, samples []sample) error {
+	for _, smp := range samples {
+		t := smp.Time.Local()
+		day := t.Format("2006-01-02")
+		if s.size > 0 && ((s.daily && day != s.day) || (s.maxSize > 0 && s.size >= s.maxSize)) {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		if s.f == nil {
+			if err := s.open(); err != nil {
+				return err
+			}
+		}
+
+		var b strings.Builder
+		w := csv.NewWriter(&b)
+		if s.size == 0 {
+			w.Write(csvHeader)
+		}
+		w.Write([]string{
+			t.Format(csvTimeFormat),
+			smp.Sensor.Host,
+			smp.Sensor.Model,
+			strconv.Itoa(smp.Sensor.Bus),
+			smp.Sensor.Address,
+			csvValue(smp.Temperature),
+			csvValue(smp.Pressure),
+			csvValue(smp.Humidity),
+		})
+		w.Flush()
+		n, err := io.WriteString(s.f, b.String())
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+		s.day = day
+	}
+	return nil
+}
+
+// A value, or nothing if it couldn't be read
+func csvValue(v float64) string {
+	if math.IsNaN(v) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Move the file aside under a name with its day in, and start a new one
+func (s *csvSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.f = nil
+	ext := filepath.Ext(s.path)
+	base := strings.TrimSuffix(s.path, ext)
+	var name string
+	for n := 0; ; n++ {
+		name = fmt.Sprintf("%s-%s%s", base, s.day, ext)
+		if n > 0 {
+			name = fmt.Sprintf("%s-%s.%d%s", base, s.day, n, ext)
+		}
+		if !csvExists(name) && !csvExists(name+".gz") {
+			break
+		}
+	}
+	if err := os.Rename(s.path, name); err != nil {
+		return err
+	}
+	if s.gzip {
+		// The readings are safely in the old file either way, so this only
+		// gets logged
+		if err := csvCompress(name); err != nil {
+			lg.Warnf("Problem compressing %s: %v", name, err)
+		}
+	}
+	return s.open()
+}
+
+func csvExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// Gzip a file, removing the original
+func csvCompress(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(name)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+func (s *csvSink) close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+func checkCSVSettings() []configProblem {
+	if conf.GetString(csvPath) == "" {
+		return nil
+	}
+	var problems []configProblem
+	switch r := conf.GetString(csvRotate); r {
+	case "daily", "none":
+	default:
+		problems = append(problems, configError(csvRotate, "unknown rotation %q, use daily or none", r))
+	}
+	if conf.GetInt(csvMaxSize) < 0 {
+		problems = append(problems, configError(csvMaxSize, "can't be negative"))
+	}
+	if conf.GetBool(csvGzip) && conf.GetString(csvRotate) == "none" && conf.GetInt(csvMaxSize) == 0 {
+		problems = append(problems, configWarning(csvGzip, "does nothing, as the file's never rotated"))
+	}
+	return problems
+}
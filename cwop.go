@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Reports the latest reading to the Citizen Weather Observer Program, which
+// passes it on to NOAA's MADIS, as an APRS weather packet over APRS-IS. See
+// http://www.wxqa.com/ and the APRS spec's chapter 12 for the format.
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "cwop",
+		intervalKey: cwopInterval,
+		enabled:     func() bool { return conf.GetString(cwopCallsign) != "" },
+		open:        openCWOP,
+		addresses:   func() []string { return hostAddress(conf.GetString(cwopServer), "14580") },
+	})
+	configChecks = append(configChecks, checkCWOPSettings)
+}
+
+// CWOP asks stations not to report more often than this
+const cwopMinInterval = 5 * time.Minute
+
+// Amateur callsigns and CWOP's CW/DW/EW ones, with an optional SSID
+var cwopCallsignRe = regexp.MustCompile(`^[A-Z0-9]{3,6}(-[0-9]{1,2})?$`)
+
+// The pressure at sea level, from the station's pressure, temperature and
+// altitude in metres, with the hypsometric formula
+func seaLevelPressure(pressure, temperature, altitude float64) float64 {
+	return pressure * math.Pow(1-0.0065*altitude/(temperature+0.0065*altitude+273.15), -5.257)
+}
+
+// APRS positions are in degrees and minutes to two decimal places
+func aprsPosition(lat, lon float64) string {
+	format := func(v float64, width int, pos, neg string) string {
+		hemisphere := pos
+		if v < 0 {
+			hemisphere = neg
+		}
+		m := int(math.Round(math.Abs(v) * 6000))
+		return fmt.Sprintf("%0*d%02d.%02d%s", width, m/6000, m%6000/100, m%100, hemisphere)
+	}
+	return format(lat, 2, "N", "S") + "/" + format(lon, 3, "E", "W")
+}
+
+// A complete weather report with a position and timestamp. Wind's unknown;
+// temperature's in °F, humidity's in percent with 100 as 00, and pressure's
+// in tenths of hPa, at sea level when the altitude's known.
+func cwopPacket(callsign, position string, r reading, altitude float64) string {
+	t, h, b := "t...", "h..", "b....."
+	if !math.IsNaN(r.Temperature) {
+		f := int(math.Round(r.Temperature*9/5 + 32))
+		if f < 0 {
+			t = fmt.Sprintf("t-%02d", min(-f, 99))
+		} else {
+			t = fmt.Sprintf("t%03d", min(f, 999))
+		}
+	}
+	if !math.IsNaN(r.Humidity) {
+		h = fmt.Sprintf("h%02d", min(max(int(math.Round(r.Humidity)), 1), 100)%100)
+	}
+	if !math.IsNaN(r.Pressure) {
+		p := r.Pressure
+		if altitude != 0 && !math.IsNaN(r.Temperature) {
+			p = seaLevelPressure(p, r.Temperature, altitude)
+		}
+		b = fmt.Sprintf("b%05d", int(math.Round(p/10)))
+	}
+	return fmt.Sprintf("%s>APRS,TCPIP*:@%sz%s_.../...g...%s%s%s", callsign, r.Time.UTC().Format("021504"), position, t, h, b)
+}
+
+type cwopSink struct {
+	server   string
+	callsign string
+	passcode int
+	position string
+	altitude float64
+}
+
+func openCWOP() (sink, error) {
+	s := &cwopSink{
+		server:   conf.GetString(cwopServer),
+		callsign: strings.ToUpper(conf.GetString(cwopCallsign)),
+		passcode: conf.GetInt(cwopPasscode),
+		position: aprsPosition(conf.GetFloat64(cwopLatitude), conf.GetFloat64(cwopLongitude)),
+		altitude: conf.GetFloat64(cwopAltitude),
+	}
+	if _, _, err := net.SplitHostPort(s.server); err != nil {
+		s.server = net.JoinHostPort(s.server, "14580")
+	}
+	return s, nil
+}
+
+// Log in, send the packet and hang up, which is how CWOP wants it done
+func (s *cwopSink) push(ctx context.Context, samples []sample) error {
+	latest := samples[len(samples)-1].reading
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	br := bufio.NewReader(conn)
+	// The server's banner
+	if _, err := br.ReadString('\n'); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "user %s pass %d vers bme280-exporter %s\r\n", s.callsign, s.passcode, version); err != nil {
+		return err
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "# logresp") {
+			continue
+		}
+		// Unverified is expected with -1, and packets from CW stations are
+		// still taken, but a ham callsign with a wrong passcode gets its
+		// packets dropped
+		if s.passcode != -1 && strings.Contains(line, "unverified") {
+			return errors.New("APRS-IS didn't accept the passcode")
+		}
+		break
+	}
+	_, err = fmt.Fprintf(conn, "%s\r\n", cwopPacket(s.callsign, s.position, latest, s.altitude))
+	return err
+}
+
+func (s *cwopSink) close() error {
+	return nil
+}
+
+func checkCWOPSettings() []configProblem {
+	callsign := conf.GetString(cwopCallsign)
+	if callsign == "" {
+		return nil
+	}
+	var problems []configProblem
+	if !cwopCallsignRe.MatchString(strings.ToUpper(callsign)) {
+		problems = append(problems, configError(cwopCallsign, "%q isn't a callsign, like CW1234 or N0CALL-13", callsign))
+	}
+	lat, lon := conf.GetFloat64(cwopLatitude), conf.GetFloat64(cwopLongitude)
+	if lat == 0 && lon == 0 {
+		problems = append(problems, configError(cwopLatitude, "and %s need setting to the station's position", cwopLongitude))
+	}
+	if lat < -90 || lat > 90 {
+		problems = append(problems, configError(cwopLatitude, "must be from -90 to 90"))
+	}
+	if lon < -180 || lon > 180 {
+		problems = append(problems, configError(cwopLongitude, "must be from -180 to 180"))
+	}
+	if i := conf.GetDuration(cwopInterval); i < cwopMinInterval {
+		problems = append(problems, configWarning(cwopInterval, "is more often than the %s CWOP asks for", cwopMinInterval))
+	}
+	return problems
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Running as a traditional daemon for init systems without systemd, like
+// SysV init and OpenRC
+
+// Set in the environment of the background process, with the file descriptor
+// it reports readiness on
+const daemonChildEnv = "_BME280_EXPORTER_DAEMON_READY_FD"
+
+// The background process's end of the readiness pipe
+var daemonReady *os.File
+
+func init() {
+	configChecks = append(configChecks, checkDaemonSettings)
+}
+
+// Start the exporter again in the background, detached from the terminal, and
+// wait until it's ready so init scripts know whether starting it worked
+func runInBackground() int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Problem finding the executable: %v\n", err)
+		return 1
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer devNull.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonChildEnv+"=3")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = devNull, devNull, devNull
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Problem starting in the background: %v\n", err)
+		return 1
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	// The pipe closes without a word if the exporter gives up before it's ready
+	status, _ := io.ReadAll(r)
+	if strings.TrimSpace(string(status)) != "ready" {
+		fmt.Fprintln(os.Stderr, "The exporter failed to start, run it without --daemon to see why")
+		return 1
+	}
+	lg.Infof("Running in the background as process %d", pid)
+	return 0
+}
+
+// Whether this is the background process started by runInBackground, picking
+// up the readiness pipe if so
+func isDaemonChild() bool {
+	v := os.Getenv(daemonChildEnv)
+	if v == "" {
+		return false
+	}
+	os.Unsetenv(daemonChildEnv)
+	if fd, err := strconv.Atoi(v); err == nil {
+		syscall.CloseOnExec(fd)
+		daemonReady = os.NewFile(uintptr(fd), "daemon-ready")
+	}
+	return true
+}
+
+// Let the process that started us in the background know we're up
+func notifyDaemonReady() {
+	if daemonReady == nil {
+		return
+	}
+	if _, err := daemonReady.WriteString("ready\n"); err != nil {
+		lg.Warnf("Problem reporting readiness: %v", err)
+	}
+	daemonReady.Close()
+	daemonReady = nil
+}
+
+// Write our PID to the file, refusing if another exporter that's still
+// running already has. The returned function removes it again.
+func writePIDFile(path string) (func(), error) {
+	if b, err := os.ReadFile(path); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && pid != os.Getpid() && processRunning(pid) {
+			return nil, fmt.Errorf("already running as process %d according to %s", pid, path)
+		}
+		lg.Infof("Replacing stale PID file %s", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// Write it somewhere else first so nobody ever sees a half-written file
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(tmp, "%d\n", os.Getpid())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return func() {
+		// Only if it's still ours
+		if b, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(b)) == strconv.Itoa(os.Getpid()) {
+			if err := os.Remove(path); err != nil {
+				lg.Warnf("Problem removing PID file: %v", err)
+			}
+		}
+	}, nil
+}
+
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func checkDaemonSettings() []configProblem {
+	var problems []configProblem
+	if conf.GetBool(daemonMode) && conf.GetBool(systemdSocket) {
+		problems = append(problems, configError(daemonMode, "systemd manages the process itself, don't use --daemon with socket activation"))
+	}
+	if path := conf.GetString(pidFile); path != "" {
+		if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+			problems = append(problems, configError(pidFile, "the directory for %s doesn't exist", path))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed assets/dashboard
+var dashboardAssets embed.FS
+
+// Serve the live dashboard page at /dashboard/
+func registerDashboard(mux *http.ServeMux) {
+	content, err := fs.Sub(dashboardAssets, "assets/dashboard")
+	if err != nil {
+		lg.Fatal(err)
+	}
+	mux.Handle("/dashboard", http.RedirectHandler("dashboard/", http.StatusMovedPermanently))
+	mux.Handle("/dashboard/", http.StripPrefix("/dashboard/", http.FileServer(http.FS(content))))
+}
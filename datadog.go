@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Submits readings straight to Datadog's metrics API as gauges, for sensors
+// with no agent on them to send through. The configured labels become tags,
+// and the host is the metric's host. See
+// https://docs.datadoghq.com/api/latest/metrics/#submit-metrics
+
+// Gauges, in the v2 API's numbering
+const datadogGauge = 3
+
+// Readings to a request, which keeps it well under the API's 500 KB
+const datadogBatchSize = 1000
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "datadog",
+		intervalKey: datadogInterval,
+		enabled:     func() bool { return conf.GetString(datadogAPIKeyFile) != "" },
+		open:        openDatadog,
+		addresses:   func() []string { return urlAddress("https://api."+conf.GetString(datadogSite), "") },
+	})
+	configChecks = append(configChecks, checkDatadogSettings)
+}
+
+// Datadog's units for the metrics it has them for
+var datadogUnits = map[string]string{
+	temperatureMetric: "degree celsius",
+	humidityMetric:    "percent",
+}
+
+type datadogSeries struct {
+	Metric    string            `json:"metric"`
+	Type      int               `json:"type"`
+	Unit      string            `json:"unit,omitempty"`
+	Points    []datadogPoint    `json:"points"`
+	Tags      []string          `json:"tags,omitempty"`
+	Resources []datadogResource `json:"resources,omitempty"`
+}
+
+type datadogPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type datadogResource struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type datadogSink struct {
+	url        string
+	apiKeyFile string
+	prefix     string
+	client     *http.Client
+}
+
+func openDatadog() (sink, error) {
+	return &datadogSink{
+		url:        "https://api." + conf.GetString(datadogSite) + "/api/v2/series",
+		apiKeyFile: conf.GetString(datadogAPIKeyFile),
+		prefix:     conf.GetString(datadogPrefix),
+		client:     &http.Client{},
+	}, nil
+}
+
+func (s *datadogSink) push(ctx context.Context, samples []sample) error {
+	for start := 0; start < len(samples); start += datadogBatchSize {
+		if err := s.submit(ctx, samples[start:min(start+datadogBatchSize, len(samples))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *datadogSink) submit(ctx context.Context, samples []sample) error {
+	// Each series' points go together
+	var series []*datadogSeries
+	byKey := make(map[string]*datadogSeries)
+	for _, smp := range samples {
+		var tags []string
+		for k, v := range smp.tags() {
+			if k != "host" {
+				tags = append(tags, k+":"+v)
+			}
+		}
+		sort.Strings(tags)
+		for _, v := range smp.values() {
+			name := v.name
+			if s.prefix != "" {
+				name = s.prefix + "." + name
+			}
+			key := name + "\xff" + smp.Sensor.Host + "\xff" + strings.Join(tags, ",")
+			ds, ok := byKey[key]
+			if !ok {
+				ds = &datadogSeries{
+					Metric:    name,
+					Type:      datadogGauge,
+					Unit:      datadogUnits[v.name],
+					Tags:      tags,
+					Resources: []datadogResource{{Name: smp.Sensor.Host, Type: "host"}},
+				}
+				byKey[key] = ds
+				series = append(series, ds)
+			}
+			ds.Points = append(ds.Points, datadogPoint{Timestamp: smp.Time.Unix(), Value: v.value})
+		}
+	}
+	if len(series) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string][]*datadogSeries{"series": series})
+	if err != nil {
+		return err
+	}
+	// Read each time so a rotated key gets picked up
+	key, err := os.ReadFile(s.apiKeyFile)
+	if err != nil {
+		return fmt.Errorf("API key: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	req.Header.Set("DD-API-KEY", strings.TrimSpace(string(key)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(msg, &e) == nil && len(e.Errors) > 0 {
+			return fmt.Errorf("%s: %s", resp.Status, strings.Join(e.Errors, "; "))
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *datadogSink) close() error {
+	return nil
+}
+
+var datadogPrefixRe = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9_.]*)?$`)
+
+func checkDatadogSettings() []configProblem {
+	keyFile := conf.GetString(datadogAPIKeyFile)
+	if keyFile == "" {
+		return nil
+	}
+	var problems []configProblem
+	if _, err := os.Stat(keyFile); err != nil {
+		problems = append(problems, configError(datadogAPIKeyFile, "%v", err))
+	}
+	if site := conf.GetString(datadogSite); site == "" || strings.Contains(site, "/") {
+		problems = append(problems, configError(datadogSite, "invalid site %q, use e.g. datadoghq.com or datadoghq.eu", site))
+	}
+	if p := conf.GetString(datadogPrefix); !datadogPrefixRe.MatchString(p) {
+		problems = append(problems, configError(datadogPrefix, "invalid prefix %q, use letters, digits, underscores and dots, starting with a letter", p))
+	}
+	if conf.GetDuration(datadogInterval) > 30*time.Minute {
+		problems = append(problems, configWarning(datadogInterval, "Datadog drops points more than an hour old, so readings may be lost if a push fails"))
+	}
+	return problems
+}
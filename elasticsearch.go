@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Indexes readings as documents in Elasticsearch or OpenSearch with the bulk
+// API. Each reading is created with an ID made from the sensor and its time,
+// so one sent again from the spool is turned away as a conflict rather than
+// stored twice. Creating rather than indexing works for data streams too. See
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-bulk.html
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "elasticsearch",
+		intervalKey: elasticInterval,
+		enabled:     func() bool { return conf.GetString(elasticURL) != "" },
+		open:        openElastic,
+		addresses:   func() []string { return urlAddress(conf.GetString(elasticURL), "") },
+	})
+	configChecks = append(configChecks, checkElasticSettings)
+}
+
+// A reading as a document, with the timestamp where Kibana and OpenSearch
+// Dashboards look for it
+type elasticDoc struct {
+	Timestamp   time.Time         `json:"@timestamp"`
+	Temperature *float64          `json:"temperature,omitempty"`
+	Pressure    *float64          `json:"pressure,omitempty"`
+	Humidity    *float64          `json:"humidity,omitempty"`
+	Sensor      sensorJSON        `json:"sensor"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+type elasticBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+type elasticSink struct {
+	bulkURL      string
+	index        string
+	username     string
+	passwordFile string
+	apiKeyFile   string
+	client       *http.Client
+}
+
+func openElastic() (sink, error) {
+	u, err := url.Parse(conf.GetString(elasticURL))
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/_bulk"
+	s := &elasticSink{
+		bulkURL:      u.String(),
+		index:        conf.GetString(elasticIndex),
+		username:     conf.GetString(elasticUsername),
+		passwordFile: conf.GetString(elasticPasswordFile),
+		apiKeyFile:   conf.GetString(elasticAPIKeyFile),
+		client:       &http.Client{},
+	}
+	if u.Scheme == "https" {
+		cfg, err := clientTLSConfig(conf.GetString(elasticCAFile), "", "", conf.GetBool(elasticInsecureSkipVerify))
+		if err != nil {
+			return nil, err
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = cfg
+		s.client.Transport = t
+	}
+	return s, nil
+}
+
+func (s *elasticSink) push(ctx context.Context, samples []sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, smp := range samples {
+		action := map[string]map[string]string{"create": {
+			"_index": strings.ReplaceAll(s.index, "{date}", smp.Time.UTC().Format("2006.01.02")),
+			"_id":    fmt.Sprintf("%s-%d-%s-%d", smp.Sensor.Host, smp.Sensor.Bus, smp.Sensor.Address, smp.Time.UnixNano()),
+		}}
+		if err := enc.Encode(action); err != nil {
+			return err
+		}
+		if err := enc.Encode(elasticDoc{
+			Timestamp:   smp.Time.UTC(),
+			Temperature: spoolValue(smp.Temperature),
+			Pressure:    spoolValue(smp.Pressure),
+			Humidity:    spoolValue(smp.Humidity),
+			Sensor:      smp.Sensor,
+			Labels:      smp.Labels,
+		}); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.bulkURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	// Read each time so rotated credentials get picked up
+	switch {
+	case s.apiKeyFile != "":
+		key, err := os.ReadFile(s.apiKeyFile)
+		if err != nil {
+			return fmt.Errorf("API key: %w", err)
+		}
+		req.Header.Set("Authorization", "ApiKey "+strings.TrimSpace(string(key)))
+	case s.username != "":
+		var password []byte
+		if s.passwordFile != "" {
+			if password, err = os.ReadFile(s.passwordFile); err != nil {
+				return fmt.Errorf("password: %w", err)
+			}
+		}
+		req.SetBasicAuth(s.username, strings.TrimSpace(string(password)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var result elasticBulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Errors {
+		return nil
+	}
+	for _, item := range result.Items {
+		for _, r := range item {
+			// A conflict means the reading's already there
+			if r.Status/100 != 2 && r.Status != http.StatusConflict {
+				return fmt.Errorf("%s: %s", r.Error.Type, r.Error.Reason)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *elasticSink) close() error {
+	return nil
+}
+
+func checkElasticSettings() []configProblem {
+	v := conf.GetString(elasticURL)
+	if v == "" {
+		return nil
+	}
+	var problems []configProblem
+	if u, err := url.Parse(v); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		problems = append(problems, configError(elasticURL, "invalid URL %q, use e.g. https://elasticsearch:9200", v))
+	}
+	index := conf.GetString(elasticIndex)
+	if index == "" || index != strings.ToLower(index) || strings.ContainsAny(index, `\/*?"<>| ,#`) || strings.HasPrefix(index, "_") {
+		problems = append(problems, configError(elasticIndex, "invalid index %q, use lower case without spaces or \\/*?\"<>|,#", index))
+	}
+	if conf.GetString(elasticAPIKeyFile) != "" && conf.GetString(elasticUsername) != "" {
+		problems = append(problems, configWarning(elasticUsername, "ignored, %s is used instead", elasticAPIKeyFile))
+	}
+	for _, key := range []string{elasticPasswordFile, elasticAPIKeyFile, elasticCAFile} {
+		if f := conf.GetString(key); f != "" {
+			if _, err := os.Stat(f); err != nil {
+				problems = append(problems, configError(key, "%v", err))
+			}
+		}
+	}
+	if conf.GetBool(elasticInsecureSkipVerify) {
+		problems = append(problems, configWarning(elasticInsecureSkipVerify, "Elasticsearch's certificate isn't checked"))
+	}
+	return problems
+}
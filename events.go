@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A short history of notable things that happened to the exporter, so a gap
+// in the graphs can be explained without digging through the logs
+
+type event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+}
+
+var (
+	eventsMu  sync.Mutex
+	events    []event
+	maxEvents = 100
+)
+
+// Remember an event, dropping the oldest once there are too many
+func recordEvent(kind, format string, args ...interface{}) {
+	e := event{Time: time.Now().UTC(), Kind: kind, Message: fmt.Sprintf(format, args...)}
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if maxEvents <= 0 {
+		return
+	}
+	if len(events) >= maxEvents {
+		events = append(events[:0], events[len(events)-maxEvents+1:]...)
+	}
+	events = append(events, e)
+}
+
+// The remembered events, oldest first
+func recentEvents() []event {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	return append([]event{}, events...)
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, recentEvents())
+}
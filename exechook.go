@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Runs a command for readings, with the reading as JSON on its stdin, so
+// anything can be done with them without a sink of its own. It runs for each
+// reading, or only when a value goes over or under a threshold.
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "exec",
+		intervalKey: execInterval,
+		enabled:     func() bool { return conf.GetString(execCommand) != "" },
+		open:        openExec,
+	})
+	configChecks = append(configChecks, checkExecSettings)
+}
+
+// What the command gets on stdin
+type execJSON struct {
+	sampleJSON
+	// The thresholds that were crossed, when running on those
+	Crossed []execCrossing `json:"crossed,omitempty"`
+}
+
+type execCrossing struct {
+	Metric    string  `json:"metric"`
+	Threshold float64 `json:"threshold"`
+	// above or below
+	Direction string  `json:"direction"`
+	Value     float64 `json:"value"`
+}
+
+type execSink struct {
+	command string
+	args    []string
+	// Only run when a value crosses its threshold
+	onThreshold bool
+	thresholds  map[string]float64
+	// The last value of each metric with a threshold
+	last map[string]float64
+}
+
+func openExec() (sink, error) {
+	thresholds, err := execThresholds()
+	if err != nil {
+		return nil, err
+	}
+	return &execSink{
+		command:     conf.GetString(execCommand),
+		args:        conf.GetStringSlice(execArgs),
+		onThreshold: conf.GetString(execOn) == "threshold",
+		thresholds:  thresholds,
+		last:        make(map[string]float64),
+	}, nil
+}
+
+func execThresholds() (map[string]float64, error) {
+	thresholds := make(map[string]float64)
+	for metric, v := range conf.GetStringMapString(execThresholdsKey) {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("invalid threshold %q for %s", v, metric)
+		}
+		thresholds[metric] = f
+	}
+	return thresholds, nil
+}
+
+func (s *execSink) push(ctx context.Context, samples []sample) error {
+	for _, smp := range samples {
+		in := execJSON{sampleJSON: smp.json()}
+		// Where the values were, kept only once the command has run, so
+		// crossings aren't lost if it fails and the readings are sent again
+		next := make(map[string]float64)
+		for _, v := range smp.values() {
+			t, ok := s.thresholds[v.name]
+			if !ok {
+				continue
+			}
+			next[v.name] = v.value
+			prev, seen := s.last[v.name]
+			switch {
+			case !seen:
+			case prev < t && v.value >= t:
+				in.Crossed = append(in.Crossed, execCrossing{Metric: v.name, Threshold: t, Direction: "above", Value: v.value})
+			case prev >= t && v.value < t:
+				in.Crossed = append(in.Crossed, execCrossing{Metric: v.name, Threshold: t, Direction: "below", Value: v.value})
+			}
+		}
+		if !s.onThreshold || len(in.Crossed) > 0 {
+			if err := s.run(ctx, in); err != nil {
+				return err
+			}
+		}
+		for k, v := range next {
+			s.last[k] = v
+		}
+	}
+	return nil
+}
+
+func (s *execSink) run(ctx context.Context, in execJSON) error {
+	stdin, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	event := "reading"
+	if len(in.Crossed) > 0 {
+		event = "threshold"
+	}
+	cmd := exec.CommandContext(ctx, s.command, s.args...)
+	cmd.Stdin = bytes.NewReader(append(stdin, '\n'))
+	cmd.Env = append(os.Environ(), "BME280_EVENT="+event)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := lastLine(out); msg != "" {
+			return fmt.Errorf("%s: %w: %s", s.command, err, msg)
+		}
+		return fmt.Errorf("%s: %w", s.command, err)
+	}
+	if len(out) > 0 {
+		lg.Debugf("%s said: %s", s.command, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// The last line of a command's output, which is most likely to say what went wrong
+func lastLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func (s *execSink) close() error {
+	return nil
+}
+
+func checkExecSettings() []configProblem {
+	command := conf.GetString(execCommand)
+	if command == "" {
+		return nil
+	}
+	var problems []configProblem
+	if _, err := exec.LookPath(command); err != nil {
+		problems = append(problems, configError(execCommand, "%v", err))
+	}
+	on := conf.GetString(execOn)
+	if on != "reading" && on != "threshold" {
+		problems = append(problems, configError(execOn, "unknown value %q, use reading or threshold", on))
+	}
+	thresholds := conf.GetStringMapString(execThresholdsKey)
+	metrics := make([]string, 0, len(thresholds))
+	for metric := range thresholds {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+	for _, metric := range metrics {
+		if metric != temperatureMetric && metric != pressureMetric && metric != humidityMetric {
+			problems = append(problems, configError(execThresholdsKey, "unknown metric %q, use temperature, pressure or humidity", metric))
+		}
+	}
+	if _, err := execThresholds(); err != nil {
+		problems = append(problems, configError(execThresholdsKey, "%v", err))
+	}
+	if on == "threshold" && len(thresholds) == 0 {
+		problems = append(problems, configError(execThresholdsKey, "there are no thresholds for %s=threshold", execOn))
+	}
+	return problems
+}
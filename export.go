@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	exportFormat   string
+	exportOutput   string
+	exportFrom     string
+	exportTo       string
+	exportJob      string
+	exportInstance string
+	exportStep     time.Duration
+)
+
+func exportFlags(fs *pflag.FlagSet) {
+	historyFlags(fs)
+	fs.StringVarP(&exportFormat, "format", "o", "csv", "Output format: csv, json, parquet, or openmetrics")
+	fs.StringVarP(&exportOutput, "output", "O", "-", "The file to write, or - for standard output")
+	fs.StringVar(&exportFrom, "from", "", "Only readings from this time on, like 2024-01-01 or 2024-01-01T12:00:00Z (default is the oldest)")
+	fs.StringVar(&exportTo, "to", "", "Only readings up to this time, like 2024-01-31 or 2024-01-31T12:00:00Z (default is the newest)")
+	fs.DurationVar(&exportStep, "step", 0, "Average the readings over this long, like 15m, which also gets averages kept after the readings themselves are gone")
+	fs.StringVar(&exportJob, "job", "", "The job label to give OpenMetrics series, to match the scrape config")
+	fs.StringVar(&exportInstance, "instance", "", "The instance label to give OpenMetrics series, to match the scrape config")
+}
+
+// `bme280-exporter export` writes out the history kept by --sqlite.path, for
+// looking at in a spreadsheet, pandas or DuckDB, or backfilling Prometheus
+func runExport(args []string) int {
+	writers := map[string]func(io.Writer, []historyRow) error{
+		"csv":         writeHistoryCSV,
+		"json":        writeHistoryJSON,
+		"parquet":     writeParquet,
+		"openmetrics": writeHistoryOpenMetrics,
+	}
+	write, ok := writers[exportFormat]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown format %q, use csv, json, parquet, or openmetrics\n", exportFormat)
+		return 2
+	}
+	if conf.GetString(sqlitePath) == "" {
+		fmt.Fprintf(os.Stderr, "There's no history to export without --%s\n", sqlitePath)
+		return 2
+	}
+	var from, to time.Time
+	var err error
+	if exportFrom != "" {
+		if from, err = parseExportTime(exportFrom, false); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --from: %v\n", err)
+			return 2
+		}
+	}
+	if exportTo != "" {
+		if to, err = parseExportTime(exportTo, true); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --to: %v\n", err)
+			return 2
+		}
+	}
+
+	if _, err := os.Stat(conf.GetString(sqlitePath)); err != nil {
+		fmt.Fprintf(os.Stderr, "Problem opening the history: %v\n", err)
+		return 1
+	}
+	if exportStep < 0 || (exportStep > 0 && exportStep < time.Second) {
+		fmt.Fprintln(os.Stderr, "Invalid --step, use at least 1s")
+		return 2
+	}
+	rows, err := queryHistory(context.Background(), historyQuery{from: from, to: to, step: exportStep, agg: "avg"})
+	closeHistoryDB()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Problem querying the history: %v\n", err)
+		return 1
+	}
+
+	out := os.Stdout
+	if exportOutput != "-" {
+		if out, err = os.Create(exportOutput); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	w := bufio.NewWriter(out)
+	err = write(w, rows)
+	if err == nil {
+		err = w.Flush()
+	}
+	if out != os.Stdout {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Problem writing the history: %v\n", err)
+		return 1
+	}
+	if exportOutput != "-" {
+		fmt.Fprintf(os.Stderr, "Wrote %d readings to %s\n", len(rows), exportOutput)
+	}
+	return 0
+}
+
+// A time as RFC 3339, or a date, which is midnight local time. At the end of
+// a range, a date takes in the whole of that day.
+func parseExportTime(v string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q isn't a date or RFC 3339 time", v)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1).Add(-time.Millisecond)
+	}
+	return t, nil
+}
+
+func writeHistoryCSV(w io.Writer, rows []historyRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, row := range rows {
+		cw.Write([]string{
+			time.UnixMilli(row.Time).Format(csvTimeFormat),
+			row.Host,
+			row.Model,
+			strconv.Itoa(row.Bus),
+			row.Address,
+			exportValue(row.Temperature),
+			exportValue(row.Pressure),
+			exportValue(row.Humidity),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func exportValue(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return csvValue(*v)
+}
+
+// One reading to a line, each like those from /api/v1/history
+func writeHistoryJSON(w io.Writer, rows []historyRow) error {
+	enc := json.NewEncoder(w)
+	for _, row := range rows {
+		if err := enc.Encode(historyReading(row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The history as the exporter's own gauges, with timestamps, for
+// `promtool tsdb create-blocks-from openmetrics` to fill in a gap. Each
+// metric's samples have to come together, so it's a pass per metric.
+func writeHistoryOpenMetrics(w io.Writer, rows []historyRow) error {
+	// Rows from the same sensor with the same labels share their label set
+	series := make(map[string]string)
+	labels := make([]string, len(rows))
+	for i, row := range rows {
+		key := row.Host + "\xff" + row.Model + "\xff"
+		if row.Labels != nil {
+			key += *row.Labels
+		}
+		if _, ok := series[key]; !ok {
+			set := map[string]string{"host": row.Host, "sensor_type": row.Model}
+			if row.Labels != nil {
+				var configured map[string]string
+				if err := json.Unmarshal([]byte(*row.Labels), &configured); err != nil {
+					return fmt.Errorf("labels %s: %w", *row.Labels, err)
+				}
+				for k, v := range configured {
+					set[k] = v
+				}
+			}
+			if exportJob != "" {
+				set["job"] = exportJob
+			}
+			if exportInstance != "" {
+				set["instance"] = exportInstance
+			}
+			series[key] = openMetricsLabels(set)
+		}
+		labels[i] = series[key]
+	}
+
+	metrics := []struct {
+		name  string
+		value func(historyRow) *float64
+	}{
+		{temperatureMetric, func(row historyRow) *float64 { return row.Temperature }},
+		{pressureMetric, func(row historyRow) *float64 { return row.Pressure }},
+		{humidityMetric, func(row historyRow) *float64 { return row.Humidity }},
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n", m.name); err != nil {
+			return err
+		}
+		for i, row := range rows {
+			v := m.value(row)
+			if v == nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%s%s %s %d.%03d\n", m.name, labels[i], strconv.FormatFloat(*v, 'g', -1, 64), row.Time/1000, row.Time%1000); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, "# EOF\n")
+	return err
+}
+
+// Labels sorted by name, with their values escaped
+func openMetricsLabels(set map[string]string) string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var b strings.Builder
+	b.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, escape.Replace(set[name]))
+	}
+	b.WriteString("}")
+	return b.String()
+}
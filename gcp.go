@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access tokens for Google Cloud, found the way Google's own libraries find
+// application default credentials: a service account key or gcloud's
+// credentials in a file, or the metadata server when running on GCP. See
+// https://cloud.google.com/docs/authentication/application-default-credentials
+
+// What's in a credentials file, of either type
+type gcpCredentialsFile struct {
+	Type string `json:"type"`
+	// Service accounts
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+	// gcloud auth application-default login
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type gcpTokenSource struct {
+	scope  string
+	file   *gcpCredentialsFile
+	key    *rsa.PrivateKey
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// The credentials file to use, if there is one
+func gcpCredentialsPath() string {
+	if v := conf.GetString(gcpCredentialsFileKey); v != "" {
+		return v
+	}
+	if v := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); v != "" {
+		return v
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		name := filepath.Join(dir, "gcloud", "application_default_credentials.json")
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+func newGCPTokenSource(scope string) (*gcpTokenSource, error) {
+	s := &gcpTokenSource{scope: scope, client: &http.Client{Timeout: 30 * time.Second}}
+	name := gcpCredentialsPath()
+	if name == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var f gcpCredentialsFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	switch f.Type {
+	case "service_account":
+		block, _ := pem.Decode([]byte(f.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("%s: no private key", name)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		var ok bool
+		if s.key, ok = key.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("%s: the private key isn't RSA", name)
+		}
+		if f.TokenURI == "" {
+			f.TokenURI = "https://oauth2.googleapis.com/token"
+		}
+	case "authorized_user":
+		if f.TokenURI == "" {
+			f.TokenURI = "https://oauth2.googleapis.com/token"
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported credentials type %q", name, f.Type)
+	}
+	s.file = &f
+	return s, nil
+}
+
+// A token that's good for a while yet, getting a new one if need be
+func (s *gcpTokenSource) get(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Until(s.expires) > 5*time.Minute {
+		return s.token, nil
+	}
+	var req *http.Request
+	var err error
+	switch {
+	case s.file == nil:
+		req, err = s.metadataRequest(ctx)
+	case s.key != nil:
+		req, err = s.serviceAccountRequest(ctx)
+	default:
+		req, err = s.refreshRequest(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("getting a Google Cloud access token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("getting a Google Cloud access token: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("no access token in Google's response")
+	}
+	s.token = result.AccessToken
+	s.expires = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// On GCP, the instance's service account gives out tokens
+func (s *gcpTokenSource) metadataRequest(ctx context.Context) (*http.Request, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	u := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/token?scopes=" + url.QueryEscape(s.scope)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return req, nil
+}
+
+// A service account swaps a JWT signed with its key for a token
+func (s *gcpTokenSource) serviceAccountRequest(ctx context.Context) (*http.Request, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.file.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   s.file.ClientEmail,
+		"scope": s.scope,
+		"aud":   s.file.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	jwt := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(jwt))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	jwt += "." + base64.RawURLEncoding.EncodeToString(sig)
+	return gcpTokenRequest(ctx, s.file.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {jwt},
+	})
+}
+
+// gcloud's credentials are a refresh token
+func (s *gcpTokenSource) refreshRequest(ctx context.Context) (*http.Request, error) {
+	return gcpTokenRequest(ctx, s.file.TokenURI, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {s.file.ClientID},
+		"client_secret": {s.file.ClientSecret},
+		"refresh_token": {s.file.RefreshToken},
+	})
+}
+
+func gcpTokenRequest(ctx context.Context, tokenURI string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
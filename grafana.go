@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A Grafana dashboard for this exporter's metrics, ready for Dashboards > Import.
+// The data source is left as an import input so it works with any Prometheus.
+
+type grafanaTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+	RefID        string `json:"refId"`
+}
+
+type grafanaPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Datasource  string                 `json:"datasource"`
+	GridPos     map[string]int         `json:"gridPos"`
+	Targets     []grafanaTarget        `json:"targets"`
+	FieldConfig map[string]interface{} `json:"fieldConfig"`
+	Options     map[string]interface{} `json:"options,omitempty"`
+}
+
+type grafanaMetric struct {
+	title    string
+	expr     string
+	unit     string
+	decimals int
+}
+
+// The host and the configured labels, each of which gets a selector
+func grafanaVariables() []string {
+	var names []string
+	for k := range configuredLabels() {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return append([]string{"host"}, names...)
+}
+
+// Matches the series picked with the dashboard's selectors
+func grafanaSelector() string {
+	var matchers []string
+	for _, name := range grafanaVariables() {
+		matchers = append(matchers, fmt.Sprintf(`%s=~"$%s"`, name, name))
+	}
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+// The metrics this exporter actually produces with the sensor it found
+func grafanaMetrics() []grafanaMetric {
+	sel := grafanaSelector()
+	var metrics []grafanaMetric
+	if metricEnabled(temperatureMetric) {
+		metrics = append(metrics, grafanaMetric{"Temperature", metricName(temperatureMetric) + sel, "celsius", 1})
+	}
+	// Only the BME280 measures humidity
+	if metricEnabled(humidityMetric) && sensorNameForID(currentChipID()) == "BME280" {
+		metrics = append(metrics, grafanaMetric{"Humidity", metricName(humidityMetric) + sel, "humidity", 1})
+	}
+	// Pressure is exported in Pa, which Grafana has no unit for
+	if metricEnabled(pressureMetric) {
+		metrics = append(metrics, grafanaMetric{"Pressure", metricName(pressureMetric) + sel + " / 100", "pressurehpa", 1})
+	}
+	return metrics
+}
+
+func grafanaDashboard() map[string]interface{} {
+	const ds = "${DS_PROMETHEUS}"
+
+	var panels []grafanaPanel
+	metrics := grafanaMetrics()
+	for i, m := range metrics {
+		width := 24 / len(metrics)
+		defaults := map[string]interface{}{"unit": m.unit, "decimals": m.decimals}
+		panels = append(panels, grafanaPanel{
+			ID:         i + 1,
+			Type:       "stat",
+			Title:      m.title,
+			Datasource: ds,
+			GridPos:    map[string]int{"x": i * width, "y": 0, "w": width, "h": 4},
+			Targets: []grafanaTarget{
+				{Expr: m.expr, LegendFormat: "{{host}}", RefID: "A"},
+			},
+			FieldConfig: map[string]interface{}{"defaults": defaults},
+			Options: map[string]interface{}{
+				"reduceOptions": map[string]interface{}{"calcs": []string{"lastNotNull"}},
+				"graphMode":     "area",
+			},
+		})
+		panels = append(panels, grafanaPanel{
+			ID:         len(metrics) + i + 1,
+			Type:       "timeseries",
+			Title:      m.title,
+			Datasource: ds,
+			GridPos:    map[string]int{"x": 0, "y": 4 + i*8, "w": 24, "h": 8},
+			Targets: []grafanaTarget{
+				{Expr: m.expr, LegendFormat: "{{host}} ({{sensor_type}})", RefID: "A"},
+			},
+			FieldConfig: map[string]interface{}{"defaults": defaults},
+		})
+	}
+
+	labels := configuredLabels()
+	var variables []map[string]interface{}
+	for _, name := range grafanaVariables() {
+		label, current := "Host", hostname
+		if name != "host" {
+			label, current = name, labels[name]
+		}
+		variables = append(variables, map[string]interface{}{
+			"name":       name,
+			"label":      label,
+			"type":       "query",
+			"datasource": ds,
+			// The up metric is there whichever others are enabled
+			"query":      fmt.Sprintf("label_values(%s, %s)", metricName(upMetric), name),
+			"refresh":    2,
+			"multi":      true,
+			"includeAll": true,
+			"current":    map[string]interface{}{"text": current, "value": []string{current}},
+		})
+	}
+
+	return map[string]interface{}{
+		"__inputs": []map[string]interface{}{{
+			"name":     "DS_PROMETHEUS",
+			"label":    "Prometheus",
+			"type":     "datasource",
+			"pluginId": "prometheus",
+		}},
+		"uid":           "bme280-exporter",
+		"title":         "BME280 Exporter",
+		"tags":          []string{"bme280", "environment"},
+		"editable":      true,
+		"schemaVersion": 27,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-24h", "to": "now"},
+		"templating":    map[string]interface{}{"list": variables},
+		"panels":        panels,
+	}
+}
+
+// Serve the dashboard for the sensor we found
+func grafanaDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(grafanaDashboard(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGrafanaDashboard(t *testing.T) {
+	for key, v := range map[string]interface{}{
+		metricsNamespace: "office",
+		metricsEnabled:   []string{temperatureMetric, pressureMetric},
+		extraLabels:      map[string]string{"room": "kitchen", "floor": "1"},
+	} {
+		old := viper.Get(key)
+		viper.Set(key, v)
+		t.Cleanup(func() { viper.Set(key, old) })
+	}
+
+	rec := httptest.NewRecorder()
+	grafanaDashboardHandler(rec, httptest.NewRequest("GET", "/grafana/dashboard.json", nil))
+	var dashboard struct {
+		Templating struct {
+			List []struct {
+				Name    string
+				Query   string
+				Current struct{ Text string }
+			}
+		}
+		Panels []grafanaPanel
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &dashboard); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, v := range dashboard.Templating.List {
+		names = append(names, v.Name)
+		if v.Query != "label_values(office_bme280_up, "+v.Name+")" {
+			t.Errorf("%s: got query %q", v.Name, v.Query)
+		}
+	}
+	if want := []string{"host", "floor", "room"}; !slices.Equal(names, want) {
+		t.Errorf("got variables %q, want %q", names, want)
+	}
+	if got := dashboard.Templating.List[2].Current.Text; got != "kitchen" {
+		t.Errorf("room: got %q selected, want kitchen", got)
+	}
+
+	// Humidity is off, so a stat and a graph each for the other two
+	var exprs []string
+	for _, p := range dashboard.Panels {
+		exprs = append(exprs, p.Targets[0].Expr)
+	}
+	const sel = `{host=~"$host",floor=~"$floor",room=~"$room"}`
+	want := []string{
+		"office_temperature" + sel, "office_temperature" + sel,
+		"office_pressure" + sel + " / 100", "office_pressure" + sel + " / 100",
+	}
+	if !slices.Equal(exprs, want) {
+		t.Errorf("got exprs %q, want %q", exprs, want)
+	}
+}
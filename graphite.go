@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sends readings to Graphite (carbon, go-carbon and friends) over TCP, in
+// either the plaintext or pickle protocol. See
+// https://graphite.readthedocs.io/en/latest/feeding-carbon.html
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "graphite",
+		intervalKey: graphiteInterval,
+		enabled:     func() bool { return conf.GetString(graphiteAddress) != "" },
+		open:        openGraphite,
+		addresses:   func() []string { return hostAddress(conf.GetString(graphiteAddress), "") },
+	})
+	configChecks = append(configChecks, checkGraphiteSettings)
+}
+
+type graphiteSink struct {
+	address string
+	pickle  bool
+	prefix  string
+	tagged  bool
+	conn    net.Conn
+}
+
+func openGraphite() (sink, error) {
+	return &graphiteSink{
+		address: conf.GetString(graphiteAddress),
+		pickle:  conf.GetString(graphiteProtocol) == "pickle",
+		prefix:  conf.GetString(graphitePrefix),
+		tagged:  conf.GetBool(graphiteTags),
+	}, nil
+}
+
+type graphiteMetric struct {
+	path  string
+	time  float64
+	value float64
+}
+
+func (s *graphiteSink) push(ctx context.Context, samples []sample) error {
+	var metrics []graphiteMetric
+	for _, smp := range samples {
+		prefix := strings.ReplaceAll(s.prefix, "{host}", graphiteNode(smp.Sensor.Host))
+		for _, v := range smp.values() {
+			metrics = append(metrics, graphiteMetric{
+				path:  s.path(prefix, v.name, smp.tags()),
+				time:  float64(smp.Time.UnixNano()) / 1e9,
+				value: v.value,
+			})
+		}
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	var msg []byte
+	if s.pickle {
+		msg = encodePickle(metrics)
+	} else {
+		var b bytes.Buffer
+		for _, m := range metrics {
+			fmt.Fprintf(&b, "%s %s %d\n", m.path, strconv.FormatFloat(m.value, 'f', -1, 64), int64(m.time))
+		}
+		msg = b.Bytes()
+	}
+
+	// The connection's kept open between pushes, and opened again after anything goes wrong
+	if s.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", s.address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	if _, err := s.conn.Write(msg); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// The metric's path, with the labels as Graphite tags if they're turned on
+func (s *graphiteSink) path(prefix, name string, tags map[string]string) string {
+	path := name
+	if prefix != "" {
+		path = prefix + "." + name
+	}
+	if !s.tagged {
+		return path
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if tags[k] != "" {
+			path += ";" + graphiteTag.Replace(k) + "=" + graphiteTag.Replace(tags[k])
+		}
+	}
+	return path
+}
+
+var (
+	// Dots would split a hostname into several nodes
+	graphiteNodeReplacer = strings.NewReplacer(".", "_", " ", "_", ";", "_")
+	graphiteTag          = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "!", "_", "^", "_", "=", "_")
+)
+
+func graphiteNode(s string) string {
+	return graphiteNodeReplacer.Replace(s)
+}
+
+// A list of (path, (timestamp, value)) tuples in pickle protocol 2, prefixed
+// with its length, which is what carbon's pickle receiver takes. Only the
+// handful of opcodes needed are written.
+func encodePickle(metrics []graphiteMetric) []byte {
+	b := []byte{0x80, 2, ']', '('}
+	appendFloat := func(v float64) {
+		b = append(b, 'G')
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	for _, m := range metrics {
+		b = append(b, 'X')
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(m.path)))
+		b = append(b, m.path...)
+		appendFloat(m.time)
+		appendFloat(m.value)
+		b = append(b, 0x86, 0x86)
+	}
+	b = append(b, 'e', '.')
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+func (s *graphiteSink) close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+func checkGraphiteSettings() []configProblem {
+	var problems []configProblem
+	if v := conf.GetString(graphiteAddress); v != "" {
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			problems = append(problems, configError(graphiteAddress, "%v, use e.g. graphite:2003", err))
+		}
+	}
+	if p := conf.GetString(graphiteProtocol); p != "plaintext" && p != "pickle" {
+		problems = append(problems, configError(graphiteProtocol, "unknown protocol %q, use plaintext or pickle", p))
+	}
+	return problems
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	bme280v1 "github.com/jaevans/bme280-exporter/proto/bme280/v1"
+	"github.com/prometheus/exporter-toolkit/web"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpccreds "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//go:generate buf generate
+
+// The gRPC API from proto/bme280/v1/sensor.proto, with the same TLS, basic
+// auth and allowlist as the HTTP server
+
+// Requests are all empty messages, so anything big is a mistake
+const grpcMaxMessage = 64 << 10
+
+// Checked against for users that don't exist, so they take as long to turn
+// down as a wrong password. It's "fakepassword", as in the exporter-toolkit.
+const grpcDummyHash = "$2y$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi"
+
+type grpcServer struct {
+	bme280v1.UnimplementedSensorServer
+	poller *poller
+}
+
+func (s *grpcServer) GetReadings(ctx context.Context, _ *bme280v1.GetReadingsRequest) (*bme280v1.Reading, error) {
+	current, err := currentReading(ctx, s.poller)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !current.ok() {
+		return nil, status.Error(codes.Unavailable, "problem reading the sensor")
+	}
+	return readingProto(current), nil
+}
+
+func (s *grpcServer) StreamReadings(_ *bme280v1.StreamReadingsRequest, stream grpc.ServerStreamingServer[bme280v1.Reading]) error {
+	if s.poller == nil {
+		return status.Error(codes.Unavailable, "streaming needs the background poller, see --poll.interval")
+	}
+	readings := s.poller.subscribe()
+	defer s.poller.unsubscribe(readings)
+	if latest := s.poller.Latest(); latest.ok() {
+		if err := stream.Send(readingProto(latest)); err != nil {
+			return err
+		}
+	}
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case rd, ok := <-readings:
+			if !ok {
+				return status.Error(codes.Unavailable, "the exporter is shutting down")
+			}
+			if !rd.ok() {
+				continue
+			}
+			if err := stream.Send(readingProto(rd)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *grpcServer) GetSensorInfo(context.Context, *bme280v1.GetSensorInfoRequest) (*bme280v1.SensorInfo, error) {
+	bus, addr := currentAddress()
+	id := currentChipID()
+	return &bme280v1.SensorInfo{
+		Host:          hostname,
+		Model:         conf.GetString(modelName),
+		DetectedModel: sensorNameForID(id),
+		ChipId:        uint32(id),
+		Bus:           uint32(bus),
+		Address:       uint32(addr),
+	}, nil
+}
+
+func readingProto(r reading) *bme280v1.Reading {
+	value := func(v float64) *float64 {
+		if math.IsNaN(v) {
+			return nil
+		}
+		return proto.Float64(v)
+	}
+	return &bme280v1.Reading{
+		Time:               timestamppb.New(r.Time),
+		TemperatureCelsius: value(r.Temperature),
+		PressurePascals:    value(r.Pressure),
+		HumidityPercent:    value(r.Humidity),
+	}
+}
+
+// Turn away clients outside the allowlist, and with basic_auth_users in the
+// web config, anyone without one of their passwords
+func grpcCheckAccess(ctx context.Context, allowlist *allowlistHandler) error {
+	if allowlist != nil {
+		p, ok := peer.FromContext(ctx)
+		if !ok || !allowlist.allowed(p.Addr.String()) {
+			return status.Error(codes.PermissionDenied, "not allowed")
+		}
+	}
+
+	// Read each time, like the toolkit does for HTTP
+	c, err := readWebConfig()
+	if err != nil {
+		lg.Errorf("Problem reading the web config: %v", err)
+		return status.Error(codes.Internal, "problem reading the web config")
+	}
+	if c == nil || len(c.Users) == 0 {
+		return nil
+	}
+	var auth string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		auth = md.Get("authorization")[0]
+	}
+	encoded, ok := strings.CutPrefix(auth, "Basic ")
+	if !ok {
+		return status.Error(codes.Unauthenticated, "basic auth is required")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, "basic auth is required")
+	}
+	user, pass, _ := strings.Cut(string(decoded), ":")
+	hash, known := c.Users[user]
+	if !known {
+		hash = grpcDummyHash
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil || !known {
+		return status.Error(codes.Unauthenticated, "wrong username or password")
+	}
+	return nil
+}
+
+// The web config's TLS settings, read again for each connection so renewed
+// certificates get picked up
+func grpcTLSConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c, err := readWebConfig()
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("the web config file has gone")
+	}
+	cfg, err := web.ConfigToTLSConfig(&c.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	// gRPC needs HTTP/2, whatever the web config says
+	cfg.NextProtos = []string{"h2"}
+	return cfg, nil
+}
+
+// Serve the gRPC API until the context is cancelled and in-flight calls have finished
+func serveGRPC(ctx context.Context, addr string, p *poller) error {
+	var allowlist *allowlistHandler
+	if cidrs := getStringList(allowedCIDRs); len(cidrs) > 0 {
+		var err error
+		if allowlist, err = newAllowlistHandler(cidrs, nil); err != nil {
+			return err
+		}
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(grpcMaxMessage),
+		grpc.KeepaliveParams(keepalive.ServerParameters{MaxConnectionIdle: conf.GetDuration(idleTimeout)}),
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := grpcCheckAccess(ctx, allowlist); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := grpcCheckAccess(ss.Context(), allowlist); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+	if webScheme() == "https" {
+		opts = append(opts, grpc.Creds(grpccreds.NewTLS(&tls.Config{GetConfigForClient: grpcTLSConfig})))
+	}
+	server := grpc.NewServer(opts...)
+	bme280v1.RegisterSensorServer(server, &grpcServer{poller: p})
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(conf.GetDuration(shutdownTimeout)):
+			lg.Warn("Problem shutting down gRPC server: calls didn't finish in time")
+			server.Stop()
+		}
+	}()
+
+	lg.Infof("Serving gRPC on %s", l.Addr())
+	if err := server.Serve(l); err != nil {
+		return err
+	}
+	<-shutdownDone
+	return nil
+}
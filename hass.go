@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Home Assistant's MQTT discovery, so the sensor shows up in it on its own.
+// The config messages are retained, so Home Assistant finds them again after
+// a restart. See
+// https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+
+// What Home Assistant should make of each value
+var hassEntities = []struct {
+	metric, name, deviceClass, unit string
+	// Turns the published value into the unit, for JSON payloads and for
+	// values published on their own
+	jsonTemplate, valueTemplate string
+}{
+	{temperatureMetric, "Temperature", "temperature", "°C", "{{ value_json.temperature }}", ""},
+	{pressureMetric, "Pressure", "atmospheric_pressure", "hPa", "{{ (value_json.pressure / 100) | round(2) }}", "{{ (value | float / 100) | round(2) }}"},
+	{humidityMetric, "Humidity", "humidity", "%", "{{ value_json.humidity }}", ""},
+}
+
+type hassDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SWVersion    string   `json:"sw_version"`
+}
+
+type hassConfig struct {
+	Name              string     `json:"name"`
+	UniqueID          string     `json:"unique_id"`
+	StateTopic        string     `json:"state_topic"`
+	ValueTemplate     string     `json:"value_template,omitempty"`
+	DeviceClass       string     `json:"device_class"`
+	UnitOfMeasurement string     `json:"unit_of_measurement"`
+	StateClass        string     `json:"state_class"`
+	AvailabilityTopic string     `json:"availability_topic"`
+	Device            hassDevice `json:"device"`
+}
+
+var hassIDReplacer = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// Publish a config message for each value the sensor measures
+func (s *mqttSink) publishDiscovery(ctx context.Context, c *mqttClient, sensor sensorJSON) error {
+	id := hassIDReplacer.ReplaceAllString(fmt.Sprintf("bme280_exporter_%s_%d_%s", sensor.Host, sensor.Bus, sensor.Address), "_")
+	device := hassDevice{
+		Identifiers:  []string{id},
+		Name:         fmt.Sprintf("%s on %s", sensor.Model, sensor.Host),
+		Manufacturer: "Bosch Sensortec",
+		Model:        sensor.Model,
+		SWVersion:    version,
+	}
+	for _, e := range hassEntities {
+		// Only the BME280 measures humidity
+		if e.metric == humidityMetric && !strings.EqualFold(sensor.Model, "BME280") {
+			continue
+		}
+		cfg := hassConfig{
+			Name:              e.name,
+			UniqueID:          id + "_" + e.metric,
+			StateTopic:        s.topic,
+			ValueTemplate:     e.jsonTemplate,
+			DeviceClass:       e.deviceClass,
+			UnitOfMeasurement: e.unit,
+			StateClass:        "measurement",
+			AvailabilityTopic: s.statusTopic(),
+			Device:            device,
+		}
+		if s.values {
+			cfg.StateTopic = s.topic + "/" + e.metric
+			cfg.ValueTemplate = e.valueTemplate
+		}
+		payload, err := json.Marshal(cfg)
+		if err != nil {
+			return err
+		}
+		topic := fmt.Sprintf("%s/sensor/%s/%s/config", s.discoveryPrefix, id, e.metric)
+		if err := c.publish(ctx, topic, payload, 1, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// HCI_FILTER, which x/sys doesn't have
+const hciFilter = 2
+
+// A raw HCI socket on a Bluetooth controller, for sending it commands
+type hciDevice struct {
+	fd int
+}
+
+func openHCI(dev int) (*hciDevice, error) {
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	if err != nil {
+		return nil, fmt.Errorf("problem opening a Bluetooth socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrHCI{Dev: uint16(dev), Channel: unix.HCI_CHANNEL_RAW}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("problem opening hci%d: %w", dev, err)
+	}
+	// Only events, and of those only the answers to commands
+	filter := make([]byte, 16)
+	binary.LittleEndian.PutUint32(filter, 1<<hciEventPacket)
+	binary.LittleEndian.PutUint32(filter[4:], 1<<hciCommandComplete|1<<hciCommandStatus)
+	if err := unix.SetsockoptString(fd, unix.SOL_HCI, hciFilter, string(filter)); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("problem setting the HCI filter: %w", err)
+	}
+	tv := unix.NsecToTimeval(int64(time.Second))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &hciDevice{fd}, nil
+}
+
+// Send a command and wait for the controller's answer
+func (d *hciDevice) command(ogf, ocf uint16, params []byte) error {
+	opcode := ogf<<10 | ocf
+	pkt := []byte{hciCommandPacket, byte(opcode), byte(opcode >> 8), byte(len(params))}
+	if _, err := unix.Write(d.fd, append(pkt, params...)); err != nil {
+		return err
+	}
+	buf := make([]byte, 260)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		n, err := unix.Read(d.fd, buf)
+		if err != nil {
+			if err == unix.EINTR || err == unix.EAGAIN {
+				continue
+			}
+			return err
+		}
+		ev := buf[:n]
+		if n < 7 || ev[0] != hciEventPacket {
+			continue
+		}
+		// Command complete has the number of commands allowed, the opcode,
+		// then the status; command status has the status first
+		switch ev[1] {
+		case hciCommandComplete:
+			if binary.LittleEndian.Uint16(ev[4:]) == opcode {
+				return hciError(ev[6])
+			}
+		case hciCommandStatus:
+			if binary.LittleEndian.Uint16(ev[5:]) == opcode {
+				return hciError(ev[3])
+			}
+		}
+	}
+	return errors.New("timed out waiting for the Bluetooth controller")
+}
+
+func (d *hciDevice) close() error {
+	return unix.Close(d.fd)
+}
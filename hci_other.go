@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+type hciDevice struct{}
+
+func openHCI(dev int) (*hciDevice, error) {
+	return nil, errors.New("Bluetooth is only supported on Linux")
+}
+
+func (d *hciDevice) command(ogf, ocf uint16, params []byte) error {
+	return errors.New("Bluetooth is only supported on Linux")
+}
+
+func (d *hciDevice) close() error {
+	return nil
+}
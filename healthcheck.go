@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Always OK while the process is able to serve HTTP
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "Healthy")
+}
+
+// OK as long as the last sensor read worked
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&sensorHealthy) == 0 {
+		http.Error(w, "Sensor is not responding", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "Ready")
+}
+
+// Ask a running exporter whether it's ready, for container HEALTHCHECKs and
+// the like. Returns the process exit code.
+func runHealthcheck(args []string) int {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	url := conf.GetString(healthcheckURL)
+	if url == "" {
+		url = fmt.Sprintf("%s://localhost:%d/-/ready", webScheme(), conf.GetInt(metricsPort))
+		// We're talking to ourselves on localhost, the certificate won't be for that name
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		fmt.Printf("Unhealthy: %v\n", err)
+		return 1
+	}
+	if user := conf.GetString(healthcheckUsername); user != "" {
+		var password []byte
+		if f := conf.GetString(healthcheckPasswordFile); f != "" {
+			if password, err = os.ReadFile(f); err != nil {
+				fmt.Printf("Unhealthy: password: %v\n", err)
+				return 1
+			}
+		}
+		req.SetBasicAuth(user, strings.TrimSpace(string(password)))
+	}
+
+	client := &http.Client{Timeout: conf.GetDuration(healthcheckTimeout), Transport: transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("Unhealthy: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Unhealthy: %s: %s", resp.Status, body)
+		return 1
+	}
+	fmt.Printf("%s", body)
+	return 0
+}
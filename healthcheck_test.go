@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHealthcheckBasicAuth(t *testing.T) {
+	dir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webConfig := filepath.Join(dir, "web.yml")
+	if err := os.WriteFile(webConfig, []byte(fmt.Sprintf("basic_auth_users:\n  prometheus: %s\n", hash)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/-/ready", readyHandler)
+	server := &http.Server{Handler: mux}
+	t.Cleanup(func() { server.Close() })
+	go web.Serve(l, server, &web.FlagConfig{WebConfigFile: &webConfig}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	atomic.StoreInt32(&sensorHealthy, 1)
+	for _, key := range []string{healthcheckURL, healthcheckUsername, healthcheckPasswordFile} {
+		t.Cleanup(func() { viper.Set(key, "") })
+	}
+	viper.Set(healthcheckURL, "http://"+l.Addr().String()+"/-/ready")
+
+	tests := []struct {
+		user, passwordFile string
+		want               int
+	}{
+		{"", "", 1},
+		{"prometheus", "", 1},
+		{"prometheus", passwordFile, 0},
+		{"grafana", passwordFile, 1},
+		{"prometheus", filepath.Join(dir, "missing"), 1},
+	}
+	for _, tt := range tests {
+		viper.Set(healthcheckUsername, tt.user)
+		viper.Set(healthcheckPasswordFile, tt.passwordFile)
+		if got := runHealthcheck(nil); got != tt.want {
+			t.Errorf("user %q, password file %q: got exit code %d, want %d", tt.user, tt.passwordFile, got, tt.want)
+		}
+	}
+}
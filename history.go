@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Keeps every reading in a local SQLite database, so there's history on the
+// device that outlives a Prometheus outage, with /api/v1/history to look
+// through it. modernc.org/sqlite is SQLite translated to Go, so there's no
+// cgo and nothing to install.
+//
+// Besides every reading, there are averages for each minute and each 15
+// minutes in tables of their own, kept for longer, so months of history fit
+// on an SD card. Each batch brings the averages for its minutes up to date.
+
+// The most readings /api/v1/history gives back at once
+const historyMaxLimit = 100000
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "sqlite",
+		intervalKey: sqliteInterval,
+		enabled:     func() bool { return conf.GetString(sqlitePath) != "" },
+		open:        openSQLite,
+	})
+	configChecks = append(configChecks, checkSQLiteSettings)
+}
+
+// A level of detail in the history: every reading, or averages over a step
+type historyTier struct {
+	step      time.Duration
+	retention time.Duration
+}
+
+// The table a tier's kept in
+func (t historyTier) table() string {
+	if t.step == 0 {
+		return "readings"
+	}
+	return fmt.Sprintf("readings_%dm", int(t.step.Minutes()))
+}
+
+// Pick the tier to answer a query from: the most detailed one that still goes
+// back as far as it asks, without being coarser than its step. Tiers are most
+// detailed first, and a retention of 0 is forever.
+func pickHistoryTier(hq historyQuery, tiers []historyTier) int {
+	since := time.Now()
+	best := 0
+	for i, t := range tiers {
+		if i > 0 && hq.step > 0 && t.step > hq.step {
+			break
+		}
+		best = i
+		if t.retention <= 0 || hq.from.IsZero() || !hq.from.Before(since.Add(-t.retention)) {
+			return i
+		}
+	}
+	return best
+}
+
+func sqliteTiers() []historyTier {
+	return []historyTier{
+		{0, conf.GetDuration(sqliteRetention)},
+		{time.Minute, conf.GetDuration(sqliteRetention1m)},
+		{15 * time.Minute, conf.GetDuration(sqliteRetention15m)},
+	}
+}
+
+const sqliteTable = `CREATE TABLE IF NOT EXISTS %s (
+	time INTEGER NOT NULL,
+	host TEXT NOT NULL,
+	model TEXT NOT NULL,
+	bus INTEGER NOT NULL,
+	address TEXT NOT NULL,
+	temperature REAL,
+	pressure REAL,
+	humidity REAL,
+	labels TEXT,
+	PRIMARY KEY (host, bus, address, time)
+)`
+
+// The database, opened the first time something needs it and shared by the
+// sink, /api/v1/history and export
+var historyDB struct {
+	mu sync.Mutex
+	db *sql.DB
+}
+
+func openHistoryDB() (*sql.DB, error) {
+	historyDB.mu.Lock()
+	defer historyDB.mu.Unlock()
+	if historyDB.db != nil {
+		return historyDB.db, nil
+	}
+	// WAL so the sqlite3 command can read while readings are added, and a busy
+	// timeout so either waits for the other rather than failing
+	path := (&url.URL{Path: conf.GetString(sqlitePath)}).EscapedPath()
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range sqliteTiers() {
+		if _, err := db.Exec(fmt.Sprintf(sqliteTable, t.table())); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	historyDB.db = db
+	return db, nil
+}
+
+func closeHistoryDB() error {
+	historyDB.mu.Lock()
+	defer historyDB.mu.Unlock()
+	if historyDB.db == nil {
+		return nil
+	}
+	err := historyDB.db.Close()
+	historyDB.db = nil
+	return err
+}
+
+type sqliteSink struct {
+	db    *sql.DB
+	tiers []historyTier
+}
+
+func openSQLite() (sink, error) {
+	db, err := openHistoryDB()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteSink{db: db, tiers: sqliteTiers()}, nil
+}
+
+func (s *sqliteSink) push(ctx context.Context, samples []sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Readings sent again from the spool are already there
+	insert, err := tx.PrepareContext(ctx, "INSERT OR IGNORE INTO readings VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	oldest := samples[0].Time.UnixMilli()
+	for _, smp := range samples {
+		oldest = min(oldest, smp.Time.UnixMilli())
+		var labels any
+		if len(smp.Labels) > 0 {
+			j, err := json.Marshal(smp.Labels)
+			if err != nil {
+				return err
+			}
+			labels = string(j)
+		}
+		if _, err := insert.ExecContext(ctx, smp.Time.UnixMilli(), smp.Sensor.Host, smp.Sensor.Model, smp.Sensor.Bus, smp.Sensor.Address,
+			sqliteValue(smp.Temperature), sqliteValue(smp.Pressure), sqliteValue(smp.Humidity), labels); err != nil {
+			return err
+		}
+	}
+	// Work out the averages again for every step the batch touches, each
+	// tier from the one before it, or for everything if a tier's new
+	for i := 1; i < len(s.tiers); i++ {
+		src, dst := s.tiers[i-1].table(), s.tiers[i].table()
+		step := s.tiers[i].step.Milliseconds()
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT OR REPLACE INTO %s SELECT time / ? * ? AS bucket, host, model, bus, address, avg(temperature), avg(pressure), avg(humidity), max(labels) FROM %s WHERE time >= ? OR NOT EXISTS (SELECT 1 FROM %s) GROUP BY host, model, bus, address, bucket",
+			dst, src, dst), step, step, oldest/step*step); err != nil {
+			return err
+		}
+	}
+	for _, t := range s.tiers {
+		if t.retention > 0 {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+t.table()+" WHERE time < ?", time.Now().Add(-t.retention).UnixMilli()); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Missing values are NULL
+func sqliteValue(v float64) any {
+	if math.IsNaN(v) {
+		return nil
+	}
+	return v
+}
+
+func (s *sqliteSink) close() error {
+	return closeHistoryDB()
+}
+
+// A reading from the history
+type historyRow struct {
+	Time        int64
+	Host        string
+	Model       string
+	Bus         int
+	Address     string
+	Temperature *float64
+	Pressure    *float64
+	Humidity    *float64
+	Labels      *string
+}
+
+// Which readings to get from the history. Zero times leave that end open,
+// and a limit keeps only the latest that many, 0 for all of them. With a step, they're combined into one
+// for each sensor and each step from 1970 on, with agg: avg, min, or max.
+type historyQuery struct {
+	from, to time.Time
+	limit    int
+	step     time.Duration
+	agg      string
+}
+
+// Read readings from the database, oldest first
+func queryHistory(ctx context.Context, hq historyQuery) ([]historyRow, error) {
+	db, err := openHistoryDB()
+	if err != nil {
+		return nil, err
+	}
+	tiers := sqliteTiers()
+	table := tiers[pickHistoryTier(hq, tiers)].table()
+	query := "SELECT time, host, model, bus, address, temperature, pressure, humidity, labels FROM " + table + " WHERE 1"
+	var args []any
+	step := hq.step.Milliseconds()
+	if hq.step > 0 {
+		// A function name can't be a parameter
+		if hq.agg != "avg" && hq.agg != "min" && hq.agg != "max" {
+			return nil, fmt.Errorf("unknown aggregation %q", hq.agg)
+		}
+		query = fmt.Sprintf("SELECT time / ? * ? AS time, host, model, bus, address, %s(temperature) AS temperature, %s(pressure) AS pressure, %s(humidity) AS humidity, max(labels) AS labels FROM %s WHERE 1",
+			hq.agg, hq.agg, hq.agg, table)
+		args = append(args, step, step)
+	}
+	if !hq.from.IsZero() {
+		query += " AND time >= ?"
+		args = append(args, hq.from.UnixMilli())
+	}
+	if !hq.to.IsZero() {
+		query += " AND time <= ?"
+		args = append(args, hq.to.UnixMilli())
+	}
+	if hq.step > 0 {
+		query += " GROUP BY host, model, bus, address, time / ?"
+		args = append(args, step)
+	}
+	// The latest ones when there's a limit, put back in order below
+	if hq.limit > 0 {
+		query += " ORDER BY time DESC LIMIT ?"
+		args = append(args, hq.limit)
+	} else {
+		query += " ORDER BY time"
+	}
+
+	rs, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	var rows []historyRow
+	for rs.Next() {
+		var row historyRow
+		if err := rs.Scan(&row.Time, &row.Host, &row.Model, &row.Bus, &row.Address, &row.Temperature, &row.Pressure, &row.Humidity, &row.Labels); err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	if hq.limit > 0 {
+		slices.Reverse(rows)
+	}
+	return rows, rs.Err()
+}
+
+// Serve the history from SQLite if it's kept there, otherwise from memory if
+// it's kept there
+func registerHistory(mux *http.ServeMux, mem *historyBuffer) {
+	switch {
+	case conf.GetString(sqlitePath) != "":
+		mux.HandleFunc("/api/v1/history", historyHandler(func(ctx context.Context, hq historyQuery) ([]historyRow, error) {
+			return queryHistory(ctx, hq)
+		}))
+	case mem != nil:
+		mux.HandleFunc("/api/v1/history", historyHandler(func(ctx context.Context, hq historyQuery) ([]historyRow, error) {
+			return mem.query(hq), nil
+		}))
+	}
+}
+
+// Serve the readings between ?from= and ?to=, the last day by default,
+// oldest first, optionally combined into one every ?step= with ?agg=. Only
+// the latest ?limit= are served.
+func historyHandler(query func(context.Context, historyQuery) ([]historyRow, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		hq := historyQuery{to: time.Now(), limit: 1000, agg: "avg"}
+		hq.from = hq.to.Add(-24 * time.Hour)
+		var err error
+		if v := q.Get("from"); v != "" {
+			if hq.from, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "Invalid value for from, use RFC 3339", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("to"); v != "" {
+			if hq.to, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "Invalid value for to, use RFC 3339", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			if hq.limit, err = strconv.Atoi(v); err != nil || hq.limit < 1 || hq.limit > historyMaxLimit {
+				http.Error(w, fmt.Sprintf("Invalid value for limit, use 1 to %d", historyMaxLimit), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("step"); v != "" {
+			if hq.step, err = time.ParseDuration(v); err != nil || hq.step < time.Second {
+				http.Error(w, "Invalid value for step, use a duration of at least 1s, like 5m", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("agg"); v != "" {
+			if v != "avg" && v != "min" && v != "max" {
+				http.Error(w, "Invalid value for agg, use avg, min, or max", http.StatusBadRequest)
+				return
+			}
+			hq.agg = v
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		rows, err := query(ctx, hq)
+		if err != nil {
+			lg.Errorf("Problem querying the history: %v", err)
+			http.Error(w, "Problem querying the history", http.StatusInternalServerError)
+			return
+		}
+
+		resp := []readingsJSON{}
+		for _, row := range rows {
+			resp = append(resp, historyReading(row))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			lg.Errorf("Problem writing the history: %v", err)
+		}
+	}
+}
+
+// A row as /api/v1/readings would have given it
+func historyReading(row historyRow) readingsJSON {
+	rj := readingJSON{Timestamp: time.UnixMilli(row.Time).UTC()}
+	if row.Temperature != nil {
+		rj.Temperature = jsonValue(*row.Temperature, "°C")
+	}
+	if row.Pressure != nil {
+		rj.Pressure = jsonValue(*row.Pressure, "Pa")
+	}
+	if row.Humidity != nil {
+		rj.Humidity = jsonValue(*row.Humidity, "%")
+	}
+	return readingsJSON{
+		Sensor:  sensorJSON{Host: row.Host, Model: row.Model, Bus: row.Bus, Address: row.Address},
+		Reading: rj,
+	}
+}
+
+func checkSQLiteSettings() []configProblem {
+	path := conf.GetString(sqlitePath)
+	if path == "" {
+		return nil
+	}
+	var problems []configProblem
+	if !filepath.IsAbs(path) {
+		problems = append(problems, configWarning(sqlitePath, "relative to wherever the exporter is started, use an absolute path"))
+	}
+	// Each tier should be kept at least as long as the one before, with 0 being
+	// forever
+	tiers := sqliteTiers()
+	keys := []string{sqliteRetention, sqliteRetention1m, sqliteRetention15m}
+	for i, t := range tiers {
+		switch {
+		case t.retention < 0:
+			problems = append(problems, configError(keys[i], "can't be negative"))
+		case i > 0 && t.retention > 0 && (tiers[i-1].retention <= 0 || t.retention < tiers[i-1].retention):
+			problems = append(problems, configWarning(keys[i], "is shorter than %s, so the averages are gone before the readings they're from", keys[i-1]))
+		}
+	}
+	return problems
+}
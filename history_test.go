@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// The timestamps /api/v1/history serves for a query
+func historyTimes(t *testing.T, query func(context.Context, historyQuery) ([]historyRow, error), params string) []time.Time {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	historyHandler(query)(rec, httptest.NewRequest("GET", "/api/v1/history?"+params, nil))
+	if rec.Code != 200 {
+		t.Fatalf("%s: got %d: %s", params, rec.Code, rec.Body)
+	}
+	var resp []readingsJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var times []time.Time
+	for _, r := range resp {
+		times = append(times, r.Reading.Timestamp)
+	}
+	return times
+}
+
+func TestHistoryLimit(t *testing.T) {
+	for key, v := range map[string]interface{}{
+		sqlitePath:         filepath.Join(t.TempDir(), "history.db"),
+		sqliteRetention:    0,
+		sqliteRetention1m:  0,
+		sqliteRetention15m: 0,
+	} {
+		old := viper.Get(key)
+		viper.Set(key, v)
+		t.Cleanup(func() { viper.Set(key, old) })
+	}
+
+	// A reading every 30 seconds for the last 2 hours
+	end := time.Now().UTC().Truncate(15 * time.Minute)
+	start := end.Add(-2 * time.Hour)
+	mem := newHistoryBuffer([]historyTier{{0, 24 * time.Hour}})
+	var samples []sample
+	for at := start; at.Before(end); at = at.Add(30 * time.Second) {
+		r := reading{Time: at, Temperature: 21, Pressure: 101325, Humidity: 40}
+		mem.add(r)
+		samples = append(samples, sample{reading: r, Sensor: currentSensorJSON()})
+	}
+	s, err := openSQLite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.push(context.Background(), samples); err != nil {
+		t.Fatal(err)
+	}
+
+	last := end.Add(-30 * time.Second)
+	tests := []struct {
+		params      string
+		n           int
+		first, last time.Time
+	}{
+		// The latest ones, still oldest first
+		{"limit=3", 3, last.Add(-time.Minute), last},
+		{"", 240, start, last},
+		{"from=" + start.Format(time.RFC3339) + "&to=" + start.Add(time.Minute).Format(time.RFC3339) + "&limit=1", 1, start.Add(time.Minute), start.Add(time.Minute)},
+		{"step=15m&limit=2", 2, end.Add(-30 * time.Minute), end.Add(-15 * time.Minute)},
+	}
+	for name, query := range map[string]func(context.Context, historyQuery) ([]historyRow, error){
+		"sqlite": queryHistory,
+		"memory": func(ctx context.Context, hq historyQuery) ([]historyRow, error) { return mem.query(hq), nil },
+	} {
+		for _, tt := range tests {
+			times := historyTimes(t, query, tt.params)
+			if len(times) != tt.n || !times[0].Equal(tt.first) || !times[len(times)-1].Equal(tt.last) {
+				t.Errorf("%s: %q gave %d readings from %v to %v, want %d from %v to %v", name, tt.params, len(times), times[0], times[len(times)-1], tt.n, tt.first, tt.last)
+			}
+		}
+	}
+}
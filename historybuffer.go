@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The background poller's readings for the last while, kept in memory so
+// /api/v1/history has something to draw charts from without SQLite. There
+// can be averages for each minute and each 15 minutes too, kept for longer.
+
+type historyBuffer struct {
+	mu sync.Mutex
+	// Most detailed first, starting with every reading
+	tiers []*historyBufferTier
+}
+
+type historyBufferTier struct {
+	historyTier
+	// Oldest first
+	readings []reading
+
+	// The step that's still being averaged
+	bucket                          int64
+	temperature, pressure, humidity historyAgg
+}
+
+// Keep every reading for as long as the first tier says, and averages for
+// the others that have a retention
+func newHistoryBuffer(tiers []historyTier) *historyBuffer {
+	h := &historyBuffer{}
+	for i, t := range tiers {
+		if i == 0 || t.retention > 0 {
+			h.tiers = append(h.tiers, &historyBufferTier{historyTier: t})
+		}
+	}
+	return h
+}
+
+// Add a reading and forget any that are too old now, as a poller hook
+func (h *historyBuffer) add(r reading) {
+	if !r.ok() {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, t := range h.tiers {
+		if t.step == 0 {
+			t.readings = append(t.readings, r)
+		} else {
+			if b := r.Time.UnixMilli() / t.step.Milliseconds(); b != t.bucket {
+				if p, ok := t.partial(); ok {
+					t.readings = append(t.readings, p)
+				}
+				t.bucket = b
+				t.temperature, t.pressure, t.humidity = historyAgg{}, historyAgg{}, historyAgg{}
+			}
+			t.temperature.add(r.Temperature)
+			t.pressure.add(r.Pressure)
+			t.humidity.add(r.Humidity)
+		}
+		cutoff := r.Time.Add(-t.retention)
+		if i := sort.Search(len(t.readings), func(i int) bool { return !t.readings[i].Time.Before(cutoff) }); i > 0 {
+			t.readings = t.readings[i:]
+		}
+	}
+}
+
+// Each tier's readings by its step, for saving across restarts. The step
+// that's still being averaged isn't included.
+func (h *historyBuffer) saved() map[time.Duration][]reading {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	tiers := make(map[time.Duration][]reading)
+	for _, t := range h.tiers {
+		tiers[t.step] = append([]reading(nil), t.readings...)
+	}
+	return tiers
+}
+
+// Put back the readings saved from the tier with the same step, leaving out
+// any it would have forgotten by now, before there are any new ones
+func (h *historyBuffer) restore(step time.Duration, readings []reading) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, t := range h.tiers {
+		if t.step != step {
+			continue
+		}
+		cutoff := time.Now().Add(-t.retention)
+		t.readings = nil
+		for _, r := range readings {
+			if !r.Time.Before(cutoff) {
+				t.readings = append(t.readings, r)
+			}
+		}
+		return len(t.readings)
+	}
+	return 0
+}
+
+// The average so far for the step that isn't over yet
+func (t *historyBufferTier) partial() (reading, bool) {
+	if t.temperature.n+t.pressure.n+t.humidity.n == 0 {
+		return reading{}, false
+	}
+	return reading{
+		Time:        time.UnixMilli(t.bucket * t.step.Milliseconds()),
+		Temperature: t.temperature.mean(),
+		Pressure:    t.pressure.mean(),
+		Humidity:    t.humidity.mean(),
+	}, true
+}
+
+func (h *historyBuffer) query(hq historyQuery) []historyRow {
+	sensor := currentSensorJSON()
+	row := func(t time.Time, temperature, pressure, humidity *float64) historyRow {
+		return historyRow{
+			Time:        t.UnixMilli(),
+			Host:        sensor.Host,
+			Model:       sensor.Model,
+			Bus:         sensor.Bus,
+			Address:     sensor.Address,
+			Temperature: temperature,
+			Pressure:    pressure,
+			Humidity:    humidity,
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	tiers := make([]historyTier, len(h.tiers))
+	for i, t := range h.tiers {
+		tiers[i] = t.historyTier
+	}
+	t := h.tiers[pickHistoryTier(hq, tiers)]
+	readings := t.readings
+	if p, ok := t.partial(); ok {
+		readings = append(readings[:len(readings):len(readings)], p)
+	}
+
+	var rows []historyRow
+	var bucket int64
+	var temperature, pressure, humidity historyAgg
+	flush := func() {
+		if temperature.n+pressure.n+humidity.n > 0 {
+			rows = append(rows, row(time.UnixMilli(bucket*hq.step.Milliseconds()), temperature.value(hq.agg), pressure.value(hq.agg), humidity.value(hq.agg)))
+		}
+		temperature, pressure, humidity = historyAgg{}, historyAgg{}, historyAgg{}
+	}
+	for _, r := range readings {
+		if (!hq.from.IsZero() && r.Time.Before(hq.from)) || (!hq.to.IsZero() && r.Time.After(hq.to)) {
+			continue
+		}
+		if hq.step <= 0 {
+			rows = append(rows, row(r.Time, spoolValue(r.Temperature), spoolValue(r.Pressure), spoolValue(r.Humidity)))
+			continue
+		}
+		if b := r.Time.UnixMilli() / hq.step.Milliseconds(); b != bucket {
+			flush()
+			bucket = b
+		}
+		temperature.add(r.Temperature)
+		pressure.add(r.Pressure)
+		humidity.add(r.Humidity)
+	}
+	if hq.step > 0 {
+		flush()
+	}
+	if hq.limit > 0 && len(rows) > hq.limit {
+		rows = rows[len(rows)-hq.limit:]
+	}
+	return rows
+}
+
+// The readings of one value in a step
+type historyAgg struct {
+	sum, min, max float64
+	n             int
+}
+
+func (a *historyAgg) add(v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	if a.n == 0 || v < a.min {
+		a.min = v
+	}
+	if a.n == 0 || v > a.max {
+		a.max = v
+	}
+	a.sum += v
+	a.n++
+}
+
+// The average, or NaN if there were none
+func (a historyAgg) mean() float64 {
+	if a.n == 0 {
+		return math.NaN()
+	}
+	return a.sum / float64(a.n)
+}
+
+// The value for the step, avg, min, or max, or nil if there were none
+func (a historyAgg) value(agg string) *float64 {
+	if a.n == 0 {
+		return nil
+	}
+	v := a.mean()
+	switch agg {
+	case "min":
+		v = a.min
+	case "max":
+		v = a.max
+	}
+	return &v
+}
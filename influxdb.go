@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Writes readings to InfluxDB in line protocol, over HTTP to either the 1.x
+// or 2.x API, or over UDP. See
+// https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/
+
+// Keeps UDP packets under a typical MTU
+const influxUDPPacketSize = 1400
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "influxdb",
+		intervalKey: influxInterval,
+		enabled:     func() bool { return conf.GetString(influxURL) != "" },
+		open:        openInflux,
+		addresses:   func() []string { return urlAddress(conf.GetString(influxURL), "") },
+	})
+	configChecks = append(configChecks, checkInfluxSettings)
+}
+
+type influxSink struct {
+	measurement string
+	tags        map[string]string
+
+	// Where to POST for HTTP
+	writeURL  string
+	tokenFile string
+	client    *http.Client
+
+	// Or where to send packets for UDP
+	conn net.Conn
+}
+
+func openInflux() (sink, error) {
+	u, err := url.Parse(conf.GetString(influxURL))
+	if err != nil {
+		return nil, err
+	}
+	s := &influxSink{
+		measurement: conf.GetString(influxMeasurement),
+		tags:        conf.GetStringMapString(influxTags),
+	}
+	if u.Scheme == "udp" {
+		s.conn, err = net.Dial("udp", u.Host)
+		return s, err
+	}
+
+	// A bucket means 2.x, otherwise it's the 1.x API, which 2.x also
+	// has for compatibility
+	q := url.Values{"precision": {"ns"}}
+	if bucket := conf.GetString(influxBucket); bucket != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		q.Set("org", conf.GetString(influxOrg))
+		q.Set("bucket", bucket)
+		s.tokenFile = conf.GetString(influxTokenFile)
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		q.Set("db", conf.GetString(influxDatabase))
+		if rp := conf.GetString(influxRetentionPolicy); rp != "" {
+			q.Set("rp", rp)
+		}
+	}
+	u.RawQuery = q.Encode()
+	s.writeURL = u.String()
+	s.client = &http.Client{}
+	return s, nil
+}
+
+func (s *influxSink) push(ctx context.Context, samples []sample) error {
+	var lines [][]byte
+	for _, smp := range samples {
+		if line := s.line(smp); line != nil {
+			lines = append(lines, line)
+		}
+	}
+	if s.conn != nil {
+		return s.sendUDP(ctx, lines)
+	}
+	return s.post(ctx, bytes.Join(lines, nil))
+}
+
+// One line per reading, with every value as a field
+func (s *influxSink) line(smp sample) []byte {
+	values := smp.values()
+	if len(values) == 0 {
+		return nil
+	}
+	tags := smp.tags()
+	for k, v := range s.tags {
+		tags[k] = v
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	// Sorted tags are faster for InfluxDB to handle
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString(influxMeasurementEscaper.Replace(s.measurement))
+	for _, k := range keys {
+		// Empty tag values aren't allowed
+		if tags[k] != "" {
+			fmt.Fprintf(&b, ",%s=%s", influxEscaper.Replace(k), influxEscaper.Replace(tags[k]))
+		}
+	}
+	for i, v := range values {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		fmt.Fprintf(&b, "%s%s=%s", sep, influxEscaper.Replace(v.name), strconv.FormatFloat(v.value, 'f', -1, 64))
+	}
+	fmt.Fprintf(&b, " %d\n", smp.Time.UnixNano())
+	return b.Bytes()
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxEscaper            = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+func (s *influxSink) post(ctx context.Context, body []byte) error {
+	if len(body) == 0 {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.tokenFile != "" {
+		// Read each time so a rotated token gets picked up
+		token, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return fmt.Errorf("token: %w", err)
+		}
+		req.Header.Set("Authorization", "Token "+strings.TrimSpace(string(token)))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Send as few packets as possible without splitting a line. There's no
+// telling whether they arrived.
+func (s *influxSink) sendUDP(ctx context.Context, lines [][]byte) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+len(line) > influxUDPPacketSize {
+			if _, err := s.conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		_, err := s.conn.Write(packet)
+		return err
+	}
+	return nil
+}
+
+func (s *influxSink) close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+func checkInfluxSettings() []configProblem {
+	v := conf.GetString(influxURL)
+	if v == "" {
+		return nil
+	}
+	var problems []configProblem
+	u, err := url.Parse(v)
+	switch {
+	case err != nil || u.Host == "":
+		problems = append(problems, configError(influxURL, "invalid URL %q, use e.g. http://influxdb:8086 or udp://influxdb:8089", v))
+	case u.Scheme == "udp":
+		if conf.GetString(influxBucket) != "" || conf.GetString(influxDatabase) != "" {
+			problems = append(problems, configWarning(influxURL, "the database or bucket is set by InfluxDB's UDP listener, not here"))
+		}
+	case u.Scheme != "http" && u.Scheme != "https":
+		problems = append(problems, configError(influxURL, "unsupported scheme %q, use http, https or udp", u.Scheme))
+	case conf.GetString(influxBucket) != "":
+		if conf.GetString(influxOrg) == "" {
+			problems = append(problems, configError(influxOrg, "has to be set along with %s", influxBucket))
+		}
+		if f := conf.GetString(influxTokenFile); f == "" {
+			problems = append(problems, configError(influxTokenFile, "has to be set along with %s", influxBucket))
+		} else if _, err := os.Stat(f); err != nil {
+			problems = append(problems, configError(influxTokenFile, "%v", err))
+		}
+	case conf.GetString(influxDatabase) == "":
+		problems = append(problems, configError(influxDatabase, "has to be set for InfluxDB 1.x, or %s for 2.x", influxBucket))
+	}
+	if conf.GetString(influxMeasurement) == "" {
+		problems = append(problems, configError(influxMeasurement, "can't be empty"))
+	}
+	return problems
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Produces readings to a Kafka topic, as JSON or as Avro with its schema in a
+// Confluent schema registry. They're keyed by the sensor, so each sensor's
+// readings stay in order on one partition. Like the MQTT client, just enough
+// of the protocol is written out here, for Kafka 1.0 and later. See
+// https://kafka.apache.org/protocol
+
+// API keys, and the versions used
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 4
+)
+
+// The errors a producer is most likely to see, by code
+var kafkaErrors = map[int16]string{
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not the leader for the partition",
+	7:  "request timed out",
+	10: "message too large",
+	17: "invalid topic",
+	19: "not enough replicas",
+	20: "not enough replicas after append",
+	29: "not authorized for the topic",
+	31: "not authorized for the cluster",
+}
+
+func kafkaError(code int16) error {
+	if msg, ok := kafkaErrors[code]; ok {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("Kafka error code %d", code)
+}
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// The schema for Avro messages, which is what the JSON has in it
+const kafkaAvroSchema = `{"type":"record","name":"Reading","namespace":"com.github.jaevans.bme280","fields":[` +
+	`{"name":"time","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+	`{"name":"temperature","type":["null","double"],"default":null},` +
+	`{"name":"pressure","type":["null","double"],"default":null},` +
+	`{"name":"humidity","type":["null","double"],"default":null},` +
+	`{"name":"sensor","type":{"type":"record","name":"Sensor","fields":[` +
+	`{"name":"host","type":"string"},{"name":"model","type":"string"},{"name":"bus","type":"int"},{"name":"address","type":"string"}]}},` +
+	`{"name":"labels","type":{"type":"map","values":"string"},"default":{}}]}`
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "kafka",
+		intervalKey: kafkaInterval,
+		enabled:     func() bool { return len(conf.GetStringSlice(kafkaBrokers)) > 0 },
+		open:        openKafka,
+		addresses: func() []string {
+			var addresses []string
+			for _, b := range conf.GetStringSlice(kafkaBrokers) {
+				addresses = append(addresses, hostAddress(b, "")...)
+			}
+			return addresses
+		},
+	})
+	configChecks = append(configChecks, checkKafkaSettings)
+}
+
+type kafkaSink struct {
+	bootstrap []string
+	topic     string
+	// Avro if there's a schema registry, otherwise JSON
+	registry string
+	schemaID int32
+	client   *http.Client
+
+	// From the last metadata, which is forgotten when anything goes wrong
+	leaders []int32
+	brokers map[int32]string
+	conns   map[int32]*kafkaConn
+}
+
+type kafkaRecord struct {
+	key, value []byte
+	time       time.Time
+}
+
+func openKafka() (sink, error) {
+	s := &kafkaSink{
+		bootstrap: conf.GetStringSlice(kafkaBrokers),
+		topic:     conf.GetString(kafkaTopic),
+		schemaID:  -1,
+		client:    &http.Client{},
+		conns:     make(map[int32]*kafkaConn),
+	}
+	if conf.GetString(kafkaFormat) == "avro" {
+		s.registry = strings.TrimSuffix(conf.GetString(kafkaSchemaRegistry), "/")
+	}
+	return s, nil
+}
+
+func (s *kafkaSink) push(ctx context.Context, samples []sample) error {
+	err := s.produce(ctx, samples)
+	if err != nil {
+		// The leaders may well have moved, so start again next time
+		s.reset()
+	}
+	return err
+}
+
+func (s *kafkaSink) produce(ctx context.Context, samples []sample) error {
+	if s.leaders == nil {
+		if err := s.refresh(ctx); err != nil {
+			return err
+		}
+	}
+	if s.registry != "" && s.schemaID < 0 {
+		if err := s.registerSchema(ctx); err != nil {
+			return fmt.Errorf("registering the schema: %w", err)
+		}
+	}
+
+	// The same partition the Java client would pick for the key
+	batches := make(map[int32][]kafkaRecord)
+	var partitions []int32
+	for _, smp := range samples {
+		value, err := s.encode(smp)
+		if err != nil {
+			return err
+		}
+		key := []byte(fmt.Sprintf("%s/%d/%s", smp.Sensor.Host, smp.Sensor.Bus, smp.Sensor.Address))
+		p := (kafkaMurmur2(key) & 0x7fffffff) % int32(len(s.leaders))
+		if batches[p] == nil {
+			partitions = append(partitions, p)
+		}
+		batches[p] = append(batches[p], kafkaRecord{key: key, value: value, time: smp.Time})
+	}
+
+	for _, p := range partitions {
+		leader := s.leaders[p]
+		if leader < 0 {
+			return fmt.Errorf("partition %d of %s has no leader", p, s.topic)
+		}
+		c, err := s.conn(ctx, leader)
+		if err != nil {
+			return err
+		}
+		resp, err := c.roundTrip(ctx, kafkaProduce, kafkaProduceVersion, s.produceRequest(p, batches[p]))
+		if err != nil {
+			return err
+		}
+		if err := s.parseProduceResponse(p, resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the results in a produce response for the partition
+func (s *kafkaSink) parseProduceResponse(partition int32, resp []byte) error {
+	d := kafkaDecoder{b: resp}
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		d.string()
+		for n := d.int32(); n > 0 && d.err == nil; n-- {
+			d.int32()
+			code := d.int16()
+			d.int64()
+			d.int64()
+			if d.err == nil && code != 0 {
+				return fmt.Errorf("producing to partition %d of %s: %w", partition, s.topic, kafkaError(code))
+			}
+		}
+	}
+	return d.err
+}
+
+func (s *kafkaSink) encode(smp sample) ([]byte, error) {
+	if s.registry == "" {
+		return json.Marshal(smp.json())
+	}
+
+	// The Confluent wire format, a zero and the schema's ID before the Avro
+	b := binary.BigEndian.AppendUint32([]byte{0}, uint32(s.schemaID))
+	b = appendZigZag(b, smp.Time.UnixMilli())
+	for _, v := range []float64{smp.Temperature, smp.Pressure, smp.Humidity} {
+		if math.IsNaN(v) {
+			b = appendZigZag(b, 0)
+			continue
+		}
+		b = appendZigZag(b, 1)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	b = appendAvroString(b, smp.Sensor.Host)
+	b = appendAvroString(b, smp.Sensor.Model)
+	b = appendZigZag(b, int64(smp.Sensor.Bus))
+	b = appendAvroString(b, smp.Sensor.Address)
+	if len(smp.Labels) > 0 {
+		b = appendZigZag(b, int64(len(smp.Labels)))
+		for k, v := range smp.Labels {
+			b = appendAvroString(b, k)
+			b = appendAvroString(b, v)
+		}
+	}
+	return appendZigZag(b, 0), nil
+}
+
+func appendZigZag(b []byte, v int64) []byte {
+	return protowire.AppendVarint(b, protowire.EncodeZigZag(v))
+}
+
+func appendAvroString(b []byte, s string) []byte {
+	return append(appendZigZag(b, int64(len(s))), s...)
+}
+
+// Register the schema under <topic>-value, which gives back its ID, or just
+// its ID if it's already there
+func (s *kafkaSink) registerSchema(ctx context.Context) error {
+	body, err := json.Marshal(map[string]string{"schema": kafkaAvroSchema})
+	if err != nil {
+		return err
+	}
+	u := s.registry + "/subjects/" + url.PathEscape(s.topic+"-value") + "/versions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		ID      int32  `json:"id"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, result.Message)
+	}
+	s.schemaID = result.ID
+	return nil
+}
+
+// Find the leader for each of the topic's partitions, from whichever of the
+// brokers answers first
+func (s *kafkaSink) refresh(ctx context.Context) error {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, s.topic)
+	// Let the broker create the topic, if it's set up to
+	body = append(body, 1)
+
+	var errs []error
+	for _, address := range s.bootstrap {
+		c, err := dialKafka(ctx, address)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp, err := c.roundTrip(ctx, kafkaMetadata, kafkaMetadataVersion, body)
+		c.conn.Close()
+		if err == nil {
+			err = s.parseMetadata(resp)
+		}
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", address, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *kafkaSink) parseMetadata(resp []byte) error {
+	d := kafkaDecoder{b: resp}
+	d.int32()
+	brokers := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string()
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string()
+	d.int32()
+
+	var leaders []int32
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code := d.int16()
+		name := d.string()
+		d.int8()
+		partitions := d.int32()
+		if d.err == nil && name == s.topic && code != 0 {
+			return fmt.Errorf("topic %s: %w", s.topic, kafkaError(code))
+		}
+		if partitions > 0 && partitions < 1<<16 {
+			leaders = make([]int32, partitions)
+		}
+		for ; partitions > 0 && d.err == nil; partitions-- {
+			d.int16()
+			index := d.int32()
+			leader := d.int32()
+			d.skipInt32s()
+			d.skipInt32s()
+			if name == s.topic && index >= 0 && int(index) < len(leaders) {
+				leaders[index] = leader
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("no partitions for topic %s", s.topic)
+	}
+	s.leaders = leaders
+	s.brokers = brokers
+	return nil
+}
+
+func (s *kafkaSink) conn(ctx context.Context, node int32) (*kafkaConn, error) {
+	if c, ok := s.conns[node]; ok {
+		return c, nil
+	}
+	address, ok := s.brokers[node]
+	if !ok {
+		return nil, fmt.Errorf("no address for broker %d", node)
+	}
+	c, err := dialKafka(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	s.conns[node] = c
+	return c, nil
+}
+
+func (s *kafkaSink) reset() {
+	for node, c := range s.conns {
+		c.conn.Close()
+		delete(s.conns, node)
+	}
+	s.leaders = nil
+}
+
+// A produce request for one partition, waiting for all the in-sync replicas
+func (s *kafkaSink) produceRequest(partition int32, records []kafkaRecord) []byte {
+	var b []byte
+	// No transactional ID
+	b = binary.BigEndian.AppendUint16(b, 0xffff)
+	b = binary.BigEndian.AppendUint16(b, 0xffff)
+	b = binary.BigEndian.AppendUint32(b, uint32(conf.GetDuration(sinkTimeout).Milliseconds()))
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = appendKafkaString(b, s.topic)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint32(b, uint32(partition))
+	batch := kafkaRecordBatch(records)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(batch)))
+	return append(b, batch...)
+}
+
+// A version 2 record batch, the format since Kafka 0.11
+func kafkaRecordBatch(records []kafkaRecord) []byte {
+	first := records[0].time.UnixMilli()
+	last := first
+	var recs []byte
+	for i, r := range records {
+		ts := r.time.UnixMilli()
+		last = max(last, ts)
+		var rec []byte
+		rec = append(rec, 0)
+		rec = appendZigZag(rec, ts-first)
+		rec = appendZigZag(rec, int64(i))
+		rec = appendZigZag(rec, int64(len(r.key)))
+		rec = append(rec, r.key...)
+		rec = appendZigZag(rec, int64(len(r.value)))
+		rec = append(rec, r.value...)
+		// No headers
+		rec = appendZigZag(rec, 0)
+		recs = appendZigZag(recs, int64(len(rec)))
+		recs = append(recs, rec...)
+	}
+
+	// Everything after the CRC, which it covers
+	var b []byte
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(records)-1))
+	b = binary.BigEndian.AppendUint64(b, uint64(first))
+	b = binary.BigEndian.AppendUint64(b, uint64(last))
+	// Not idempotent or transactional, so no producer ID, epoch or sequence
+	b = binary.BigEndian.AppendUint64(b, math.MaxUint64)
+	b = binary.BigEndian.AppendUint16(b, 0xffff)
+	b = binary.BigEndian.AppendUint32(b, math.MaxUint32)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(records)))
+	b = append(b, recs...)
+
+	var batch []byte
+	batch = binary.BigEndian.AppendUint64(batch, 0)
+	// The length from the partition leader epoch on
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(b)))
+	batch = binary.BigEndian.AppendUint32(batch, math.MaxUint32)
+	batch = append(batch, 2)
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(b, kafkaCRCTable))
+	return append(batch, b...)
+}
+
+// Kafka's murmur2, which its clients use to pick a partition for a key
+func kafkaMurmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	n := len(data) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch tail := data[n:]; len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+func appendKafkaString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func (s *kafkaSink) close() error {
+	s.reset()
+	return nil
+}
+
+type kafkaConn struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	correlationID int32
+}
+
+func dialKafka(ctx context.Context, address string) (*kafkaConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Send a request and wait for its response, without the correlation ID
+func (c *kafkaConn) roundTrip(ctx context.Context, apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	c.correlationID++
+	b := make([]byte, 4, 4+10+len("bme280-exporter")+len(body))
+	b = binary.BigEndian.AppendUint16(b, uint16(apiKey))
+	b = binary.BigEndian.AppendUint16(b, uint16(apiVersion))
+	b = binary.BigEndian.AppendUint32(b, uint32(c.correlationID))
+	b = appendKafkaString(b, "bme280-exporter")
+	b = append(b, body...)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	} else {
+		c.conn.SetDeadline(time.Time{})
+	}
+	if _, err := c.conn.Write(b); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > 16<<20 {
+		return nil, fmt.Errorf("unexpected response size %d from Kafka", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	if id := int32(binary.BigEndian.Uint32(resp)); id != c.correlationID {
+		return nil, fmt.Errorf("response from Kafka for request %d rather than %d", id, c.correlationID)
+	}
+	return resp[4:], nil
+}
+
+// Reads a response, remembering the first time it came up short
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+var errKafkaShort = errors.New("response from Kafka is too short")
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil || n < 0 || len(d.b) < n {
+		d.err = errKafkaShort
+		return make([]byte, max(n, 0))
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8   { return int8(d.take(1)[0]) }
+func (d *kafkaDecoder) int16() int16 { return int16(binary.BigEndian.Uint16(d.take(2))) }
+func (d *kafkaDecoder) int32() int32 { return int32(binary.BigEndian.Uint32(d.take(4))) }
+func (d *kafkaDecoder) int64() int64 { return int64(binary.BigEndian.Uint64(d.take(8))) }
+
+// A string, or a nullable one, which is empty if it's null
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *kafkaDecoder) skipInt32s() {
+	n := d.int32()
+	if n > 0 {
+		d.take(int(n) * 4)
+	}
+}
+
+// Kafka's rules for topic names
+var kafkaTopicName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+func checkKafkaSettings() []configProblem {
+	var problems []configProblem
+	for _, b := range conf.GetStringSlice(kafkaBrokers) {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			problems = append(problems, configError(kafkaBrokers, "invalid broker %q, use host:port", b))
+		}
+	}
+	if t := conf.GetString(kafkaTopic); !kafkaTopicName.MatchString(t) || t == "." || t == ".." {
+		problems = append(problems, configError(kafkaTopic, "invalid topic %q", t))
+	}
+	switch f := conf.GetString(kafkaFormat); f {
+	case "json":
+	case "avro":
+		if u, err := url.Parse(conf.GetString(kafkaSchemaRegistry)); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, configError(kafkaSchemaRegistry, "needs to be the URL of the schema registry for Avro, e.g. http://schema-registry:8081"))
+		}
+	default:
+		problems = append(problems, configError(kafkaFormat, "unknown format %q, use json or avro", f))
+	}
+	return problems
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Two records with their CRC-32C worked out separately
+const kafkaTestBatch = `
+	0000000000000000 00000046 ffffffff 02 c9435f8b
+	0000 00000001 000001a14269f7c5 000001a14269fbad ffffffffffffffff ffff ffffffff 00000002
+	12 00 00 00 02 61 04 7b7d 00
+	14 00 d00f 02 04 6263 02 78 00`
+
+func kafkaTestRecords() []kafkaRecord {
+	first := time.UnixMilli(1792115603397)
+	return []kafkaRecord{
+		{key: []byte("a"), value: []byte("{}"), time: first},
+		{key: []byte("bc"), value: []byte("x"), time: first.Add(time.Second)},
+	}
+}
+
+func TestKafkaRecordBatch(t *testing.T) {
+	if got, want := kafkaRecordBatch(kafkaTestRecords()), unhex(t, kafkaTestBatch); !bytes.Equal(got, want) {
+		t.Errorf("got  % x\nwant % x", got, want)
+	}
+}
+
+func TestKafkaProduce(t *testing.T) {
+	old := viper.Get(sinkTimeout)
+	viper.Set(sinkTimeout, 10*time.Second)
+	t.Cleanup(func() { viper.Set(sinkTimeout, old) })
+	s := &kafkaSink{topic: "readings"}
+	batch := unhex(t, kafkaTestBatch)
+	want := unhex(t, `0000008d 0000 0003 00000001 000f 62 6d 65 32 38 30 2d 65 78 70 6f 72 74 65 72
+		ffff ffff 00002710 00000001 0008 72 65 61 64 69 6e 67 73 00000001 00000002 00000052`)
+	want = append(want, batch...)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(server, got); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("request is\n% x\nwant\n% x", got, want)
+			return
+		}
+		// Offset 42, no log append time, and no throttling
+		server.Write(unhex(t, `00000030 00000001 00000001 0008 72 65 61 64 69 6e 67 73
+			00000001 00000002 0000 000000000000002a ffffffffffffffff 00000000`))
+	}()
+	c := &kafkaConn{conn: client, r: bufio.NewReader(client)}
+	resp, err := c.roundTrip(context.Background(), kafkaProduce, kafkaProduceVersion, s.produceRequest(2, kafkaTestRecords()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.parseProduceResponse(2, resp); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKafkaProduceResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		want string
+	}{
+		{
+			name: "written",
+			resp: "00000001 0008 72 65 61 64 69 6e 67 73 00000001 00000000 0000 000000000000002a ffffffffffffffff 00000000",
+		},
+		{
+			name: "not the leader",
+			resp: "00000001 0008 72 65 61 64 69 6e 67 73 00000001 00000000 0006 ffffffffffffffff ffffffffffffffff 00000000",
+			want: "producing to partition 0 of readings: not the leader for the partition",
+		},
+		{
+			name: "not enough replicas",
+			resp: "00000001 0008 72 65 61 64 69 6e 67 73 00000001 00000000 0013 ffffffffffffffff ffffffffffffffff 00000000",
+			want: "producing to partition 0 of readings: not enough replicas",
+		},
+		{
+			name: "unknown error",
+			resp: "00000001 0008 72 65 61 64 69 6e 67 73 00000001 00000000 0057 ffffffffffffffff ffffffffffffffff 00000000",
+			want: "producing to partition 0 of readings: Kafka error code 87",
+		},
+		{
+			name: "truncated",
+			resp: "00000001 0008 72 65 61 64 69 6e 67 73 00000001 00000000 00",
+			want: errKafkaShort.Error(),
+		},
+		{
+			name: "more partitions than there are",
+			resp: "00000001 0008 72 65 61 64 69 6e 67 73 7fffffff",
+			want: errKafkaShort.Error(),
+		},
+	}
+	s := &kafkaSink{topic: "readings"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.parseProduceResponse(0, unhex(t, tt.resp))
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("got %v", err)
+			case tt.want != "" && (err == nil || err.Error() != tt.want):
+				t.Errorf("got %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
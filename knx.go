@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Writes readings to KNX group addresses, through a KNXnet/IP interface's
+// tunnel or as a router on the multicast group, with the values in the
+// datapoint types KNX devices expect. Only the latest reading's sent, since
+// the bus only cares about the current value. See the KNX standard's
+// volume 3, part 8 for KNXnet/IP, and part 7.2 for the datapoint types.
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "knx",
+		intervalKey: knxInterval,
+		enabled: func() bool {
+			return len(conf.GetStringMapString(knxGroupAddresses)) > 0 && (conf.GetString(knxGateway) != "" || conf.GetBool(knxRouting))
+		},
+		open: openKNX,
+	})
+	configChecks = append(configChecks, checkKNXSettings)
+}
+
+// KNXnet/IP services
+const (
+	knxConnectRequest       = 0x0205
+	knxConnectResponse      = 0x0206
+	knxDisconnectRequest    = 0x0209
+	knxDisconnectResponse   = 0x020a
+	knxTunnellingRequest    = 0x0420
+	knxTunnellingAck        = 0x0421
+	knxRoutingIndication    = 0x0530
+	knxDefaultPort          = "3671"
+	knxDefaultMulticastAddr = "224.0.23.12:3671"
+)
+
+// cEMI message codes
+const (
+	knxLDataReq = 0x11
+	knxLDataCon = 0x2e
+	knxLDataInd = 0x29
+)
+
+// Where a metric goes, and how it's encoded
+type knxDatapoint struct {
+	metric string
+	group  uint16
+	dpt    string
+}
+
+// What each metric is sent as when it's not given
+var knxDefaultDPTs = map[string]string{
+	temperatureMetric: "9.001",
+	pressureMetric:    "14.058",
+	humidityMetric:    "9.007",
+}
+
+type knxSink struct {
+	gateway    string
+	multicast  string
+	routing    bool
+	source     uint16
+	datapoints []knxDatapoint
+}
+
+func openKNX() (sink, error) {
+	points, err := knxDatapoints()
+	if err != nil {
+		return nil, err
+	}
+	s := &knxSink{
+		gateway:    conf.GetString(knxGateway),
+		multicast:  conf.GetString(knxMulticastAddress),
+		routing:    conf.GetBool(knxRouting),
+		datapoints: points,
+	}
+	if _, _, err := net.SplitHostPort(s.gateway); err != nil && s.gateway != "" {
+		s.gateway = net.JoinHostPort(s.gateway, knxDefaultPort)
+	}
+	if s.source, err = parseKNXIndividualAddress(conf.GetString(knxIndividualAddress)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Parse the group addresses, like temperature=1/2/3 or temperature=1/2/3:9.001
+func knxDatapoints() ([]knxDatapoint, error) {
+	var points []knxDatapoint
+	for metric, spec := range conf.GetStringMapString(knxGroupAddresses) {
+		if metric != temperatureMetric && metric != pressureMetric && metric != humidityMetric {
+			return nil, fmt.Errorf("unknown metric %q, use temperature, pressure or humidity", metric)
+		}
+		addr, dpt, ok := strings.Cut(spec, ":")
+		if !ok {
+			dpt = knxDefaultDPTs[metric]
+		}
+		group, err := parseKNXGroupAddress(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", metric, err)
+		}
+		if _, err := knxEncode(dpt, 0); err != nil {
+			return nil, fmt.Errorf("%s: %w", metric, err)
+		}
+		points = append(points, knxDatapoint{metric, group, dpt})
+	}
+	return points, nil
+}
+
+// Group addresses in three levels (main/middle/sub), two (main/sub), or as a number
+func parseKNXGroupAddress(s string) (uint16, error) {
+	parts := strings.Split(s, "/")
+	var bits []int
+	switch len(parts) {
+	case 1:
+		bits = []int{16}
+	case 2:
+		bits = []int{5, 11}
+	case 3:
+		bits = []int{5, 3, 8}
+	default:
+		return 0, fmt.Errorf("invalid group address %q", s)
+	}
+	var addr uint16
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, bits[i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid group address %q", s)
+		}
+		addr = addr<<bits[i] | uint16(n)
+	}
+	if addr == 0 {
+		return 0, fmt.Errorf("invalid group address %q, 0/0/0 is the broadcast address", s)
+	}
+	return addr, nil
+}
+
+// Individual addresses, area.line.device
+func parseKNXIndividualAddress(s string) (uint16, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid individual address %q, use e.g. 15.15.250", s)
+	}
+	var addr uint16
+	for i, bits := range []int{4, 4, 8} {
+		n, err := strconv.ParseUint(parts[i], 10, bits)
+		if err != nil {
+			return 0, fmt.Errorf("invalid individual address %q, use e.g. 15.15.250", s)
+		}
+		addr = addr<<bits | uint16(n)
+	}
+	return addr, nil
+}
+
+// A value in a datapoint type: 2-byte floats (9.xxx), 4-byte floats
+// (14.xxx), or a percentage scaled to a byte (5.001)
+func knxEncode(dpt string, v float64) ([]byte, error) {
+	kind, _, _ := strings.Cut(dpt, ".")
+	switch {
+	case kind == "9":
+		// 0.01 × mantissa × 2^exponent, with an 11-bit mantissa plus sign
+		// and a 4-bit exponent
+		for e := 0; e < 16; e++ {
+			m := math.Round(v * 100 / float64(int(1)<<e))
+			// 0x7fff means invalid, so the largest mantissa with the
+			// largest exponent is out too
+			if m >= -2048 && m <= 2047 && !(e == 15 && m == 2047) {
+				raw := uint16(e)<<11 | uint16(int16(m))&0x7ff
+				if m < 0 {
+					raw |= 0x8000
+				}
+				return binary.BigEndian.AppendUint16(nil, raw), nil
+			}
+		}
+		return nil, fmt.Errorf("%g is out of range for DPT %s", v, dpt)
+	case kind == "14":
+		return binary.BigEndian.AppendUint32(nil, math.Float32bits(float32(v))), nil
+	case dpt == "5.001":
+		return []byte{byte(math.Round(min(max(v, 0), 100) * 255 / 100))}, nil
+	}
+	return nil, fmt.Errorf("unsupported datapoint type %q, use 9.xxx, 14.xxx or 5.001", dpt)
+}
+
+// A cEMI L_Data frame writing a value to a group address
+func knxGroupWrite(code byte, source, group uint16, data []byte) []byte {
+	// Standard frame, not repeated, normal broadcast, low priority; a group
+	// address with a hop count of 6
+	frame := []byte{code, 0, 0xbc, 0xe0}
+	frame = binary.BigEndian.AppendUint16(frame, source)
+	frame = binary.BigEndian.AppendUint16(frame, group)
+	// The length counts the APCI byte, then A_GroupValue_Write. Values of 6
+	// bits or less would go in the APCI, but none of ours are that small.
+	frame = append(frame, byte(len(data)+1), 0x00, 0x80)
+	return append(frame, data...)
+}
+
+func knxPacket(service uint16, body ...[]byte) []byte {
+	b := []byte{0x06, 0x10}
+	b = binary.BigEndian.AppendUint16(b, service)
+	length := 6
+	for _, part := range body {
+		length += len(part)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(length))
+	for _, part := range body {
+		b = append(b, part...)
+	}
+	return b
+}
+
+func (s *knxSink) push(ctx context.Context, samples []sample) error {
+	latest := samples[len(samples)-1]
+	var frames [][]byte
+	for _, point := range s.datapoints {
+		for _, v := range latest.values() {
+			if v.name != point.metric {
+				continue
+			}
+			data, err := knxEncode(point.dpt, v.value)
+			if err != nil {
+				lg.Warnf("Not sending %s to KNX: %v", v.name, err)
+				continue
+			}
+			frames = append(frames, knxGroupWrite(knxLDataReq, 0, point.group, data))
+		}
+	}
+	if len(frames) == 0 {
+		return nil
+	}
+	if s.routing {
+		return s.route(ctx, frames)
+	}
+	return s.tunnel(ctx, frames)
+}
+
+// Routing just multicasts the frames, with our own individual address
+func (s *knxSink) route(ctx context.Context, frames [][]byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp4", s.multicast)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, frame := range frames {
+		frame[0] = knxLDataInd
+		binary.BigEndian.PutUint16(frame[4:], s.source)
+		if _, err := conn.Write(knxPacket(knxRoutingIndication, frame)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tunnelling connects to the interface, sends each frame and waits for the
+// interface to ack it and confirm it went on the bus, then disconnects
+func (s *knxSink) tunnel(ctx context.Context, frames [][]byte) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp4", s.gateway)
+	if err != nil {
+		return err
+	}
+	conn := c.(*net.UDPConn)
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// An HPAI of 0.0.0.0:0 asks the interface to answer wherever the request
+	// came from, which works through NAT
+	hpai := []byte{0x08, 0x01, 0, 0, 0, 0, 0, 0}
+	// A tunnel connection on the link layer
+	cri := []byte{0x04, 0x04, 0x02, 0x00}
+	if _, err := conn.Write(knxPacket(knxConnectRequest, hpai, hpai, cri)); err != nil {
+		return err
+	}
+	resp, err := knxRead(conn, knxConnectResponse)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 2 {
+		return errors.New("truncated connect response")
+	}
+	if resp[1] != 0 {
+		return fmt.Errorf("the KNX interface turned down the connection: %s", knxStatus(resp[1]))
+	}
+	channel := resp[0]
+	defer func() {
+		conn.Write(knxPacket(knxDisconnectRequest, []byte{channel, 0}, hpai))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		knxRead(conn, knxDisconnectResponse)
+	}()
+
+	for seq, frame := range frames {
+		header := []byte{0x04, channel, byte(seq), 0}
+		req := knxPacket(knxTunnellingRequest, header, frame)
+		acked, confirmed := false, false
+		// The interface gets one more go if the ack doesn't come within a second
+		for attempt := 0; !acked && attempt < 2; attempt++ {
+			if _, err := conn.Write(req); err != nil {
+				return err
+			}
+			if acked, confirmed, err = s.awaitAck(ctx, conn, channel, byte(seq)); err != nil {
+				return err
+			}
+		}
+		if !acked {
+			return errors.New("the KNX interface didn't ack the tunnelling request")
+		}
+		if !confirmed {
+			return fmt.Errorf("the KNX interface didn't confirm the write to %s", knxGroupString(binary.BigEndian.Uint16(frame[6:])))
+		}
+	}
+	return nil
+}
+
+// Wait for the ack and the confirmation of a frame, acking whatever the
+// interface sends our way meanwhile
+func (s *knxSink) awaitAck(ctx context.Context, conn *net.UDPConn, channel, seq byte) (bool, bool, error) {
+	acked := false
+	ackBy := time.Now().Add(time.Second)
+	confirmBy := time.Now().Add(3 * time.Second)
+	buf := make([]byte, 512)
+	for {
+		by := confirmBy
+		if !acked {
+			by = ackBy
+		}
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(by) {
+			by = deadline
+		}
+		conn.SetReadDeadline(by)
+		n, err := conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && ctx.Err() == nil {
+				return acked, false, nil
+			}
+			return acked, false, err
+		}
+		msg := buf[:n]
+		if len(msg) < 10 || msg[0] != 0x06 || msg[1] != 0x10 {
+			continue
+		}
+		service, body := binary.BigEndian.Uint16(msg[2:]), msg[6:]
+		if body[1] != channel {
+			continue
+		}
+		switch service {
+		case knxTunnellingAck:
+			if body[2] == seq {
+				if body[3] != 0 {
+					return false, false, fmt.Errorf("the KNX interface turned down the tunnelling request: %s", knxStatus(body[3]))
+				}
+				acked = true
+			}
+		case knxTunnellingRequest:
+			conn.Write(knxPacket(knxTunnellingAck, []byte{0x04, channel, body[2], 0}))
+			// The confirmation's L_Data.con, with the confirm bit set if it failed
+			cemi := body[4:]
+			if len(cemi) > 2 && cemi[0] == knxLDataCon && len(cemi) > 2+int(cemi[1]) {
+				ctrl := cemi[2+int(cemi[1])]
+				return acked, ctrl&0x01 == 0, nil
+			}
+		}
+	}
+}
+
+// Read packets until one of the given service comes
+func knxRead(conn *net.UDPConn, service uint16) ([]byte, error) {
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 6 && buf[0] == 0x06 && binary.BigEndian.Uint16(buf[2:]) == service {
+			return append([]byte{}, buf[6:n]...), nil
+		}
+	}
+}
+
+func knxStatus(code byte) string {
+	switch code {
+	case 0x22:
+		return "connection type not supported"
+	case 0x23:
+		return "connection option not supported"
+	case 0x24:
+		return "no more connections, all its tunnels are in use"
+	case 0x29:
+		return "tunnelling layer not supported"
+	}
+	return fmt.Sprintf("error 0x%02x", code)
+}
+
+func knxGroupString(addr uint16) string {
+	return fmt.Sprintf("%d/%d/%d", addr>>11, addr>>8&0x7, addr&0xff)
+}
+
+func (s *knxSink) close() error {
+	return nil
+}
+
+func checkKNXSettings() []configProblem {
+	if len(conf.GetStringMapString(knxGroupAddresses)) == 0 {
+		return nil
+	}
+	var problems []configProblem
+	if _, err := knxDatapoints(); err != nil {
+		problems = append(problems, configError(knxGroupAddresses, "%v", err))
+	}
+	gateway, routing := conf.GetString(knxGateway), conf.GetBool(knxRouting)
+	switch {
+	case gateway == "" && !routing:
+		problems = append(problems, configWarning(knxGroupAddresses, "nothing's sent without %s or %s", knxGateway, knxRouting))
+	case gateway != "" && routing:
+		problems = append(problems, configWarning(knxGateway, "isn't used with %s", knxRouting))
+	}
+	if routing {
+		if _, err := parseKNXIndividualAddress(conf.GetString(knxIndividualAddress)); err != nil {
+			problems = append(problems, configError(knxIndividualAddress, "%v", err))
+		}
+	}
+	return problems
+}
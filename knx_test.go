@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKNXEncode(t *testing.T) {
+	tests := []struct {
+		dpt  string
+		v    float64
+		want string
+	}{
+		{"9.001", 0, "0000"},
+		{"9.001", 20.47, "07ff"},
+		{"9.001", 21.5, "0c33"},
+		{"9.001", -1, "879c"},
+		{"9.001", -20.48, "8000"},
+		{"9.001", -30, "8a24"},
+		{"9.007", 45.2, "146a"},
+		// The largest and smallest there are, as 0x7fff means invalid
+		{"9.001", 670433.28, "7ffe"},
+		{"9.001", -671088.64, "f800"},
+		{"14.058", 1013.25, "447d5000"},
+		{"14.058", 101325, "47c5e680"},
+		{"14.058", -40.5, "c2220000"},
+		{"5.001", 0, "00"},
+		{"5.001", 50, "80"},
+		{"5.001", 100, "ff"},
+		{"5.001", -5, "00"},
+		{"5.001", 150, "ff"},
+	}
+	for _, tt := range tests {
+		got, err := knxEncode(tt.dpt, tt.v)
+		if err != nil {
+			t.Errorf("knxEncode(%q, %g): %v", tt.dpt, tt.v, err)
+			continue
+		}
+		if want := unhex(t, tt.want); !bytes.Equal(got, want) {
+			t.Errorf("knxEncode(%q, %g) = % x, want % x", tt.dpt, tt.v, got, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		dpt string
+		v   float64
+	}{
+		{"9.001", 670760.96},
+		{"9.001", 1e6},
+		{"9.001", -680000},
+		{"9.001", math.NaN()},
+		{"9.001", math.Inf(1)},
+		{"9.001", math.Inf(-1)},
+		{"1.001", 1},
+		{"5.004", 1},
+		{"", 1},
+	} {
+		if got, err := knxEncode(tt.dpt, tt.v); err == nil {
+			t.Errorf("knxEncode(%q, %g) = % x, want an error", tt.dpt, tt.v, got)
+		}
+	}
+}
+
+func TestParseKNXGroupAddress(t *testing.T) {
+	for s, want := range map[string]uint16{
+		"1/2/3":    0x0a03,
+		"1/515":    0x0a03,
+		"2563":     0x0a03,
+		"31/7/255": 0xffff,
+		"0/0/1":    0x0001,
+	} {
+		if got, err := parseKNXGroupAddress(s); err != nil || got != want {
+			t.Errorf("parseKNXGroupAddress(%q) = %04x, %v, want %04x", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "0/0/0", "0", "32/0/0", "1/8/0", "1/2/256", "1/2048", "1/2/3/4", "1.2.3", "a/b/c"} {
+		if got, err := parseKNXGroupAddress(s); err == nil {
+			t.Errorf("parseKNXGroupAddress(%q) = %04x, want an error", s, got)
+		}
+	}
+}
+
+func TestKNXRouting(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := &knxSink{
+		multicast: conn.LocalAddr().String(),
+		routing:   true,
+		source:    0x11fa,
+		datapoints: []knxDatapoint{
+			{temperatureMetric, 0x0a03, "9.001"},
+			{pressureMetric, 0x0a04, "14.058"},
+			{humidityMetric, 0x0a05, "5.001"},
+			// Out of range, so it's left out
+			{pressureMetric, 0x0a06, "9.001"},
+		},
+	}
+	samples := []sample{
+		{reading: reading{Temperature: 30, Pressure: 1000, Humidity: 10}},
+		{reading: reading{Temperature: 21.5, Pressure: 1013250, Humidity: 50}},
+	}
+	if err := s.push(context.Background(), samples); err != nil {
+		t.Fatal(err)
+	}
+
+	// Routing indications from 1.1.250 with an L_Data.ind for each group
+	// write, of the latest reading only
+	want := []string{
+		"0610 0530 0013 29 00 bce0 11fa 0a03 03 0080 0c33",
+		"0610 0530 0015 29 00 bce0 11fa 0a04 05 0080 49776020",
+		"0610 0530 0012 29 00 bce0 11fa 0a05 02 0080 80",
+	}
+	buf := make([]byte, 512)
+	for _, w := range want {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := unhex(t, w); !bytes.Equal(buf[:n], want) {
+			t.Errorf("sent % x, want % x", buf[:n], want)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _, err := conn.ReadFrom(buf); err == nil {
+		t.Errorf("sent % x as well", buf[:n])
+	}
+}
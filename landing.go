@@ -0,0 +1,79 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// A page for people who open the exporter in a browser, with links to what it
+// serves and the recent events. Prometheus and curl don't ask for HTML, so
+// they still get the metrics at /, as does everything at any other path.
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>BME280 Exporter on {{.Host}}</title>
+  <link rel="stylesheet" href="dashboard/dashboard.css">
+</head>
+<body>
+  <header>
+    <h1>BME280 Exporter on {{.Host}}</h1>
+  </header>
+  <section class="card">
+    <ul>
+      <li><a href="metrics">Metrics</a></li>
+      <li><a href="dashboard/">Dashboard</a></li>
+      <li><a href="debug/events">Events</a> (JSON)</li>
+      <li><a href="api/v1/readings">Readings</a> (JSON)</li>
+      <li><a href="grafana/dashboard.json">Grafana dashboard</a></li>
+      <li><a href="-/ready">Readiness</a></li>
+{{- if .Pprof}}
+      <li><a href="debug/pprof/">Profiling</a></li>
+{{- end}}
+    </ul>
+  </section>
+  <section class="card events">
+    <h2>Recent events</h2>
+    <ul>
+{{- range .Events}}
+      <li><time datetime="{{.Time.Format "2006-01-02T15:04:05Z07:00"}}">{{.Time.Format "2006-01-02 15:04:05 MST"}}</time>{{.Message}}</li>
+{{- else}}
+      <li>Nothing yet</li>
+{{- end}}
+    </ul>
+  </section>
+  <footer>
+    <span>{{.Version}}</span>
+  </footer>
+</body>
+</html>
+`))
+
+// How many of the events the page shows, newest first, like the dashboard
+const landingEvents = 20
+
+func landingHandler(metrics http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+			metrics.ServeHTTP(w, r)
+			return
+		}
+		recent := recentEvents()
+		var shown []event
+		for i := len(recent) - 1; i >= 0 && len(shown) < landingEvents; i-- {
+			shown = append(shown, recent[i])
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := landingTemplate.Execute(w, struct {
+			Host, Version string
+			Pprof         bool
+			Events        []event
+		}{hostname, version, conf.GetBool(enablePprof), shown})
+		if err != nil {
+			lg.Warnf("Problem writing the landing page: %v", err)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLandingPage(t *testing.T) {
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("bme280_up 1\n"))
+	})
+	recordEvent("sensor", "Reading <failed>")
+	h := landingHandler(metrics)
+
+	tests := []struct {
+		path, accept string
+		html         bool
+	}{
+		{"/", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", true},
+		{"/", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", false},
+		{"/", "*/*", false},
+		{"/", "", false},
+		{"/metrics", "text/html", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Accept", tt.accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		body := rec.Body.String()
+		if !tt.html {
+			if body != "bme280_up 1\n" {
+				t.Errorf("%s with Accept %q got %q, want the metrics", tt.path, tt.accept, body)
+			}
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("Content-Type %q, want HTML", ct)
+		}
+		for _, want := range []string{`<a href="metrics">`, `<a href="debug/events">`, "Reading &lt;failed&gt;</li>"} {
+			if !strings.Contains(body, want) {
+				t.Errorf("landing page doesn't have %q:\n%s", want, body)
+			}
+		}
+	}
+}
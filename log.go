@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	d2r2 "github.com/d2r2/go-logger"
+)
+
+// Logging goes through log/slog, as text for people or JSON for log
+// collectors. The printf-style methods keep call sites short, and With adds
+// fields like the sensor's bus and address.
+
+const levelFatal = slog.Level(12)
+
+type logger struct {
+	l *slog.Logger
+}
+
+func init() {
+	configChecks = append(configChecks, checkLogSettings)
+}
+
+func newLogger(w io.Writer, format string, level slog.Leveler) logger {
+	opts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && a.Value.Any() == levelFatal {
+				a.Value = slog.StringValue("FATAL")
+			}
+			return a
+		},
+	}
+	if format == "json" {
+		return logger{slog.New(slog.NewJSONHandler(w, opts))}
+	}
+	return logger{slog.New(slog.NewTextHandler(w, opts))}
+}
+
+// A logger that adds these fields to everything it logs
+func (lg logger) With(args ...interface{}) logger {
+	return logger{lg.l.With(args...)}
+}
+
+func (lg logger) log(level slog.Level, msg func() string) {
+	ctx := context.Background()
+	if !lg.l.Enabled(ctx, level) {
+		return
+	}
+	// Report where we were called from rather than here
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+	r := slog.NewRecord(time.Now(), level, msg(), pcs[0])
+	lg.l.Handler().Handle(ctx, r)
+}
+
+func (lg logger) Debugf(format string, args ...interface{}) {
+	lg.log(slog.LevelDebug, func() string { return fmt.Sprintf(format, args...) })
+}
+
+func (lg logger) Infof(format string, args ...interface{}) {
+	lg.log(slog.LevelInfo, func() string { return fmt.Sprintf(format, args...) })
+}
+
+func (lg logger) Info(args ...interface{}) {
+	lg.log(slog.LevelInfo, func() string { return fmt.Sprint(args...) })
+}
+
+func (lg logger) Warnf(format string, args ...interface{}) {
+	lg.log(slog.LevelWarn, func() string { return fmt.Sprintf(format, args...) })
+}
+
+func (lg logger) Warn(args ...interface{}) {
+	lg.log(slog.LevelWarn, func() string { return fmt.Sprint(args...) })
+}
+
+func (lg logger) Errorf(format string, args ...interface{}) {
+	lg.log(slog.LevelError, func() string { return fmt.Sprintf(format, args...) })
+}
+
+func (lg logger) Error(args ...interface{}) {
+	lg.log(slog.LevelError, func() string { return fmt.Sprint(args...) })
+}
+
+// Log and exit
+func (lg logger) Fatal(args ...interface{}) {
+	lg.log(levelFatal, func() string { return fmt.Sprint(args...) })
+	os.Exit(1)
+}
+
+// Fields identifying a sensor, the same everywhere so logs can be filtered
+// on them. The name is left out if it isn't known.
+func sensorFields(name string, bus int, addr uint8) []interface{} {
+	fields := []interface{}{"bus", bus, "address", formatI2CAddress(addr)}
+	if name != "" {
+		fields = append([]interface{}{"sensor", name}, fields...)
+	}
+	return fields
+}
+
+func checkLogSettings() []configProblem {
+	var problems []configProblem
+	if f := conf.GetString(logFormat); f != "text" && f != "json" {
+		problems = append(problems, configError(logFormat, "unknown format %q, use text or json", f))
+	}
+	switch output := conf.GetString(logOutput); output {
+	case "stderr", "syslog":
+	case "file":
+		if path := conf.GetString(logFilePath); path == "" {
+			problems = append(problems, configError(logFilePath, "needed for --log.output file"))
+		} else if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+			problems = append(problems, configError(logFilePath, "the directory for %s doesn't exist", path))
+		}
+	case "journal":
+		if _, err := os.Stat(journalSocket); err != nil {
+			problems = append(problems, configWarning(logOutput, "the journal isn't running here (%v)", err))
+		}
+	default:
+		problems = append(problems, configError(logOutput, "unknown output %q, use stderr, syslog, journal, or file", output))
+	}
+	for _, key := range []string{logLevel, logLevelI2C, logLevelSensor} {
+		if v := conf.GetString(key); v != "" {
+			if _, err := parseLogLevel(v); err != nil {
+				problems = append(problems, configError(key, "%v", err))
+			}
+		}
+	}
+	if conf.GetDuration(logDedupeWindow) < 0 {
+		problems = append(problems, configError(logDedupeWindow, "can't be negative"))
+	}
+	if conf.GetInt(logFileMaxSize) < 0 || conf.GetInt(logFileMaxBackups) < 0 || conf.GetDuration(logFileMaxAge) < 0 {
+		problems = append(problems, configError("log.file", "sizes, ages, and backups can't be negative"))
+	}
+	if addr := conf.GetString(logSyslogAddress); addr != "" {
+		if u, err := url.Parse(addr); err != nil || u.Host == "" {
+			problems = append(problems, configError(logSyslogAddress, "invalid address %q, use e.g. udp://loghost:514", addr))
+		}
+	}
+	return problems
+}
+
+// Logs go to stderr so they never get mixed up with a command's output,
+// unless they're going to syslog, the journal, or a file
+func setupLogging(level slog.Level) {
+	var problems []string
+	if v := conf.GetString(logLevel); v != "" {
+		if l, err := parseLogLevel(v); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			level = l
+		}
+	}
+	if conf.GetBool(verbose) {
+		level = slog.LevelDebug
+	}
+	lg = newLogger(os.Stderr, conf.GetString(logFormat), level)
+
+	var h slog.Handler
+	var err error
+	switch output := conf.GetString(logOutput); output {
+	case "syslog":
+		h, err = newSyslogHandler(conf.GetString(logSyslogAddress), level)
+	case "journal":
+		h, err = newJournalHandler(level)
+	case "file":
+		var f *rotatingFile
+		f, err = openRotatingFile(conf.GetString(logFilePath), int64(conf.GetInt(logFileMaxSize))<<20,
+			conf.GetDuration(logFileMaxAge), conf.GetInt(logFileMaxBackups))
+		if err == nil {
+			h = newLogger(f, conf.GetString(logFormat), level).l.Handler()
+		}
+	}
+	if err != nil {
+		lg.Warnf("Logging to stderr instead of %s: %v", conf.GetString(logOutput), err)
+	} else if h != nil {
+		lg = logger{slog.New(h)}
+	}
+
+	// The I2C and sensor libraries have their own logger, which can only
+	// write to stdout, so they're kept quiet unless asked or we're debugging
+	for pkg, key := range map[string]string{"i2c": logLevelI2C, "bsbmp": logLevelSensor} {
+		libLevel := d2r2.FatalLevel
+		if level <= slog.LevelDebug {
+			libLevel = d2r2.DebugLevel
+		}
+		if v := conf.GetString(key); v != "" {
+			if l, err := parseLogLevel(v); err != nil {
+				problems = append(problems, err.Error())
+			} else {
+				libLevel = d2r2Level(l)
+			}
+		}
+		d2r2.ChangePackageLogLevel(pkg, libLevel)
+	}
+
+	if window := conf.GetDuration(logDedupeWindow); window > 0 {
+		lg = logger{slog.New(newDedupeHandler(lg.l.Handler(), window))}
+	}
+
+	for _, p := range problems {
+		lg.Warn(p)
+	}
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, use debug, info, warn, or error", s)
+	}
+	return l, nil
+}
+
+// The closest level the libraries' logger has
+func d2r2Level(l slog.Level) d2r2.LogLevel {
+	switch {
+	case l <= slog.LevelDebug:
+		return d2r2.DebugLevel
+	case l <= slog.LevelInfo:
+		return d2r2.InfoLevel
+	case l <= slog.LevelWarn:
+		return d2r2.WarnLevel
+	}
+	return d2r2.ErrorLevel
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keeps a dead sensor from filling the logs with the same error on every
+// scrape. The first of a run of identical warnings or errors is logged, the
+// rest are counted and summed up once the window has passed.
+
+type dedupeHandler struct {
+	next   slog.Handler
+	window time.Duration
+	state  *dedupeState
+	// The attributes and groups added so far, so that otherwise identical
+	// messages about different sensors aren't lumped together
+	key string
+}
+
+type dedupeState struct {
+	mu   sync.Mutex
+	seen map[string]*dedupeEntry
+}
+
+type dedupeEntry struct {
+	count int
+	last  slog.Record
+}
+
+func newDedupeHandler(next slog.Handler, window time.Duration) *dedupeHandler {
+	return &dedupeHandler{
+		next:   next,
+		window: window,
+		state:  &dedupeState{seen: make(map[string]*dedupeEntry)},
+	}
+}
+
+func (h *dedupeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *dedupeHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn || r.Level >= levelFatal {
+		return h.next.Handle(ctx, r)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\x00%s\x00%s", h.key, r.Level, r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, "\x00%s", a)
+		return true
+	})
+	key := b.String()
+
+	h.state.mu.Lock()
+	if e, ok := h.state.seen[key]; ok {
+		e.count++
+		e.last = r.Clone()
+		h.state.mu.Unlock()
+		return nil
+	}
+	h.state.seen[key] = &dedupeEntry{}
+	h.state.mu.Unlock()
+
+	time.AfterFunc(h.window, func() { h.summarize(key) })
+	return h.next.Handle(ctx, r)
+}
+
+// Log how many times a message was held back, and start over
+func (h *dedupeHandler) summarize(key string) {
+	h.state.mu.Lock()
+	e := h.state.seen[key]
+	delete(h.state.seen, key)
+	h.state.mu.Unlock()
+	if e == nil || e.count == 0 {
+		return
+	}
+
+	msg := fmt.Sprintf("%s (repeated %d more times in the last %s)", e.last.Message, e.count, h.window)
+	r := slog.NewRecord(time.Now(), e.last.Level, msg, e.last.PC)
+	e.last.Attrs(func(a slog.Attr) bool {
+		r.AddAttrs(a)
+		return true
+	})
+	h.next.Handle(context.Background(), r)
+}
+
+func (h *dedupeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.next = h.next.WithAttrs(attrs)
+	for _, a := range attrs {
+		c.key += fmt.Sprintf("\x00%s", a)
+	}
+	return &c
+}
+
+func (h *dedupeHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.next = h.next.WithGroup(name)
+	c.key += "\x00" + name + "."
+	return &c
+}
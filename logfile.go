@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A log file that rotates itself by size and age, keeping wear and space on
+// SD cards and eMMC bounded without needing logrotate
+
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	created time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Open the file for appending, carrying on from wherever it got to
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.created = f, info.Size(), time.Now()
+	if r.size > 0 {
+		// The closest we can get to when the existing file was started
+		r.created = info.ModTime()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tooBig := r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	tooOld := r.maxAge > 0 && r.size > 0 && time.Since(r.created) > r.maxAge
+	if tooBig || tooOld {
+		if err := r.rotate(); err != nil {
+			// Better to keep writing to an oversized file than to lose logs
+			fmt.Fprintf(os.Stderr, "Problem rotating %s: %v\n", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Move the current file to .1, shifting older ones along and dropping any
+// beyond the backups we keep
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if r.maxBackups == 0 {
+		os.Remove(r.path)
+	}
+	for i := r.maxBackups - 1; i >= 0; i-- {
+		if err := os.Rename(r.backup(i), r.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	r.removeStray()
+	return r.open()
+}
+
+// The n'th most recent backup, where 0 is the current file
+func (r *rotatingFile) backup(n int) string {
+	if n == 0 {
+		return r.path
+	}
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+// Clear out backups left over from when more were kept
+func (r *rotatingFile) removeStray() {
+	matches, _ := filepath.Glob(r.path + ".*")
+	for _, m := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(m, r.path+"."))
+		if err == nil && n > r.maxBackups {
+			os.Remove(m)
+		}
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Logging straight to syslog or the systemd journal, for devices without a
+// log collector, with the log levels turned into priorities
+
+const (
+	logIdentifier = "bme280-exporter"
+	journalSocket = "/run/systemd/journal/socket"
+)
+
+// A slog handler that passes each record with its fields to a function
+type sendHandler struct {
+	level  slog.Leveler
+	attrs  []slog.Attr
+	prefix string
+	send   func(r slog.Record, attrs []slog.Attr) error
+}
+
+func (h *sendHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *sendHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := append([]slog.Attr(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, flattenAttr(h.prefix, a)...)
+		return true
+	})
+	return h.send(r, attrs)
+}
+
+func (h *sendHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		c.attrs = append(c.attrs, flattenAttr(h.prefix, a)...)
+	}
+	return &c
+}
+
+func (h *sendHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.prefix = h.prefix + name + "."
+	return &c
+}
+
+// Groups become dotted names, neither syslog nor the journal nest
+func flattenAttr(prefix string, a slog.Attr) []slog.Attr {
+	v := a.Value.Resolve()
+	if v.Kind() != slog.KindGroup {
+		return []slog.Attr{{Key: prefix + a.Key, Value: v}}
+	}
+	var out []slog.Attr
+	for _, g := range v.Group() {
+		out = append(out, flattenAttr(prefix+a.Key+".", g)...)
+	}
+	return out
+}
+
+// The syslog(3) priority for a level
+func syslogPriority(level slog.Level) syslog.Priority {
+	switch {
+	case level >= levelFatal:
+		return syslog.LOG_CRIT
+	case level >= slog.LevelError:
+		return syslog.LOG_ERR
+	case level >= slog.LevelWarn:
+		return syslog.LOG_WARNING
+	case level >= slog.LevelInfo:
+		return syslog.LOG_INFO
+	}
+	return syslog.LOG_DEBUG
+}
+
+// Log to the local syslog daemon, or a remote one at e.g. udp://loghost:514
+func newSyslogHandler(address string, level slog.Leveler) (slog.Handler, error) {
+	network, addr := "", ""
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q, use e.g. udp://loghost:514", address)
+		}
+		network, addr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_DAEMON|syslog.LOG_INFO, logIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sendHandler{level: level, send: func(r slog.Record, attrs []slog.Attr) error {
+		var b strings.Builder
+		b.WriteString(r.Message)
+		for _, a := range attrs {
+			v := a.Value.String()
+			if strings.ContainsAny(v, " \"=") || v == "" {
+				v = strconv.Quote(v)
+			}
+			fmt.Fprintf(&b, " %s=%s", a.Key, v)
+		}
+		msg := b.String()
+		switch syslogPriority(r.Level) {
+		case syslog.LOG_CRIT:
+			return w.Crit(msg)
+		case syslog.LOG_ERR:
+			return w.Err(msg)
+		case syslog.LOG_WARNING:
+			return w.Warning(msg)
+		case syslog.LOG_INFO:
+			return w.Info(msg)
+		}
+		return w.Debug(msg)
+	}}, nil
+}
+
+// Log to the systemd journal with its native protocol, which keeps the
+// fields as journal fields, see systemd.journal-fields(7)
+func newJournalHandler(level slog.Leveler) (slog.Handler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &sendHandler{level: level, send: func(r slog.Record, attrs []slog.Attr) error {
+		var b bytes.Buffer
+		appendJournalField(&b, "MESSAGE", r.Message)
+		appendJournalField(&b, "PRIORITY", strconv.Itoa(int(syslogPriority(r.Level))))
+		appendJournalField(&b, "SYSLOG_IDENTIFIER", logIdentifier)
+		if r.PC != 0 {
+			f, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+			appendJournalField(&b, "CODE_FILE", f.File)
+			appendJournalField(&b, "CODE_LINE", strconv.Itoa(f.Line))
+			appendJournalField(&b, "CODE_FUNC", f.Function)
+		}
+		for _, a := range attrs {
+			if name := journalFieldName(a.Key); name != "" {
+				appendJournalField(&b, name, a.Value.String())
+			}
+		}
+		_, err := conn.Write(b.Bytes())
+		return err
+	}}, nil
+}
+
+func appendJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	// Values with newlines are sent with their length instead
+	b.WriteString(name)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// Journal field names are upper case letters, digits, and underscores, and
+// can't start with an underscore
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sends readings as LoRaWAN uplinks through a LoRa module on a serial port,
+// for stations out of Wi-Fi range that report through The Things Network or
+// another network server. The module runs the LoRaWAN stack itself and is
+// driven with its AT commands; its keys, region and so on are set up on the
+// module beforehand. Only the latest reading's sent, as Cayenne LPP or a
+// compact 6-byte payload.
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "lorawan",
+		intervalKey: lorawanInterval,
+		enabled: func() bool {
+			return conf.GetString(lorawanDevice) != ""
+		},
+		open: openLoRaWAN,
+	})
+	configChecks = append(configChecks, checkLoRaWANSettings)
+}
+
+// The commands a module takes, and what it answers. Answers are matched on
+// their start. The setup and send commands get the port, and send gets the
+// payload in hex after it.
+type loraModule struct {
+	baud       int
+	setup      []string
+	join       string
+	joined     []string
+	joinFailed []string
+	send       string
+	sent       []string
+	sendFailed []string
+	notJoined  []string
+}
+
+var loraModules = map[string]loraModule{
+	// Microchip RN2483 and RN2903
+	"rn2483": {
+		baud:       57600,
+		join:       "mac join otaa",
+		joined:     []string{"accepted"},
+		joinFailed: []string{"denied", "keys_not_init", "no_free_ch", "silent", "busy", "mac_paused", "invalid_param"},
+		send:       "mac tx uncnf %d %s",
+		sent:       []string{"mac_tx_ok", "mac_rx"},
+		sendFailed: []string{"not_joined", "mac_err", "invalid_data_len", "no_free_ch", "busy", "frame_counter_err_rejoin_needed", "mac_paused", "silent", "invalid_param"},
+		notJoined:  []string{"not_joined", "frame_counter_err_rejoin_needed"},
+	},
+	// RAK3172 and other modules with RAKwireless's RUI3
+	"rak3172": {
+		baud:       115200,
+		join:       "AT+JOIN=1:0:10:8",
+		joined:     []string{"+EVT:JOINED"},
+		joinFailed: []string{"+EVT:JOIN_FAILED", "AT_ERROR", "AT_BUSY_ERROR", "AT_PARAM_ERROR"},
+		send:       "AT+SEND=%d:%s",
+		sent:       []string{"+EVT:TX_DONE", "+EVT:SEND_CONFIRMED_OK"},
+		sendFailed: []string{"AT_NO_NETWORK_JOINED", "AT_ERROR", "AT_BUSY_ERROR", "AT_PARAM_ERROR", "+EVT:SEND_CONFIRMED_FAILED"},
+		notJoined:  []string{"AT_NO_NETWORK_JOINED"},
+	},
+	// Seeed's Wio-E5 (LoRa-E5)
+	"wio-e5": {
+		baud:       9600,
+		setup:      []string{"AT+MODE=LWOTAA", "AT+PORT=%d"},
+		join:       "AT+JOIN",
+		joined:     []string{"+JOIN: Network joined", "+JOIN: Joined already"},
+		joinFailed: []string{"+JOIN: Join failed", "+JOIN: LoRaWAN modem is busy", "+JOIN: No free channel"},
+		send:       "AT+MSGHEX=\"%[2]s\"",
+		sent:       []string{"+MSGHEX: Done"},
+		sendFailed: []string{"+MSGHEX: Please join network first", "+MSGHEX: LoRaWAN modem is busy", "+MSGHEX: Length error", "+MSGHEX: No free channel", "+MSGHEX: DR error", "ERROR"},
+		notJoined:  []string{"+MSGHEX: Please join network first"},
+	},
+}
+
+// How long a join gets before it's tried again
+const loraJoinTimeout = 5 * time.Minute
+
+// Cayenne LPP data types
+const (
+	lppTemperature = 0x67
+	lppHumidity    = 0x68
+	lppBarometer   = 0x73
+)
+
+// Cayenne LPP, each value on its own channel: temperature in 0.1 °C on 1,
+// humidity in 0.5 % on 2, and pressure in 0.1 hPa on 3
+func lppPayload(r reading) []byte {
+	var b []byte
+	if !math.IsNaN(r.Temperature) && math.Abs(r.Temperature) < 3276 {
+		b = binary.BigEndian.AppendUint16(append(b, 1, lppTemperature), uint16(int16(math.Round(r.Temperature*10))))
+	}
+	if !math.IsNaN(r.Humidity) {
+		b = append(b, 2, lppHumidity, byte(math.Round(min(max(r.Humidity, 0), 100)*2)))
+	}
+	if !math.IsNaN(r.Pressure) {
+		b = binary.BigEndian.AppendUint16(append(b, 3, lppBarometer), uint16(math.Round(min(r.Pressure/10, 0xfffe))))
+	}
+	return b
+}
+
+// Six bytes, big endian: temperature in 0.01 °C as an int16, humidity in
+// 0.01 % as a uint16, and pressure in 0.1 hPa as a uint16. Missing values
+// are 0x8000 and 0xffff.
+func compactPayload(r reading) []byte {
+	t, h, p := uint16(0x8000), uint16(0xffff), uint16(0xffff)
+	if !math.IsNaN(r.Temperature) && math.Abs(r.Temperature) < 327 {
+		t = uint16(int16(math.Round(r.Temperature * 100)))
+	}
+	if !math.IsNaN(r.Humidity) {
+		h = uint16(math.Round(min(max(r.Humidity, 0), 100) * 100))
+	}
+	if !math.IsNaN(r.Pressure) {
+		p = uint16(math.Round(min(r.Pressure/10, 0xfffe)))
+	}
+	b := binary.BigEndian.AppendUint16(nil, t)
+	b = binary.BigEndian.AppendUint16(b, h)
+	return binary.BigEndian.AppendUint16(b, p)
+}
+
+type loraSink struct {
+	module loraModule
+	port   int
+	format string
+	f      *os.File
+	lines  chan string
+
+	mu      sync.Mutex
+	joined  bool
+	joining time.Time
+}
+
+func openLoRaWAN() (sink, error) {
+	module, ok := loraModules[conf.GetString(lorawanModule)]
+	if !ok {
+		return nil, fmt.Errorf("unknown LoRa module %q", conf.GetString(lorawanModule))
+	}
+	baud := conf.GetInt(lorawanBaudRate)
+	if baud == 0 {
+		baud = module.baud
+	}
+	f, err := openSerial(conf.GetString(lorawanDevice), baud)
+	if err != nil {
+		return nil, err
+	}
+	s := &loraSink{
+		module: module,
+		port:   conf.GetInt(lorawanPort),
+		format: conf.GetString(lorawanFormat),
+		f:      f,
+		lines:  make(chan string, 64),
+	}
+	go s.read()
+	for _, cmd := range module.setup {
+		if strings.Contains(cmd, "%d") {
+			cmd = fmt.Sprintf(cmd, s.port)
+		}
+		if err := s.write(cmd); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Hand the module's lines over to whoever's waiting, dropping them if no one
+// is for a while
+func (s *loraSink) read() {
+	defer close(s.lines)
+	scanner := bufio.NewScanner(s.f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		lg.Debugf("LoRa module: %s", line)
+		select {
+		case s.lines <- line:
+		default:
+		}
+	}
+}
+
+func (s *loraSink) write(cmd string) error {
+	lg.Debugf("To the LoRa module: %s", cmd)
+	_, err := s.f.WriteString(cmd + "\r\n")
+	return err
+}
+
+// Wait for a line that starts with one of the answers, skipping the rest
+func (s *loraSink) await(ctx context.Context, ok, failed []string) (string, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case line, open := <-s.lines:
+			if !open {
+				return "", errors.New("the LoRa module's serial port closed")
+			}
+			if hasAnyPrefix(line, ok) {
+				return line, nil
+			}
+			if hasAnyPrefix(line, failed) {
+				return line, fmt.Errorf("the LoRa module said %q", line)
+			}
+		}
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Joining can take longer than a push has, so a join carries on where it left
+// off at the next push. One that's heard nothing back in a few minutes starts
+// over, in case the answer went missing.
+func (s *loraSink) join(ctx context.Context) error {
+	if s.joining.IsZero() || time.Since(s.joining) > loraJoinTimeout {
+		lg.Infof("Joining the LoRaWAN network")
+		if err := s.write(s.module.join); err != nil {
+			return err
+		}
+		s.joining = time.Now()
+	}
+	_, err := s.await(ctx, s.module.joined, s.module.joinFailed)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.New("still joining the LoRaWAN network")
+	}
+	s.joining = time.Time{}
+	if err != nil {
+		return fmt.Errorf("problem joining the LoRaWAN network: %w", err)
+	}
+	lg.Infof("Joined the LoRaWAN network")
+	s.joined = true
+	return nil
+}
+
+func (s *loraSink) push(ctx context.Context, samples []sample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.joined {
+		if err := s.join(ctx); err != nil {
+			return err
+		}
+	}
+	latest := samples[len(samples)-1].reading
+	payload := lppPayload(latest)
+	if s.format == "compact" {
+		payload = compactPayload(latest)
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	if err := s.write(fmt.Sprintf(s.module.send, s.port, strings.ToUpper(hex.EncodeToString(payload)))); err != nil {
+		return err
+	}
+	line, err := s.await(ctx, s.module.sent, s.module.sendFailed)
+	if hasAnyPrefix(line, s.module.notJoined) {
+		s.joined = false
+	}
+	return err
+}
+
+func (s *loraSink) close() error {
+	return s.f.Close()
+}
+
+func checkLoRaWANSettings() []configProblem {
+	if conf.GetString(lorawanDevice) == "" {
+		return nil
+	}
+	var problems []configProblem
+	name := conf.GetString(lorawanModule)
+	if _, ok := loraModules[name]; !ok {
+		problems = append(problems, configError(lorawanModule, "unknown module %q, use rn2483, rak3172 or wio-e5", name))
+	}
+	if b := conf.GetInt(lorawanBaudRate); b != 0 && !validSerialBaudRate(b) {
+		problems = append(problems, configError(lorawanBaudRate, "unsupported baud rate %d", b))
+	}
+	if port := conf.GetInt(lorawanPort); port < 1 || port > 223 {
+		problems = append(problems, configError(lorawanPort, "must be from 1 to 223"))
+	}
+	if f := conf.GetString(lorawanFormat); f != "lpp" && f != "compact" {
+		problems = append(problems, configError(lorawanFormat, "must be lpp or compact"))
+	}
+	return problems
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/d2r2/go-bsbmp"
-	"github.com/d2r2/go-i2c"
-	logger "github.com/d2r2/go-logger"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -21,115 +30,1252 @@ const (
 	metricsPort = "port"
 	modelName   = "model"
 	verbose     = "verbose"
+	logFormat   = "log.format"
+	logOutput   = "log.output"
+
+	logLevel          = "log.level"
+	logLevelI2C       = "log.level-i2c"
+	logLevelSensor    = "log.level-sensor"
+	logDedupeWindow   = "log.dedupe-window"
+	logSyslogAddress  = "log.syslog.address"
+	logFilePath       = "log.file.path"
+	logFileMaxSize    = "log.file.max-size"
+	logFileMaxAge     = "log.file.max-age"
+	logFileMaxBackups = "log.file.max-backups"
+	webConfigFile     = "web.config.file"
+	allowedCIDRs      = "web.allowed-cidrs"
+
+	readHeaderTimeout = "web.read-header-timeout"
+	readTimeout       = "web.read-timeout"
+	writeTimeout      = "web.write-timeout"
+	idleTimeout       = "web.idle-timeout"
+	maxHeaderBytes    = "web.max-header-bytes"
+
+	rateLimit          = "web.rate-limit"
+	rateBurst          = "web.rate-burst"
+	rateLimitPerClient = "web.rate-limit-per-client"
+	shutdownTimeout    = "web.shutdown-timeout"
+	systemdSocket      = "web.systemd-socket"
+	webDisable         = "web.disable"
+	enablePprof        = "web.enable-pprof"
+	enableLifecycle    = "web.enable-lifecycle"
+	accessLog          = "web.access-log"
+	timeoutOffset      = "web.timeout-offset"
+
+	metricsNamespace = "metrics.namespace"
+	metricsEnabled   = "metrics.enabled"
+
+	pollInterval   = "poll.interval"
+	pollRecent     = "poll.recent"
+	pollStateFile  = "poll.state-file"
+	pollHistory    = "poll.history"
+	pollHistory1m  = "poll.history-1m"
+	pollHistory15m = "poll.history-15m"
+
+	eventsMax = "events.max"
+
+	recoveryAfterFailures = "recovery.after-failures"
+	recoveryBackoff       = "recovery.backoff"
+	recoveryMaxBackoff    = "recovery.max-backoff"
+	recoveryResetAfter    = "recovery.reset-after"
+	recoveryReadTimeout   = "recovery.read-timeout"
+
+	pidFile    = "pid-file"
+	daemonMode = "daemon"
+	runAsUser  = "user"
+	runAsGroup = "group"
+
+	healthcheckURL          = "healthcheck.url"
+	healthcheckTimeout      = "healthcheck.timeout"
+	healthcheckUsername     = "healthcheck.username"
+	healthcheckPasswordFile = "healthcheck.password-file"
+
+	checkConnect = "check.connect"
+	checkTimeout = "check.timeout"
+
+	mdnsEnable   = "mdns.enable"
+	mdnsService  = "mdns.service"
+	mdnsInstance = "mdns.instance"
+
+	grpcListenAddress = "grpc.listen-address"
+
+	snmpListenAddress = "snmp.listen-address"
+	snmpCommunity     = "snmp.community"
+	snmpBaseOID       = "snmp.base-oid"
+	snmpContact       = "snmp.contact"
+	snmpLocation      = "snmp.location"
+
+	modbusListenAddress    = "modbus.listen-address"
+	modbusRegisters        = "modbus.registers"
+	modbusUnitID           = "modbus.unit-id"
+	modbusHoldingRegisters = "modbus.holding-registers"
+
+	bacnetListenAddress    = "bacnet.listen-address"
+	bacnetDeviceID         = "bacnet.device-id"
+	bacnetDeviceName       = "bacnet.device-name"
+	bacnetLocation         = "bacnet.location"
+	bacnetBroadcastAddress = "bacnet.broadcast-address"
+	bacnetCOVIncrements    = "bacnet.cov-increments"
+
+	coapListenAddress = "coap.listen-address"
+	coapFormat        = "coap.format"
+
+	bthomeEnable              = "bthome.enable"
+	bthomeDevice              = "bthome.device"
+	bthomeName                = "bthome.name"
+	bthomeAdvertisingInterval = "bthome.advertising-interval"
+
+	nmeaListenAddress = "nmea.listen-address"
+	nmeaDevice        = "nmea.device"
+	nmeaBaudRate      = "nmea.baud-rate"
+	nmeaTalker        = "nmea.talker"
+	nmeaSentences     = "nmea.sentences"
+
+	tracingEndpoint    = "tracing.endpoint"
+	tracingSampleRatio = "tracing.sample-ratio"
+
+	sinkTimeout        = "sinks.timeout"
+	sinkSpoolDirectory = "sinks.spool.directory"
+	sinkSpoolMaxSize   = "sinks.spool.max-size"
+
+	pushgatewayURL      = "pushgateway.url"
+	pushgatewayJob      = "pushgateway.job"
+	pushgatewayInstance = "pushgateway.instance"
+	pushgatewayInterval = "pushgateway.interval"
+	pushgatewayDelete   = "pushgateway.delete-on-shutdown"
+
+	remoteWriteURL       = "remote-write.url"
+	remoteWriteTokenFile = "remote-write.bearer-token-file"
+	remoteWriteHeaders   = "remote-write.headers"
+	remoteWriteJob       = "remote-write.job"
+	remoteWriteInstance  = "remote-write.instance"
+	remoteWriteInterval  = "remote-write.interval"
+
+	influxURL             = "influxdb.url"
+	influxDatabase        = "influxdb.database"
+	influxRetentionPolicy = "influxdb.retention-policy"
+	influxOrg             = "influxdb.org"
+	influxBucket          = "influxdb.bucket"
+	influxTokenFile       = "influxdb.token-file"
+	influxMeasurement     = "influxdb.measurement"
+	influxTags            = "influxdb.tags"
+	influxInterval        = "influxdb.interval"
+
+	graphiteAddress  = "graphite.address"
+	graphiteProtocol = "graphite.protocol"
+	graphitePrefix   = "graphite.prefix"
+	graphiteTags     = "graphite.tags"
+	graphiteInterval = "graphite.interval"
+
+	statsdAddress   = "statsd.address"
+	statsdPrefix    = "statsd.prefix"
+	statsdDogStatsD = "statsd.dogstatsd"
+	statsdInterval  = "statsd.interval"
+
+	otlpEndpoint           = "otlp.endpoint"
+	otlpProtocol           = "otlp.protocol"
+	otlpHeaders            = "otlp.headers"
+	otlpResourceAttributes = "otlp.resource-attributes"
+	otlpInterval           = "otlp.interval"
+
+	mqttBroker    = "mqtt.broker"
+	mqttClientID  = "mqtt.client-id"
+	mqttKeepAlive = "mqtt.keep-alive"
+	mqttTopic     = "mqtt.topic"
+	mqttPayload   = "mqtt.payload"
+	mqttQoS       = "mqtt.qos"
+	mqttRetain    = "mqtt.retain"
+	mqttInterval  = "mqtt.interval"
+
+	mqttDiscoveryPrefix = "mqtt.homeassistant.discovery-prefix"
+
+	mqttUsername           = "mqtt.username"
+	mqttPasswordFile       = "mqtt.password-file"
+	mqttCleanSession       = "mqtt.clean-session"
+	mqttCAFile             = "mqtt.tls.ca-file"
+	mqttCertFile           = "mqtt.tls.cert-file"
+	mqttKeyFile            = "mqtt.tls.key-file"
+	mqttInsecureSkipVerify = "mqtt.tls.insecure-skip-verify"
+	mqttCommands           = "mqtt.commands"
+	mqttTopicTemplate      = "mqtt.topic-template"
+	mqttPayloadTemplate    = "mqtt.payload-template"
+
+	mqttSparkplugGroupID    = "mqtt.sparkplug.group-id"
+	mqttSparkplugEdgeNodeID = "mqtt.sparkplug.edge-node-id"
+
+	kafkaBrokers        = "kafka.brokers"
+	kafkaTopic          = "kafka.topic"
+	kafkaFormat         = "kafka.format"
+	kafkaSchemaRegistry = "kafka.schema-registry"
+	kafkaInterval       = "kafka.interval"
+
+	natsURL       = "nats.url"
+	natsSubject   = "nats.subject"
+	natsJetStream = "nats.jetstream"
+	natsCAFile    = "nats.tls.ca-file"
+	natsCertFile  = "nats.tls.cert-file"
+	natsKeyFile   = "nats.tls.key-file"
+	natsInterval  = "nats.interval"
+
+	redisURL       = "redis.url"
+	redisKey       = "redis.key"
+	redisRetention = "redis.retention"
+	redisInterval  = "redis.interval"
+
+	postgresURL      = "postgres.url"
+	postgresTable    = "postgres.table"
+	postgresInterval = "postgres.interval"
+
+	elasticURL                = "elasticsearch.url"
+	elasticIndex              = "elasticsearch.index"
+	elasticUsername           = "elasticsearch.username"
+	elasticPasswordFile       = "elasticsearch.password-file"
+	elasticAPIKeyFile         = "elasticsearch.api-key-file"
+	elasticCAFile             = "elasticsearch.tls.ca-file"
+	elasticInsecureSkipVerify = "elasticsearch.tls.insecure-skip-verify"
+	elasticInterval           = "elasticsearch.interval"
+
+	sqlitePath         = "sqlite.path"
+	sqliteRetention    = "sqlite.retention"
+	sqliteRetention1m  = "sqlite.retention-1m"
+	sqliteRetention15m = "sqlite.retention-15m"
+	sqliteInterval     = "sqlite.interval"
+
+	csvPath     = "csv.path"
+	csvRotate   = "csv.rotate"
+	csvMaxSize  = "csv.max-size"
+	csvGzip     = "csv.gzip"
+	csvInterval = "csv.interval"
+
+	awsRegion                 = "aws.region"
+	awsProfile                = "aws.profile"
+	awsIoTEndpoint            = "aws.iot.endpoint"
+	awsIoTThingName           = "aws.iot.thing-name"
+	awsIoTTopic               = "aws.iot.topic"
+	awsIoTShadow              = "aws.iot.shadow"
+	awsIoTCAFile              = "aws.iot.tls.ca-file"
+	awsIoTCertFile            = "aws.iot.tls.cert-file"
+	awsIoTKeyFile             = "aws.iot.tls.key-file"
+	awsIoTCredentialsEndpoint = "aws.iot.credentials-endpoint"
+	awsIoTRoleAlias           = "aws.iot.role-alias"
+	awsIoTInterval            = "aws.iot.interval"
+
+	cloudwatchNamespace = "cloudwatch.namespace"
+	cloudwatchEndpoint  = "cloudwatch.endpoint"
+	cloudwatchInterval  = "cloudwatch.interval"
+
+	timestreamDatabase    = "timestream.database"
+	timestreamTable       = "timestream.table"
+	timestreamMeasureName = "timestream.measure-name"
+	timestreamEndpoint    = "timestream.endpoint"
+	timestreamInterval    = "timestream.interval"
+
+	datadogAPIKeyFile = "datadog.api-key-file"
+	datadogSite       = "datadog.site"
+	datadogPrefix     = "datadog.prefix"
+	datadogInterval   = "datadog.interval"
+
+	newRelicAPIKeyFile = "newrelic.api-key-file"
+	newRelicRegion     = "newrelic.region"
+	newRelicPrefix     = "newrelic.prefix"
+	newRelicInterval   = "newrelic.interval"
+
+	splunkURL                = "splunk.url"
+	splunkTokenFile          = "splunk.token-file"
+	splunkIndex              = "splunk.index"
+	splunkSource             = "splunk.source"
+	splunkSourcetype         = "splunk.sourcetype"
+	splunkPrefix             = "splunk.prefix"
+	splunkCAFile             = "splunk.tls.ca-file"
+	splunkInsecureSkipVerify = "splunk.tls.insecure-skip-verify"
+	splunkInterval           = "splunk.interval"
+
+	thingSpeakChannel      = "thingspeak.channel"
+	thingSpeakWriteKeyFile = "thingspeak.write-key-file"
+	thingSpeakFields       = "thingspeak.fields"
+	thingSpeakURL          = "thingspeak.url"
+	thingSpeakInterval     = "thingspeak.interval"
+
+	adafruitIOUsername  = "adafruitio.username"
+	adafruitIOKeyFile   = "adafruitio.key-file"
+	adafruitIOFeeds     = "adafruitio.feeds"
+	adafruitIORateLimit = "adafruitio.rate-limit"
+	adafruitIOURL       = "adafruitio.url"
+	adafruitIOInterval  = "adafruitio.interval"
+
+	webhookURL                = "webhook.url"
+	webhookTokenFile          = "webhook.bearer-token-file"
+	webhookHeaders            = "webhook.headers"
+	webhookBatch              = "webhook.batch"
+	webhookCAFile             = "webhook.tls.ca-file"
+	webhookInsecureSkipVerify = "webhook.tls.insecure-skip-verify"
+	webhookInterval           = "webhook.interval"
+
+	execCommand       = "exec.command"
+	execArgs          = "exec.args"
+	execOn            = "exec.on"
+	execThresholdsKey = "exec.thresholds"
+	execInterval      = "exec.interval"
+
+	textfileDirectory = "textfile.directory"
+	textfileName      = "textfile.name"
+	textfileRemove    = "textfile.remove-on-shutdown"
+	textfileInterval  = "textfile.interval"
+
+	zabbixServer     = "zabbix.server"
+	zabbixHost       = "zabbix.host"
+	zabbixKeys       = "zabbix.keys"
+	zabbixCAFile     = "zabbix.tls.ca-file"
+	zabbixCertFile   = "zabbix.tls.cert-file"
+	zabbixKeyFile    = "zabbix.tls.key-file"
+	zabbixServerName = "zabbix.tls.server-name"
+	zabbixInterval   = "zabbix.interval"
+
+	knxGateway           = "knx.gateway"
+	knxRouting           = "knx.routing"
+	knxMulticastAddress  = "knx.multicast-address"
+	knxIndividualAddress = "knx.individual-address"
+	knxGroupAddresses    = "knx.group-addresses"
+	knxInterval          = "knx.interval"
+
+	lorawanDevice   = "lorawan.device"
+	lorawanModule   = "lorawan.module"
+	lorawanBaudRate = "lorawan.baud-rate"
+	lorawanPort     = "lorawan.port"
+	lorawanFormat   = "lorawan.format"
+	lorawanInterval = "lorawan.interval"
+
+	signalkURL         = "signalk.url"
+	signalkTokenFile   = "signalk.token-file"
+	signalkCAFile      = "signalk.tls.ca-file"
+	signalkContext     = "signalk.context"
+	signalkSourceLabel = "signalk.source"
+	signalkPaths       = "signalk.paths"
+	signalkInterval    = "signalk.interval"
+
+	cwopCallsign  = "cwop.callsign"
+	cwopPasscode  = "cwop.passcode"
+	cwopServer    = "cwop.server"
+	cwopLatitude  = "cwop.latitude"
+	cwopLongitude = "cwop.longitude"
+	cwopAltitude  = "cwop.altitude"
+	cwopInterval  = "cwop.interval"
+
+	windyAPIKeyFile = "windy.api-key-file"
+	windyStation    = "windy.station"
+	windyAltitude   = "windy.altitude"
+	windyURL        = "windy.url"
+	windyInterval   = "windy.interval"
+
+	openSenseMapBoxID        = "opensensemap.box-id"
+	openSenseMapTokenFile    = "opensensemap.token-file"
+	openSenseMapSensors      = "opensensemap.sensors"
+	openSenseMapPressureUnit = "opensensemap.pressure-unit"
+	openSenseMapURL          = "opensensemap.url"
+	openSenseMapInterval     = "opensensemap.interval"
+
+	sensorCommunitySensorID  = "sensorcommunity.sensor-id"
+	sensorCommunityURL       = "sensorcommunity.url"
+	sensorCommunityMadavi    = "sensorcommunity.madavi"
+	sensorCommunityMadaviURL = "sensorcommunity.madavi-url"
+	sensorCommunityInterval  = "sensorcommunity.interval"
+
+	azureConnectionStringFile = "azure.iothub.connection-string-file"
+	azureHost                 = "azure.iothub.host"
+	azureDeviceID             = "azure.iothub.device-id"
+	azureTwin                 = "azure.iothub.twin"
+	azureCAFile               = "azure.iothub.tls.ca-file"
+	azureCertFile             = "azure.iothub.tls.cert-file"
+	azureKeyFile              = "azure.iothub.tls.key-file"
+	azureInterval             = "azure.iothub.interval"
+
+	gcpCredentialsFileKey     = "gcp.credentials-file"
+	gcpMonitoringProject      = "gcp.monitoring.project"
+	gcpMonitoringMetricPrefix = "gcp.monitoring.metric-prefix"
+	gcpMonitoringLocation     = "gcp.monitoring.location"
+	gcpMonitoringNamespace    = "gcp.monitoring.namespace"
+	gcpMonitoringEndpoint     = "gcp.monitoring.endpoint"
+	gcpMonitoringInterval     = "gcp.monitoring.interval"
+
+	temperatureOffset = "calibration.temperature-offset"
+	pressureOffset    = "calibration.pressure-offset"
+	humidityOffset    = "calibration.humidity-offset"
 )
 
+// Metric names, shared with the generated Grafana dashboard
+const (
+	temperatureMetric = "temperature"
+	humidityMetric    = "humidity"
+	pressureMetric    = "pressure"
+	upMetric          = "bme280_up"
+)
+
+// A metric's name as exported, with the configured namespace in front
+func metricName(name string) string {
+	return prometheus.BuildFQName(conf.GetString(metricsNamespace), "", name)
+}
+
+// Whether the reading's value goes in the exported metrics
+func metricEnabled(name string) bool {
+	return slices.Contains(getStringList(metricsEnabled), name)
+}
+
 var (
-	lg logger.PackageLog
+	lg = newLogger(os.Stderr, "text", slog.LevelInfo)
+
+	// All the settings and their defaults
+	configDefaults = make(map[string]interface{})
 
 	hostname string
 	sensor   *bsbmp.BMP
+	chipID   uint8
 )
 
 type bmeexporter struct {
 	Temperature *prometheus.Desc
 	Humidity    *prometheus.Desc
 	Pressure    *prometheus.Desc
+	Up          *prometheus.Desc
+
+	// The metrics from metrics.enabled, keyed by their unprefixed names
+	enabled map[string]bool
+
+	// Bounds the sensor read, normally to the scrape's timeout
+	ctx context.Context
+	// With the background poller running, scrapes get its latest reading
+	poller *poller
 }
 
 // Describe the metrics that we export
 func (c *bmeexporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.Temperature
-	ch <- c.Humidity
-	ch <- c.Pressure
+	if c.enabled[temperatureMetric] {
+		ch <- c.Temperature
+	}
+	if c.enabled[humidityMetric] {
+		ch <- c.Humidity
+	}
+	if c.enabled[pressureMetric] {
+		ch <- c.Pressure
+	}
+	ch <- c.Up
 }
 
 // Read the sensor and present the metrics
 func (c *bmeexporter) Collect(ch chan<- prometheus.Metric) {
-	t, err := sensor.ReadTemperatureC(bsbmp.ACCURACY_HIGH)
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	r, err := currentReading(ctx, c.poller)
 	if err != nil {
-		lg.Error("Problem reading temp")
-	} else {
+		lg.Warnf("Gave up waiting for the sensor: %v", err)
+		recordEvent("scrape", "Gave up waiting for the sensor: %v", err)
+		c.collectUp(ch, false)
+		return
+	}
+	c.collectUp(ch, r.ok())
+	c.collectReading(ch, r)
+}
+
+// Whether the sensor could be read, so a dead one can be told apart from a dead exporter
+func (c *bmeexporter) collectUp(ch chan<- prometheus.Metric, up bool) {
+	v := 0.0
+	if up {
+		v = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.Up, prometheus.GaugeValue, v, hostname)
+}
+
+// Present the values from a reading, skipping any that couldn't be read
+func (c *bmeexporter) collectReading(ch chan<- prometheus.Metric, r reading) {
+	if c.enabled[temperatureMetric] && !math.IsNaN(r.Temperature) {
 		ch <- prometheus.MustNewConstMetric(c.Temperature,
 			prometheus.GaugeValue,
-			math.Round(float64(t)*100)/100,
+			r.Temperature,
 			hostname,
 		)
 	}
-
-	// Read atmospheric pressure in pascal
-	p, err := sensor.ReadPressurePa(bsbmp.ACCURACY_HIGH)
-	if err != nil {
-		lg.Error("Problem reading pressure")
-	} else {
+	if c.enabled[pressureMetric] && !math.IsNaN(r.Pressure) {
 		ch <- prometheus.MustNewConstMetric(c.Pressure,
 			prometheus.GaugeValue,
-			math.Round(float64(p)*100)/100,
+			r.Pressure,
 			hostname,
 		)
 	}
-
-	// Read atmospheric pressure in mmHg
-	supported, h1, err := sensor.ReadHumidityRH(bsbmp.ACCURACY_HIGH)
-	if supported {
-		if err != nil {
-			lg.Error("Problem reading humidity")
-		} else {
-			ch <- prometheus.MustNewConstMetric(c.Humidity,
-				prometheus.GaugeValue,
-				math.Round(float64(h1)*100)/100,
-				hostname,
-			)
-		}
-	} else {
-		lg.Info("Humidity not supported on this sensor")
+	if c.enabled[humidityMetric] && !math.IsNaN(r.Humidity) {
+		ch <- prometheus.MustNewConstMetric(c.Humidity,
+			prometheus.GaugeValue,
+			r.Humidity,
+			hostname,
+		)
 	}
 }
 
+// The exporter for the main sensor, with the labels from the configuration file
 func NewBMEExporter() *bmeexporter {
-	sensorName := getSensorName()
+	return newExporter(sensorNameForID(currentChipID()), configuredLabels())
+}
+
+func newExporter(sensorName string, labels prometheus.Labels) *bmeexporter {
+	constLabels := prometheus.Labels{"sensor_type": sensorName}
+	for k, v := range labels {
+		constLabels[k] = v
+	}
+	enabled := make(map[string]bool)
+	for _, name := range []string{temperatureMetric, humidityMetric, pressureMetric} {
+		enabled[name] = metricEnabled(name)
+	}
 	return &bmeexporter{
-		Temperature: prometheus.NewDesc("temperature", "Current temperature in celsius", []string{"host"}, prometheus.Labels{"sensor_type": sensorName}),
-		Humidity:    prometheus.NewDesc("humidity", "Current realtive humidity", []string{"host"}, prometheus.Labels{"sensor_type": sensorName}),
-		Pressure:    prometheus.NewDesc("pressure", "Current atmospheric pressure in hPa", []string{"host"}, prometheus.Labels{"sensor_type": sensorName}),
+		Temperature: prometheus.NewDesc(metricName(temperatureMetric), "Current temperature in celsius", []string{"host"}, constLabels),
+		Humidity:    prometheus.NewDesc(metricName(humidityMetric), "Current realtive humidity", []string{"host"}, constLabels),
+		Pressure:    prometheus.NewDesc(metricName(pressureMetric), "Current atmospheric pressure in hPa", []string{"host"}, constLabels),
+		Up:          prometheus.NewDesc(metricName(upMetric), "Whether the sensor could be read", []string{"host"}, constLabels),
+		enabled:     enabled,
 	}
 }
 
+// A copy of the exporter whose reads give up when the context is done
+func (c *bmeexporter) withContext(ctx context.Context, p *poller) *bmeexporter {
+	e := *c
+	e.ctx, e.poller = ctx, p
+	return &e
+}
+
+// A context for the request that expires shortly before Prometheus would give up on it
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		return context.WithCancel(r.Context())
+	}
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		lg.Warnf("Bad scrape timeout %q: %v", v, err)
+		return context.WithCancel(r.Context())
+	}
+	timeout := time.Duration(secs * float64(time.Second))
+	if timeout > conf.GetDuration(timeoutOffset) {
+		timeout -= conf.GetDuration(timeoutOffset)
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// Serve the metrics, abandoning the sensor reads shortly before Prometheus
+// would give up on the scrape anyway
+func metricsHandler(p *poller) http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := scrapeContext(r)
+			defer cancel()
+			ctx, span := startSpan(contextFromTraceparent(ctx, r.Header.Get("Traceparent")), "scrape", spanKindServer,
+				spanAttr{"http.request.method", r.Method},
+				spanAttr{"url.path", r.URL.Path},
+				spanAttr{"client.address", r.RemoteAddr})
+			defer span.finish()
+
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(NewBMEExporter().withContext(ctx, p))
+			gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+
+			// The extra sensors have a sensor label the main one doesn't, which
+			// one registry would refuse
+			for _, s := range configuredSensors() {
+				registry := prometheus.NewRegistry()
+				registry.MustRegister(newSensorCollector(ctx, s))
+				gatherers = append(gatherers, registry)
+			}
+			promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		}))
+}
+
 func init() {
 	viper.SetDefault(i2cAddress, "0x76")
 	viper.SetDefault(i2cBus, 1)
 	viper.SetDefault(metricsPort, 8000)
 	viper.SetDefault(modelName, "BME280")
 	viper.SetDefault(verbose, false)
+	viper.SetDefault(logFormat, "text")
+	viper.SetDefault(logLevel, "")
+	viper.SetDefault(logLevelI2C, "")
+	viper.SetDefault(logLevelSensor, "")
+	viper.SetDefault(logDedupeWindow, 5*time.Minute)
+	viper.SetDefault(logOutput, "stderr")
+	viper.SetDefault(logSyslogAddress, "")
+	viper.SetDefault(logFilePath, "")
+	viper.SetDefault(logFileMaxSize, 10)
+	viper.SetDefault(logFileMaxAge, time.Duration(0))
+	viper.SetDefault(logFileMaxBackups, 3)
+	viper.SetDefault(webConfigFile, "")
+	viper.SetDefault(allowedCIDRs, []string{})
+	viper.SetDefault(readHeaderTimeout, 5*time.Second)
+	viper.SetDefault(readTimeout, 10*time.Second)
+	viper.SetDefault(writeTimeout, 30*time.Second)
+	viper.SetDefault(idleTimeout, 60*time.Second)
+	viper.SetDefault(maxHeaderBytes, 16<<10)
+	viper.SetDefault(rateLimit, 0.0)
+	viper.SetDefault(rateBurst, 5)
+	viper.SetDefault(rateLimitPerClient, true)
+	viper.SetDefault(shutdownTimeout, 5*time.Second)
+	viper.SetDefault(systemdSocket, false)
+	viper.SetDefault(webDisable, false)
+	viper.SetDefault(enablePprof, false)
+	viper.SetDefault(enableLifecycle, false)
+	viper.SetDefault(accessLog, false)
+	viper.SetDefault(timeoutOffset, 500*time.Millisecond)
+	viper.SetDefault(metricsNamespace, "")
+	viper.SetDefault(metricsEnabled, []string{temperatureMetric, pressureMetric, humidityMetric})
+	viper.SetDefault(pollInterval, time.Duration(0))
+	viper.SetDefault(pollRecent, 60)
+	viper.SetDefault(pollStateFile, "")
+	viper.SetDefault(pollHistory, time.Duration(0))
+	viper.SetDefault(pollHistory1m, time.Duration(0))
+	viper.SetDefault(pollHistory15m, time.Duration(0))
+	viper.SetDefault(healthcheckURL, "")
+	viper.SetDefault(healthcheckTimeout, 5*time.Second)
+	viper.SetDefault(healthcheckUsername, "")
+	viper.SetDefault(healthcheckPasswordFile, "")
+	viper.SetDefault(checkConnect, false)
+	viper.SetDefault(checkTimeout, 3*time.Second)
+	viper.SetDefault(mdnsEnable, false)
+	viper.SetDefault(mdnsService, "_prometheus-http._tcp")
+	viper.SetDefault(mdnsInstance, "")
+	viper.SetDefault(grpcListenAddress, "")
+	viper.SetDefault(snmpListenAddress, "")
+	viper.SetDefault(snmpCommunity, "public")
+	viper.SetDefault(snmpBaseOID, "1.3.6.1.4.1.8072.9999.9999.280")
+	viper.SetDefault(snmpContact, "")
+	viper.SetDefault(snmpLocation, "")
+	viper.SetDefault(modbusListenAddress, "")
+	viper.SetDefault(modbusRegisters, map[string]string{temperatureMetric: "0:int16:100", humidityMetric: "1:uint16:100", pressureMetric: "2:uint32:1", modbusUp: "4:uint16"})
+	viper.SetDefault(modbusUnitID, 0)
+	viper.SetDefault(modbusHoldingRegisters, false)
+	viper.SetDefault(bacnetListenAddress, "")
+	viper.SetDefault(bacnetDeviceID, 280)
+	viper.SetDefault(bacnetDeviceName, "")
+	viper.SetDefault(bacnetLocation, "")
+	viper.SetDefault(bacnetBroadcastAddress, "255.255.255.255")
+	viper.SetDefault(bacnetCOVIncrements, map[string]string{temperatureMetric: "0.1", pressureMetric: "0.1", humidityMetric: "1"})
+	viper.SetDefault(coapListenAddress, "")
+	viper.SetDefault(coapFormat, "json")
+	viper.SetDefault(bthomeEnable, false)
+	viper.SetDefault(bthomeDevice, 0)
+	viper.SetDefault(bthomeName, "")
+	viper.SetDefault(bthomeAdvertisingInterval, time.Second)
+	viper.SetDefault(nmeaListenAddress, "")
+	viper.SetDefault(nmeaDevice, "")
+	viper.SetDefault(nmeaBaudRate, 4800)
+	viper.SetDefault(nmeaTalker, "WI")
+	viper.SetDefault(nmeaSentences, []string{"xdr", "mda"})
+	viper.SetDefault(tracingEndpoint, "")
+	viper.SetDefault(tracingSampleRatio, 1.0)
+	viper.SetDefault(sinkTimeout, 10*time.Second)
+	viper.SetDefault(sinkSpoolDirectory, "")
+	viper.SetDefault(sinkSpoolMaxSize, 100)
+	viper.SetDefault(pushgatewayURL, "")
+	viper.SetDefault(pushgatewayJob, "bme280-exporter")
+	viper.SetDefault(pushgatewayInstance, "")
+	viper.SetDefault(pushgatewayInterval, time.Duration(0))
+	viper.SetDefault(pushgatewayDelete, false)
+	viper.SetDefault(remoteWriteURL, "")
+	viper.SetDefault(remoteWriteTokenFile, "")
+	viper.SetDefault(remoteWriteHeaders, map[string]string{})
+	viper.SetDefault(remoteWriteJob, "bme280-exporter")
+	viper.SetDefault(remoteWriteInstance, "")
+	viper.SetDefault(remoteWriteInterval, 15*time.Second)
+	viper.SetDefault(influxURL, "")
+	viper.SetDefault(influxDatabase, "")
+	viper.SetDefault(influxRetentionPolicy, "")
+	viper.SetDefault(influxOrg, "")
+	viper.SetDefault(influxBucket, "")
+	viper.SetDefault(influxTokenFile, "")
+	viper.SetDefault(influxMeasurement, "bme280")
+	viper.SetDefault(influxTags, map[string]string{})
+	viper.SetDefault(influxInterval, 10*time.Second)
+	viper.SetDefault(graphiteAddress, "")
+	viper.SetDefault(graphiteProtocol, "plaintext")
+	viper.SetDefault(graphitePrefix, "bme280.{host}")
+	viper.SetDefault(graphiteTags, false)
+	viper.SetDefault(graphiteInterval, time.Minute)
+	viper.SetDefault(statsdAddress, "")
+	viper.SetDefault(statsdPrefix, "bme280")
+	viper.SetDefault(statsdDogStatsD, false)
+	viper.SetDefault(statsdInterval, time.Duration(0))
+	viper.SetDefault(otlpEndpoint, "")
+	viper.SetDefault(otlpProtocol, "http/protobuf")
+	viper.SetDefault(otlpHeaders, map[string]string{})
+	viper.SetDefault(otlpResourceAttributes, map[string]string{})
+	viper.SetDefault(otlpInterval, 15*time.Second)
+	viper.SetDefault(mqttBroker, "")
+	viper.SetDefault(mqttClientID, "")
+	viper.SetDefault(mqttKeepAlive, time.Minute)
+	viper.SetDefault(mqttTopic, "bme280/{host}")
+	viper.SetDefault(mqttPayload, "json")
+	viper.SetDefault(mqttQoS, 0)
+	viper.SetDefault(mqttRetain, false)
+	viper.SetDefault(mqttInterval, time.Duration(0))
+	viper.SetDefault(mqttDiscoveryPrefix, "homeassistant")
+	viper.SetDefault(mqttUsername, "")
+	viper.SetDefault(mqttPasswordFile, "")
+	viper.SetDefault(mqttCleanSession, false)
+	viper.SetDefault(mqttCAFile, "")
+	viper.SetDefault(mqttCertFile, "")
+	viper.SetDefault(mqttKeyFile, "")
+	viper.SetDefault(mqttInsecureSkipVerify, false)
+	viper.SetDefault(mqttCommands, false)
+	viper.SetDefault(mqttTopicTemplate, "")
+	viper.SetDefault(mqttPayloadTemplate, "")
+	viper.SetDefault(mqttSparkplugGroupID, "")
+	viper.SetDefault(mqttSparkplugEdgeNodeID, "")
+	viper.SetDefault(kafkaBrokers, []string{})
+	viper.SetDefault(kafkaTopic, "bme280")
+	viper.SetDefault(kafkaFormat, "json")
+	viper.SetDefault(kafkaSchemaRegistry, "")
+	viper.SetDefault(kafkaInterval, time.Duration(0))
+	viper.SetDefault(natsURL, "")
+	viper.SetDefault(natsSubject, "bme280.{{ .Sensor.Host }}")
+	viper.SetDefault(natsJetStream, false)
+	viper.SetDefault(natsCAFile, "")
+	viper.SetDefault(natsCertFile, "")
+	viper.SetDefault(natsKeyFile, "")
+	viper.SetDefault(natsInterval, time.Duration(0))
+	viper.SetDefault(redisURL, "")
+	viper.SetDefault(redisKey, "bme280:{host}:{metric}")
+	viper.SetDefault(redisRetention, time.Duration(0))
+	viper.SetDefault(redisInterval, time.Duration(0))
+	viper.SetDefault(postgresURL, "")
+	viper.SetDefault(postgresTable, "bme280_readings")
+	viper.SetDefault(postgresInterval, time.Minute)
+	viper.SetDefault(elasticURL, "")
+	viper.SetDefault(elasticIndex, "bme280-{date}")
+	viper.SetDefault(elasticUsername, "")
+	viper.SetDefault(elasticPasswordFile, "")
+	viper.SetDefault(elasticAPIKeyFile, "")
+	viper.SetDefault(elasticCAFile, "")
+	viper.SetDefault(elasticInsecureSkipVerify, false)
+	viper.SetDefault(elasticInterval, 30*time.Second)
+	viper.SetDefault(sqlitePath, "")
+	viper.SetDefault(sqliteRetention, 30*24*time.Hour)
+	viper.SetDefault(sqliteRetention1m, 365*24*time.Hour)
+	viper.SetDefault(sqliteRetention15m, time.Duration(0))
+	viper.SetDefault(sqliteInterval, time.Minute)
+	viper.SetDefault(csvPath, "")
+	viper.SetDefault(csvRotate, "daily")
+	viper.SetDefault(csvMaxSize, 0)
+	viper.SetDefault(csvGzip, false)
+	viper.SetDefault(csvInterval, 0)
+	viper.SetDefault(awsRegion, "")
+	viper.SetDefault(awsProfile, "")
+	viper.SetDefault(awsIoTEndpoint, "")
+	viper.SetDefault(awsIoTThingName, "")
+	viper.SetDefault(awsIoTTopic, "bme280/{thing}")
+	viper.SetDefault(awsIoTShadow, false)
+	viper.SetDefault(awsIoTCAFile, "")
+	viper.SetDefault(awsIoTCertFile, "")
+	viper.SetDefault(awsIoTKeyFile, "")
+	viper.SetDefault(awsIoTCredentialsEndpoint, "")
+	viper.SetDefault(awsIoTRoleAlias, "")
+	viper.SetDefault(awsIoTInterval, time.Duration(0))
+	viper.SetDefault(cloudwatchNamespace, "")
+	viper.SetDefault(cloudwatchEndpoint, "")
+	viper.SetDefault(cloudwatchInterval, time.Minute)
+	viper.SetDefault(timestreamDatabase, "")
+	viper.SetDefault(timestreamTable, "readings")
+	viper.SetDefault(timestreamMeasureName, "bme280")
+	viper.SetDefault(timestreamEndpoint, "")
+	viper.SetDefault(timestreamInterval, time.Minute)
+	viper.SetDefault(datadogAPIKeyFile, "")
+	viper.SetDefault(datadogSite, "datadoghq.com")
+	viper.SetDefault(datadogPrefix, "bme280")
+	viper.SetDefault(datadogInterval, time.Minute)
+	viper.SetDefault(newRelicAPIKeyFile, "")
+	viper.SetDefault(newRelicRegion, "us")
+	viper.SetDefault(newRelicPrefix, "bme280")
+	viper.SetDefault(newRelicInterval, time.Minute)
+	viper.SetDefault(splunkURL, "")
+	viper.SetDefault(splunkTokenFile, "")
+	viper.SetDefault(splunkIndex, "")
+	viper.SetDefault(splunkSource, "bme280-exporter")
+	viper.SetDefault(splunkSourcetype, "bme280")
+	viper.SetDefault(splunkPrefix, "bme280")
+	viper.SetDefault(splunkCAFile, "")
+	viper.SetDefault(splunkInsecureSkipVerify, false)
+	viper.SetDefault(splunkInterval, 30*time.Second)
+	viper.SetDefault(thingSpeakChannel, "")
+	viper.SetDefault(thingSpeakWriteKeyFile, "")
+	viper.SetDefault(thingSpeakFields, map[string]string{temperatureMetric: "1", pressureMetric: "2", humidityMetric: "3"})
+	viper.SetDefault(thingSpeakURL, "https://api.thingspeak.com")
+	viper.SetDefault(thingSpeakInterval, time.Minute)
+	viper.SetDefault(adafruitIOUsername, "")
+	viper.SetDefault(adafruitIOKeyFile, "")
+	viper.SetDefault(adafruitIOFeeds, map[string]string{temperatureMetric: "bme280-temperature", pressureMetric: "bme280-pressure", humidityMetric: "bme280-humidity"})
+	viper.SetDefault(adafruitIORateLimit, 30)
+	viper.SetDefault(adafruitIOURL, "https://io.adafruit.com")
+	viper.SetDefault(adafruitIOInterval, time.Minute)
+	viper.SetDefault(webhookURL, "")
+	viper.SetDefault(webhookTokenFile, "")
+	viper.SetDefault(webhookHeaders, map[string]string{})
+	viper.SetDefault(webhookBatch, false)
+	viper.SetDefault(webhookCAFile, "")
+	viper.SetDefault(webhookInsecureSkipVerify, false)
+	viper.SetDefault(webhookInterval, time.Duration(0))
+	viper.SetDefault(execCommand, "")
+	viper.SetDefault(execArgs, []string{})
+	viper.SetDefault(execOn, "reading")
+	viper.SetDefault(execThresholdsKey, map[string]string{})
+	viper.SetDefault(execInterval, time.Duration(0))
+	viper.SetDefault(textfileDirectory, "")
+	viper.SetDefault(textfileName, "bme280.prom")
+	viper.SetDefault(textfileRemove, false)
+	viper.SetDefault(textfileInterval, time.Duration(0))
+	viper.SetDefault(zabbixServer, "")
+	viper.SetDefault(zabbixHost, "")
+	viper.SetDefault(zabbixKeys, map[string]string{temperatureMetric: "bme280.temperature", pressureMetric: "bme280.pressure", humidityMetric: "bme280.humidity"})
+	viper.SetDefault(zabbixCAFile, "")
+	viper.SetDefault(zabbixCertFile, "")
+	viper.SetDefault(zabbixKeyFile, "")
+	viper.SetDefault(zabbixServerName, "")
+	viper.SetDefault(zabbixInterval, time.Minute)
+	viper.SetDefault(knxGateway, "")
+	viper.SetDefault(knxRouting, false)
+	viper.SetDefault(knxMulticastAddress, knxDefaultMulticastAddr)
+	viper.SetDefault(knxIndividualAddress, "15.15.250")
+	viper.SetDefault(knxGroupAddresses, map[string]string{})
+	viper.SetDefault(knxInterval, time.Minute)
+	viper.SetDefault(lorawanDevice, "")
+	viper.SetDefault(lorawanModule, "rn2483")
+	viper.SetDefault(lorawanBaudRate, 0)
+	viper.SetDefault(lorawanPort, 1)
+	viper.SetDefault(lorawanFormat, "lpp")
+	viper.SetDefault(lorawanInterval, 15*time.Minute)
+	viper.SetDefault(signalkURL, "")
+	viper.SetDefault(signalkTokenFile, "")
+	viper.SetDefault(signalkCAFile, "")
+	viper.SetDefault(signalkContext, "vessels.self")
+	viper.SetDefault(signalkSourceLabel, "bme280")
+	viper.SetDefault(signalkPaths, map[string]string{temperatureMetric: "environment.outside.temperature", pressureMetric: "environment.outside.pressure", humidityMetric: "environment.outside.relativeHumidity"})
+	viper.SetDefault(signalkInterval, time.Duration(0))
+	viper.SetDefault(cwopCallsign, "")
+	viper.SetDefault(cwopPasscode, -1)
+	viper.SetDefault(cwopServer, "cwop.aprs.net:14580")
+	viper.SetDefault(cwopLatitude, 0.0)
+	viper.SetDefault(cwopLongitude, 0.0)
+	viper.SetDefault(cwopAltitude, 0.0)
+	viper.SetDefault(cwopInterval, 10*time.Minute)
+	viper.SetDefault(windyAPIKeyFile, "")
+	viper.SetDefault(windyStation, 0)
+	viper.SetDefault(windyAltitude, 0.0)
+	viper.SetDefault(windyURL, "https://stations.windy.com/pws/update")
+	viper.SetDefault(windyInterval, 5*time.Minute)
+	viper.SetDefault(openSenseMapBoxID, "")
+	viper.SetDefault(openSenseMapTokenFile, "")
+	viper.SetDefault(openSenseMapSensors, map[string]string{})
+	viper.SetDefault(openSenseMapPressureUnit, "hPa")
+	viper.SetDefault(openSenseMapURL, "https://api.opensensemap.org")
+	viper.SetDefault(openSenseMapInterval, time.Minute)
+	viper.SetDefault(sensorCommunitySensorID, "")
+	viper.SetDefault(sensorCommunityURL, "https://api.sensor.community/v1/push-sensor-data/")
+	viper.SetDefault(sensorCommunityMadavi, false)
+	viper.SetDefault(sensorCommunityMadaviURL, "https://api-rrd.madavi.de/data.php")
+	viper.SetDefault(sensorCommunityInterval, 145*time.Second)
+	viper.SetDefault(azureConnectionStringFile, "")
+	viper.SetDefault(azureHost, "")
+	viper.SetDefault(azureDeviceID, "")
+	viper.SetDefault(azureTwin, true)
+	viper.SetDefault(azureCAFile, "")
+	viper.SetDefault(azureCertFile, "")
+	viper.SetDefault(azureKeyFile, "")
+	viper.SetDefault(azureInterval, time.Duration(0))
+	viper.SetDefault(gcpCredentialsFileKey, "")
+	viper.SetDefault(gcpMonitoringProject, "")
+	viper.SetDefault(gcpMonitoringMetricPrefix, "custom.googleapis.com/bme280")
+	viper.SetDefault(gcpMonitoringLocation, "global")
+	viper.SetDefault(gcpMonitoringNamespace, "bme280")
+	viper.SetDefault(gcpMonitoringEndpoint, "https://monitoring.googleapis.com")
+	viper.SetDefault(gcpMonitoringInterval, time.Minute)
+	viper.SetDefault(eventsMax, 100)
+	viper.SetDefault(recoveryAfterFailures, 3)
+	viper.SetDefault(recoveryBackoff, time.Second)
+	viper.SetDefault(recoveryMaxBackoff, 5*time.Minute)
+	viper.SetDefault(recoveryResetAfter, 5)
+	viper.SetDefault(recoveryReadTimeout, 5*time.Second)
+	viper.SetDefault(pidFile, "")
+	viper.SetDefault(daemonMode, false)
+	viper.SetDefault(runAsUser, "")
+	viper.SetDefault(runAsGroup, "")
+	viper.SetDefault(temperatureOffset, 0.0)
+	viper.SetDefault(pressureOffset, 0.0)
+	viper.SetDefault(humidityOffset, 0.0)
 
-	// Create the flags with the same names as the viper configuration
-	pflag.String(i2cAddress, viper.GetString(i2cAddress), "The I2C address of the sensor")
-	pflag.Int(i2cBus, viper.GetInt(i2cBus), "The I2C bus ID")
-	pflag.IntP(metricsPort, "p", viper.GetInt(metricsPort), "The port on which to serve metrics")
-	pflag.String(modelName, viper.GetString(modelName), "The model of sensor")
-	pflag.BoolP(verbose, "v", viper.GetBool(verbose), "Change logging level to verbose")
-	pflag.Parse()
-
-	// Bind pflags to viper so they override defaults
-	viper.BindPFlags(pflag.CommandLine)
+	// Everything with a default is a setting, which is all there is before
+	// any configuration has been read
+	for _, k := range conf.AllKeys() {
+		configDefaults[k] = conf.Get(k)
+	}
 
 	var err error
 	hostname, err = os.Hostname()
 	if err != nil {
 		hostname = "unknown"
 	}
+}
 
-	if viper.GetBool(verbose) {
-		lg = logger.NewPackageLogger("main", logger.DebugLevel)
-	} else {
-		lg = logger.NewPackageLogger("main", logger.InfoLevel)
-	}
+// The flags all have the same names as the viper configuration
+
+// Picking and reading the sensor, for everything that talks to it
+func sensorFlags(fs *pflag.FlagSet) {
+	fs.String(i2cAddress, conf.GetString(i2cAddress), "The I2C address of the sensor, e.g. 0x76, 118, or 1:0x76 with the bus")
+	fs.Int(i2cBus, conf.GetInt(i2cBus), "The I2C bus ID")
+	fs.String(modelName, conf.GetString(modelName), "The model of sensor")
+	fs.Float64(temperatureOffset, conf.GetFloat64(temperatureOffset), "Added to every temperature reading in celsius, e.g. to correct for self-heating")
+	fs.Float64(pressureOffset, conf.GetFloat64(pressureOffset), "Added to every pressure reading in pascal")
+	fs.Float64(humidityOffset, conf.GetFloat64(humidityOffset), "Added to every humidity reading in percent")
+}
+
+// Finding the exporter's web server
+func webFlags(fs *pflag.FlagSet) {
+	fs.IntP(metricsPort, "p", conf.GetInt(metricsPort), "The port on which to serve metrics")
+	fs.String(webConfigFile, conf.GetString(webConfigFile), "Path to a web configuration file enabling TLS and/or basic authentication")
+}
+
+// Running the exporter
+func serveFlags(fs *pflag.FlagSet) {
+	sensorFlags(fs)
+	webFlags(fs)
+	fs.StringSlice(allowedCIDRs, conf.GetStringSlice(allowedCIDRs), "Only answer requests from these networks (comma separated CIDRs), everything else gets a 403")
+	fs.Duration(readHeaderTimeout, conf.GetDuration(readHeaderTimeout), "Maximum time to read request headers")
+	fs.Duration(readTimeout, conf.GetDuration(readTimeout), "Maximum time to read an entire request")
+	fs.Duration(writeTimeout, conf.GetDuration(writeTimeout), "Maximum time to write a response")
+	fs.Duration(idleTimeout, conf.GetDuration(idleTimeout), "How long to keep idle keep-alive connections open")
+	fs.Int(maxHeaderBytes, conf.GetInt(maxHeaderBytes), "Maximum size of request headers in bytes")
+	fs.Float64(rateLimit, conf.GetFloat64(rateLimit), "Maximum requests per second to serve, 0 for no limit")
+	fs.Int(rateBurst, conf.GetInt(rateBurst), "Number of requests allowed in a burst above the rate limit")
+	fs.Bool(rateLimitPerClient, conf.GetBool(rateLimitPerClient), "Apply the rate limit to each client address separately instead of to all requests together")
+	fs.Duration(shutdownTimeout, conf.GetDuration(shutdownTimeout), "How long to wait for in-flight requests to finish when shutting down")
+	fs.Bool(systemdSocket, conf.GetBool(systemdSocket), "Use the socket passed by systemd socket activation instead of listening on the port")
+	fs.Bool(webDisable, conf.GetBool(webDisable), "Don't serve HTTP at all, e.g. when the readings only go to a textfile")
+	fs.Bool(enablePprof, conf.GetBool(enablePprof), "Serve Go profiling data under /debug/pprof, to users from the web config file's basic_auth_users")
+	fs.Bool(enableLifecycle, conf.GetBool(enableLifecycle), "Allow the configuration to be reloaded with a POST to /-/reload")
+	fs.Bool(accessLog, conf.GetBool(accessLog), "Log every HTTP request with the client address, path, status, and duration")
+	fs.Duration(timeoutOffset, conf.GetDuration(timeoutOffset), "Give up on sensor reads this long before the scrape timeout Prometheus sends")
+	fs.String(metricsNamespace, conf.GetString(metricsNamespace), "Put this and an underscore in front of every metric name, e.g. office for office_temperature")
+	fs.StringSlice(metricsEnabled, conf.GetStringSlice(metricsEnabled), "Which of temperature, pressure and humidity to export")
+	fs.Duration(pollInterval, conf.GetDuration(pollInterval), "How often to read the sensor in the background, 0 to only read when scraped")
+	fs.Int(pollRecent, conf.GetInt(pollRecent), "How many of the background poller's readings to keep for the readings API")
+	fs.String(pollStateFile, conf.GetString(pollStateFile), "Save the background poller's readings to this file when stopping, and load them again when starting")
+	fs.Duration(pollHistory, conf.GetDuration(pollHistory), "How long to keep the background poller's readings in memory for /api/v1/history, e.g. 24h, or 0 for not at all")
+	fs.Duration(pollHistory1m, conf.GetDuration(pollHistory1m), "How long to keep each minute's averages in memory too, or 0 for not at all")
+	fs.Duration(pollHistory15m, conf.GetDuration(pollHistory15m), "How long to keep each 15 minutes' averages in memory too, or 0 for not at all")
+	fs.Bool(mdnsEnable, conf.GetBool(mdnsEnable), "Advertise the exporter on the local network with mDNS/DNS-SD")
+	fs.String(mdnsService, conf.GetString(mdnsService), "The DNS-SD service type to advertise")
+	fs.String(mdnsInstance, conf.GetString(mdnsInstance), "The DNS-SD instance name to advertise (default is the hostname)")
+	fs.String(grpcListenAddress, conf.GetString(grpcListenAddress), "Address to serve the gRPC API on, e.g. :8001 (disabled by default)")
+	fs.String(snmpListenAddress, conf.GetString(snmpListenAddress), "Address to serve SNMP on, e.g. :161 (disabled by default)")
+	fs.String(snmpCommunity, conf.GetString(snmpCommunity), "The SNMP community that can read the readings")
+	fs.String(snmpBaseOID, conf.GetString(snmpBaseOID), "Where the readings are in the SNMP tree, see mibs/BME280-EXPORTER-MIB.txt")
+	fs.String(snmpContact, conf.GetString(snmpContact), "The SNMP sysContact")
+	fs.String(snmpLocation, conf.GetString(snmpLocation), "The SNMP sysLocation, e.g. where the sensor is")
+	fs.String(modbusListenAddress, conf.GetString(modbusListenAddress), "Address to serve Modbus TCP on, e.g. :502 (disabled by default)")
+	fs.StringToString(modbusRegisters, conf.GetStringMapString(modbusRegisters), "Which input registers each value goes in, as address:type:scale")
+	fs.Int(modbusUnitID, conf.GetInt(modbusUnitID), "Only answer Modbus requests for this unit ID, 0 for any")
+	fs.Bool(modbusHoldingRegisters, conf.GetBool(modbusHoldingRegisters), "Serve the same registers as holding registers too, for masters that can't read input registers")
+	fs.String(bacnetListenAddress, conf.GetString(bacnetListenAddress), "Address to serve BACnet/IP on, e.g. :47808 (disabled by default)")
+	fs.Int(bacnetDeviceID, conf.GetInt(bacnetDeviceID), "The BACnet device instance, which has to be unique on the network")
+	fs.String(bacnetDeviceName, conf.GetString(bacnetDeviceName), "The BACnet device's name (defaults to the hostname)")
+	fs.String(bacnetLocation, conf.GetString(bacnetLocation), "The BACnet device's location, e.g. where the sensor is")
+	fs.String(bacnetBroadcastAddress, conf.GetString(bacnetBroadcastAddress), "Where to broadcast I-Am, e.g. the subnet's broadcast address")
+	fs.StringToString(bacnetCOVIncrements, conf.GetStringMapString(bacnetCOVIncrements), "How much each value has to change by for a COV notification")
+	fs.String(coapListenAddress, conf.GetString(coapListenAddress), "Address to serve CoAP on, e.g. :5683 (disabled by default)")
+	fs.String(coapFormat, conf.GetString(coapFormat), "The CoAP payload for clients that don't ask for one: json, cbor, senml+json or senml+cbor")
+	fs.Bool(bthomeEnable, conf.GetBool(bthomeEnable), "Broadcast readings as BTHome Bluetooth advertisements")
+	fs.Int(bthomeDevice, conf.GetInt(bthomeDevice), "The Bluetooth controller to advertise with, 0 for hci0")
+	fs.String(bthomeName, conf.GetString(bthomeName), "The name to advertise (defaults to the hostname, shortened to fit)")
+	fs.Duration(bthomeAdvertisingInterval, conf.GetDuration(bthomeAdvertisingInterval), "How often to send the advertisement")
+	fs.String(nmeaListenAddress, conf.GetString(nmeaListenAddress), "Send readings as NMEA 0183 sentences to TCP clients connecting to this address, e.g. :10110")
+	fs.String(nmeaDevice, conf.GetString(nmeaDevice), "Send readings as NMEA 0183 sentences to this serial port")
+	fs.Int(nmeaBaudRate, conf.GetInt(nmeaBaudRate), "The NMEA serial port's baud rate, 4800 for NMEA 0183 or 38400 for high speed")
+	fs.String(nmeaTalker, conf.GetString(nmeaTalker), "The NMEA talker ID sentences are sent with")
+	fs.StringSlice(nmeaSentences, conf.GetStringSlice(nmeaSentences), "Which NMEA sentences to send: xdr, mda or both")
+	fs.String(tracingEndpoint, conf.GetString(tracingEndpoint), "Send OpenTelemetry traces to this OTLP/HTTP endpoint, e.g. http://tempo:4318 (disabled by default)")
+	fs.Float64(tracingSampleRatio, conf.GetFloat64(tracingSampleRatio), "The fraction of scrapes and reads to trace, from 0 to 1")
+	fs.Int(eventsMax, conf.GetInt(eventsMax), "How many recent events to keep for /debug/events")
+	fs.Int(recoveryAfterFailures, conf.GetInt(recoveryAfterFailures), "Re-open the sensor after this many failed reads in a row, 0 to never")
+	fs.Duration(recoveryBackoff, conf.GetDuration(recoveryBackoff), "How long to wait before re-opening the sensor again if it still isn't answering, doubling each time")
+	fs.Duration(recoveryMaxBackoff, conf.GetDuration(recoveryMaxBackoff), "The longest to wait between attempts to re-open the sensor")
+	fs.Int(recoveryResetAfter, conf.GetInt(recoveryResetAfter), "Soft reset the sensor after this many stuck or impossible readings in a row, 0 to never")
+	fs.Duration(recoveryReadTimeout, conf.GetDuration(recoveryReadTimeout), "Give up on a sensor read that takes longer than this and open the sensor again, 0 to wait forever")
+	fs.String(pidFile, conf.GetString(pidFile), "Write the process ID to this file while running")
+	fs.Bool(daemonMode, conf.GetBool(daemonMode), "Detach from the terminal and run in the background, for init systems without systemd")
+	fs.String(runAsUser, conf.GetString(runAsUser), "Switch to this user once the sensor is open, when started as root")
+	fs.String(runAsGroup, conf.GetString(runAsGroup), "Switch to this group with --user (default is the user's primary group)")
+	sinkFlags(fs)
+}
+
+// Where to send readings besides serving them to Prometheus
+func sinkFlags(fs *pflag.FlagSet) {
+	fs.Duration(sinkTimeout, conf.GetDuration(sinkTimeout), "How long to wait for each attempt to send readings to a sink")
+	fs.String(sinkSpoolDirectory, conf.GetString(sinkSpoolDirectory), "Keep readings that couldn't be sent in this directory and send them later (default is to drop them)")
+	fs.Int(sinkSpoolMaxSize, conf.GetInt(sinkSpoolMaxSize), "The most megabytes to spool for each sink, dropping the oldest readings past that")
+
+	fs.String(pushgatewayURL, conf.GetString(pushgatewayURL), "Push readings to the Prometheus Pushgateway at this URL, e.g. http://pushgateway:9091")
+	fs.String(pushgatewayJob, conf.GetString(pushgatewayJob), "The job label to push readings under")
+	fs.String(pushgatewayInstance, conf.GetString(pushgatewayInstance), "The instance label to push readings under (default is the hostname)")
+	fs.Duration(pushgatewayInterval, conf.GetDuration(pushgatewayInterval), "How often to push to the Pushgateway (default is every reading)")
+	fs.Bool(pushgatewayDelete, conf.GetBool(pushgatewayDelete), "Delete the pushed readings from the Pushgateway on shutdown")
+
+	fs.String(remoteWriteURL, conf.GetString(remoteWriteURL), "Send readings with Prometheus remote write to this URL, e.g. http://prometheus:9090/api/v1/write")
+	fs.String(remoteWriteTokenFile, conf.GetString(remoteWriteTokenFile), "Authenticate remote writes with the bearer token in this file")
+	fs.StringToString(remoteWriteHeaders, conf.GetStringMapString(remoteWriteHeaders), "Extra HTTP headers for remote writes, e.g. X-Scope-OrgID=home")
+	fs.String(remoteWriteJob, conf.GetString(remoteWriteJob), "The job label to add to remote written series")
+	fs.String(remoteWriteInstance, conf.GetString(remoteWriteInstance), "The instance label to add to remote written series (default is the hostname)")
+	fs.Duration(remoteWriteInterval, conf.GetDuration(remoteWriteInterval), "How often to send readings with remote write")
+
+	fs.String(influxURL, conf.GetString(influxURL), "Write readings to InfluxDB at this URL, e.g. http://influxdb:8086, or udp://influxdb:8089 for its UDP listener")
+	fs.String(influxDatabase, conf.GetString(influxDatabase), "The InfluxDB 1.x database to write to")
+	fs.String(influxRetentionPolicy, conf.GetString(influxRetentionPolicy), "The InfluxDB 1.x retention policy to write to (default is the database's default)")
+	fs.String(influxOrg, conf.GetString(influxOrg), "The InfluxDB 2.x organization to write to")
+	fs.String(influxBucket, conf.GetString(influxBucket), "The InfluxDB 2.x bucket to write to")
+	fs.String(influxTokenFile, conf.GetString(influxTokenFile), "A file with the InfluxDB 2.x API token")
+	fs.String(influxMeasurement, conf.GetString(influxMeasurement), "The InfluxDB measurement to write readings as")
+	fs.StringToString(influxTags, conf.GetStringMapString(influxTags), "Extra tags to add to InfluxDB points, e.g. room=kitchen")
+	fs.Duration(influxInterval, conf.GetDuration(influxInterval), "How often to write readings to InfluxDB")
+
+	fs.String(graphiteAddress, conf.GetString(graphiteAddress), "Send readings to the Graphite carbon receiver at this host:port, e.g. graphite:2003")
+	fs.String(graphiteProtocol, conf.GetString(graphiteProtocol), "Talk to carbon in plaintext or pickle (usually on port 2004)")
+	fs.String(graphitePrefix, conf.GetString(graphitePrefix), "What to put before the metric names in Graphite, with {host} replaced by the hostname")
+	fs.Bool(graphiteTags, conf.GetBool(graphiteTags), "Add the labels to Graphite metrics as tags, for Graphite 1.1 and later")
+	fs.Duration(graphiteInterval, conf.GetDuration(graphiteInterval), "How often to send readings to Graphite")
+
+	fs.String(statsdAddress, conf.GetString(statsdAddress), "Send readings as StatsD gauges to this UDP host:port, or unix:///path for a Unix socket")
+	fs.String(statsdPrefix, conf.GetString(statsdPrefix), "What to put before the StatsD metric names")
+	fs.Bool(statsdDogStatsD, conf.GetBool(statsdDogStatsD), "Add the labels as DogStatsD tags, for the Datadog agent or Telegraf with datadog_extensions")
+	fs.Duration(statsdInterval, conf.GetDuration(statsdInterval), "How often to send readings to StatsD (default is every reading)")
+
+	fs.String(otlpEndpoint, conf.GetString(otlpEndpoint), "Export readings as OpenTelemetry metrics to this endpoint, e.g. http://otel-collector:4318, or port 4317 for gRPC")
+	fs.String(otlpProtocol, conf.GetString(otlpProtocol), "Export OpenTelemetry metrics with http/protobuf or grpc")
+	fs.StringToString(otlpHeaders, conf.GetStringMapString(otlpHeaders), "Extra headers for OpenTelemetry metric exports, e.g. api-key=secret")
+	fs.StringToString(otlpResourceAttributes, conf.GetStringMapString(otlpResourceAttributes), "Extra resource attributes for OpenTelemetry metrics, e.g. deployment.environment=home")
+	fs.Duration(otlpInterval, conf.GetDuration(otlpInterval), "How often to export OpenTelemetry metrics")
+
+	fs.String(mqttBroker, conf.GetString(mqttBroker), "Publish readings to the MQTT broker at this URL, e.g. tcp://mosquitto:1883")
+	fs.String(mqttClientID, conf.GetString(mqttClientID), "The MQTT client ID (default is bme280-exporter-<hostname>)")
+	fs.Duration(mqttKeepAlive, conf.GetDuration(mqttKeepAlive), "How often to check the MQTT connection is still there when nothing's being published")
+	fs.String(mqttTopic, conf.GetString(mqttTopic), "The MQTT topic to publish to, with {host} replaced by the hostname")
+	fs.String(mqttPayload, conf.GetString(mqttPayload), "Publish readings as one json message, or values to a topic each under the topic")
+	fs.Int(mqttQoS, conf.GetInt(mqttQoS), "The MQTT quality of service to publish with, 0, 1 or 2")
+	fs.Bool(mqttRetain, conf.GetBool(mqttRetain), "Have the MQTT broker keep the latest reading for new subscribers")
+	fs.Duration(mqttInterval, conf.GetDuration(mqttInterval), "How often to publish readings to MQTT (default is every reading)")
+	fs.String(mqttDiscoveryPrefix, conf.GetString(mqttDiscoveryPrefix), "Where Home Assistant looks for MQTT discovery messages, or empty not to send them")
+	fs.String(mqttUsername, conf.GetString(mqttUsername), "The user name to log in to the MQTT broker with")
+	fs.String(mqttPasswordFile, conf.GetString(mqttPasswordFile), "A file with the password to log in to the MQTT broker with")
+	fs.Bool(mqttCleanSession, conf.GetBool(mqttCleanSession), "Start a new MQTT session on each connection rather than resuming the last one")
+	fs.String(mqttCAFile, conf.GetString(mqttCAFile), "Check the MQTT broker's certificate against the CAs in this file (default is the system's)")
+	fs.String(mqttCertFile, conf.GetString(mqttCertFile), "A client certificate for the MQTT broker")
+	fs.String(mqttKeyFile, conf.GetString(mqttKeyFile), "The key for --"+mqttCertFile)
+	fs.Bool(mqttInsecureSkipVerify, conf.GetBool(mqttInsecureSkipVerify), "Don't check the MQTT broker's certificate")
+	fs.Bool(mqttCommands, conf.GetBool(mqttCommands), "Take commands to read, change the poll interval, or change the calibration from <topic>/command")
+	fs.String(mqttTopicTemplate, conf.GetString(mqttTopicTemplate), "A Go template for the MQTT topic to publish each reading to, instead of the topic")
+	fs.String(mqttPayloadTemplate, conf.GetString(mqttPayloadTemplate), "A Go template for the MQTT payload of each reading, instead of the usual JSON")
+	fs.String(mqttSparkplugGroupID, conf.GetString(mqttSparkplugGroupID), "Publish as a Sparkplug B edge node in this group, instead of to the topic")
+	fs.String(mqttSparkplugEdgeNodeID, conf.GetString(mqttSparkplugEdgeNodeID), "The Sparkplug B edge node ID (default is the hostname)")
+	fs.StringSlice(kafkaBrokers, conf.GetStringSlice(kafkaBrokers), "Produce readings to Kafka, starting from these brokers (comma separated host:port)")
+	fs.String(kafkaTopic, conf.GetString(kafkaTopic), "The Kafka topic to produce readings to")
+	fs.String(kafkaFormat, conf.GetString(kafkaFormat), "Produce readings as json, or avro with the schema in the schema registry")
+	fs.String(kafkaSchemaRegistry, conf.GetString(kafkaSchemaRegistry), "The URL of the Confluent schema registry for avro, e.g. http://schema-registry:8081")
+	fs.Duration(kafkaInterval, conf.GetDuration(kafkaInterval), "How often to produce readings to Kafka (default is every reading)")
+	fs.String(natsURL, conf.GetString(natsURL), "Publish readings to the NATS server at this URL, e.g. nats://nats:4222")
+	fs.String(natsSubject, conf.GetString(natsSubject), "A Go template for the NATS subject to publish each reading to")
+	fs.Bool(natsJetStream, conf.GetBool(natsJetStream), "Wait for a JetStream stream to store each reading")
+	fs.String(natsCAFile, conf.GetString(natsCAFile), "Check the NATS server's certificate against the CAs in this file (default is the system's)")
+	fs.String(natsCertFile, conf.GetString(natsCertFile), "A client certificate for the NATS server")
+	fs.String(natsKeyFile, conf.GetString(natsKeyFile), "The key for --"+natsCertFile)
+	fs.Duration(natsInterval, conf.GetDuration(natsInterval), "How often to publish readings to NATS (default is every reading)")
+	fs.String(redisURL, conf.GetString(redisURL), "Add readings to RedisTimeSeries at this URL, e.g. redis://redis:6379/0")
+	fs.String(redisKey, conf.GetString(redisKey), "The Redis key for each series, with {host} and {metric} replaced")
+	fs.Duration(redisRetention, conf.GetDuration(redisRetention), "How long Redis keeps readings in series it creates (default is forever)")
+	fs.Duration(redisInterval, conf.GetDuration(redisInterval), "How often to add readings to Redis (default is every reading)")
+	fs.String(postgresURL, conf.GetString(postgresURL), "Insert readings into the PostgreSQL or TimescaleDB database at this URL, e.g. postgres://bme280:password@db:5432/sensors")
+	fs.String(postgresTable, conf.GetString(postgresTable), "The table to insert readings into, which is created if it isn't there")
+	fs.Duration(postgresInterval, conf.GetDuration(postgresInterval), "How often to insert the readings since the last time into PostgreSQL")
+	fs.String(elasticURL, conf.GetString(elasticURL), "Index readings in Elasticsearch or OpenSearch at this URL, e.g. https://elasticsearch:9200")
+	fs.String(elasticIndex, conf.GetString(elasticIndex), "The index or data stream to put readings in, with {date} replaced by the reading's date")
+	fs.String(elasticUsername, conf.GetString(elasticUsername), "The user name to log in to Elasticsearch with")
+	fs.String(elasticPasswordFile, conf.GetString(elasticPasswordFile), "A file with the password to log in to Elasticsearch with")
+	fs.String(elasticAPIKeyFile, conf.GetString(elasticAPIKeyFile), "A file with an Elasticsearch API key, instead of a user name and password")
+	fs.String(elasticCAFile, conf.GetString(elasticCAFile), "Check Elasticsearch's certificate against the CAs in this file (default is the system's)")
+	fs.Bool(elasticInsecureSkipVerify, conf.GetBool(elasticInsecureSkipVerify), "Don't check Elasticsearch's certificate")
+	fs.Duration(elasticInterval, conf.GetDuration(elasticInterval), "How often to index the readings since the last time in Elasticsearch")
+	historyFlags(fs)
+	fs.Duration(sqliteRetention, conf.GetDuration(sqliteRetention), "How long to keep readings in SQLite, or 0 for forever")
+	fs.Duration(sqliteRetention1m, conf.GetDuration(sqliteRetention1m), "How long to keep each minute's averages in SQLite, or 0 for forever")
+	fs.Duration(sqliteRetention15m, conf.GetDuration(sqliteRetention15m), "How long to keep each 15 minutes' averages in SQLite, or 0 for forever")
+	fs.Duration(sqliteInterval, conf.GetDuration(sqliteInterval), "How often to add the readings since the last time to SQLite")
+	fs.String(csvPath, conf.GetString(csvPath), "Write readings to the CSV file at this path")
+	fs.String(csvRotate, conf.GetString(csvRotate), "When to start a new CSV file, daily or none")
+	fs.Int(csvMaxSize, conf.GetInt(csvMaxSize), "Start a new CSV file once it's this many megabytes, or 0 for no limit")
+	fs.Bool(csvGzip, conf.GetBool(csvGzip), "Gzip CSV files once a new one's started")
+	fs.Duration(csvInterval, conf.GetDuration(csvInterval), "How often to write the readings since the last time to CSV, or 0 for each reading")
+	fs.String(awsRegion, conf.GetString(awsRegion), "The AWS region for CloudWatch and Timestream (default is $AWS_REGION)")
+	fs.String(awsProfile, conf.GetString(awsProfile), "The profile in ~/.aws/credentials to use, instead of credentials in the environment")
+	fs.String(awsIoTEndpoint, conf.GetString(awsIoTEndpoint), "Publish readings to AWS IoT Core at this device data endpoint, e.g. abc123-ats.iot.eu-west-1.amazonaws.com")
+	fs.String(awsIoTThingName, conf.GetString(awsIoTThingName), "The AWS IoT thing name, also used as the MQTT client ID (default is the hostname)")
+	fs.String(awsIoTTopic, conf.GetString(awsIoTTopic), "The AWS IoT topic to publish to, with {thing} replaced by the thing name")
+	fs.Bool(awsIoTShadow, conf.GetBool(awsIoTShadow), "Report the latest reading in the thing's shadow too")
+	fs.String(awsIoTCAFile, conf.GetString(awsIoTCAFile), "Check AWS IoT's certificate against the CAs in this file, like AmazonRootCA1.pem (default is the system's)")
+	fs.String(awsIoTCertFile, conf.GetString(awsIoTCertFile), "The device's certificate registered in AWS IoT")
+	fs.String(awsIoTKeyFile, conf.GetString(awsIoTKeyFile), "The key for --"+awsIoTCertFile)
+	fs.String(awsIoTCredentialsEndpoint, conf.GetString(awsIoTCredentialsEndpoint), "Get AWS credentials for CloudWatch with the device's certificate from this AWS IoT credentials provider endpoint")
+	fs.String(awsIoTRoleAlias, conf.GetString(awsIoTRoleAlias), "The AWS IoT role alias to get credentials for")
+	fs.Duration(awsIoTInterval, conf.GetDuration(awsIoTInterval), "How often to publish readings to AWS IoT (default is every reading)")
+	fs.String(cloudwatchNamespace, conf.GetString(cloudwatchNamespace), "Put readings in CloudWatch as metrics in this namespace, e.g. BME280")
+	fs.String(cloudwatchEndpoint, conf.GetString(cloudwatchEndpoint), "The CloudWatch endpoint URL (default is the region's)")
+	fs.Duration(cloudwatchInterval, conf.GetDuration(cloudwatchInterval), "How often to put the readings since the last time in CloudWatch")
+	fs.String(timestreamDatabase, conf.GetString(timestreamDatabase), "Write readings to this Amazon Timestream database")
+	fs.String(timestreamTable, conf.GetString(timestreamTable), "The Timestream table to write readings to")
+	fs.String(timestreamMeasureName, conf.GetString(timestreamMeasureName), "The measure name of the Timestream records")
+	fs.String(timestreamEndpoint, conf.GetString(timestreamEndpoint), "The Timestream ingest endpoint URL (default is to ask Timestream)")
+	fs.Duration(timestreamInterval, conf.GetDuration(timestreamInterval), "How often to write the readings since the last time to Timestream")
+	fs.String(datadogAPIKeyFile, conf.GetString(datadogAPIKeyFile), "Submit readings to Datadog with the API key in this file")
+	fs.String(datadogSite, conf.GetString(datadogSite), "The Datadog site, like datadoghq.com, datadoghq.eu or us5.datadoghq.com")
+	fs.String(datadogPrefix, conf.GetString(datadogPrefix), "What Datadog metric names start with, before a dot")
+	fs.Duration(datadogInterval, conf.GetDuration(datadogInterval), "How often to submit the readings since the last time to Datadog")
+	fs.String(newRelicAPIKeyFile, conf.GetString(newRelicAPIKeyFile), "Send readings to New Relic with the license key in this file")
+	fs.String(newRelicRegion, conf.GetString(newRelicRegion), "The New Relic account's region, us or eu")
+	fs.String(newRelicPrefix, conf.GetString(newRelicPrefix), "What New Relic metric names start with, before a dot")
+	fs.Duration(newRelicInterval, conf.GetDuration(newRelicInterval), "How often to send the readings since the last time to New Relic")
+	fs.String(splunkURL, conf.GetString(splunkURL), "Send readings to the Splunk HTTP Event Collector at this URL, e.g. https://splunk:8088")
+	fs.String(splunkTokenFile, conf.GetString(splunkTokenFile), "A file with the HEC token")
+	fs.String(splunkIndex, conf.GetString(splunkIndex), "The metrics index to put readings in (default is the token's)")
+	fs.String(splunkSource, conf.GetString(splunkSource), "The source of the events sent to Splunk")
+	fs.String(splunkSourcetype, conf.GetString(splunkSourcetype), "The sourcetype of the events sent to Splunk")
+	fs.String(splunkPrefix, conf.GetString(splunkPrefix), "What Splunk metric names start with, before a dot")
+	fs.String(splunkCAFile, conf.GetString(splunkCAFile), "Check Splunk's certificate against the CAs in this file (default is the system's)")
+	fs.Bool(splunkInsecureSkipVerify, conf.GetBool(splunkInsecureSkipVerify), "Don't check Splunk's certificate")
+	fs.Duration(splunkInterval, conf.GetDuration(splunkInterval), "How often to send the readings since the last time to Splunk")
+	fs.String(thingSpeakChannel, conf.GetString(thingSpeakChannel), "Upload readings to the ThingSpeak channel with this ID")
+	fs.String(thingSpeakWriteKeyFile, conf.GetString(thingSpeakWriteKeyFile), "A file with the channel's write API key")
+	fs.StringToString(thingSpeakFields, conf.GetStringMapString(thingSpeakFields), "Which channel field each metric goes in")
+	fs.String(thingSpeakURL, conf.GetString(thingSpeakURL), "The ThingSpeak server, for a self-hosted one")
+	fs.Duration(thingSpeakInterval, conf.GetDuration(thingSpeakInterval), "How often to upload the readings since the last time to ThingSpeak, 15s at the least on a free account")
+	fs.String(adafruitIOUsername, conf.GetString(adafruitIOUsername), "Upload readings to this Adafruit IO user's feeds")
+	fs.String(adafruitIOKeyFile, conf.GetString(adafruitIOKeyFile), "A file with the Adafruit IO key")
+	fs.StringToString(adafruitIOFeeds, conf.GetStringMapString(adafruitIOFeeds), "Which feed each metric goes to")
+	fs.Int(adafruitIORateLimit, conf.GetInt(adafruitIORateLimit), "How many data points to send Adafruit IO a minute at most, 30 on a free account")
+	fs.String(adafruitIOURL, conf.GetString(adafruitIOURL), "The Adafruit IO server")
+	fs.Duration(adafruitIOInterval, conf.GetDuration(adafruitIOInterval), "How often to upload the readings since the last time to Adafruit IO")
+	fs.String(webhookURL, conf.GetString(webhookURL), "POST readings as JSON to this URL")
+	fs.String(webhookTokenFile, conf.GetString(webhookTokenFile), "Authenticate webhook requests with the bearer token in this file")
+	fs.StringToString(webhookHeaders, conf.GetStringMapString(webhookHeaders), "Extra HTTP headers for webhook requests, e.g. X-Api-Key=secret")
+	fs.Bool(webhookBatch, conf.GetBool(webhookBatch), "POST the readings since the last time as one JSON array, instead of one request each")
+	fs.String(webhookCAFile, conf.GetString(webhookCAFile), "Check the webhook's certificate against the CAs in this file (default is the system's)")
+	fs.Bool(webhookInsecureSkipVerify, conf.GetBool(webhookInsecureSkipVerify), "Don't check the webhook's certificate")
+	fs.Duration(webhookInterval, conf.GetDuration(webhookInterval), "How often to send the readings since the last time to the webhook (default is each as it's read)")
+	fs.String(execCommand, conf.GetString(execCommand), "Run this command for readings, with each reading as JSON on its stdin")
+	fs.StringSlice(execArgs, conf.GetStringSlice(execArgs), "Arguments to run the command with")
+	fs.String(execOn, conf.GetString(execOn), "When to run the command: reading, for each reading, or threshold, when a value crosses its threshold")
+	fs.StringToString(execThresholdsKey, conf.GetStringMapString(execThresholdsKey), "Thresholds for running the command, e.g. temperature=30,humidity=70")
+	fs.Duration(execInterval, conf.GetDuration(execInterval), "How often to run the command for the readings since the last time (default is each as it's read)")
+	fs.String(textfileDirectory, conf.GetString(textfileDirectory), "Write the latest reading to a file in this directory for node_exporter's textfile collector")
+	fs.String(textfileName, conf.GetString(textfileName), "The name of the file for the textfile collector")
+	fs.Bool(textfileRemove, conf.GetBool(textfileRemove), "Remove the file for the textfile collector on shutdown")
+	fs.Duration(textfileInterval, conf.GetDuration(textfileInterval), "How often to write the file for the textfile collector (default is every reading)")
+	fs.String(zabbixServer, conf.GetString(zabbixServer), "Send readings to the Zabbix server or proxy at this address, e.g. zabbix:10051")
+	fs.String(zabbixHost, conf.GetString(zabbixHost), "The host in Zabbix the items belong to (default is the hostname)")
+	fs.StringToString(zabbixKeys, conf.GetStringMapString(zabbixKeys), "Which trapper item key each metric goes to")
+	fs.String(zabbixCAFile, conf.GetString(zabbixCAFile), "Check Zabbix's certificate against the CAs in this file (default is the system's)")
+	fs.String(zabbixCertFile, conf.GetString(zabbixCertFile), "Connect to Zabbix with TLS, with the client certificate in this file")
+	fs.String(zabbixKeyFile, conf.GetString(zabbixKeyFile), "The client certificate's key for Zabbix")
+	fs.String(zabbixServerName, conf.GetString(zabbixServerName), "The name in Zabbix's certificate (default is the server's host)")
+	fs.Duration(zabbixInterval, conf.GetDuration(zabbixInterval), "How often to send the readings since the last time to Zabbix")
+	fs.String(knxGateway, conf.GetString(knxGateway), "Send readings to KNX through the tunnel of the KNXnet/IP interface at this address")
+	fs.Bool(knxRouting, conf.GetBool(knxRouting), "Send readings to KNX by multicast to KNXnet/IP routers instead of through a tunnel")
+	fs.String(knxMulticastAddress, conf.GetString(knxMulticastAddress), "The KNXnet/IP routing multicast group")
+	fs.String(knxIndividualAddress, conf.GetString(knxIndividualAddress), "The individual address readings come from when routing")
+	fs.StringToString(knxGroupAddresses, conf.GetStringMapString(knxGroupAddresses), "Which KNX group address each metric is written to, with the datapoint type after a colon")
+	fs.Duration(knxInterval, conf.GetDuration(knxInterval), "How often to send the latest reading to KNX")
+	fs.String(lorawanDevice, conf.GetString(lorawanDevice), "Send readings as LoRaWAN uplinks through the LoRa module on this serial port")
+	fs.String(lorawanModule, conf.GetString(lorawanModule), "The LoRa module's command set: rn2483, rak3172 or wio-e5")
+	fs.Int(lorawanBaudRate, conf.GetInt(lorawanBaudRate), "The LoRa module's baud rate, or 0 for the module's default")
+	fs.Int(lorawanPort, conf.GetInt(lorawanPort), "The LoRaWAN port (FPort) uplinks are sent on")
+	fs.String(lorawanFormat, conf.GetString(lorawanFormat), "The uplink payload: lpp for Cayenne LPP, or compact")
+	fs.Duration(lorawanInterval, conf.GetDuration(lorawanInterval), "How often to send the latest reading over LoRaWAN")
+	fs.String(signalkURL, conf.GetString(signalkURL), "Send readings as deltas to the Signal K server's stream at this ws://, wss:// or udp:// URL")
+	fs.String(signalkTokenFile, conf.GetString(signalkTokenFile), "A file with the token to give the Signal K server, if it has security turned on")
+	fs.String(signalkCAFile, conf.GetString(signalkCAFile), "The CA to check the Signal K server's certificate against for wss://")
+	fs.String(signalkContext, conf.GetString(signalkContext), "The Signal K context readings are about")
+	fs.String(signalkSourceLabel, conf.GetString(signalkSourceLabel), "The source label readings show up with in Signal K")
+	fs.StringToString(signalkPaths, conf.GetStringMapString(signalkPaths), "Which Signal K path each metric is sent as")
+	fs.Duration(signalkInterval, conf.GetDuration(signalkInterval), "How often to send readings to Signal K, or 0 to send each as it comes")
+	fs.String(cwopCallsign, conf.GetString(cwopCallsign), "Report readings to CWOP as this station, e.g. CW1234 or an amateur callsign")
+	fs.Int(cwopPasscode, conf.GetInt(cwopPasscode), "The APRS-IS passcode for an amateur callsign, -1 for CWOP stations")
+	fs.String(cwopServer, conf.GetString(cwopServer), "The APRS-IS server to report to")
+	fs.Float64(cwopLatitude, conf.GetFloat64(cwopLatitude), "The station's latitude in degrees, negative for south")
+	fs.Float64(cwopLongitude, conf.GetFloat64(cwopLongitude), "The station's longitude in degrees, negative for west")
+	fs.Float64(cwopAltitude, conf.GetFloat64(cwopAltitude), "The sensor's altitude in metres, for working out the pressure at sea level")
+	fs.Duration(cwopInterval, conf.GetDuration(cwopInterval), "How often to report to CWOP, at least 5m")
+	fs.String(windyAPIKeyFile, conf.GetString(windyAPIKeyFile), "Upload readings to Windy with the station API key in this file")
+	fs.Int(windyStation, conf.GetInt(windyStation), "Which of the account's Windy stations readings are for")
+	fs.Float64(windyAltitude, conf.GetFloat64(windyAltitude), "The sensor's altitude in metres, to send Windy the pressure at sea level")
+	fs.String(windyURL, conf.GetString(windyURL), "Windy's station update URL, which the key is added to")
+	fs.Duration(windyInterval, conf.GetDuration(windyInterval), "How often to upload to Windy, at least 5m")
+	fs.String(openSenseMapBoxID, conf.GetString(openSenseMapBoxID), "Upload readings to this senseBox on openSenseMap")
+	fs.String(openSenseMapTokenFile, conf.GetString(openSenseMapTokenFile), "A file with the senseBox's access token")
+	fs.StringToString(openSenseMapSensors, conf.GetStringMapString(openSenseMapSensors), "Which of the senseBox's sensor IDs each metric is uploaded as")
+	fs.String(openSenseMapPressureUnit, conf.GetString(openSenseMapPressureUnit), "The unit the senseBox's pressure sensor is in: hPa or Pa")
+	fs.String(openSenseMapURL, conf.GetString(openSenseMapURL), "The openSenseMap API")
+	fs.Duration(openSenseMapInterval, conf.GetDuration(openSenseMapInterval), "How often to upload to openSenseMap")
+	fs.String(sensorCommunitySensorID, conf.GetString(sensorCommunitySensorID), "Push readings to sensor.community as this sensor, e.g. raspi-0000000012345678")
+	fs.String(sensorCommunityURL, conf.GetString(sensorCommunityURL), "The sensor.community push API")
+	fs.Bool(sensorCommunityMadavi, conf.GetBool(sensorCommunityMadavi), "Push readings to Madavi too, for its graphs")
+	fs.String(sensorCommunityMadaviURL, conf.GetString(sensorCommunityMadaviURL), "The Madavi push API")
+	fs.Duration(sensorCommunityInterval, conf.GetDuration(sensorCommunityInterval), "How often to push to sensor.community")
+	fs.String(azureConnectionStringFile, conf.GetString(azureConnectionStringFile), "Send readings to Azure IoT Hub as the device in the connection string in this file")
+	fs.String(azureHost, conf.GetString(azureHost), "The Azure IoT Hub host name, e.g. example.azure-devices.net, for a device with an X.509 certificate and no connection string")
+	fs.String(azureDeviceID, conf.GetString(azureDeviceID), "The Azure IoT Hub device ID, with --"+azureHost+" (default is the hostname)")
+	fs.Bool(azureTwin, conf.GetBool(azureTwin), "Report the sensor, poll interval, calibration and labels in the device twin")
+	fs.String(azureCAFile, conf.GetString(azureCAFile), "Check Azure IoT Hub's certificate against the CAs in this file (default is the system's)")
+	fs.String(azureCertFile, conf.GetString(azureCertFile), "The device's X.509 certificate, instead of a SAS key")
+	fs.String(azureKeyFile, conf.GetString(azureKeyFile), "The key for --"+azureCertFile)
+	fs.Duration(azureInterval, conf.GetDuration(azureInterval), "How often to send readings to Azure IoT Hub (default is every reading)")
+	fs.String(gcpCredentialsFileKey, conf.GetString(gcpCredentialsFileKey), "A Google Cloud service account key or gcloud credentials file (default is $GOOGLE_APPLICATION_CREDENTIALS, gcloud's, or the metadata server's)")
+	fs.String(gcpMonitoringProject, conf.GetString(gcpMonitoringProject), "Write readings to Google Cloud Monitoring in this project")
+	fs.String(gcpMonitoringMetricPrefix, conf.GetString(gcpMonitoringMetricPrefix), "What Cloud Monitoring metric types start with")
+	fs.String(gcpMonitoringLocation, conf.GetString(gcpMonitoringLocation), "The location resource label, like a zone or a site name")
+	fs.String(gcpMonitoringNamespace, conf.GetString(gcpMonitoringNamespace), "The namespace resource label, for telling groups of sensors apart")
+	fs.String(gcpMonitoringEndpoint, conf.GetString(gcpMonitoringEndpoint), "The Cloud Monitoring API URL")
+	fs.Duration(gcpMonitoringInterval, conf.GetDuration(gcpMonitoringInterval), "How often to write the readings since the last time to Cloud Monitoring")
 }
 
-func getSensorName() string {
-	id, err := sensor.ReadSensorID()
+// Where the history's kept, for serve and export
+func historyFlags(fs *pflag.FlagSet) {
+	fs.String(sqlitePath, conf.GetString(sqlitePath), "Keep readings in the SQLite database at this path, and serve them from /api/v1/history")
+}
+
+func healthcheckFlags(fs *pflag.FlagSet) {
+	webFlags(fs)
+	fs.String(healthcheckURL, conf.GetString(healthcheckURL), "Readiness URL queried by the healthcheck command (default is /-/ready on the local port)")
+	fs.Duration(healthcheckTimeout, conf.GetDuration(healthcheckTimeout), "How long the healthcheck command waits for an answer")
+	fs.String(healthcheckUsername, conf.GetString(healthcheckUsername), "The user from the web config's basic_auth_users to log in as")
+	fs.String(healthcheckPasswordFile, conf.GetString(healthcheckPasswordFile), "A file with the password for --healthcheck.username")
+}
+
+func checkConfigFlags(fs *pflag.FlagSet) {
+	allFlags(fs)
+	fs.Bool(checkConnect, conf.GetBool(checkConnect), "Try connecting to each sink that's enabled, and report the ones that can't be reached")
+	fs.Duration(checkTimeout, conf.GetDuration(checkTimeout), "How long to wait for each sink with --check.connect")
+}
+
+// The model of an open sensor, going by its chip ID
+func getSensorName(s *bsbmp.BMP) string {
+	if s == nil {
+		return "unknown"
+	}
+	id, err := s.ReadSensorID()
 	if err != nil {
 		return "unknown"
 	}
+	return sensorNameForID(id)
+}
+
+func sensorNameForID(id uint8) string {
 	switch id {
 	case 0x55:
 		return "BME180"
@@ -143,6 +1289,9 @@ func getSensorName() string {
 	return "unknown"
 }
 
+// The models getSensorID knows about
+var sensorModels = []string{"BME180", "BMP280", "BME280", "BME388"}
+
 func getSensorID(name string) (bsbmp.SensorType, error) {
 	switch name {
 	case "BME180":
@@ -159,58 +1308,356 @@ func getSensorID(name string) (bsbmp.SensorType, error) {
 }
 
 func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+// How often the background poller should read the sensor, if at all. The
+// systemd watchdog's heartbeats need it to run often enough.
+func configuredPollInterval() time.Duration {
+	interval := conf.GetDuration(pollInterval)
+	if wd := sdWatchdogInterval(); wd > 0 && (interval <= 0 || interval > wd/2) {
+		interval = wd / 2
+	}
+	return interval
+}
 
-	defer logger.FinalizeLogger()
+// Run the exporter until it's told to stop
+func runServe(args []string) int {
+	if conf.GetBool(daemonMode) && !isDaemonChild() {
+		return runInBackground()
+	}
+	var runAs *credentials
+	if name := conf.GetString(runAsUser); name != "" {
+		var err error
+		if runAs, err = lookupCredentials(name, conf.GetString(runAsGroup)); err != nil {
+			lg.Fatal(err)
+		}
+	}
+	if path := conf.GetString(pidFile); path != "" {
+		removePIDFile, err := writePIDFile(path)
+		if err != nil {
+			lg.Fatal(err)
+		}
+		defer removePIDFile()
+	}
 
-	// Create new connection to i2c-bus on 1 line with address 0x76.
-	// Use i2cdetect utility to find device address over the i2c-bus
-	i2c, err := i2c.NewI2C(uint8(viper.GetUint(i2cAddress)), viper.GetInt(i2cBus))
+	maxEvents = conf.GetInt(eventsMax)
+	recordEvent("start", "Exporter started")
 
-	if err != nil {
+	// Connect to the sensor on the i2c bus. Use i2cdetect utility to find
+	// device address over the i2c-bus. At boot it might not be there yet, so
+	// carry on without it and keep trying in the background.
+	if _, _, err := configuredAddress(); err != nil {
+		lg.Fatal(err)
+	}
+	if _, err := getSensorID(conf.GetString(modelName)); err != nil {
 		lg.Fatal(err)
 	}
-	defer i2c.Close()
+	sensorOpened := true
+	if err := openSensor(); err != nil {
+		// Once we've switched users it most likely can't be opened at all
+		if runAs != nil {
+			lg.Errorf("Problem opening the sensor before switching to user %s: %v", conf.GetString(runAsUser), err)
+			return 1
+		}
+		lg.Warnf("Problem opening the sensor, will keep trying: %v", err)
+		recordEvent("sensor", "Problem opening the sensor: %v", err)
+		sensorOpened = false
+		atomic.StoreInt32(&sensorHealthy, 0)
+	}
+	defer closeSensor()
+
+	// Everything from here on only needs the already open device
+	if runAs != nil {
+		if err := dropPrivileges(runAs); err != nil {
+			lg.Fatal(err)
+		}
+	}
 
-	// Turn down the logging levels for the libraries
-	logger.ChangePackageLogLevel("i2c", logger.InfoLevel)
-	logger.ChangePackageLogLevel("bsbmp", logger.InfoLevel)
+	setCalibration(calibrationFromConfig())
 
-	// Figure out what kind of sensor we have
-	modelID, err := getSensorID(viper.GetString(modelName))
+	// Spans keep arriving until everything else has shut down, so tracing
+	// gets its own context that's only cancelled at the very end
+	tracingCtx, stopTracing := context.WithCancel(context.Background())
+	t, err := startTracing(tracingCtx)
 	if err != nil {
 		lg.Fatal(err)
 	}
-	sensor, err = bsbmp.NewBMP(modelID, i2c)
 
-	if err != nil {
-		lg.Fatal(err)
+	// Stop cleanly on SIGINT/SIGTERM so the deferred cleanup above actually runs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// and the same way when one of the servers fails
+	svcs, ctx := newServices(ctx)
+
+	go recoverSensor(ctx)
+	if !sensorOpened {
+		wakeRecovery()
 	}
 
-	id, err := sensor.ReadSensorID()
-	if err != nil {
-		lg.Fatal(err)
+	// SIGHUP reloads the configuration, like the rest of the Prometheus ecosystem
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig()
+		}
+	}()
+
+	// With the systemd watchdog enabled, only send heartbeats while the
+	// sensor is actually answering, so a wedged I2C bus gets us restarted
+	interval := configuredPollInterval()
+	var hooks []func(reading)
+	if wd := sdWatchdogInterval(); wd > 0 {
+		lg.Infof("systemd watchdog enabled with a %s timeout", wd)
+		hooks = append(hooks, func(r reading) {
+			if !r.ok() {
+				lg.Warn("Not sending watchdog heartbeat, the sensor read failed")
+				return
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				lg.Errorf("Problem sending watchdog heartbeat: %v", err)
+			}
+		})
 	}
-	fmt.Println(id)
 
-	lg.Infof("This Bosch Sensortec sensor has signature: 0x%x", id)
+	var p *poller
+	if interval > 0 {
+		p = newPoller(interval, conf.GetInt(pollRecent))
+		for _, hook := range hooks {
+			p.onReading(hook)
+		}
+	}
+	var history *historyBuffer
+	if p != nil && conf.GetDuration(pollHistory) > 0 && conf.GetString(sqlitePath) == "" {
+		history = newHistoryBuffer([]historyTier{
+			{0, conf.GetDuration(pollHistory)},
+			{time.Minute, conf.GetDuration(pollHistory1m)},
+			{15 * time.Minute, conf.GetDuration(pollHistory15m)},
+		})
+		p.onReading(history.add)
+	}
+	restorePollState(p, history)
 
-	err = sensor.IsValidCoefficients()
+	// The sinks send what they have left once the poller has stopped
+	sinksCtx, stopSinks := context.WithCancel(context.Background())
+	sinks, err := startSinks(sinksCtx, p)
 	if err != nil {
 		lg.Fatal(err)
 	}
+	if p != nil {
+		p.start(ctx)
+	}
 
-	exporter := NewBMEExporter()
-	prometheus.MustRegister(exporter)
+	onReload(func() {
+		setCalibration(calibrationFromConfig())
+		interval := configuredPollInterval()
+		switch {
+		case p == nil && interval > 0:
+			lg.Warn("Starting the background poller needs a restart")
+		case p != nil && interval <= 0:
+			lg.Warn("Stopping the background poller needs a restart")
+		case p != nil && interval != p.Interval():
+			p.setInterval(interval)
+		}
+	})
 
-	// Since all we do is get the info when we're scraped, sit forver serving metrics on the main thread
-	serveMetrics()
+	var mdns *mdnsServer
+	if conf.GetBool(mdnsEnable) {
+		instance := conf.GetString(mdnsInstance)
+		if instance == "" {
+			instance = hostname
+		}
+		bus, addr := currentAddress()
+		mdns = newMDNSServer(instance, conf.GetString(mdnsService), conf.GetInt(metricsPort), []string{
+			"path=/",
+			"scheme=" + webScheme(),
+			"sensor=" + getSensorName(sensor),
+			fmt.Sprintf("bus=%d", bus),
+			"address=" + formatI2CAddress(addr),
+		})
+		if err := mdns.start(ctx); err != nil {
+			lg.Errorf("Problem starting mDNS advertisement: %v", err)
+			mdns = nil
+		}
+	}
+
+	if addr := conf.GetString(grpcListenAddress); addr != "" {
+		svcs.start("the gRPC server", func(ctx context.Context) error { return serveGRPC(ctx, addr, p) })
+	}
+	if addr := conf.GetString(snmpListenAddress); addr != "" {
+		svcs.start("the SNMP agent", func(ctx context.Context) error { return serveSNMP(ctx, addr, p) })
+	}
+	if addr := conf.GetString(modbusListenAddress); addr != "" {
+		svcs.start("the Modbus server", func(ctx context.Context) error { return serveModbus(ctx, addr, p) })
+	}
+	if addr := conf.GetString(bacnetListenAddress); addr != "" {
+		svcs.start("the BACnet server", func(ctx context.Context) error { return serveBACnet(ctx, addr, p) })
+	}
+	if addr := conf.GetString(coapListenAddress); addr != "" {
+		svcs.start("the CoAP server", func(ctx context.Context) error { return serveCoAP(ctx, addr, p) })
+	}
+	if conf.GetBool(bthomeEnable) {
+		svcs.start("BTHome advertising", func(ctx context.Context) error { return runBTHome(ctx, p) })
+	}
+	if conf.GetString(nmeaListenAddress) != "" || conf.GetString(nmeaDevice) != "" {
+		svcs.start("NMEA 0183 output", func(ctx context.Context) error { return runNMEA(ctx, p) })
+	}
+
+	svcs.start("the metrics server", func(ctx context.Context) error { return serveMetrics(ctx, p, history) })
+	// Sit here until told to stop, or something fails
+	failed := svcs.wait() != nil
+
+	sdNotify("STOPPING=1")
+	if p != nil {
+		p.wait()
+		savePollState(p, history)
+	}
+	stopSinks()
+	sinks.wait()
+	if mdns != nil {
+		mdns.wait()
+	}
+	stopTracing()
+	if t != nil {
+		t.wait()
+	}
+	lg.Info("Shut down")
+	if failed {
+		return 1
+	}
+	return 0
 }
 
-func serveMetrics() {
-	http.Handle("/", promhttp.Handler())
-	lg.Infof("Listening for metrics on port :%d", viper.GetInt(metricsPort))
-	err := http.ListenAndServe(fmt.Sprintf(":%d", viper.GetInt(metricsPort)), nil)
-	if err != nil {
-		lg.Fatal(err)
+// Servers that run alongside the metrics one until the context is cancelled.
+// One that fails is logged and cancels the context, so everything shuts down
+// the same way as on SIGTERM and state still gets saved.
+type services struct {
+	ctx   context.Context
+	group *errgroup.Group
+}
+
+func newServices(ctx context.Context) (*services, context.Context) {
+	g, ctx := errgroup.WithContext(ctx)
+	return &services{ctx: ctx, group: g}, ctx
+}
+
+func (s *services) start(name string, run func(ctx context.Context) error) {
+	s.group.Go(func() error {
+		err := run(s.ctx)
+		if err != nil {
+			lg.Errorf("Problem with %s, shutting down: %v", name, err)
+		}
+		return err
+	})
+}
+
+// Wait for everything to stop, returning the first failure
+func (s *services) wait() error {
+	return s.group.Wait()
+}
+
+// Serve metrics until the context is cancelled, then drain in-flight
+// requests. Fails if a listener does.
+func serveMetrics(ctx context.Context, p *poller, history *historyBuffer) error {
+	mux := http.NewServeMux()
+	mux.Handle("/", landingHandler(metricsHandler(p)))
+	mux.HandleFunc("/-/healthy", healthyHandler)
+	mux.HandleFunc("/-/ready", readyHandler)
+	mux.HandleFunc("/probe", probeHandler)
+	mux.HandleFunc("/api/v1/readings", readingsHandler(p))
+	mux.HandleFunc("/api/v1/stream", streamHandler(p))
+	registerDashboard(mux)
+	mux.HandleFunc("/grafana/dashboard.json", grafanaDashboardHandler)
+	mux.Handle("/config", requireAuth(http.HandlerFunc(configHandler)))
+	registerAdmin(mux, p)
+	registerHistory(mux, history)
+	mux.HandleFunc("/debug/events", eventsHandler)
+	if conf.GetBool(enableLifecycle) {
+		mux.HandleFunc("/-/reload", reloadHandler)
+	}
+	if conf.GetBool(enablePprof) {
+		registerPprof(mux)
+	}
+
+	var listeners []net.Listener
+	if conf.GetBool(systemdSocket) {
+		var err error
+		listeners, err = systemdListeners()
+		if err != nil {
+			return err
+		}
+		for _, l := range listeners {
+			lg.Infof("Listening for metrics on systemd socket %s", l.Addr())
+		}
+	} else if conf.GetBool(webDisable) {
+		lg.Info("Not serving HTTP")
+	} else {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", conf.GetInt(metricsPort)))
+		if err != nil {
+			return err
+		}
+		lg.Infof("Listening for metrics on port :%d", conf.GetInt(metricsPort))
+		listeners = append(listeners, l)
+	}
+
+	var handler http.Handler = mux
+	if rate := conf.GetFloat64(rateLimit); rate > 0 {
+		handler = newRateLimitHandler(rate, conf.GetInt(rateBurst), conf.GetBool(rateLimitPerClient), handler)
+	}
+
+	if cidrs := getStringList(allowedCIDRs); len(cidrs) > 0 {
+		var err error
+		if handler, err = newAllowlistHandler(cidrs, handler); err != nil {
+			return err
+		}
+	}
+
+	// Log outside the rest so rejected requests show up too. The toolkit's
+	// basic auth goes outside all of this.
+	if conf.GetBool(accessLog) {
+		handler = &accessLogHandler{handler: handler}
+	}
+
+	// The toolkit wraps the server's handler as it starts serving, so each
+	// listener gets a server of its own. Don't let slow or misbehaving
+	// clients hold connections open forever.
+	var servers []*http.Server
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		server := &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: conf.GetDuration(readHeaderTimeout),
+			ReadTimeout:       conf.GetDuration(readTimeout),
+			WriteTimeout:      conf.GetDuration(writeTimeout),
+			IdleTimeout:       conf.GetDuration(idleTimeout),
+			MaxHeaderBytes:    conf.GetInt(maxHeaderBytes),
+		}
+		servers = append(servers, server)
+		go func(l net.Listener) {
+			errCh <- web.Serve(l, server, toolkitFlags(), lg.l)
+		}(l)
+	}
+
+	// The sensor is initialized and we're listening, so we're ready as far as systemd is concerned
+	if err := sdNotify("READY=1"); err != nil {
+		lg.Warnf("Problem notifying systemd: %v", err)
+	}
+	notifyDaemonReady()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+	}
+
+	lg.Info("Shutting down, waiting for in-flight requests to finish")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.GetDuration(shutdownTimeout))
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			lg.Warnf("Problem shutting down HTTP server: %v", err)
+		}
 	}
+	return err
 }
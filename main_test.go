@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A poller that's just taken the reading, without a sensor behind it
+func testPoller(r reading) *poller {
+	p := newPoller(time.Minute, 1)
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	p.latest = r
+	return p
+}
+
+// Bytes written as hex, with spaces wherever they help
+func unhex(t testing.TB, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// A minimal multicast DNS responder (RFC 6762/6763) that advertises the
+// exporter as a DNS-SD service, so discovery tooling can find it without any
+// extra daemons
+
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeANY  = 255
+
+	dnsClassIN     = 1
+	dnsCacheFlush  = 0x8000
+	dnsUnicastResp = 0x8000
+
+	mdnsHostTTL    = 120
+	mdnsServiceTTL = 4500
+)
+
+var (
+	mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+	// Where the A and AAAA records come from
+	mdnsInterfaceAddrs = net.InterfaceAddrs
+
+	errDNSMessage = errors.New("malformed DNS message")
+)
+
+type dnsRecord struct {
+	name  string
+	typ   uint16
+	flush bool
+	ttl   uint32
+	data  []byte
+}
+
+type mdnsServer struct {
+	service  string // e.g. _prometheus-http._tcp.local.
+	instance string // e.g. raspberrypi._prometheus-http._tcp.local., with any dots in the first label escaped
+	host     string // e.g. raspberrypi.local.
+	port     int
+	txt      []string
+
+	conn *net.UDPConn
+	done chan struct{}
+}
+
+func newMDNSServer(instance, service string, port int, txt []string) *mdnsServer {
+	host := hostname
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		host = host[:i]
+	}
+	service = strings.TrimSuffix(service, ".") + ".local."
+	return &mdnsServer{
+		service:  service,
+		instance: escapeDNSLabel(instance) + "." + service,
+		host:     host + ".local.",
+		port:     port,
+		txt:      txt,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start answering queries and announce ourselves until the context is cancelled
+func (s *mdnsServer) start(ctx context.Context) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	lg.Infof("Advertising %s via mDNS", s.instance)
+
+	go func() {
+		<-ctx.Done()
+		// Tell everyone to forget about us before we go
+		s.send(s.response(0, nil, s.allRecords(0), nil), mdnsGroup)
+		s.conn.Close()
+	}()
+
+	go func() {
+		defer close(s.done)
+		s.serve()
+	}()
+
+	// Unsolicited announcements, repeated as RFC 6762 section 8.3 suggests
+	go func() {
+		for i := 0; i < 3; i++ {
+			s.send(s.response(0, nil, s.allRecords(-1), nil), mdnsGroup)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(1<<uint(i)) * time.Second):
+			}
+		}
+	}()
+	return nil
+}
+
+// Wait for the responder to exit after its context has been cancelled
+func (s *mdnsServer) wait() {
+	<-s.done
+}
+
+func (s *mdnsServer) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				lg.Errorf("Problem reading mDNS query: %v", err)
+			}
+			return
+		}
+		if err := s.handleQuery(buf[:n], src); err != nil {
+			lg.Debugf("Ignoring mDNS packet from %s: %v", src, err)
+		}
+	}
+}
+
+func (s *mdnsServer) handleQuery(msg []byte, src *net.UDPAddr) error {
+	if len(msg) < 12 {
+		return errDNSMessage
+	}
+	id := binary.BigEndian.Uint16(msg[0:])
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 != 0 {
+		// A response from someone else
+		return nil
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+
+	var answers, extra []dnsRecord
+	var questions [][]byte
+	unicast := src.Port != mdnsGroup.Port
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		start := off
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return err
+		}
+		if next+4 > len(msg) {
+			return errDNSMessage
+		}
+		qtype := binary.BigEndian.Uint16(msg[next:])
+		qclass := binary.BigEndian.Uint16(msg[next+2:])
+		off = next + 4
+		if qclass&dnsUnicastResp != 0 {
+			unicast = true
+		}
+
+		a, e := s.answer(strings.ToLower(name), qtype)
+		answers = append(answers, a...)
+		extra = append(extra, e...)
+		if len(a) > 0 {
+			questions = append(questions, msg[start:off])
+		}
+	}
+	if len(answers) == 0 {
+		return nil
+	}
+
+	// Legacy resolvers querying from some other port get a conventional
+	// unicast answer, everyone else gets it on the multicast group
+	if src.Port != mdnsGroup.Port {
+		s.send(s.response(id, questions, answers, extra), src)
+	} else if unicast {
+		s.send(s.response(0, nil, answers, extra), src)
+	} else {
+		s.send(s.response(0, nil, answers, extra), mdnsGroup)
+	}
+	return nil
+}
+
+// The records answering a question, and any additional records that are likely to be useful
+func (s *mdnsServer) answer(name string, qtype uint16) ([]dnsRecord, []dnsRecord) {
+	is := func(t uint16) bool { return qtype == t || qtype == dnsTypeANY }
+
+	switch name {
+	case "_services._dns-sd._udp.local.":
+		if is(dnsTypePTR) {
+			return []dnsRecord{{name: name, typ: dnsTypePTR, ttl: mdnsServiceTTL, data: appendDNSName(nil, s.service)}}, nil
+		}
+	case strings.ToLower(s.service):
+		if is(dnsTypePTR) {
+			return []dnsRecord{s.ptrRecord(mdnsServiceTTL)}, append(s.serviceRecords(-1), s.hostRecords(-1)...)
+		}
+	case strings.ToLower(s.instance):
+		var answers []dnsRecord
+		for _, r := range s.serviceRecords(-1) {
+			if is(r.typ) {
+				answers = append(answers, r)
+			}
+		}
+		return answers, s.hostRecords(-1)
+	case strings.ToLower(s.host):
+		var answers []dnsRecord
+		for _, r := range s.hostRecords(-1) {
+			if is(r.typ) {
+				answers = append(answers, r)
+			}
+		}
+		return answers, nil
+	}
+	return nil, nil
+}
+
+func (s *mdnsServer) ptrRecord(ttl uint32) dnsRecord {
+	return dnsRecord{name: s.service, typ: dnsTypePTR, ttl: ttl, data: appendDNSName(nil, s.instance)}
+}
+
+// SRV and TXT records for our instance. A negative TTL means the default.
+func (s *mdnsServer) serviceRecords(ttl int) []dnsRecord {
+	srvTTL, txtTTL := uint32(mdnsHostTTL), uint32(mdnsServiceTTL)
+	if ttl >= 0 {
+		srvTTL, txtTTL = uint32(ttl), uint32(ttl)
+	}
+
+	srv := make([]byte, 6, 6+len(s.host)+2)
+	binary.BigEndian.PutUint16(srv[4:], uint16(s.port))
+	srv = appendDNSName(srv, s.host)
+
+	var txt []byte
+	for _, t := range s.txt {
+		if len(t) > 255 {
+			t = t[:255]
+		}
+		txt = append(append(txt, byte(len(t))), t...)
+	}
+	if len(txt) == 0 {
+		txt = []byte{0}
+	}
+
+	return []dnsRecord{
+		{name: s.instance, typ: dnsTypeSRV, flush: true, ttl: srvTTL, data: srv},
+		{name: s.instance, typ: dnsTypeTXT, flush: true, ttl: txtTTL, data: txt},
+	}
+}
+
+// A and AAAA records for our interfaces. A negative TTL means the default.
+func (s *mdnsServer) hostRecords(ttl int) []dnsRecord {
+	t := uint32(mdnsHostTTL)
+	if ttl >= 0 {
+		t = uint32(ttl)
+	}
+	addrs, err := mdnsInterfaceAddrs()
+	if err != nil {
+		lg.Errorf("Problem listing interface addresses: %v", err)
+		return nil
+	}
+	var records []dnsRecord
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			records = append(records, dnsRecord{name: s.host, typ: dnsTypeA, flush: true, ttl: t, data: ip4})
+		} else {
+			records = append(records, dnsRecord{name: s.host, typ: dnsTypeAAAA, flush: true, ttl: t, data: ipnet.IP.To16()})
+		}
+	}
+	return records
+}
+
+func (s *mdnsServer) allRecords(ttl int) []dnsRecord {
+	ptrTTL := uint32(mdnsServiceTTL)
+	if ttl >= 0 {
+		ptrTTL = uint32(ttl)
+	}
+	records := []dnsRecord{s.ptrRecord(ptrTTL)}
+	records = append(records, s.serviceRecords(ttl)...)
+	return append(records, s.hostRecords(ttl)...)
+}
+
+func (s *mdnsServer) response(id uint16, questions [][]byte, answers, extra []dnsRecord) []byte {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(questions)))
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(msg[10:], uint16(len(extra)))
+	for _, q := range questions {
+		msg = append(msg, q...)
+	}
+	for _, r := range append(answers, extra...) {
+		msg = appendDNSName(msg, r.name)
+		class := uint16(dnsClassIN)
+		if r.flush {
+			class |= dnsCacheFlush
+		}
+		var rr [10]byte
+		binary.BigEndian.PutUint16(rr[0:], r.typ)
+		binary.BigEndian.PutUint16(rr[2:], class)
+		binary.BigEndian.PutUint32(rr[4:], r.ttl)
+		binary.BigEndian.PutUint16(rr[8:], uint16(len(r.data)))
+		msg = append(append(msg, rr[:]...), r.data...)
+	}
+	return msg
+}
+
+func (s *mdnsServer) send(msg []byte, to *net.UDPAddr) {
+	if _, err := s.conn.WriteToUDP(msg, to); err != nil && !errors.Is(err, net.ErrClosed) {
+		lg.Warnf("Problem sending mDNS response: %v", err)
+	}
+}
+
+// DNS-SD instance names are one label that can have dots in it, like
+// "pi.lan", so in names they're escaped as in RFC 6763 section 4.3
+func escapeDNSLabel(label string) string {
+	return strings.NewReplacer(`\`, `\\`, ".", `\.`).Replace(label)
+}
+
+// Append a name in uncompressed wire format, with escaped dots kept in their label
+func appendDNSName(b []byte, name string) []byte {
+	var label []byte
+	appendLabel := func() {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(append(b, byte(len(label))), label...)
+		label = label[:0]
+	}
+	name = strings.TrimSuffix(name, ".")
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c == '\\' && i+1 < len(name):
+			i++
+			label = append(label, name[i])
+		case c == '.':
+			appendLabel()
+		default:
+			label = append(label, c)
+		}
+	}
+	if name != "" {
+		appendLabel()
+	}
+	return append(b, 0)
+}
+
+// Read a possibly compressed name, returning it and the offset just after it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMessage
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errDNSMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSMessage
+			}
+			labels = append(labels, escapeDNSLabel(string(msg[off+1:off+1+l])))
+			off += 1 + l
+		}
+	}
+}
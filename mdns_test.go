@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// pi.lan._prometheus-http._tcp.local., with pi.lan as one label
+const mdnsInstanceName = "06 70692e6c616e 10 5f70726f6d6574686575732d68747470 04 5f746370 05 6c6f63616c 00"
+
+func TestDNSNames(t *testing.T) {
+	tests := []struct {
+		name string
+		wire string
+	}{
+		{`pi\.lan._prometheus-http._tcp.local.`, mdnsInstanceName},
+		{"pi.local.", "02 7069 05 6c6f63616c 00"},
+		{`a\\b.local.`, "03 615c62 05 6c6f63616c 00"},
+		{".", "00"},
+	}
+	for _, tt := range tests {
+		want := unhex(t, tt.wire)
+		if got := appendDNSName(nil, tt.name); !bytes.Equal(got, want) {
+			t.Errorf("appendDNSName(%q) = %x, want %x", tt.name, got, want)
+		}
+		if got, next, err := readDNSName(want, 0); err != nil || got != tt.name || next != len(want) {
+			t.Errorf("readDNSName(%x) = %q, %d, %v, want %q", want, got, next, err, tt.name)
+		}
+	}
+}
+
+// A server answering on loopback, and a legacy resolver to ask it things
+func testMDNS(t *testing.T) (*mdnsServer, *net.UDPConn) {
+	saved := hostname
+	hostname = "pi.lan"
+	t.Cleanup(func() { hostname = saved })
+	mdnsInterfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{&net.IPNet{IP: net.IPv4(192, 168, 1, 10), Mask: net.CIDRMask(24, 32)}}, nil
+	}
+	t.Cleanup(func() { mdnsInterfaceAddrs = net.InterfaceAddrs })
+
+	s := newMDNSServer(hostname, "_prometheus-http._tcp", 8000, []string{"path=/"})
+	var err error
+	if s.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.conn.Close() })
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return s, client
+}
+
+func TestMDNSQuery(t *testing.T) {
+	s, client := testMDNS(t)
+	src := client.LocalAddr().(*net.UDPAddr)
+
+	// SRV for the instance, from some port other than 5353
+	question := mdnsInstanceName + " 0021 0001"
+	query := unhex(t, "1234 0000 0001 0000 0000 0000"+question)
+	if err := s.handleQuery(query, src); err != nil {
+		t.Fatal(err)
+	}
+	want := unhex(t, "1234 8400 0001 0001 0000 0001"+question+
+		// The SRV record, pointing at port 8000 on pi.local.
+		mdnsInstanceName+" 0021 8001 00000078 0010 0000 0000 1f40 02 7069 05 6c6f63616c 00"+
+		// And pi.local.'s address
+		"02 7069 05 6c6f63616c 00 0001 8001 00000078 0004 c0a8010a")
+	buf := make([]byte, 512)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("got  %x\nwant %x", buf[:n], want)
+	}
+
+	// pi and lan as two labels is some other instance
+	query = unhex(t, "1235 0000 0001 0000 0000 0000"+
+		"02 7069 03 6c616e 10 5f70726f6d6574686575732d68747470 04 5f746370 05 6c6f63616c 00 0021 0001")
+	if err := s.handleQuery(query, src); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := client.Read(buf); err == nil {
+		t.Errorf("got an answer for someone else: %x", buf[:n])
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rejects requests that don't come from one of the allowed networks
+type allowlistHandler struct {
+	nets    []*net.IPNet
+	handler http.Handler
+}
+
+// Build an allowlist from CIDRs, also accepting bare addresses as single hosts
+func newAllowlistHandler(cidrs []string, handler http.Handler) (*allowlistHandler, error) {
+	h := &allowlistHandler{handler: handler}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q in allowlist", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			h.nets = append(h.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q in allowlist: %w", cidr, err)
+		}
+		h.nets = append(h.nets, n)
+	}
+	return h, nil
+}
+
+func (h *allowlistHandler) allowed(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *allowlistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.allowed(r.RemoteAddr) {
+		lg.Debugf("Rejected request for %s from %s", r.URL.Path, r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token bucket rate limiting, either for everyone at once or per client address
+type rateLimitHandler struct {
+	rate      float64
+	burst     float64
+	perClient bool
+	handler   http.Handler
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimitHandler(rate float64, burst int, perClient bool, handler http.Handler) *rateLimitHandler {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimitHandler{
+		rate:      rate,
+		burst:     float64(burst),
+		perClient: perClient,
+		handler:   handler,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take a token from the key's bucket, or report how long until one is available
+func (h *rateLimitHandler) take(key string, now time.Time) (bool, time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Forget clients whose buckets have had time to fill back up, so the map
+	// doesn't grow forever when something is scanning the network
+	full := time.Duration(h.burst / h.rate * float64(time.Second))
+	if now.Sub(h.lastSweep) > full && now.Sub(h.lastSweep) > time.Minute {
+		for k, b := range h.buckets {
+			if now.Sub(b.last) > full {
+				delete(h.buckets, k)
+			}
+		}
+		h.lastSweep = now
+	}
+
+	b, ok := h.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: h.burst, last: now}
+		h.buckets[key] = b
+	}
+	b.tokens = math.Min(h.burst, b.tokens+now.Sub(b.last).Seconds()*h.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / h.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (h *rateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := ""
+	if h.perClient {
+		key, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	ok, wait := h.take(key, time.Now())
+	if !ok {
+		lg.Debugf("Rate limited request for %s from %s", r.URL.Path, r.RemoteAddr)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// Remembers the status code and size of a response for the access log
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Lets http.ResponseController get at the real writer
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Logs who asked for what, the outcome, and how long it took
+type accessLogHandler struct {
+	handler http.Handler
+}
+
+func (h *accessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	lw := &loggingResponseWriter{ResponseWriter: w}
+	h.handler.ServeHTTP(lw, r)
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	lg.Infof("%s %s %s %s %d %d %s %q", r.RemoteAddr, r.Method, r.URL.RequestURI(), r.Proto,
+		lw.status, lw.size, time.Since(start).Round(time.Microsecond), r.UserAgent())
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Modbus TCP server with the readings in input registers, for PLCs and
+// SCADA systems. Where each value goes, its type and scale are configurable.
+// See https://modbus.org/docs/Modbus_Messaging_Implementation_Guide_V1_0b.pdf
+
+func init() {
+	configChecks = append(configChecks, checkModbusSettings)
+}
+
+// Function codes and exceptions
+const (
+	modbusReadHoldingRegisters = 0x03
+	modbusReadInputRegisters   = 0x04
+
+	modbusIllegalFunction    = 0x01
+	modbusIllegalDataAddress = 0x02
+	modbusIllegalDataValue   = 0x03
+)
+
+// The most registers one request can read
+const modbusMaxRegisters = 125
+
+// Where a value goes: the first register, its type, and what it's
+// multiplied by before it's rounded
+type modbusRegister struct {
+	name    string
+	address uint16
+	typ     string
+	scale   float64
+}
+
+// How many registers each type takes
+var modbusTypeSize = map[string]int{
+	"int16":   1,
+	"uint16":  1,
+	"int32":   2,
+	"uint32":  2,
+	"float32": 2,
+}
+
+// The values that can go in registers, besides the readings
+const modbusUp = "up"
+
+// Parse the register map, like temperature=0:int16:100
+func modbusRegisterMap() ([]modbusRegister, error) {
+	var regs []modbusRegister
+	for name, spec := range conf.GetStringMapString(modbusRegisters) {
+		if name != temperatureMetric && name != pressureMetric && name != humidityMetric && name != modbusUp {
+			return nil, fmt.Errorf("unknown value %q, use temperature, pressure, humidity or up", name)
+		}
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid register %q for %s, use address:type or address:type:scale", spec, name)
+		}
+		addr, err := strconv.ParseUint(parts[0], 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q for %s", parts[0], name)
+		}
+		r := modbusRegister{name: name, address: uint16(addr), typ: parts[1], scale: 1}
+		size, ok := modbusTypeSize[r.typ]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q for %s, use int16, uint16, int32, uint32 or float32", r.typ, name)
+		}
+		if int(r.address)+size > 1<<16 {
+			return nil, fmt.Errorf("%s doesn't fit at address %d", name, r.address)
+		}
+		if len(parts) == 3 {
+			if r.scale, err = strconv.ParseFloat(parts[2], 64); err != nil || r.scale == 0 || math.IsInf(r.scale, 0) || math.IsNaN(r.scale) {
+				return nil, fmt.Errorf("invalid scale %q for %s", parts[2], name)
+			}
+		}
+		regs = append(regs, r)
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].address < regs[j].address })
+	for i := 1; i < len(regs); i++ {
+		prev := regs[i-1]
+		if int(prev.address)+modbusTypeSize[prev.typ] > int(regs[i].address) {
+			return nil, fmt.Errorf("%s and %s overlap", prev.name, regs[i].name)
+		}
+	}
+	return regs, nil
+}
+
+// The register words for a value. Missing values, and ones out of range
+// for the type, are the type's most negative value for signed ones, its
+// largest for unsigned, and NaN for floats. 32-bit values are big-endian,
+// high word first.
+func (r modbusRegister) words(v float64) []uint16 {
+	s := math.Round(v * r.scale)
+	switch r.typ {
+	case "int16":
+		if math.IsNaN(s) || s < math.MinInt16 || s > math.MaxInt16 {
+			return []uint16{0x8000}
+		}
+		return []uint16{uint16(int16(s))}
+	case "uint16":
+		if math.IsNaN(s) || s < 0 || s > math.MaxUint16 {
+			return []uint16{0xffff}
+		}
+		return []uint16{uint16(s)}
+	case "int32":
+		u := uint32(0x80000000)
+		if !math.IsNaN(s) && s >= math.MinInt32 && s <= math.MaxInt32 {
+			u = uint32(int32(s))
+		}
+		return []uint16{uint16(u >> 16), uint16(u)}
+	case "uint32":
+		u := uint32(0xffffffff)
+		if !math.IsNaN(s) && s >= 0 && s <= math.MaxUint32 {
+			u = uint32(s)
+		}
+		return []uint16{uint16(u >> 16), uint16(u)}
+	}
+	u := math.Float32bits(float32(v * r.scale))
+	return []uint16{uint16(u >> 16), uint16(u)}
+}
+
+type modbusServer struct {
+	registers []modbusRegister
+	// The registers that can be read, from 0 to just past the last value
+	size      int
+	unitID    int
+	holding   bool
+	poller    *poller
+	allowlist *allowlistHandler
+}
+
+func newModbusServer(p *poller) (*modbusServer, error) {
+	regs, err := modbusRegisterMap()
+	if err != nil {
+		return nil, err
+	}
+	s := &modbusServer{
+		registers: regs,
+		unitID:    conf.GetInt(modbusUnitID),
+		holding:   conf.GetBool(modbusHoldingRegisters),
+		poller:    p,
+	}
+	if len(regs) > 0 {
+		last := regs[len(regs)-1]
+		s.size = int(last.address) + modbusTypeSize[last.typ]
+	}
+	if cidrs := getStringList(allowedCIDRs); len(cidrs) > 0 {
+		if s.allowlist, err = newAllowlistHandler(cidrs, nil); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Serve Modbus TCP until the context is cancelled
+func serveModbus(ctx context.Context, addr string, p *poller) error {
+	s, err := newModbusServer(p)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	lg.Infof("Serving Modbus TCP on %s", l.Addr())
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if s.allowlist != nil && !s.allowlist.allowed(conn.RemoteAddr().String()) {
+			conn.Close()
+			continue
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+func (s *modbusServer) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	// Close the connection on shutdown, without leaving anything behind once
+	// it's closed for any other reason
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	header := make([]byte, 7)
+	for {
+		// PLCs poll on a connection they keep open, so only let it sit idle for so long
+		conn.SetReadDeadline(time.Now().Add(conf.GetDuration(idleTimeout)))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				lg.Debugf("Closing Modbus connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		// Transaction ID, protocol ID (0 for Modbus), length of the unit ID and PDU, unit ID
+		length := binary.BigEndian.Uint16(header[4:])
+		if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > 254 {
+			lg.Debugf("Closing Modbus connection from %s: not a Modbus request", conn.RemoteAddr())
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		// Requests for other units behind a gateway get no answer
+		if s.unitID != 0 && int(header[6]) != s.unitID {
+			continue
+		}
+		resp := s.handle(ctx, pdu)
+		out := append([]byte{}, header[:4]...)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(resp)+1))
+		out = append(out, header[6])
+		conn.SetWriteDeadline(time.Now().Add(conf.GetDuration(writeTimeout)))
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// Answer a request PDU with the response PDU
+func (s *modbusServer) handle(ctx context.Context, pdu []byte) []byte {
+	fc := pdu[0]
+	exception := func(code byte) []byte { return []byte{fc | 0x80, code} }
+	if fc != modbusReadInputRegisters && !(fc == modbusReadHoldingRegisters && s.holding) {
+		return exception(modbusIllegalFunction)
+	}
+	if len(pdu) != 5 {
+		return exception(modbusIllegalDataValue)
+	}
+	start, count := int(binary.BigEndian.Uint16(pdu[1:])), int(binary.BigEndian.Uint16(pdu[3:]))
+	if count < 1 || count > modbusMaxRegisters {
+		return exception(modbusIllegalDataValue)
+	}
+	if start+count > s.size {
+		return exception(modbusIllegalDataAddress)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	r, err := currentReading(ctx, s.poller)
+	if err != nil {
+		r = reading{Temperature: math.NaN(), Pressure: math.NaN(), Humidity: math.NaN()}
+	}
+	// Registers in between values read as 0
+	words := make([]uint16, s.size)
+	for _, reg := range s.registers {
+		var v float64
+		switch reg.name {
+		case temperatureMetric:
+			v = r.Temperature
+		case pressureMetric:
+			v = r.Pressure
+		case humidityMetric:
+			v = r.Humidity
+		case modbusUp:
+			v = 0
+			if r.ok() {
+				v = 1
+			}
+		}
+		copy(words[reg.address:], reg.words(v))
+	}
+
+	resp := []byte{fc, byte(2 * count)}
+	for _, w := range words[start : start+count] {
+		resp = binary.BigEndian.AppendUint16(resp, w)
+	}
+	return resp
+}
+
+func checkModbusSettings() []configProblem {
+	addr := conf.GetString(modbusListenAddress)
+	if addr == "" {
+		return nil
+	}
+	var problems []configProblem
+	if _, port, err := net.SplitHostPort(addr); err != nil {
+		problems = append(problems, configError(modbusListenAddress, "%v, use e.g. :502", err))
+	} else if n, _ := strconv.Atoi(port); n < 1024 && conf.GetString(runAsUser) != "" {
+		problems = append(problems, configWarning(modbusListenAddress, "ports below 1024 need root, which is given up before listening"))
+	}
+	if regs, err := modbusRegisterMap(); err != nil {
+		problems = append(problems, configError(modbusRegisters, "%v", err))
+	} else if len(regs) == 0 {
+		problems = append(problems, configError(modbusRegisters, "there are no values to serve"))
+	}
+	if id := conf.GetInt(modbusUnitID); id < 0 || id > 255 {
+		problems = append(problems, configError(modbusUnitID, "must be from 0 to 255"))
+	}
+	return problems
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestModbusRegisterWords(t *testing.T) {
+	tests := []struct {
+		typ   string
+		scale float64
+		v     float64
+		want  []uint16
+	}{
+		{"int16", 100, 21.37, []uint16{0x0859}},
+		{"int16", 100, -40.5, []uint16{0xf02e}},
+		{"int16", 100, 400, []uint16{0x8000}},
+		{"int16", 100, math.NaN(), []uint16{0x8000}},
+		{"uint16", 100, 45.2, []uint16{0x11a8}},
+		{"uint16", 1, -1, []uint16{0xffff}},
+		{"uint16", 1, 65536, []uint16{0xffff}},
+		{"int32", 1, 101325, []uint16{0x0001, 0x8bcd}},
+		{"int32", 1000, -40.5, []uint16{0xffff, 0x61cc}},
+		{"int32", 1, math.NaN(), []uint16{0x8000, 0x0000}},
+		{"uint32", 1, 101325, []uint16{0x0001, 0x8bcd}},
+		{"uint32", 1, -1, []uint16{0xffff, 0xffff}},
+		{"float32", 1, 21.37, []uint16{0x41aa, 0xf5c3}},
+		{"float32", 1, -40.5, []uint16{0xc222, 0x0000}},
+		{"float32", 1, 101325, []uint16{0x47c5, 0xe680}},
+		{"float32", 1, math.NaN(), []uint16{0x7fc0, 0x0000}},
+	}
+	for _, tt := range tests {
+		r := modbusRegister{typ: tt.typ, scale: tt.scale}
+		if got := r.words(tt.v); !slices.Equal(got, tt.want) {
+			t.Errorf("%s scaled by %g words(%g) = %04x, want %04x", tt.typ, tt.scale, tt.v, got, tt.want)
+		}
+	}
+}
+
+// Answers to each request, up to the one after it that's always answered,
+// or nil if the connection's closed first
+func modbusExchange(t *testing.T, s *modbusServer, req []byte) []byte {
+	t.Helper()
+	// Input register 4, up, with transaction ID ffff
+	marker := unhex(t, "ffff 0000 0006 01 04 0004 0001")
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.serveConn(context.Background(), server)
+	go client.Write(append(append([]byte{}, req...), marker...))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := []byte{}
+	header := make([]byte, 6)
+	for {
+		if _, err := io.ReadFull(client, header); err != nil {
+			return nil
+		}
+		body := make([]byte, binary.BigEndian.Uint16(header[4:]))
+		if _, err := io.ReadFull(client, body); err != nil {
+			t.Fatalf("truncated response: %v", err)
+		}
+		if header[0] == 0xff && header[1] == 0xff {
+			return got
+		}
+		got = append(append(got, header...), body...)
+	}
+}
+
+func TestModbusServe(t *testing.T) {
+	tests := []struct {
+		name    string
+		unitID  int
+		holding bool
+		req     string
+		// Empty for no answer, and closed for the connection being dropped
+		want string
+	}{
+		{
+			name: "every input register",
+			req:  "0001 0000 0006 01 04 0000 0005",
+			want: "0001 0000 000d 01 04 0a 0859 11a8 0001 8bcd 0001",
+		},
+		{
+			name: "pressure",
+			req:  "0002 0000 0006 11 04 0002 0002",
+			want: "0002 0000 0007 11 04 04 0001 8bcd",
+		},
+		{
+			name: "holding registers when they're off",
+			req:  "0003 0000 0006 01 03 0000 0001",
+			want: "0003 0000 0003 01 83 01",
+		},
+		{
+			name:    "holding registers",
+			holding: true,
+			req:     "0003 0000 0006 01 03 0000 0001",
+			want:    "0003 0000 0005 01 03 02 0859",
+		},
+		{
+			name: "write single register",
+			req:  "0004 0000 0006 01 06 0000 0001",
+			want: "0004 0000 0003 01 86 01",
+		},
+		{
+			name: "past the last register",
+			req:  "0005 0000 0006 01 04 0004 0002",
+			want: "0005 0000 0003 01 84 02",
+		},
+		{
+			name: "no registers",
+			req:  "0006 0000 0006 01 04 0000 0000",
+			want: "0006 0000 0003 01 84 03",
+		},
+		{
+			name: "too many registers",
+			req:  "0007 0000 0006 01 04 0000 007e",
+			want: "0007 0000 0003 01 84 03",
+		},
+		{
+			name: "request too short",
+			req:  "0008 0000 0005 01 04 0000 00",
+			want: "0008 0000 0003 01 84 03",
+		},
+		{
+			name:   "another unit",
+			unitID: 1,
+			req:    "0009 0000 0006 02 04 0000 0001",
+		},
+		{
+			name:   "this unit",
+			unitID: 1,
+			req:    "000a 0000 0006 01 04 0000 0001",
+			want:   "000a 0000 0005 01 04 02 0859",
+		},
+		{
+			name: "not Modbus",
+			req:  "000b 0001 0006 01 04 0000 0001",
+			want: "closed",
+		},
+		{
+			name: "no function code",
+			req:  "000c 0000 0001 01",
+			want: "closed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newModbusServer(testPoller(reading{Temperature: 21.37, Pressure: 101325, Humidity: 45.2}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.unitID, s.holding = tt.unitID, tt.holding
+			got := modbusExchange(t, s, unhex(t, tt.req))
+			switch {
+			case tt.want == "closed":
+				if got != nil {
+					t.Errorf("got % x, want the connection closed", got)
+				}
+			case got == nil:
+				t.Errorf("the connection was closed")
+			case !bytes.Equal(got, unhex(t, tt.want)):
+				t.Errorf("got % x, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzModbusFrames(f *testing.F) {
+	for _, s := range []string{
+		"0001 0000 0006 01 04 0000 0005",
+		"0001 0000 0006 01 03 0000 0001 0002 0000 0006 01 04 0004 0001",
+		"0001 0000 0002 01 04",
+		"0001 0000 00fe 01",
+	} {
+		f.Add(unhex(f, s))
+	}
+	s, err := newModbusServer(testPoller(reading{Temperature: 21.37, Pressure: 101325, Humidity: 45.2}))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			s.serveConn(context.Background(), server)
+			close(done)
+		}()
+		go func() {
+			client.Write(in)
+			client.Close()
+		}()
+		out, _ := io.ReadAll(client)
+		<-done
+
+		// Whatever comes back is whole frames, each answering a request
+		for len(out) > 0 {
+			if len(out) < 9 {
+				t.Fatalf("truncated frame % x", out)
+			}
+			n := int(binary.BigEndian.Uint16(out[4:]))
+			if n < 3 || len(out) < 6+n {
+				t.Fatalf("bad length in % x", out)
+			}
+			if fc := out[7]; fc&0x80 != 0 && n != 3 {
+				t.Fatalf("exception that isn't 3 bytes: % x", out[:6+n])
+			} else if fc&0x80 == 0 && int(out[8]) != n-3 {
+				t.Fatalf("byte count doesn't match: % x", out[:6+n])
+			}
+			out = out[6+n:]
+		}
+	})
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Publishes readings to an MQTT broker, either as one JSON message or a
+// message per value, for Home Assistant, Node-RED, openHAB and the like
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "mqtt",
+		intervalKey: mqttInterval,
+		enabled:     func() bool { return conf.GetString(mqttBroker) != "" },
+		open:        openMQTT,
+		addresses: func() []string {
+			u, err := url.Parse(conf.GetString(mqttBroker))
+			if err != nil || u.Hostname() == "" {
+				return nil
+			}
+			return []string{mqttAddress(u)}
+		},
+	})
+	configChecks = append(configChecks, checkMQTTSettings)
+}
+
+type mqttSink struct {
+	address string
+	opts    mqttOptions
+	topic   string
+	// Publish each value to its own topic under topic, rather than JSON
+	values bool
+	qos    byte
+	retain bool
+	// Make the topic and payload for each reading, if set
+	topicTemplate   *template.Template
+	payloadTemplate *template.Template
+	// Publish as a Sparkplug B edge node instead, if set
+	sparkplug *sparkplugNode
+	// Where to send Home Assistant's discovery messages, if anywhere
+	discoveryPrefix string
+
+	mu     sync.Mutex
+	client *mqttClient
+	// Closed once there's a connection, and replaced when it's lost
+	connected chan struct{}
+
+	// Commands waiting to be run, if they're turned on
+	commands chan []byte
+
+	ctx  context.Context
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func openMQTT() (sink, error) {
+	u, err := url.Parse(conf.GetString(mqttBroker))
+	if err != nil {
+		return nil, err
+	}
+	clientID := conf.GetString(mqttClientID)
+	if clientID == "" {
+		clientID = "bme280-exporter-" + hostname
+	}
+	s := &mqttSink{
+		address: mqttAddress(u),
+		opts: mqttOptions{
+			clientID:   clientID,
+			keepAlive:  conf.GetDuration(mqttKeepAlive),
+			persistent: !conf.GetBool(mqttCleanSession),
+			username:   conf.GetString(mqttUsername),
+		},
+		topic:  strings.ReplaceAll(conf.GetString(mqttTopic), "{host}", hostname),
+		values: conf.GetString(mqttPayload) == "values",
+		qos:    byte(conf.GetInt(mqttQoS)),
+		retain: conf.GetBool(mqttRetain),
+
+		discoveryPrefix: conf.GetString(mqttDiscoveryPrefix),
+		connected:       make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	if u.User != nil {
+		s.opts.username = u.User.Username()
+		s.opts.password, _ = u.User.Password()
+	}
+	if f := conf.GetString(mqttPasswordFile); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("password: %w", err)
+		}
+		s.opts.password = strings.TrimSpace(string(b))
+	}
+	if mqttUsesTLS(u) {
+		if s.opts.tls, err = clientTLSConfig(conf.GetString(mqttCAFile), conf.GetString(mqttCertFile), conf.GetString(mqttKeyFile), conf.GetBool(mqttInsecureSkipVerify)); err != nil {
+			return nil, err
+		}
+	}
+	// If the exporter goes away without saying so, the broker says it's offline
+	s.opts.will = &mqttMessage{topic: s.statusTopic(), payload: []byte("offline"), qos: 1, retain: true}
+	if t := conf.GetString(mqttTopicTemplate); t != "" {
+		if s.topicTemplate, err = parseSinkTemplate(mqttTopicTemplate, t); err != nil {
+			return nil, err
+		}
+	}
+	if t := conf.GetString(mqttPayloadTemplate); t != "" {
+		if s.payloadTemplate, err = parseSinkTemplate(mqttPayloadTemplate, t); err != nil {
+			return nil, err
+		}
+	}
+	// Home Assistant would be told to look for readings that aren't there
+	if s.topicTemplate != nil || s.payloadTemplate != nil {
+		s.discoveryPrefix = ""
+	}
+	if conf.GetBool(mqttCommands) {
+		s.commands = make(chan []byte, mqttCommandQueueSize)
+	}
+	if group := conf.GetString(mqttSparkplugGroupID); group != "" {
+		node := conf.GetString(mqttSparkplugEdgeNodeID)
+		if node == "" {
+			node = hostname
+		}
+		s.sparkplug = &sparkplugNode{group: group, node: node}
+		// It has births and deaths instead of the status and discovery, and
+		// Sparkplug hosts expect a clean session
+		s.discoveryPrefix = ""
+		s.opts.persistent = false
+	}
+	s.opts.onMessage = s.received
+
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	go s.maintain(s.ctx)
+	return s, nil
+}
+
+func mqttUsesTLS(u *url.URL) bool {
+	return u.Scheme == "ssl" || u.Scheme == "tls" || u.Scheme == "mqtts"
+}
+
+// The broker's host:port, with the usual port if there isn't one
+func mqttAddress(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if mqttUsesTLS(u) {
+		return net.JoinHostPort(u.Hostname(), "8883")
+	}
+	return net.JoinHostPort(u.Hostname(), "1883")
+}
+
+// Stay connected to the broker, connecting again with backoff whenever the
+// connection drops, until the context is cancelled
+func (s *mqttSink) maintain(ctx context.Context) {
+	defer close(s.done)
+	backoff := time.Second
+	for {
+		c, err := s.connect(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			lg.Warnf("Problem connecting to the MQTT broker at %s, trying again in %s: %v", s.address, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, mqttMaxBackoff)
+			continue
+		}
+		backoff = time.Second
+
+		s.mu.Lock()
+		s.client = c
+		close(s.connected)
+		s.mu.Unlock()
+
+		select {
+		case <-c.done:
+			lg.Warnf("Lost the connection to the MQTT broker at %s: %v", s.address, c.err)
+			s.mu.Lock()
+			s.client = nil
+			s.connected = make(chan struct{})
+			s.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// The most time between attempts to connect to the broker
+const mqttMaxBackoff = 2 * time.Minute
+
+// Connect, then say the exporter's online and tell Home Assistant about it
+// if that's on
+func (s *mqttSink) connect(ctx context.Context) (*mqttClient, error) {
+	ctx, cancel := context.WithTimeout(ctx, conf.GetDuration(sinkTimeout))
+	defer cancel()
+	opts := s.opts
+	if s.sparkplug != nil {
+		opts.will = s.sparkplug.will()
+	}
+	c, err := dialMQTT(ctx, s.address, opts)
+	if err != nil {
+		return nil, err
+	}
+	if c.sessionPresent {
+		lg.Infof("Connected to the MQTT broker at %s, resuming the last session", s.address)
+	} else {
+		lg.Infof("Connected to the MQTT broker at %s", s.address)
+	}
+	if err := s.announce(ctx, c); err != nil {
+		c.disconnect()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *mqttSink) announce(ctx context.Context, c *mqttClient) error {
+	if s.commands != nil {
+		if err := c.subscribe(ctx, s.commandTopic(), 1); err != nil {
+			return err
+		}
+	}
+	if s.sparkplug != nil {
+		// Subscribed first so a rebirth asked for straight away isn't missed
+		if err := c.subscribe(ctx, s.sparkplug.topic("NCMD"), 1); err != nil {
+			return err
+		}
+		return c.publish(ctx, s.sparkplug.topic("NBIRTH"), s.sparkplug.birth(currentSensorJSON()), 0, false)
+	}
+	if s.discoveryPrefix != "" {
+		if err := s.publishDiscovery(ctx, c, currentSensorJSON()); err != nil {
+			return err
+		}
+	}
+	return c.publish(ctx, s.statusTopic(), []byte("online"), 1, true)
+}
+
+// Hand on a message for one of the subscriptions
+func (s *mqttSink) received(msg mqttMessage) {
+	if s.sparkplug != nil && msg.topic == s.sparkplug.topic("NCMD") {
+		if sparkplugWantsRebirth(msg.payload) {
+			go s.rebirth()
+		}
+		return
+	}
+	if s.commands != nil {
+		s.queueCommand(msg)
+	}
+}
+
+// Wait for the connection to the broker, as long as the context allows
+func (s *mqttSink) current(ctx context.Context) (*mqttClient, error) {
+	s.mu.Lock()
+	connected := s.connected
+	s.mu.Unlock()
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("not connected to the MQTT broker at %s", s.address)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil, errMQTTClosed
+	}
+	return s.client, nil
+}
+
+func (s *mqttSink) push(ctx context.Context, samples []sample) error {
+	c, err := s.current(ctx)
+	if err != nil {
+		return err
+	}
+	for _, smp := range samples {
+		if err := s.publish(ctx, c, smp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mqttSink) publish(ctx context.Context, c *mqttClient, smp sample) error {
+	if s.sparkplug != nil {
+		return c.publish(ctx, s.sparkplug.topic("NDATA"), s.sparkplug.data(smp), 0, false)
+	}
+
+	// The templates get the same fields as the JSON
+	data := smp.json()
+	topic := s.topic
+	if s.topicTemplate != nil {
+		b, err := executeSinkTemplate(s.topicTemplate, data)
+		if err != nil {
+			return err
+		}
+		if topic = strings.TrimSpace(string(b)); topic == "" || strings.ContainsAny(topic, "+#") {
+			return fmt.Errorf("%q isn't a topic that can be published to", topic)
+		}
+	}
+
+	var payload []byte
+	var err error
+	switch {
+	case s.payloadTemplate != nil:
+		payload, err = executeSinkTemplate(s.payloadTemplate, data)
+	case s.values:
+		for _, v := range smp.values() {
+			if err := c.publish(ctx, topic+"/"+v.name, []byte(strconv.FormatFloat(v.value, 'f', -1, 64)), s.qos, s.retain); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		payload, err = json.Marshal(data)
+	}
+	if err != nil {
+		return err
+	}
+	return c.publish(ctx, topic, payload, s.qos, s.retain)
+}
+
+// Where the sink says whether it's online, for Home Assistant's availability
+// among other things
+func (s *mqttSink) statusTopic() string {
+	return s.topic + "/status"
+}
+
+func (s *mqttSink) close() error {
+	s.stop()
+	<-s.done
+	s.mu.Lock()
+	c := s.client
+	s.mu.Unlock()
+	if c == nil {
+		return nil
+	}
+	// A clean disconnect doesn't set off the will, so it has to be said
+	ctx, cancel := context.WithTimeout(context.Background(), conf.GetDuration(sinkTimeout))
+	defer cancel()
+	if s.sparkplug != nil {
+		death := s.sparkplug.death()
+		c.publish(ctx, death.topic, death.payload, death.qos, death.retain)
+	} else {
+		c.publish(ctx, s.statusTopic(), []byte("offline"), 1, true)
+	}
+	return c.disconnect()
+}
+
+func checkMQTTSettings() []configProblem {
+	var problems []configProblem
+	if v := conf.GetString(mqttBroker); v != "" {
+		u, err := url.Parse(v)
+		switch {
+		case err != nil || u.Host == "":
+			problems = append(problems, configError(mqttBroker, "invalid URL %q, use e.g. tcp://mosquitto:1883", v))
+		case u.Scheme != "tcp" && u.Scheme != "mqtt" && !mqttUsesTLS(u):
+			problems = append(problems, configError(mqttBroker, "unsupported scheme %q, use tcp or mqtt, or ssl or mqtts for TLS", u.Scheme))
+		case u.User != nil && conf.GetString(mqttUsername) != "":
+			problems = append(problems, configWarning(mqttUsername, "ignored, the user name in %s is used instead", mqttBroker))
+		case u.User == nil && conf.GetString(mqttUsername) == "" && conf.GetString(mqttPasswordFile) != "":
+			problems = append(problems, configError(mqttPasswordFile, "MQTT needs a user name to go with the password"))
+		}
+	}
+	for _, key := range []string{mqttPasswordFile, mqttCAFile, mqttCertFile, mqttKeyFile} {
+		if f := conf.GetString(key); f != "" {
+			if _, err := os.Stat(f); err != nil {
+				problems = append(problems, configError(key, "%v", err))
+			}
+		}
+	}
+	if (conf.GetString(mqttCertFile) == "") != (conf.GetString(mqttKeyFile) == "") {
+		problems = append(problems, configError(mqttCertFile, "%s and %s go together", mqttCertFile, mqttKeyFile))
+	}
+	if conf.GetBool(mqttInsecureSkipVerify) {
+		problems = append(problems, configWarning(mqttInsecureSkipVerify, "the MQTT broker's certificate isn't checked"))
+	}
+	topic := conf.GetString(mqttTopic)
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		problems = append(problems, configError(mqttTopic, "%q isn't a topic that can be published to", topic))
+	}
+	if p := conf.GetString(mqttPayload); p != "json" && p != "values" {
+		problems = append(problems, configError(mqttPayload, "unknown payload %q, use json or values", p))
+	}
+	for _, key := range []string{mqttTopicTemplate, mqttPayloadTemplate} {
+		if _, err := parseSinkTemplate(key, conf.GetString(key)); err != nil {
+			problems = append(problems, configError(key, "%v", err))
+		}
+	}
+	if conf.GetString(mqttPayloadTemplate) != "" && conf.GetString(mqttPayload) == "values" {
+		problems = append(problems, configWarning(mqttPayload, "ignored, %s is used instead", mqttPayloadTemplate))
+	}
+	if q := conf.GetInt(mqttQoS); q < 0 || q > 2 {
+		problems = append(problems, configError(mqttQoS, "must be 0, 1 or 2"))
+	}
+	if strings.ContainsAny(conf.GetString(mqttDiscoveryPrefix), "+#") {
+		problems = append(problems, configError(mqttDiscoveryPrefix, "can't have wildcards in it"))
+	}
+	for _, key := range []string{mqttSparkplugGroupID, mqttSparkplugEdgeNodeID} {
+		if strings.ContainsAny(conf.GetString(key), "/+#") {
+			problems = append(problems, configError(key, "can't have /, + or # in it"))
+		}
+	}
+	if k := conf.GetDuration(mqttKeepAlive); k < 0 || k > 18*time.Hour || k%time.Second != 0 {
+		problems = append(problems, configError(mqttKeepAlive, "must be a whole number of seconds up to 18h"))
+	}
+	return problems
+}
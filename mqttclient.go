@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Just enough of an MQTT 3.1.1 client to publish readings and take commands,
+// written out here rather than pulling in a whole library for it. See
+// https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html
+
+// Control packet types, already shifted into the top of the first byte
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttPubrec     = 0x50
+	mqttPubrel     = 0x60
+	mqttPubcomp    = 0x70
+	mqttSubscribe  = 0x80
+	mqttSuback     = 0x90
+	mqttPingreq    = 0xc0
+	mqttPingresp   = 0xd0
+	mqttDisconnect = 0xe0
+)
+
+// Why a broker refused to connect, by CONNACK return code
+var mqttConnectErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// A broker that can't take a packet in this long is as good as gone
+const mqttWriteTimeout = 10 * time.Second
+
+var errMQTTClosed = errors.New("connection to the MQTT broker closed")
+
+type mqttOptions struct {
+	clientID  string
+	keepAlive time.Duration
+	// Keep the session, and so subscriptions and anything queued for them,
+	// when disconnected
+	persistent bool
+	username   string
+	password   string
+	// Published by the broker if the connection goes away without a DISCONNECT
+	will *mqttMessage
+	// Connect with TLS if set
+	tls *tls.Config
+	// Called with messages for the client's subscriptions, which can arrive
+	// as soon as it connects when the session's resumed. It mustn't block.
+	onMessage func(mqttMessage)
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+type mqttClient struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	keepAlive time.Duration
+
+	// Held while writing a packet so they don't get mixed up
+	writeMu sync.Mutex
+
+	mu     sync.Mutex
+	nextID uint16
+	// Packets waiting for the broker to acknowledge them, by packet
+	// identifier, to be sent the acknowledgement
+	pending map[uint16]chan []byte
+
+	onMessage func(mqttMessage)
+
+	// Whether the broker still had the session from last time
+	sessionPresent bool
+
+	done chan struct{}
+	err  error
+}
+
+// Connect to a broker and start handling what it sends back until the
+// connection is closed
+func dialMQTT(ctx context.Context, address string, opts mqttOptions) (*mqttClient, error) {
+	var conn net.Conn
+	var err error
+	if opts.tls != nil {
+		d := tls.Dialer{Config: opts.tls}
+		conn, err = d.DialContext(ctx, "tcp", address)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return startMQTT(ctx, conn, opts)
+}
+
+// Connect over a connection to a broker that's already open, and start
+// handling what it sends back. The connection's closed if that fails.
+func startMQTT(ctx context.Context, conn net.Conn, opts mqttOptions) (*mqttClient, error) {
+	c := &mqttClient{
+		conn:      conn,
+		r:         bufio.NewReader(conn),
+		keepAlive: opts.keepAlive,
+		pending:   make(map[uint16]chan []byte),
+		onMessage: opts.onMessage,
+		done:      make(chan struct{}),
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := c.connect(opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.read()
+	if c.keepAlive > 0 {
+		go c.ping()
+	}
+	return c, nil
+}
+
+func (c *mqttClient) connect(opts mqttOptions) error {
+	var flags byte
+	if !opts.persistent {
+		flags |= 0x02
+	}
+	if w := opts.will; w != nil {
+		flags |= 0x04 | w.qos<<3
+		if w.retain {
+			flags |= 0x20
+		}
+	}
+	if opts.password != "" {
+		flags |= 0x40
+	}
+	if opts.username != "" {
+		flags |= 0x80
+	}
+
+	var b []byte
+	b = appendMQTTString(b, "MQTT")
+	// Protocol level 4 is 3.1.1
+	b = append(b, 4, flags)
+	b = binary.BigEndian.AppendUint16(b, uint16(opts.keepAlive/time.Second))
+	b = appendMQTTString(b, opts.clientID)
+	if w := opts.will; w != nil {
+		b = appendMQTTString(b, w.topic)
+		b = appendMQTTString(b, string(w.payload))
+	}
+	if opts.username != "" {
+		b = appendMQTTString(b, opts.username)
+	}
+	if opts.password != "" {
+		b = appendMQTTString(b, opts.password)
+	}
+	if err := c.write(mqttConnect, b); err != nil {
+		return err
+	}
+
+	typ, body, err := readMQTTPacket(c.r)
+	if err != nil {
+		return err
+	}
+	if typ&0xf0 != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("expected CONNACK from the broker, got packet type %d", typ>>4)
+	}
+	if body[1] != 0 {
+		if msg, ok := mqttConnectErrors[body[1]]; ok {
+			return fmt.Errorf("broker refused the connection: %s", msg)
+		}
+		return fmt.Errorf("broker refused the connection with code %d", body[1])
+	}
+	c.sessionPresent = body[0]&1 == 1
+	return nil
+}
+
+// Publish a message, waiting until the broker has it for QoS 1 and 2
+func (c *mqttClient) publish(ctx context.Context, topic string, payload []byte, qos byte, retain bool) error {
+	flags := qos << 1
+	if retain {
+		flags |= 1
+	}
+	b := appendMQTTString(nil, topic)
+	if qos == 0 {
+		return c.write(mqttPublish|flags, append(b, payload...))
+	}
+	_, err := c.send(ctx, mqttPublish|flags, b, payload)
+	return err
+}
+
+// Subscribe to a topic filter
+func (c *mqttClient) subscribe(ctx context.Context, filter string, qos byte) error {
+	ack, err := c.send(ctx, mqttSubscribe|0x02, nil, append(appendMQTTString(nil, filter), qos))
+	if err != nil {
+		return err
+	}
+	if len(ack) < 3 || ack[2] == 0x80 {
+		return fmt.Errorf("broker refused the subscription to %s", filter)
+	}
+	return nil
+}
+
+// Send a packet with a new packet identifier between the start and the rest
+// of it, and wait for the broker's acknowledgement
+func (c *mqttClient) send(ctx context.Context, typ byte, start, rest []byte) ([]byte, error) {
+	c.mu.Lock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	acked := make(chan []byte, 1)
+	c.pending[id] = acked
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	b := binary.BigEndian.AppendUint16(start, id)
+	if err := c.write(typ, append(b, rest...)); err != nil {
+		return nil, err
+	}
+	select {
+	case ack := <-acked:
+		return ack, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Handle what the broker sends until the connection goes away
+func (c *mqttClient) read() {
+	for {
+		if c.keepAlive > 0 {
+			// The broker answers pings, so nothing for this long means it's gone
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		}
+		typ, body, err := readMQTTPacket(c.r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errMQTTClosed
+			}
+			c.shutdown(err)
+			return
+		}
+		switch typ & 0xf0 {
+		case mqttPuback, mqttPubcomp, mqttSuback:
+			if len(body) >= 2 {
+				c.ack(binary.BigEndian.Uint16(body), body)
+			}
+		case mqttPublish:
+			if !c.received(typ, body) {
+				return
+			}
+		case mqttPubrel:
+			// The last step of QoS 2 the other way
+			if len(body) >= 2 {
+				if c.write(mqttPubcomp, body[:2]) != nil {
+					return
+				}
+			}
+		case mqttPubrec:
+			// The second step of QoS 2
+			if len(body) >= 2 {
+				if c.write(mqttPubrel|0x02, body[:2]) != nil {
+					return
+				}
+			}
+		}
+		// Anything else, like PINGRESP, needs nothing doing
+	}
+}
+
+func (c *mqttClient) ack(id uint16, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.pending[id]; ok {
+		ch <- body
+		delete(c.pending, id)
+	}
+}
+
+// Hand on a message from the broker and acknowledge it. False if the
+// connection's gone.
+func (c *mqttClient) received(typ byte, body []byte) bool {
+	qos := typ >> 1 & 3
+	if len(body) < 2 {
+		return true
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return true
+	}
+	msg := mqttMessage{topic: string(body[2 : 2+n]), qos: qos, retain: typ&1 == 1}
+	rest := body[2+n:]
+	var id []byte
+	if qos > 0 {
+		if len(rest) < 2 {
+			return true
+		}
+		id, rest = rest[:2], rest[2:]
+	}
+	msg.payload = rest
+
+	// With QoS 2 the broker could send it again if the PUBREC is lost, which
+	// the commands don't mind
+	if c.onMessage != nil {
+		c.onMessage(msg)
+	}
+	switch qos {
+	case 1:
+		return c.write(mqttPuback, id) == nil
+	case 2:
+		return c.write(mqttPubrec, id) == nil
+	}
+	return true
+}
+
+func (c *mqttClient) ping() {
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c.write(mqttPingreq, nil) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Whether the connection has gone away
+func (c *mqttClient) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *mqttClient) shutdown(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+// Say goodbye to the broker and close the connection
+func (c *mqttClient) disconnect() error {
+	if c.closed() {
+		return nil
+	}
+	err := c.write(mqttDisconnect, nil)
+	c.shutdown(errMQTTClosed)
+	return err
+}
+
+// Send a packet. Failing part way through leaves the connection unusable, so
+// it's closed.
+func (c *mqttClient) write(typ byte, body []byte) error {
+	b := []byte{typ}
+	b = appendMQTTLength(b, len(body))
+	b = append(b, body...)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(mqttWriteTimeout))
+	if _, err := c.conn.Write(b); err != nil {
+		c.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// The remaining length, seven bits at a time
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("malformed MQTT packet length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// The topics and payloads used below, as hex
+const (
+	mqttTestStatus  = "0010 62 6d 65 32 38 30 2f 70 69 2f 73 74 61 74 75 73" // bme280/pi/status
+	mqttTestOffline = "6f 66 66 6c 69 6e 65"
+	mqttTestOnline  = "6f 6e 6c 69 6e 65"
+)
+
+// The broker's end of a connection, which expects packets in order
+type mqttTestBroker struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newMQTTTestBroker(t *testing.T, conn net.Conn) *mqttTestBroker {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &mqttTestBroker{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (b *mqttTestBroker) expect(want string) {
+	b.t.Helper()
+	typ, body, err := readMQTTPacket(b.r)
+	if err != nil {
+		b.t.Fatalf("reading %s: %v", want, err)
+	}
+	got := appendMQTTLength([]byte{typ}, len(body))
+	got = append(got, body...)
+	if !bytes.Equal(got, unhex(b.t, want)) {
+		b.t.Fatalf("got % x, want %s", got, want)
+	}
+}
+
+func (b *mqttTestBroker) send(packet string) {
+	b.t.Helper()
+	if _, err := b.conn.Write(unhex(b.t, packet)); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+func TestMQTTLength(t *testing.T) {
+	// The examples from the spec's table of remaining lengths
+	for n, want := range map[int]string{
+		0:         "00",
+		127:       "7f",
+		128:       "80 01",
+		16383:     "ff 7f",
+		16384:     "80 80 01",
+		2097151:   "ff ff 7f",
+		2097152:   "80 80 80 01",
+		268435455: "ff ff ff 7f",
+	} {
+		if got := appendMQTTLength(nil, n); !bytes.Equal(got, unhex(t, want)) {
+			t.Errorf("length %d is % x, want %s", n, got, want)
+		}
+		packet := append(appendMQTTLength([]byte{mqttPublish}, n), make([]byte, n)...)
+		typ, body, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || typ != mqttPublish || len(body) != n {
+			t.Errorf("read back length %d as %d: %v", n, len(body), err)
+		}
+	}
+	if _, _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(unhex(t, "30 ff ff ff ff 01")))); err == nil {
+		t.Error("read a length with five bytes")
+	}
+}
+
+func TestMQTTConnect(t *testing.T) {
+	will := &mqttMessage{topic: "bme280/pi/status", payload: []byte("offline"), qos: 1, retain: true}
+	tests := []struct {
+		name    string
+		opts    mqttOptions
+		connect string
+		connack string
+		err     string
+	}{
+		{
+			name:    "clean session",
+			opts:    mqttOptions{clientID: "pi", keepAlive: time.Minute},
+			connect: "10 0e 0004 4d 51 54 54 04 02 003c 0002 70 69",
+			connack: "20 02 00 00",
+		},
+		{
+			name:    "will and login",
+			opts:    mqttOptions{clientID: "pi", keepAlive: time.Minute, username: "u", password: "p", will: will},
+			connect: "10 2f 0004 4d 51 54 54 04 ee 003c 0002 70 69 " + mqttTestStatus + " 0007 " + mqttTestOffline + " 0001 75 0001 70",
+			connack: "20 02 00 00",
+		},
+		{
+			name:    "resumed session",
+			opts:    mqttOptions{clientID: "pi", persistent: true, will: will},
+			connect: "10 29 0004 4d 51 54 54 04 2c 0000 0002 70 69 " + mqttTestStatus + " 0007 " + mqttTestOffline,
+			connack: "20 02 01 00",
+		},
+		{
+			name:    "refused",
+			opts:    mqttOptions{clientID: "pi", username: "u"},
+			connect: "10 11 0004 4d 51 54 54 04 82 0000 0002 70 69 0001 75",
+			connack: "20 02 00 05",
+			err:     "broker refused the connection: not authorized",
+		},
+		{
+			name:    "not a CONNACK",
+			opts:    mqttOptions{clientID: "pi"},
+			connect: "10 0e 0004 4d 51 54 54 04 02 0000 0002 70 69",
+			connack: "d0 00",
+			err:     "expected CONNACK from the broker, got packet type 13",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			broker := newMQTTTestBroker(t, server)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				broker.expect(tt.connect)
+				broker.send(tt.connack)
+			}()
+			c, err := startMQTT(context.Background(), client, tt.opts)
+			<-done
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.shutdown(errMQTTClosed)
+			if c.sessionPresent != tt.opts.persistent {
+				t.Errorf("session present is %v", c.sessionPresent)
+			}
+		})
+	}
+}
+
+func TestMQTTSession(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	broker := newMQTTTestBroker(t, server)
+	go func() {
+		broker.expect("10 0e 0004 4d 51 54 54 04 02 0000 0002 70 69")
+		broker.send("20 02 00 00")
+	}()
+	received := make(chan mqttMessage, 2)
+	c, err := startMQTT(context.Background(), client, mqttOptions{clientID: "pi", onMessage: func(m mqttMessage) { received <- m }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	t.Run("QoS 1 publish", func(t *testing.T) {
+		done := make(chan error)
+		go func() { done <- c.publish(ctx, "bme280/pi/status", []byte("online"), 1, true) }()
+		broker.expect("33 1a " + mqttTestStatus + " 0001 " + mqttTestOnline)
+		select {
+		case <-done:
+			t.Fatal("publish returned before the PUBACK")
+		case <-time.After(10 * time.Millisecond):
+		}
+		// An ack for something else first
+		broker.send("40 02 00 09")
+		broker.send("40 02 00 01")
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("QoS 0 publish", func(t *testing.T) {
+		done := make(chan error)
+		go func() { done <- c.publish(ctx, "t", []byte("x"), 0, false) }()
+		broker.expect("30 04 0001 74 78")
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("subscribe", func(t *testing.T) {
+		done := make(chan error)
+		go func() { done <- c.subscribe(ctx, "cmd", 1) }()
+		broker.expect("82 08 0002 0003 63 6d 64 01")
+		broker.send("90 03 0002 01")
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		go func() { done <- c.subscribe(ctx, "cmd", 1) }()
+		broker.expect("82 08 0003 0003 63 6d 64 01")
+		broker.send("90 03 0003 80")
+		if err := <-done; err == nil {
+			t.Fatal("a refused subscription worked")
+		}
+	})
+
+	t.Run("QoS 1 message", func(t *testing.T) {
+		broker.send("32 09 0003 63 6d 64 0007 7b 7d")
+		broker.expect("40 02 0007")
+		if m := <-received; m.topic != "cmd" || string(m.payload) != "{}" || m.qos != 1 {
+			t.Errorf("got %+v", m)
+		}
+	})
+
+	t.Run("QoS 2 message", func(t *testing.T) {
+		broker.send("35 09 0003 63 6d 64 0008 7b 7d")
+		broker.expect("50 02 0008")
+		broker.send("62 02 0008")
+		broker.expect("70 02 0008")
+		if m := <-received; m.topic != "cmd" || m.qos != 2 || !m.retain {
+			t.Errorf("got %+v", m)
+		}
+	})
+
+	t.Run("lost waiting for a PUBACK", func(t *testing.T) {
+		done := make(chan error)
+		go func() { done <- c.publish(ctx, "t", []byte("x"), 1, false) }()
+		broker.expect("32 06 0001 74 0004 78")
+		server.Close()
+		if err := <-done; !errors.Is(err, errMQTTClosed) {
+			t.Fatalf("got %v", err)
+		}
+		if !c.closed() {
+			t.Error("the client isn't closed")
+		}
+	})
+}
+
+func TestMQTTKeepAlive(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	broker := newMQTTTestBroker(t, server)
+	go func() {
+		broker.expect("10 0e 0004 4d 51 54 54 04 02 0000 0002 70 69")
+		broker.send("20 02 00 00")
+	}()
+	c, err := startMQTT(context.Background(), client, mqttOptions{clientID: "pi", keepAlive: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.expect("c0 00")
+	broker.send("d0 00")
+	broker.expect("c0 00")
+	// Without an answer the broker's taken to be gone
+	select {
+	case <-c.done:
+		if !errors.Is(c.err, os.ErrDeadlineExceeded) {
+			t.Errorf("closed with %v", c.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still connected")
+	}
+}
+
+// The sink connects again when the connection's lost, says it's online each
+// time, and says it's offline before it disconnects
+func TestMQTTSinkReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := &mqttSink{
+		address: l.Addr().String(),
+		opts: mqttOptions{
+			clientID: "pi",
+			will:     &mqttMessage{topic: "bme280/pi/status", payload: []byte("offline"), qos: 1, retain: true},
+		},
+		topic:     "bme280/pi",
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	go s.maintain(s.ctx)
+
+	connect := "10 29 0004 4d 51 54 54 04 2e 0000 0002 70 69 " + mqttTestStatus + " 0007 " + mqttTestOffline
+	online := "33 1a " + mqttTestStatus + " 0001 " + mqttTestOnline
+	for i := 0; i < 2; i++ {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		broker := newMQTTTestBroker(t, conn)
+		broker.expect(connect)
+		broker.send("20 02 00 00")
+		broker.expect(online)
+		broker.send("40 02 0001")
+		if _, err := s.current(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			done := make(chan error)
+			go func() { done <- s.close() }()
+			broker.expect("33 1b " + mqttTestStatus + " 0002 " + mqttTestOffline)
+			broker.send("40 02 0002")
+			broker.expect("e0 00")
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		conn.Close()
+	}
+}
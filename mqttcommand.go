@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Commands over MQTT, for managing a fleet of sensors through the broker
+// they already publish to. They do what the admin API does, and like it
+// their changes only last until the exporter restarts. Each command gets a
+// result published to <topic>/command/result.
+
+// How many commands can be waiting before more are ignored
+const mqttCommandQueueSize = 16
+
+type mqttCommand struct {
+	Command string `json:"command"`
+	// For set-interval
+	Interval string `json:"interval,omitempty"`
+	// For set-offsets, anything left out stays as it is
+	offsetsUpdate
+}
+
+type mqttCommandResult struct {
+	Command  string       `json:"command"`
+	OK       bool         `json:"ok"`
+	Error    string       `json:"error,omitempty"`
+	Reading  *readingJSON `json:"reading,omitempty"`
+	Interval string       `json:"interval,omitempty"`
+	Offsets  *offsets     `json:"offsets,omitempty"`
+}
+
+func (s *mqttSink) commandTopic() string {
+	return s.topic + "/command"
+}
+
+// Queue a command from the broker without holding up the connection
+func (s *mqttSink) queueCommand(msg mqttMessage) {
+	if msg.topic != s.commandTopic() {
+		return
+	}
+	// Otherwise it would run again every time the exporter connects
+	if msg.retain {
+		lg.Warnf("Ignoring a retained MQTT command on %s", msg.topic)
+		return
+	}
+	select {
+	case s.commands <- msg.payload:
+	default:
+		lg.Warnf("Ignoring an MQTT command, too many are waiting")
+	}
+}
+
+func (s *mqttSink) setPoller(p *poller) {
+	if s.commands == nil {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case payload := <-s.commands:
+				s.runCommand(p, payload)
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *mqttSink) runCommand(p *poller, payload []byte) {
+	ctx, cancel := context.WithTimeout(s.ctx, conf.GetDuration(sinkTimeout))
+	defer cancel()
+
+	var cmd mqttCommand
+	res := mqttCommandResult{}
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		res.Error = fmt.Sprintf("invalid command: %v", err)
+	} else {
+		res = s.do(ctx, p, cmd)
+	}
+	res.OK = res.Error == ""
+	if res.OK {
+		lg.Infof("Ran the %s command from MQTT", cmd.Command)
+	} else {
+		lg.Warnf("Problem with a command from MQTT: %s", res.Error)
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return
+	}
+	c, err := s.current(ctx)
+	if err == nil {
+		err = c.publish(ctx, s.commandTopic()+"/result", b, 1, false)
+	}
+	if err != nil {
+		lg.Warnf("Problem publishing the result of an MQTT command: %v", err)
+	}
+}
+
+func (s *mqttSink) do(ctx context.Context, p *poller, cmd mqttCommand) mqttCommandResult {
+	res := mqttCommandResult{Command: cmd.Command}
+	switch cmd.Command {
+	case "read":
+		// The reading goes out everywhere a scheduled one would, this included
+		r, err := p.pollNow(ctx)
+		if err == nil && !r.ok() {
+			err = fmt.Errorf("problem reading the sensor")
+		}
+		if err != nil {
+			res.Error = err.Error()
+			break
+		}
+		rj := newReadingJSON(r)
+		res.Reading = &rj
+	case "set-interval":
+		interval, err := parsePollInterval(cmd.Interval)
+		if err != nil {
+			res.Error = err.Error()
+			break
+		}
+		p.setInterval(interval)
+		res.Interval = interval.String()
+	case "set-offsets":
+		o := cmd.offsetsUpdate.apply()
+		res.Offsets = &o
+	default:
+		res.Error = fmt.Sprintf("unknown command %q, use read, set-interval or set-offsets", cmd.Command)
+	}
+	return res
+}
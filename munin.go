@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// `bme280-exporter munin <graph>` is a Munin plugin, one graph per value.
+// Symlinked into Munin's plugins directory as bme280_temperature and so on,
+// it's run that way without the command. See
+// https://guide.munin-monitoring.org/en/latest/develop/plugins/howto-write-plugins.html
+
+// What Munin's plugins are called when they're the binary symlinked
+const muninPrefix = "bme280_"
+
+type muninGraph struct {
+	title  string
+	vlabel string
+	args   string
+	info   string
+	value  func(reading) float64
+}
+
+var muninGraphs = map[string]muninGraph{
+	"temperature": {"Temperature", "°C", "--base 1000", "The temperature in celsius", func(r reading) float64 { return r.Temperature }},
+	"pressure":    {"Pressure", "hPa", "--base 1000 --alt-autoscale", "The atmospheric pressure in hPa", func(r reading) float64 { return r.Pressure / 100 }},
+	"humidity":    {"Humidity", "%", "--base 1000 -l 0 -u 100", "The relative humidity in percent", func(r reading) float64 { return r.Humidity }},
+}
+
+// In the order suggest lists them
+var muninGraphNames = []string{"temperature", "pressure", "humidity"}
+
+func runMunin(args []string) int {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "Give the graph, temperature, pressure or humidity, and optionally config, autoconf or suggest")
+		return 2
+	}
+	name, action := args[0], ""
+	if len(args) > 1 {
+		action = args[1]
+	}
+	// Munin asks these of the wildcard plugin, before there's a graph
+	switch name {
+	case "autoconf", "suggest":
+		name, action = "", name
+	}
+
+	switch action {
+	case "autoconf":
+		// Munin wants a yes or a no with why, and 0 either way
+		r, err := muninRead()
+		if err == nil && !r.ok() {
+			err = fmt.Errorf("the sensor gave no readings")
+		}
+		if err != nil {
+			fmt.Printf("no (%s)\n", strings.ReplaceAll(err.Error(), "\n", "; "))
+		} else {
+			fmt.Println("yes")
+		}
+		return 0
+	case "suggest":
+		r, err := muninRead()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, name := range muninGraphNames {
+			if !math.IsNaN(muninGraphs[name].value(r)) {
+				fmt.Println(name)
+			}
+		}
+		return 0
+	}
+
+	graph, ok := muninGraphs[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown graph %q, use temperature, pressure or humidity\n", name)
+		return 2
+	}
+	switch action {
+	case "config":
+		printMuninConfig(os.Stdout, name, graph)
+		return 0
+	case "":
+		r, err := muninRead()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printMuninValue(os.Stdout, name, graph.value(r))
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "Unknown action %q, use config, autoconf or suggest\n", action)
+	return 2
+}
+
+func muninRead() (reading, error) {
+	if err := openSensor(); err != nil {
+		return reading{}, fmt.Errorf("problem opening the sensor: %w", err)
+	}
+	defer closeSensor()
+	setCalibration(calibrationFromConfig())
+	return doReadSensor(), nil
+}
+
+func printMuninConfig(w io.Writer, name string, graph muninGraph) {
+	fmt.Fprintf(w, "graph_title %s\n", graph.title)
+	fmt.Fprintf(w, "graph_vlabel %s\n", graph.vlabel)
+	fmt.Fprintf(w, "graph_args %s\n", graph.args)
+	fmt.Fprintln(w, "graph_category sensors")
+	fmt.Fprintf(w, "graph_info %s, from the %s\n", graph.info, conf.GetString(modelName))
+	fmt.Fprintf(w, "%s.label %s\n", name, name)
+	fmt.Fprintf(w, "%s.type GAUGE\n", name)
+}
+
+// Munin takes U for a value it doesn't have
+func printMuninValue(w io.Writer, name string, v float64) {
+	value := "U"
+	if !math.IsNaN(v) {
+		value = strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	fmt.Fprintf(w, "%s.value %s\n", name, value)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Publishes readings to NATS as JSON, to a subject made from a template. With
+// JetStream on, each reading waits for the stream to acknowledge it, and has
+// a message ID so that readings sent twice, like after a retry, are only
+// stored once. The client protocol is simple enough to write out here. See
+// https://docs.nats.io/reference/reference-protocols/nats-protocol
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "nats",
+		intervalKey: natsInterval,
+		enabled:     func() bool { return conf.GetString(natsURL) != "" },
+		open:        openNATS,
+		addresses:   func() []string { return urlAddress(conf.GetString(natsURL), "4222") },
+	})
+	configChecks = append(configChecks, checkNATSSettings)
+}
+
+type natsSink struct {
+	address  string
+	user     string
+	password string
+	token    string
+	tls      *tls.Config
+	// Otherwise TLS is only used if the server asks for it
+	useTLS    bool
+	subject   *template.Template
+	jetStream bool
+
+	// Kept open between pushes, and opened again after anything goes wrong
+	conn net.Conn
+	r    *bufio.Reader
+	// Where JetStream's acknowledgements come back to
+	inbox string
+	next  int
+}
+
+// What the server says about itself when a client connects
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+}
+
+type natsConnect struct {
+	Verbose      bool   `json:"verbose"`
+	Pedantic     bool   `json:"pedantic"`
+	Name         string `json:"name"`
+	Lang         string `json:"lang"`
+	Version      string `json:"version"`
+	Protocol     int    `json:"protocol"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+	User         string `json:"user,omitempty"`
+	Pass         string `json:"pass,omitempty"`
+	AuthToken    string `json:"auth_token,omitempty"`
+}
+
+func openNATS() (sink, error) {
+	u, err := url.Parse(conf.GetString(natsURL))
+	if err != nil {
+		return nil, err
+	}
+	s := &natsSink{
+		address:   u.Host,
+		useTLS:    u.Scheme == "tls",
+		jetStream: conf.GetBool(natsJetStream),
+	}
+	if u.Port() == "" {
+		s.address = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	// A user name on its own is a token
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			s.user, s.password = u.User.Username(), p
+		} else {
+			s.token = u.User.Username()
+		}
+	}
+	if s.tls, err = clientTLSConfig(conf.GetString(natsCAFile), conf.GetString(natsCertFile), conf.GetString(natsKeyFile), false); err != nil {
+		return nil, err
+	}
+	s.tls.ServerName = u.Hostname()
+	if s.subject, err = parseSinkTemplate(natsSubject, conf.GetString(natsSubject)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *natsSink) push(ctx context.Context, samples []sample) error {
+	err := s.publish(ctx, samples)
+	if err != nil && s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *natsSink) publish(ctx context.Context, samples []sample) error {
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+	} else {
+		s.conn.SetDeadline(time.Time{})
+	}
+
+	var b []byte
+	for _, smp := range samples {
+		data := smp.json()
+		subject, err := executeSinkTemplate(s.subject, data)
+		if err != nil {
+			return err
+		}
+		if !natsValidSubject(string(subject)) {
+			return fmt.Errorf("%q isn't a subject that can be published to", subject)
+		}
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if !s.jetStream {
+			b = fmt.Appendf(b, "PUB %s %d\r\n", subject, len(payload))
+			b = append(b, payload...)
+			b = append(b, "\r\n"...)
+			continue
+		}
+		s.next++
+		header := fmt.Sprintf("NATS/1.0\r\nNats-Msg-Id: %s/%d/%s/%d\r\n\r\n", smp.Sensor.Host, smp.Sensor.Bus, smp.Sensor.Address, smp.Time.UnixNano())
+		b = fmt.Appendf(b, "HPUB %s %s.%d %d %d\r\n%s", subject, s.inbox, s.next, len(header), len(header)+len(payload), header)
+		b = append(b, payload...)
+		b = append(b, "\r\n"...)
+	}
+	if !s.jetStream {
+		// The PONG means the server has everything before it
+		b = append(b, "PING\r\n"...)
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		return err
+	}
+
+	if !s.jetStream {
+		return s.waitForPong()
+	}
+	for range samples {
+		if err := s.waitForAck(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *natsSink) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	fail := func(err error) error {
+		conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	line, err := s.readLine()
+	if err != nil {
+		return fail(err)
+	}
+	infoJSON, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		return fail(fmt.Errorf("expected INFO from the NATS server, got %q", line))
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(infoJSON), &info); err != nil {
+		return fail(err)
+	}
+	if s.jetStream && !info.Headers {
+		return fail(errors.New("the NATS server is too old for JetStream"))
+	}
+	if info.TLSRequired || s.useTLS {
+		tc := tls.Client(conn, s.tls)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return fail(err)
+		}
+		s.conn, s.r = tc, bufio.NewReader(tc)
+	}
+
+	connect, err := json.Marshal(natsConnect{
+		Name:         "bme280-exporter",
+		Lang:         "go",
+		Version:      version,
+		Protocol:     1,
+		Headers:      info.Headers,
+		NoResponders: info.Headers,
+		User:         s.user,
+		Pass:         s.password,
+		AuthToken:    s.token,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	b := fmt.Appendf(nil, "CONNECT %s\r\n", connect)
+	if s.jetStream {
+		var id [8]byte
+		rand.Read(id[:])
+		s.inbox = "_INBOX." + hex.EncodeToString(id[:])
+		b = fmt.Appendf(b, "SUB %s.* 1\r\n", s.inbox)
+	}
+	b = append(b, "PING\r\n"...)
+	if _, err := s.conn.Write(b); err != nil {
+		return fail(err)
+	}
+	// Bad credentials get an -ERR rather than the PONG
+	if err := s.waitForPong(); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+func (s *natsSink) waitForPong() error {
+	for {
+		line, _, err := s.readMessage()
+		if err != nil {
+			return err
+		}
+		if line == "PONG" {
+			return nil
+		}
+	}
+}
+
+// Wait for JetStream's acknowledgement of a message
+func (s *natsSink) waitForAck() error {
+	for {
+		line, payload, err := s.readMessage()
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != "MSG" && fields[0] != "HMSG") || !strings.HasPrefix(fields[1], s.inbox+".") {
+			continue
+		}
+		if fields[0] == "HMSG" {
+			// A status in the headers, without a body, is the server saying
+			// there's no stream for the subject
+			status, rest, _ := strings.Cut(string(payload), "\r\n\r\n")
+			if f := strings.Fields(strings.SplitN(status, "\r\n", 2)[0]); len(f) > 1 && f[1] == "503" {
+				return errors.New("no JetStream stream for the subject")
+			}
+			payload = []byte(rest)
+		}
+		var ack struct {
+			Stream string `json:"stream"`
+			Error  *struct {
+				Description string `json:"description"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(payload, &ack); err != nil {
+			return fmt.Errorf("unexpected JetStream acknowledgement %q", payload)
+		}
+		if ack.Error != nil {
+			return fmt.Errorf("JetStream: %s", ack.Error.Description)
+		}
+		return nil
+	}
+}
+
+// Read what the server sends next, answering its pings along the way. For
+// MSG and HMSG the payload, with any headers, comes too.
+func (s *natsSink) readMessage() (string, []byte, error) {
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case line == "PING":
+			if _, err := io.WriteString(s.conn, "PONG\r\n"); err != nil {
+				return "", nil, err
+			}
+			continue
+		case strings.HasPrefix(line, "-ERR"):
+			return "", nil, fmt.Errorf("NATS server: %s", strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'"))
+		case strings.HasPrefix(line, "MSG ") || strings.HasPrefix(line, "HMSG "):
+			fields := strings.Fields(line)
+			n, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || n < 0 {
+				return "", nil, fmt.Errorf("unexpected message from the NATS server: %q", line)
+			}
+			payload := make([]byte, n+2)
+			if _, err := io.ReadFull(s.r, payload); err != nil {
+				return "", nil, err
+			}
+			return line, payload[:n], nil
+		}
+		return line, nil, nil
+	}
+}
+
+func (s *natsSink) readLine() (string, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Whether a subject can be published to, so it has no wildcards, spaces or
+// empty tokens
+func natsValidSubject(subject string) bool {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n*>") {
+		return false
+	}
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *natsSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func checkNATSSettings() []configProblem {
+	var problems []configProblem
+	if v := conf.GetString(natsURL); v != "" {
+		if u, err := url.Parse(v); err != nil || u.Host == "" || (u.Scheme != "nats" && u.Scheme != "tls") {
+			problems = append(problems, configError(natsURL, "invalid URL %q, use e.g. nats://nats:4222, or tls:// for TLS", v))
+		}
+	}
+	if _, err := parseSinkTemplate(natsSubject, conf.GetString(natsSubject)); err != nil {
+		problems = append(problems, configError(natsSubject, "%v", err))
+	}
+	for _, key := range []string{natsCAFile, natsCertFile, natsKeyFile} {
+		if f := conf.GetString(key); f != "" {
+			if _, err := os.Stat(f); err != nil {
+				problems = append(problems, configError(key, "%v", err))
+			}
+		}
+	}
+	if (conf.GetString(natsCertFile) == "") != (conf.GetString(natsKeyFile) == "") {
+		problems = append(problems, configError(natsCertFile, "%s and %s go together", natsCertFile, natsKeyFile))
+	}
+	return problems
+}
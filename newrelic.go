@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Sends readings to New Relic's Metric API as gauges, so they land in NRDB
+// as dimensional metrics without an agent. The host, sensor type and
+// configured labels are the metrics' attributes. See
+// https://docs.newrelic.com/docs/data-apis/ingest-apis/metric-api/report-metrics-metric-api/
+
+// Readings to a request, which keeps it well under the API's 1 MB
+const newRelicBatchSize = 1000
+
+// The Metric API's endpoint for each region
+var newRelicEndpoints = map[string]string{
+	"us": "https://metric-api.newrelic.com/metric/v1",
+	"eu": "https://metric-api.eu.newrelic.com/metric/v1",
+}
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "newrelic",
+		intervalKey: newRelicInterval,
+		enabled:     func() bool { return conf.GetString(newRelicAPIKeyFile) != "" },
+		open:        openNewRelic,
+		addresses:   func() []string { return urlAddress(newRelicEndpoints[conf.GetString(newRelicRegion)], "") },
+	})
+	configChecks = append(configChecks, checkNewRelicSettings)
+}
+
+type newRelicMetric struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Value      float64           `json:"value"`
+	Timestamp  int64             `json:"timestamp"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type newRelicPayload struct {
+	Common struct {
+		Attributes map[string]string `json:"attributes"`
+	} `json:"common"`
+	Metrics []newRelicMetric `json:"metrics"`
+}
+
+type newRelicSink struct {
+	url        string
+	apiKeyFile string
+	prefix     string
+	client     *http.Client
+}
+
+func openNewRelic() (sink, error) {
+	return &newRelicSink{
+		url:        newRelicEndpoints[conf.GetString(newRelicRegion)],
+		apiKeyFile: conf.GetString(newRelicAPIKeyFile),
+		prefix:     conf.GetString(newRelicPrefix),
+		client:     &http.Client{},
+	}, nil
+}
+
+func (s *newRelicSink) push(ctx context.Context, samples []sample) error {
+	for start := 0; start < len(samples); start += newRelicBatchSize {
+		if err := s.send(ctx, samples[start:min(start+newRelicBatchSize, len(samples))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *newRelicSink) send(ctx context.Context, samples []sample) error {
+	var payload newRelicPayload
+	payload.Common.Attributes = map[string]string{"instrumentation.provider": "bme280-exporter"}
+	for _, smp := range samples {
+		tags := smp.tags()
+		for _, v := range smp.values() {
+			name := v.name
+			if s.prefix != "" {
+				name = s.prefix + "." + name
+			}
+			payload.Metrics = append(payload.Metrics, newRelicMetric{
+				Name:       name,
+				Type:       "gauge",
+				Value:      v.value,
+				Timestamp:  smp.Time.UnixMilli(),
+				Attributes: tags,
+			})
+		}
+	}
+	if len(payload.Metrics) == 0 {
+		return nil
+	}
+
+	// New Relic asks for payloads to be gzipped
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	if err := json.NewEncoder(zw).Encode([]newRelicPayload{payload}); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	// Read each time so a rotated key gets picked up
+	key, err := os.ReadFile(s.apiKeyFile)
+	if err != nil {
+		return fmt.Errorf("API key: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	req.Header.Set("Api-Key", strings.TrimSpace(string(key)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *newRelicSink) close() error {
+	return nil
+}
+
+func checkNewRelicSettings() []configProblem {
+	keyFile := conf.GetString(newRelicAPIKeyFile)
+	if keyFile == "" {
+		return nil
+	}
+	var problems []configProblem
+	if _, err := os.Stat(keyFile); err != nil {
+		problems = append(problems, configError(newRelicAPIKeyFile, "%v", err))
+	}
+	if r := conf.GetString(newRelicRegion); newRelicEndpoints[r] == "" {
+		problems = append(problems, configError(newRelicRegion, "unknown region %q, use us or eu", r))
+	}
+	return problems
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sends readings as NMEA 0183 sentences, over TCP to whoever connects and to
+// a serial port, so chart plotters, OpenCPN and the like can show the
+// pressure, temperature and humidity. XDR is the generic transducer
+// sentence; MDA is the older meteorological composite some instruments
+// still want.
+
+func init() {
+	configChecks = append(configChecks, checkNMEASettings)
+}
+
+// Magnus formula dew point in °C, with the Alduchov and Eskridge constants
+func dewPoint(temperature, humidity float64) float64 {
+	const a, b = 17.625, 243.04
+	g := math.Log(humidity/100) + a*temperature/(b+temperature)
+	return b * g / (a - g)
+}
+
+func nmeaSentence(talker, body string) string {
+	var sum byte
+	s := talker + body
+	for i := 0; i < len(s); i++ {
+		sum ^= s[i]
+	}
+	return fmt.Sprintf("$%s*%02X\r\n", s, sum)
+}
+
+func nmeaNumber(v float64, decimals int) string {
+	if math.IsNaN(v) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', decimals, 64)
+}
+
+// XDR with a measurement for each value there is: type, value, unit and
+// name. Pressure's in bars, the unit chart plotters expect.
+func nmeaXDR(talker string, r reading) string {
+	var fields []string
+	if !math.IsNaN(r.Pressure) {
+		fields = append(fields, "P", nmeaNumber(r.Pressure/1e5, 5), "B", "Barometer")
+	}
+	if !math.IsNaN(r.Temperature) {
+		fields = append(fields, "C", nmeaNumber(r.Temperature, 1), "C", "AirTemp")
+	}
+	if !math.IsNaN(r.Humidity) {
+		fields = append(fields, "H", nmeaNumber(r.Humidity, 1), "P", "Humidity")
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return nmeaSentence(talker, "XDR,"+strings.Join(fields, ","))
+}
+
+// MDA, with the pressure in inches of mercury and bars, the air temperature,
+// humidity and dew point, and the water temperature and wind left empty
+func nmeaMDA(talker string, r reading) string {
+	if math.IsNaN(r.Pressure) && math.IsNaN(r.Temperature) && math.IsNaN(r.Humidity) {
+		return ""
+	}
+	dew := math.NaN()
+	if !math.IsNaN(r.Temperature) && r.Humidity > 0 {
+		dew = dewPoint(r.Temperature, r.Humidity)
+	}
+	return nmeaSentence(talker, fmt.Sprintf("MDA,%s,I,%s,B,%s,C,,C,%s,,%s,C,,T,,M,,N,,M",
+		nmeaNumber(r.Pressure/3386.389, 2), nmeaNumber(r.Pressure/1e5, 5),
+		nmeaNumber(r.Temperature, 1), nmeaNumber(r.Humidity, 1), nmeaNumber(dew, 1)))
+}
+
+var nmeaEncoders = map[string]func(string, reading) string{
+	"xdr": nmeaXDR,
+	"mda": nmeaMDA,
+}
+
+// The TCP clients, which only ever get sentences written to them
+type nmeaClients struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (c *nmeaClients) add(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conns[conn] = struct{}{}
+}
+
+// Write to every client, dropping any that can't keep up
+func (c *nmeaClients) write(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.conns {
+		conn.SetWriteDeadline(time.Now().Add(conf.GetDuration(writeTimeout)))
+		if _, err := conn.Write(b); err != nil {
+			lg.Debugf("Closing NMEA connection from %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			delete(c.conns, conn)
+		}
+	}
+}
+
+func (c *nmeaClients) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.conns {
+		conn.Close()
+		delete(c.conns, conn)
+	}
+}
+
+// Send each reading the poller takes until the context is cancelled
+func runNMEA(ctx context.Context, p *poller) error {
+	if p == nil {
+		return fmt.Errorf("NMEA needs %s", pollInterval)
+	}
+	talker := conf.GetString(nmeaTalker)
+	var encoders []func(string, reading) string
+	for _, name := range getStringList(nmeaSentences) {
+		if enc := nmeaEncoders[strings.ToLower(name)]; enc != nil {
+			encoders = append(encoders, enc)
+		}
+	}
+	encode := func(r reading) []byte {
+		var b []byte
+		for _, enc := range encoders {
+			b = append(b, enc(talker, r)...)
+		}
+		return b
+	}
+
+	var serial io.WriteCloser
+	if dev := conf.GetString(nmeaDevice); dev != "" {
+		f, err := openSerial(dev, conf.GetInt(nmeaBaudRate))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		serial = f
+		lg.Infof("Sending NMEA 0183 to %s", dev)
+	}
+
+	clients := &nmeaClients{conns: map[net.Conn]struct{}{}}
+	defer clients.close()
+	if addr := conf.GetString(nmeaListenAddress); addr != "" {
+		var allowlist *allowlistHandler
+		if cidrs := getStringList(allowedCIDRs); len(cidrs) > 0 {
+			var err error
+			if allowlist, err = newAllowlistHandler(cidrs, nil); err != nil {
+				return err
+			}
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		lg.Infof("Serving NMEA 0183 on %s", l.Addr())
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+						lg.Warnf("Problem accepting an NMEA connection: %v", err)
+					}
+					return
+				}
+				if allowlist != nil && !allowlist.allowed(conn.RemoteAddr().String()) {
+					conn.Close()
+					continue
+				}
+				// Something to show straight away, rather than at the next poll
+				if r := p.Latest(); r.ok() {
+					conn.SetWriteDeadline(time.Now().Add(conf.GetDuration(writeTimeout)))
+					conn.Write(encode(r))
+				}
+				clients.add(conn)
+			}
+		}()
+	}
+
+	readings := p.subscribe()
+	defer p.unsubscribe(readings)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case r, ok := <-readings:
+			if !ok {
+				return nil
+			}
+			b := encode(r)
+			if len(b) == 0 {
+				continue
+			}
+			if serial != nil {
+				if _, err := serial.Write(b); err != nil {
+					lg.Warnf("Problem writing NMEA to %s: %v", conf.GetString(nmeaDevice), err)
+				}
+			}
+			clients.write(b)
+		}
+	}
+}
+
+func checkNMEASettings() []configProblem {
+	if conf.GetString(nmeaListenAddress) == "" && conf.GetString(nmeaDevice) == "" {
+		return nil
+	}
+	var problems []configProblem
+	if configuredPollInterval() <= 0 {
+		problems = append(problems, configError(nmeaListenAddress, "needs %s set", pollInterval))
+	}
+	if conf.GetString(nmeaDevice) != "" && !validSerialBaudRate(conf.GetInt(nmeaBaudRate)) {
+		problems = append(problems, configError(nmeaBaudRate, "unsupported baud rate %d", conf.GetInt(nmeaBaudRate)))
+	}
+	if t := conf.GetString(nmeaTalker); len(t) != 2 || strings.ToUpper(t) != t {
+		problems = append(problems, configError(nmeaTalker, "must be two capital letters, like WI"))
+	}
+	sentences := getStringList(nmeaSentences)
+	if len(sentences) == 0 {
+		problems = append(problems, configError(nmeaSentences, "needs at least one of xdr or mda"))
+	}
+	for _, s := range sentences {
+		if nmeaEncoders[strings.ToLower(s)] == nil {
+			problems = append(problems, configError(nmeaSentences, "unknown sentence %q, use xdr or mda", s))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Uploads readings to a senseBox on openSenseMap, each metric as one of the
+// box's sensors. See https://docs.opensensemap.org/#api-Measurements-postNewMeasurements
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "opensensemap",
+		intervalKey: openSenseMapInterval,
+		enabled:     func() bool { return conf.GetString(openSenseMapBoxID) != "" },
+		open:        openOpenSenseMap,
+		addresses:   func() []string { return urlAddress(conf.GetString(openSenseMapURL), "") },
+	})
+	configChecks = append(configChecks, checkOpenSenseMapSettings)
+}
+
+// The most measurements openSenseMap takes in one upload
+const openSenseMapBatchSize = 2500
+
+// Boxes and sensors have MongoDB object IDs
+var openSenseMapIDRe = regexp.MustCompile(`^[0-9a-f]{24}$`)
+
+type openSenseMapMeasurement struct {
+	Sensor    string `json:"sensor"`
+	Value     string `json:"value"`
+	CreatedAt string `json:"createdAt"`
+}
+
+type openSenseMapSink struct {
+	url       string
+	tokenFile string
+	sensors   map[string]string
+	hPa       bool
+	client    *http.Client
+}
+
+func openOpenSenseMap() (sink, error) {
+	return &openSenseMapSink{
+		url:       strings.TrimSuffix(conf.GetString(openSenseMapURL), "/") + "/boxes/" + url.PathEscape(conf.GetString(openSenseMapBoxID)) + "/data",
+		tokenFile: conf.GetString(openSenseMapTokenFile),
+		sensors:   conf.GetStringMapString(openSenseMapSensors),
+		hPa:       conf.GetString(openSenseMapPressureUnit) == "hPa",
+		client:    &http.Client{},
+	}, nil
+}
+
+func (s *openSenseMapSink) push(ctx context.Context, samples []sample) error {
+	var measurements []openSenseMapMeasurement
+	for _, smp := range samples {
+		for _, v := range smp.values() {
+			id := s.sensors[v.name]
+			if id == "" {
+				continue
+			}
+			value := v.value
+			if v.name == pressureMetric && s.hPa {
+				value /= 100
+			}
+			measurements = append(measurements, openSenseMapMeasurement{
+				Sensor:    id,
+				Value:     strconv.FormatFloat(value, 'f', 2, 64),
+				CreatedAt: smp.Time.UTC().Format("2006-01-02T15:04:05.000Z"),
+			})
+		}
+	}
+	for start := 0; start < len(measurements); start += openSenseMapBatchSize {
+		if err := s.upload(ctx, measurements[start:min(start+openSenseMapBatchSize, len(measurements))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *openSenseMapSink) upload(ctx context.Context, measurements []openSenseMapMeasurement) error {
+	body, err := json.Marshal(measurements)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	// Boxes made since 2018 need their access token. Read it each time so a
+	// new one gets picked up.
+	if s.tokenFile != "" {
+		token, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return fmt.Errorf("access token: %w", err)
+		}
+		req.Header.Set("Authorization", strings.TrimSpace(string(token)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(msg, &e) == nil && e.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Message)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *openSenseMapSink) close() error {
+	return nil
+}
+
+func checkOpenSenseMapSettings() []configProblem {
+	box := conf.GetString(openSenseMapBoxID)
+	if box == "" {
+		return nil
+	}
+	var problems []configProblem
+	if !openSenseMapIDRe.MatchString(box) {
+		problems = append(problems, configError(openSenseMapBoxID, "invalid senseBox ID %q, it's 24 hex digits", box))
+	}
+	if f := conf.GetString(openSenseMapTokenFile); f == "" {
+		problems = append(problems, configWarning(openSenseMapTokenFile, "isn't set, which only works for boxes made before 2018"))
+	} else if _, err := os.Stat(f); err != nil {
+		problems = append(problems, configError(openSenseMapTokenFile, "%v", err))
+	}
+	if u, err := url.Parse(conf.GetString(openSenseMapURL)); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		problems = append(problems, configError(openSenseMapURL, "invalid URL %q", conf.GetString(openSenseMapURL)))
+	}
+	sensors := conf.GetStringMapString(openSenseMapSensors)
+	if len(sensors) == 0 {
+		problems = append(problems, configError(openSenseMapSensors, "no metrics are mapped to the box's sensors"))
+	}
+	for metric, id := range sensors {
+		if metric != temperatureMetric && metric != pressureMetric && metric != humidityMetric {
+			problems = append(problems, configError(openSenseMapSensors, "unknown metric %q, use temperature, pressure or humidity", metric))
+		}
+		if !openSenseMapIDRe.MatchString(id) {
+			problems = append(problems, configError(openSenseMapSensors, "invalid sensor ID %q for %s, it's 24 hex digits", id, metric))
+		}
+	}
+	if u := conf.GetString(openSenseMapPressureUnit); u != "hPa" && u != "Pa" {
+		problems = append(problems, configError(openSenseMapPressureUnit, "must be hPa or Pa"))
+	}
+	return problems
+}
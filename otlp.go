@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	grpccreds "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Exports readings as OpenTelemetry gauges, over OTLP/HTTP or OTLP/gRPC, for
+// an OpenTelemetry collector. The messages are encoded by hand like the
+// traces are. See
+// https://opentelemetry.io/docs/specs/otlp/
+
+const otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "otlp",
+		intervalKey: otlpInterval,
+		enabled:     func() bool { return conf.GetString(otlpEndpoint) != "" },
+		open:        openOTLP,
+		addresses:   func() []string { return urlAddress(conf.GetString(otlpEndpoint), "") },
+	})
+	configChecks = append(configChecks, checkOTLPSettings)
+}
+
+// What each reading becomes in OpenTelemetry, with UCUM units
+var otlpMetrics = []struct {
+	name, description, unit string
+}{
+	{temperatureMetric, "Current temperature", "Cel"},
+	{pressureMetric, "Current atmospheric pressure", "Pa"},
+	{humidityMetric, "Current relative humidity", "%"},
+}
+
+type otlpSink struct {
+	url        string
+	headers    map[string]string
+	attributes map[string]string
+	client     *http.Client
+	// Set when sending over gRPC instead
+	conn *grpc.ClientConn
+}
+
+// The messages are already encoded, so gRPC just passes the bytes along
+type otlpRawCodec struct{}
+
+func (otlpRawCodec) Marshal(v any) ([]byte, error) { return v.([]byte), nil }
+
+func (otlpRawCodec) Unmarshal(data []byte, v any) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (otlpRawCodec) Name() string { return "proto" }
+
+func openOTLP() (sink, error) {
+	u, err := url.Parse(conf.GetString(otlpEndpoint))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", conf.GetString(otlpEndpoint))
+	}
+	s := &otlpSink{
+		headers:    conf.GetStringMapString(otlpHeaders),
+		attributes: conf.GetStringMapString(otlpResourceAttributes),
+		client:     &http.Client{},
+	}
+	if conf.GetString(otlpProtocol) == "grpc" {
+		// Plain HTTP/2 for http://, like the exporter's own gRPC server
+		creds := insecure.NewCredentials()
+		port := "80"
+		if u.Scheme != "http" {
+			creds = grpccreds.NewTLS(&tls.Config{})
+			port = "443"
+		}
+		if u.Port() != "" {
+			port = u.Port()
+		}
+		s.conn, err = grpc.NewClient(net.JoinHostPort(u.Hostname(), port),
+			grpc.WithTransportCredentials(creds),
+			grpc.WithUserAgent("bme280-exporter/"+version))
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/metrics"
+	}
+	s.url = u.String()
+	return s, nil
+}
+
+func (s *otlpSink) push(ctx context.Context, samples []sample) error {
+	body := s.encode(samples)
+	if s.conn != nil {
+		for k, v := range s.headers {
+			ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(k), v)
+		}
+		var resp []byte
+		return s.conn.Invoke(ctx, otlpGRPCPath, body, &resp, grpc.ForceCodec(otlpRawCodec{}))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, otlpErrorMessage(msg))
+	}
+	return nil
+}
+
+// The message in a google.rpc.Status, which is what OTLP/HTTP errors come
+// as, or the body as it is if it's something else
+func otlpErrorMessage(b []byte) string {
+	for rest := b; len(rest) > 0; {
+		num, typ, n := protowire.ConsumeTag(rest)
+		if n < 0 {
+			break
+		}
+		rest = rest[n:]
+		if num == 2 && typ == protowire.BytesType {
+			if v, n := protowire.ConsumeBytes(rest); n >= 0 {
+				return string(v)
+			}
+			break
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, rest); n < 0 {
+			break
+		}
+		rest = rest[n:]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// opentelemetry.proto.collector.metrics.v1.ExportMetricsServiceRequest, with a
+// resource for each sensor the readings came from
+func (s *otlpSink) encode(samples []sample) []byte {
+	type resource struct {
+		attrs   []spanAttr
+		samples []sample
+	}
+	var resources []*resource
+	byKey := make(map[string]*resource)
+	for _, smp := range samples {
+		attrs := s.resourceAttributes(smp)
+		key := fmt.Sprint(attrs)
+		r := byKey[key]
+		if r == nil {
+			r = &resource{attrs: attrs}
+			byKey[key] = r
+			resources = append(resources, r)
+		}
+		r.samples = append(r.samples, smp)
+	}
+
+	var b []byte
+	for _, r := range resources {
+		var res []byte
+		for _, a := range r.attrs {
+			res = protowire.AppendTag(res, 1, protowire.BytesType)
+			res = protowire.AppendBytes(res, encodeKeyValue(a))
+		}
+
+		var scope []byte
+		scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+		scope = protowire.AppendString(scope, "github.com/jaevans/bme280-exporter")
+		scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+		scope = protowire.AppendString(scope, version)
+
+		var scopeMetrics []byte
+		scopeMetrics = protowire.AppendTag(scopeMetrics, 1, protowire.BytesType)
+		scopeMetrics = protowire.AppendBytes(scopeMetrics, scope)
+		for _, m := range otlpMetrics {
+			if metric := encodeOTLPGauge(m.name, m.description, m.unit, r.samples); metric != nil {
+				scopeMetrics = protowire.AppendTag(scopeMetrics, 2, protowire.BytesType)
+				scopeMetrics = protowire.AppendBytes(scopeMetrics, metric)
+			}
+		}
+
+		var resourceMetrics []byte
+		resourceMetrics = protowire.AppendTag(resourceMetrics, 1, protowire.BytesType)
+		resourceMetrics = protowire.AppendBytes(resourceMetrics, res)
+		resourceMetrics = protowire.AppendTag(resourceMetrics, 2, protowire.BytesType)
+		resourceMetrics = protowire.AppendBytes(resourceMetrics, scopeMetrics)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, resourceMetrics)
+	}
+	return b
+}
+
+// The exporter and the sensor as resource attributes, with the configured
+// labels and any extra attributes
+func (s *otlpSink) resourceAttributes(smp sample) []spanAttr {
+	attrs := []spanAttr{
+		{"service.name", "bme280-exporter"},
+		{"service.version", version},
+		{"host.name", smp.Sensor.Host},
+		{"sensor.model", smp.Sensor.Model},
+		{"sensor.bus", smp.Sensor.Bus},
+		{"sensor.address", smp.Sensor.Address},
+	}
+	extra := make(map[string]string)
+	for k, v := range smp.Labels {
+		extra[k] = v
+	}
+	for k, v := range s.attributes {
+		extra[k] = v
+	}
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		attrs = append(attrs, spanAttr{k, extra[k]})
+	}
+	return attrs
+}
+
+// opentelemetry.proto.metrics.v1.Metric holding a Gauge with a point for
+// each reading that has the value, or nil if none do
+func encodeOTLPGauge(name, description, unit string, samples []sample) []byte {
+	var gauge []byte
+	for _, smp := range samples {
+		for _, v := range smp.values() {
+			if v.name != name {
+				continue
+			}
+			var point []byte
+			point = protowire.AppendTag(point, 3, protowire.Fixed64Type)
+			point = protowire.AppendFixed64(point, uint64(smp.Time.UnixNano()))
+			point = protowire.AppendTag(point, 4, protowire.Fixed64Type)
+			point = protowire.AppendFixed64(point, math.Float64bits(v.value))
+			gauge = protowire.AppendTag(gauge, 1, protowire.BytesType)
+			gauge = protowire.AppendBytes(gauge, point)
+		}
+	}
+	if gauge == nil {
+		return nil
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, description)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, unit)
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	return protowire.AppendBytes(b, gauge)
+}
+
+func (s *otlpSink) close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+func checkOTLPSettings() []configProblem {
+	var problems []configProblem
+	if endpoint := conf.GetString(otlpEndpoint); endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, configError(otlpEndpoint, "invalid endpoint %q, use e.g. http://otel-collector:4318", endpoint))
+		}
+	}
+	if p := conf.GetString(otlpProtocol); p != "http/protobuf" && p != "grpc" {
+		problems = append(problems, configError(otlpProtocol, "unknown protocol %q, use http/protobuf or grpc", p))
+	}
+	return problems
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Just enough of Parquet to write the history out for pandas, DuckDB and
+// friends: a flat schema, PLAIN encoded values, one gzipped page per column
+// in each row group, and the footer in Thrift's compact protocol. See
+// https://parquet.apache.org/docs/file-format/ and parquet.thrift.
+
+const parquetRowGroupSize = 1 << 17
+
+// Physical types, from parquet.thrift
+const (
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+type parquetColumn struct {
+	name     string
+	typ      int32
+	optional bool
+	// "string" or "timestamp", or nothing for plain numbers
+	logical string
+	// Append a row's value PLAIN encoded, or report that it's null
+	value func(b []byte, row historyRow) ([]byte, bool)
+}
+
+var parquetColumns = []parquetColumn{
+	{name: "time", typ: parquetInt64, logical: "timestamp", value: func(b []byte, row historyRow) ([]byte, bool) {
+		return binary.LittleEndian.AppendUint64(b, uint64(row.Time)), true
+	}},
+	{name: "host", typ: parquetByteArray, logical: "string", value: func(b []byte, row historyRow) ([]byte, bool) {
+		return parquetAppendString(b, row.Host), true
+	}},
+	{name: "sensor", typ: parquetByteArray, logical: "string", value: func(b []byte, row historyRow) ([]byte, bool) {
+		return parquetAppendString(b, row.Model), true
+	}},
+	{name: "bus", typ: parquetInt32, value: func(b []byte, row historyRow) ([]byte, bool) {
+		return binary.LittleEndian.AppendUint32(b, uint32(int32(row.Bus))), true
+	}},
+	{name: "address", typ: parquetByteArray, logical: "string", value: func(b []byte, row historyRow) ([]byte, bool) {
+		return parquetAppendString(b, row.Address), true
+	}},
+	{name: "temperature_celsius", typ: parquetDouble, optional: true, value: func(b []byte, row historyRow) ([]byte, bool) {
+		return parquetAppendDouble(b, row.Temperature)
+	}},
+	{name: "pressure_pascals", typ: parquetDouble, optional: true, value: func(b []byte, row historyRow) ([]byte, bool) {
+		return parquetAppendDouble(b, row.Pressure)
+	}},
+	{name: "humidity_percent", typ: parquetDouble, optional: true, value: func(b []byte, row historyRow) ([]byte, bool) {
+		return parquetAppendDouble(b, row.Humidity)
+	}},
+	{name: "labels", typ: parquetByteArray, optional: true, logical: "string", value: func(b []byte, row historyRow) ([]byte, bool) {
+		if row.Labels == nil {
+			return b, false
+		}
+		return parquetAppendString(b, *row.Labels), true
+	}},
+}
+
+func parquetAppendString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func parquetAppendDouble(b []byte, v *float64) ([]byte, bool) {
+	if v == nil {
+		return b, false
+	}
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(*v)), true
+}
+
+// Where a column chunk ended up in the file, for the footer
+type parquetChunk struct {
+	offset           int64
+	compressedSize   int64
+	uncompressedSize int64
+	values           int64
+}
+
+func writeParquet(w io.Writer, rows []historyRow) error {
+	var offset int64
+	write := func(b []byte) error {
+		n, err := w.Write(b)
+		offset += int64(n)
+		return err
+	}
+	if err := write([]byte("PAR1")); err != nil {
+		return err
+	}
+
+	var groups [][]parquetChunk
+	var groupRows []int
+	for start := 0; start < len(rows); start += parquetRowGroupSize {
+		group := rows[start:min(start+parquetRowGroupSize, len(rows))]
+		var chunks []parquetChunk
+		for _, col := range parquetColumns {
+			page, err := parquetPage(col, group)
+			if err != nil {
+				return err
+			}
+			chunk := parquetChunk{offset: offset, values: int64(len(group))}
+			header := parquetPageHeader(len(group), page)
+			if err := write(header); err != nil {
+				return err
+			}
+			if err := write(page.compressed); err != nil {
+				return err
+			}
+			chunk.compressedSize = int64(len(header) + len(page.compressed))
+			chunk.uncompressedSize = int64(len(header) + page.uncompressedSize)
+			chunks = append(chunks, chunk)
+		}
+		groups = append(groups, chunks)
+		groupRows = append(groupRows, len(group))
+	}
+
+	footer := parquetFooter(len(rows), groups, groupRows)
+	if err := write(footer); err != nil {
+		return err
+	}
+	return write(append(binary.LittleEndian.AppendUint32(nil, uint32(len(footer))), "PAR1"...))
+}
+
+type parquetPageData struct {
+	compressed       []byte
+	uncompressedSize int
+}
+
+// A data page with a column's values for some rows, led by their definition
+// levels if the column's optional, then gzipped
+func parquetPage(col parquetColumn, rows []historyRow) (parquetPageData, error) {
+	var values []byte
+	present := make([]bool, len(rows))
+	for i, row := range rows {
+		values, present[i] = col.value(values, row)
+	}
+	var page []byte
+	if col.optional {
+		page = parquetLevels(present)
+	}
+	page = append(page, values...)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(page); err != nil {
+		return parquetPageData{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return parquetPageData{}, err
+	}
+	return parquetPageData{compressed: buf.Bytes(), uncompressedSize: len(page)}, nil
+}
+
+// Definition levels, 1 for a value and 0 for a null, as runs in the
+// RLE/bit-packing hybrid encoding, after their length
+func parquetLevels(present []bool) []byte {
+	b := make([]byte, 4)
+	for i := 0; i < len(present); {
+		j := i
+		for j < len(present) && present[j] == present[i] {
+			j++
+		}
+		b = binary.AppendUvarint(b, uint64(j-i)<<1)
+		if present[i] {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+		i = j
+	}
+	binary.LittleEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+func parquetPageHeader(values int, page parquetPageData) []byte {
+	var t thriftWriter
+	t.begin()
+	t.i32(1, 0) // DATA_PAGE
+	t.i32(2, int32(page.uncompressedSize))
+	t.i32(3, int32(len(page.compressed)))
+	t.beginField(5)
+	t.i32(1, int32(values))
+	t.i32(2, 0) // PLAIN
+	t.i32(3, 3) // RLE
+	t.i32(4, 3)
+	t.end()
+	t.end()
+	return t.b
+}
+
+func parquetFooter(numRows int, groups [][]parquetChunk, groupRows []int) []byte {
+	var t thriftWriter
+	t.begin()
+	t.i32(1, 1)
+
+	t.list(2, thriftStruct, len(parquetColumns)+1)
+	t.begin()
+	t.str(4, "schema")
+	t.i32(5, int32(len(parquetColumns)))
+	t.end()
+	for _, col := range parquetColumns {
+		t.begin()
+		t.i32(1, col.typ)
+		if col.optional {
+			t.i32(3, 1) // OPTIONAL
+		} else {
+			t.i32(3, 0) // REQUIRED
+		}
+		t.str(4, col.name)
+		switch col.logical {
+		case "string":
+			t.i32(6, 0) // UTF8
+			t.beginField(10)
+			t.beginField(1) // STRING
+			t.end()
+			t.end()
+		case "timestamp":
+			t.i32(6, 9) // TIMESTAMP_MILLIS
+			t.beginField(10)
+			t.beginField(8) // TIMESTAMP
+			t.boolean(1, true)
+			t.beginField(2)
+			t.beginField(1) // MILLIS
+			t.end()
+			t.end()
+			t.end()
+			t.end()
+		}
+		t.end()
+	}
+
+	t.i64(3, int64(numRows))
+	t.list(4, thriftStruct, len(groups))
+	for g, chunks := range groups {
+		t.begin()
+		t.list(1, thriftStruct, len(chunks))
+		var total int64
+		for i, chunk := range chunks {
+			col := parquetColumns[i]
+			total += chunk.uncompressedSize
+			t.begin()
+			t.i64(2, chunk.offset)
+			t.beginField(3)
+			t.i32(1, col.typ)
+			t.list(2, thriftI32, 2)
+			t.varint(0) // PLAIN
+			t.varint(3) // RLE
+			t.list(3, thriftBinary, 1)
+			t.binary(col.name)
+			t.i32(4, 2) // GZIP
+			t.i64(5, chunk.values)
+			t.i64(6, chunk.uncompressedSize)
+			t.i64(7, chunk.compressedSize)
+			t.i64(9, chunk.offset)
+			t.end()
+			t.end()
+		}
+		t.i64(2, total)
+		t.i64(3, int64(groupRows[g]))
+		t.end()
+	}
+	t.str(6, "bme280-exporter version "+version)
+	t.end()
+	return t.b
+}
+
+// Types in Thrift's compact protocol
+const (
+	thriftBoolTrue  = 1
+	thriftBoolFalse = 2
+	thriftI32       = 5
+	thriftI64       = 6
+	thriftBinary    = 8
+	thriftList      = 9
+	thriftStruct    = 12
+)
+
+// Writes Thrift's compact protocol, where each field's ID is written as the
+// difference from the one before it in the same struct
+type thriftWriter struct {
+	b []byte
+	// The last field ID in each struct that's open
+	last []int16
+}
+
+// Start a struct that isn't a field, like the outermost one or one in a list
+func (t *thriftWriter) begin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) beginField(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+func (t *thriftWriter) end() {
+	t.b = append(t.b, 0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	top := &t.last[len(t.last)-1]
+	if d := id - *top; d > 0 && d <= 15 {
+		t.b = append(t.b, byte(d)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.varint(int64(id))
+	}
+	*top = id
+}
+
+// A zigzag varint, as integers are written
+func (t *thriftWriter) varint(v int64) {
+	t.b = binary.AppendUvarint(t.b, uint64(v<<1)^uint64(v>>63))
+}
+
+func (t *thriftWriter) binary(s string) {
+	t.b = binary.AppendUvarint(t.b, uint64(len(s)))
+	t.b = append(t.b, s...)
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.binary(s)
+}
+
+func (t *thriftWriter) boolean(id int16, v bool) {
+	if v {
+		t.field(id, thriftBoolTrue)
+	} else {
+		t.field(id, thriftBoolFalse)
+	}
+}
+
+// Start a list of n elements, which follow without field headers
+func (t *thriftWriter) list(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.b = append(t.b, byte(n)<<4|elem)
+	} else {
+		t.b = append(t.b, 0xf0|elem)
+		t.b = binary.AppendUvarint(t.b, uint64(n))
+	}
+}
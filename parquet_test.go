@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func openParquet(t *testing.T, rows []historyRow) *parquet.File {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, rows); err != nil {
+		t.Fatal(err)
+	}
+	f, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func readParquetRows(t *testing.T, f *parquet.File) []parquet.Row {
+	t.Helper()
+	r := parquet.NewReader(f)
+	defer r.Close()
+	var rows []parquet.Row
+	for {
+		row := make([]parquet.Row, 1)
+		n, err := r.ReadRows(row)
+		if n == 1 {
+			rows = append(rows, row[0].Clone())
+		}
+		if err == io.EOF {
+			return rows
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	f := openParquet(t, nil)
+	wantSchema := `message schema {
+	required int64 time (TIMESTAMP(isAdjustedToUTC=true,unit=MILLIS));
+	required binary host (STRING);
+	required binary sensor (STRING);
+	required int32 bus;
+	required binary address (STRING);
+	optional double temperature_celsius;
+	optional double pressure_pascals;
+	optional double humidity_percent;
+	optional binary labels (STRING);
+}`
+	if got := f.Schema().String(); got != wantSchema {
+		t.Errorf("schema is\n%s\nwant\n%s", got, wantSchema)
+	}
+	if f.NumRows() != 0 {
+		t.Errorf("empty file has %d rows", f.NumRows())
+	}
+
+	temp, pressure, humidity := 21.37, 101325.4, 48.12
+	labels := `{"room":"attic"}`
+	rows := []historyRow{
+		{Time: 1792115603397, Host: "raspberrypi", Model: "BME280", Bus: 1, Address: "0x76", Temperature: &temp, Pressure: &pressure, Humidity: &humidity, Labels: &labels},
+		{Time: 1792115663397, Host: "raspberrypi", Model: "BMP280", Bus: 1, Address: "0x77", Temperature: &temp, Pressure: &pressure},
+		{Time: 1792115723397, Host: "raspberrypi", Model: "BME280", Bus: -1, Address: "0x76"},
+	}
+	f = openParquet(t, rows)
+	if f.NumRows() != int64(len(rows)) {
+		t.Fatalf("got %d rows, want %d", f.NumRows(), len(rows))
+	}
+	got := readParquetRows(t, f)
+	if len(got) != len(rows) {
+		t.Fatalf("read %d rows, want %d", len(got), len(rows))
+	}
+	double := func(v parquet.Value) *float64 {
+		if v.IsNull() {
+			return nil
+		}
+		d := v.Double()
+		return &d
+	}
+	equal := func(a, b *float64) bool { return a == nil && b == nil || a != nil && b != nil && *a == *b }
+	for i, want := range rows {
+		var vals [9]parquet.Value
+		for _, v := range got[i] {
+			vals[v.Column()] = v
+		}
+		if vals[0].Int64() != want.Time || string(vals[1].ByteArray()) != want.Host || string(vals[2].ByteArray()) != want.Model ||
+			int(vals[3].Int32()) != want.Bus || string(vals[4].ByteArray()) != want.Address {
+			t.Errorf("row %d: got %v, want %+v", i, got[i], want)
+		}
+		if !equal(double(vals[5]), want.Temperature) || !equal(double(vals[6]), want.Pressure) || !equal(double(vals[7]), want.Humidity) {
+			t.Errorf("row %d: readings %v, want %+v", i, got[i], want)
+		}
+		if want.Labels == nil && !vals[8].IsNull() || want.Labels != nil && string(vals[8].ByteArray()) != *want.Labels {
+			t.Errorf("row %d: labels %v, want %v", i, vals[8], want.Labels)
+		}
+	}
+}
+
+func TestParquetRowGroups(t *testing.T) {
+	temp := 20.0
+	rows := make([]historyRow, parquetRowGroupSize+3)
+	for i := range rows {
+		rows[i] = historyRow{Time: int64(i), Host: "raspberrypi", Model: "BME280", Bus: 1, Address: "0x76"}
+		if i%2 == 0 {
+			rows[i].Temperature = &temp
+		}
+	}
+	f := openParquet(t, rows)
+	groups := f.RowGroups()
+	if len(groups) != 2 || groups[0].NumRows() != parquetRowGroupSize || groups[1].NumRows() != 3 {
+		t.Fatalf("got %d row groups", len(groups))
+	}
+	got := readParquetRows(t, f)
+	if len(got) != len(rows) {
+		t.Fatalf("read %d rows, want %d", len(got), len(rows))
+	}
+	for _, i := range []int{0, 1, parquetRowGroupSize - 1, parquetRowGroupSize, len(rows) - 1} {
+		if got[i][0].Int64() != int64(i) || got[i][5].IsNull() != (i%2 != 0) {
+			t.Errorf("row %d: got %v", i, got[i])
+		}
+	}
+}
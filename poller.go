@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Reads the sensor in the background on a fixed interval and hands each
+// reading to whoever is interested
+type poller struct {
+	hooks   []func(reading)
+	done    chan struct{}
+	wake    chan struct{}
+	trigger chan chan reading
+
+	mu        sync.RWMutex
+	interval  time.Duration
+	latest    reading
+	recent    []reading
+	maxRecent int
+	subs      map[chan reading]struct{}
+	stopped   bool
+}
+
+// Poll every interval, remembering the last maxRecent readings
+func newPoller(interval time.Duration, maxRecent int) *poller {
+	return &poller{
+		interval:  interval,
+		done:      make(chan struct{}),
+		wake:      make(chan struct{}, 1),
+		trigger:   make(chan chan reading),
+		maxRecent: max(maxRecent, 0),
+		subs:      make(map[chan reading]struct{}),
+	}
+}
+
+// Get a channel that receives each new reading until unsubscribe is called
+// or the poller stops, at which point it's closed. Slow subscribers miss
+// readings rather than holding up the poller.
+func (p *poller) subscribe() chan reading {
+	ch := make(chan reading, 4)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		close(ch)
+		return ch
+	}
+	p.subs[ch] = struct{}{}
+	return ch
+}
+
+func (p *poller) unsubscribe(ch chan reading) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.subs[ch]; ok {
+		delete(p.subs, ch)
+		close(ch)
+	}
+}
+
+// Register a function to be called with every new reading. Must be called before start.
+func (p *poller) onReading(hook func(reading)) {
+	p.hooks = append(p.hooks, hook)
+}
+
+func (p *poller) Interval() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.interval
+}
+
+// Change how often the sensor is polled, starting from now
+func (p *poller) setInterval(interval time.Duration) {
+	p.mu.Lock()
+	p.interval = interval
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Poll straight away rather than waiting for the next tick, returning the
+// reading. Fails if the context is done first or the poller has stopped.
+func (p *poller) pollNow(ctx context.Context) (reading, error) {
+	reply := make(chan reading, 1)
+	select {
+	case p.trigger <- reply:
+	case <-p.done:
+		return reading{}, errors.New("the poller has stopped")
+	case <-ctx.Done():
+		return reading{}, ctx.Err()
+	}
+	select {
+	case r := <-reply:
+		return r, nil
+	case <-ctx.Done():
+		return reading{}, ctx.Err()
+	}
+}
+
+// The most recent reading, which has a zero Time if nothing has been read yet
+func (p *poller) Latest() reading {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.latest
+}
+
+// The last few readings, oldest first
+func (p *poller) Recent() []reading {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]reading(nil), p.recent...)
+}
+
+// Put back readings from before a restart, oldest first. Must be called
+// before start.
+func (p *poller) restore(readings []reading) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(readings) > p.maxRecent {
+		readings = readings[len(readings)-p.maxRecent:]
+	}
+	p.recent = append([]reading(nil), readings...)
+}
+
+// Start polling until the context is cancelled
+func (p *poller) start(ctx context.Context) {
+	lg.Infof("Polling the sensor every %s", p.Interval())
+	go func() {
+		defer close(p.done)
+		defer p.closeSubscribers()
+		ticker := time.NewTicker(p.Interval())
+		defer ticker.Stop()
+		p.poll()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.poll()
+			case reply := <-p.trigger:
+				reply <- p.poll()
+				ticker.Reset(p.Interval())
+			case <-p.wake:
+				lg.Infof("Polling the sensor every %s", p.Interval())
+				ticker.Reset(p.Interval())
+			}
+		}
+	}()
+}
+
+func (p *poller) closeSubscribers() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	for ch := range p.subs {
+		delete(p.subs, ch)
+		close(ch)
+	}
+}
+
+// Wait for the poll loop to exit after its context has been cancelled
+func (p *poller) wait() {
+	<-p.done
+}
+
+func (p *poller) poll() reading {
+	r := readSensor()
+	p.mu.Lock()
+	p.latest = r
+	if p.maxRecent > 0 {
+		if len(p.recent) >= p.maxRecent {
+			p.recent = append(p.recent[:0], p.recent[len(p.recent)-p.maxRecent+1:]...)
+		}
+		p.recent = append(p.recent, r)
+	}
+	for ch := range p.subs {
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+	p.mu.Unlock()
+	for _, hook := range p.hooks {
+		hook(r)
+	}
+	return r
+}
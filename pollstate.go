@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// The poller's recent readings, and the history kept in memory, saved when
+// the exporter stops and loaded again when it starts, so the dashboard and
+// the readings and history APIs don't come back empty after every upgrade
+
+type pollState struct {
+	Sensor   sensorJSON         `json:"sensor"`
+	Readings []pollStateReading `json:"readings"`
+	History  []pollStateTier    `json:"history,omitempty"`
+}
+
+// The history's readings, or averages over each step
+type pollStateTier struct {
+	Step     string             `json:"step"`
+	Readings []pollStateReading `json:"readings"`
+}
+
+type pollStateReading struct {
+	Time        time.Time `json:"time"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	Pressure    *float64  `json:"pressure,omitempty"`
+	Humidity    *float64  `json:"humidity,omitempty"`
+}
+
+// Load the readings saved last time, if there are any and they're from the
+// same sensor
+func restorePollState(p *poller, history *historyBuffer) {
+	path := conf.GetString(pollStateFile)
+	if path == "" || p == nil {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		lg.Warnf("Problem loading the poller's readings: %v", err)
+		return
+	}
+	var state pollState
+	if err := json.Unmarshal(b, &state); err != nil {
+		lg.Warnf("Problem loading the poller's readings from %s: %v", path, err)
+		return
+	}
+	current := currentSensorJSON()
+	if state.Sensor.Bus != current.Bus || state.Sensor.Address != current.Address {
+		lg.Infof("Not loading the poller's readings, they're from the sensor on bus %d at %s", state.Sensor.Bus, state.Sensor.Address)
+		return
+	}
+
+	// Leave out any the poller would have forgotten by now anyway
+	since := time.Now().Add(-time.Duration(p.maxRecent) * p.Interval())
+	var readings []reading
+	for _, r := range pollStateReadings(state.Readings) {
+		if !r.Time.Before(since) {
+			readings = append(readings, r)
+		}
+	}
+	p.restore(readings)
+	lg.Infof("Loaded %d of the poller's readings from %s", len(readings), path)
+
+	if history == nil || len(state.History) == 0 {
+		return
+	}
+	n := 0
+	for _, tier := range state.History {
+		step, err := time.ParseDuration(tier.Step)
+		if err != nil {
+			lg.Warnf("Problem loading the history from %s: %v", path, err)
+			continue
+		}
+		n += history.restore(step, pollStateReadings(tier.Readings))
+	}
+	lg.Infof("Loaded %d readings and averages into the history from %s", n, path)
+}
+
+// Save the poller's recent readings and the history for next time, once it's
+// stopped
+func savePollState(p *poller, history *historyBuffer) {
+	path := conf.GetString(pollStateFile)
+	if path == "" || p == nil {
+		return
+	}
+	state := pollState{Sensor: currentSensorJSON(), Readings: toPollStateReadings(p.Recent())}
+	if history != nil {
+		tiers := history.saved()
+		steps := make([]time.Duration, 0, len(tiers))
+		for step := range tiers {
+			steps = append(steps, step)
+		}
+		slices.Sort(steps)
+		for _, step := range steps {
+			state.History = append(state.History, pollStateTier{Step: step.String(), Readings: toPollStateReadings(tiers[step])})
+		}
+	}
+	if err := writePollState(path, state); err != nil {
+		lg.Errorf("Problem saving the poller's readings: %v", err)
+		return
+	}
+	lg.Infof("Saved %d of the poller's readings to %s", len(state.Readings), path)
+}
+
+func toPollStateReadings(readings []reading) []pollStateReading {
+	saved := []pollStateReading{}
+	for _, r := range readings {
+		saved = append(saved, pollStateReading{
+			Time:        r.Time,
+			Temperature: spoolValue(r.Temperature),
+			Pressure:    spoolValue(r.Pressure),
+			Humidity:    spoolValue(r.Humidity),
+		})
+	}
+	return saved
+}
+
+func pollStateReadings(saved []pollStateReading) []reading {
+	var readings []reading
+	for _, rec := range saved {
+		r := reading{Time: rec.Time, Temperature: math.NaN(), Pressure: math.NaN(), Humidity: math.NaN()}
+		if rec.Temperature != nil {
+			r.Temperature = *rec.Temperature
+		}
+		if rec.Pressure != nil {
+			r.Pressure = *rec.Pressure
+		}
+		if rec.Humidity != nil {
+			r.Humidity = *rec.Humidity
+		}
+		readings = append(readings, r)
+	}
+	return readings
+}
+
+// Write it somewhere else first so a crash halfway through doesn't lose the
+// last lot
+func writePollState(path string, state pollState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestPollStateHistory(t *testing.T) {
+	old := viper.Get(pollStateFile)
+	viper.Set(pollStateFile, filepath.Join(t.TempDir(), "recent.json"))
+	t.Cleanup(func() { viper.Set(pollStateFile, old) })
+
+	tiers := []historyTier{{0, time.Hour}, {time.Minute, 24 * time.Hour}}
+	history := newHistoryBuffer(tiers)
+	// Every 30 seconds for the last hour and a half, with a value missing
+	start := time.Now().Truncate(time.Minute).Add(-90 * time.Minute)
+	for i := 0; i < 180; i++ {
+		r := reading{Time: start.Add(time.Duration(i) * 30 * time.Second), Temperature: 20 + float64(i)/10, Pressure: 101325, Humidity: 40}
+		if i == 150 {
+			r.Humidity = math.NaN()
+		}
+		history.add(r)
+	}
+	savePollState(testPoller(reading{}), history)
+
+	// Every reading is only kept for an hour
+	cutoff := time.Now().Add(-time.Hour).UnixMilli()
+	var want []historyRow
+	for _, row := range history.query(historyQuery{}) {
+		if row.Time >= cutoff {
+			want = append(want, row)
+		}
+	}
+	// The minute that was still being averaged is lost
+	averages := history.query(historyQuery{from: start, step: time.Minute, agg: "avg"})
+	wantAverages := averages[:len(averages)-1]
+
+	restored := newHistoryBuffer(tiers)
+	restorePollState(testPoller(reading{}), restored)
+	if got := restored.query(historyQuery{}); len(got) < 118 || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d readings after a restart, want the %d from the last hour", len(got), len(want))
+	}
+	got := restored.query(historyQuery{from: start, step: time.Minute, agg: "avg"})
+	if len(got) != 89 || !reflect.DeepEqual(got, wantAverages) {
+		t.Errorf("got %d averages after a restart, want %d", len(got), len(wantAverages))
+	}
+}
+
+func TestPollStateRecent(t *testing.T) {
+	old := viper.Get(pollStateFile)
+	viper.Set(pollStateFile, filepath.Join(t.TempDir(), "recent.json"))
+	t.Cleanup(func() { viper.Set(pollStateFile, old) })
+
+	// Ten readings from the last ten seconds
+	p := newPoller(30*time.Second, 10)
+	var readings []reading
+	for i := 9; i >= 0; i-- {
+		readings = append(readings, reading{Time: time.Now().Add(-time.Duration(i) * time.Second), Temperature: 20 - float64(i), Pressure: 101325, Humidity: 40})
+	}
+	p.restore(readings)
+	savePollState(p, nil)
+
+	for _, tt := range []struct{ maxRecent, want int }{{20, 10}, {2, 2}, {0, 0}, {-5, 0}} {
+		p := newPoller(30*time.Second, tt.maxRecent)
+		restorePollState(p, nil)
+		got := p.Recent()
+		if len(got) != tt.want {
+			t.Errorf("poll.recent %d: got %d readings, want %d", tt.maxRecent, len(got), tt.want)
+		} else if tt.want > 0 && got[len(got)-1].Temperature != 20 {
+			t.Errorf("poll.recent %d: got %+v, want the latest last", tt.maxRecent, got)
+		}
+	}
+}
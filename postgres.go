@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Inserts readings into a PostgreSQL table, which is created if it isn't
+// there and made a hypertable if TimescaleDB is installed, for history that
+// can be queried with SQL. Each push is one multi-row INSERT, so a longer
+// interval means bigger batches. The wire protocol is written out here like
+// the other clients. See
+// https://www.postgresql.org/docs/current/protocol.html
+
+// Columns for each reading, which is as many parameters
+const postgresColumns = 9
+
+// Keeps each INSERT well under the 65535 parameters Postgres allows
+const postgresMaxRows = 1000
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "postgres",
+		intervalKey: postgresInterval,
+		enabled:     func() bool { return conf.GetString(postgresURL) != "" },
+		open:        openPostgres,
+		addresses:   func() []string { return urlAddress(conf.GetString(postgresURL), "5432") },
+	})
+	configChecks = append(configChecks, checkPostgresSettings)
+}
+
+type postgresSink struct {
+	address  string
+	user     string
+	password string
+	database string
+	sslMode  string
+	tls      *tls.Config
+	table    string
+
+	// Kept open between pushes, and opened again after anything goes wrong
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func openPostgres() (sink, error) {
+	u, err := url.Parse(conf.GetString(postgresURL))
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	s := &postgresSink{
+		address:  u.Host,
+		user:     u.User.Username(),
+		database: strings.TrimPrefix(u.Path, "/"),
+		sslMode:  q.Get("sslmode"),
+		table:    conf.GetString(postgresTable),
+	}
+	if u.Port() == "" {
+		s.address = net.JoinHostPort(u.Hostname(), "5432")
+	}
+	s.password, _ = u.User.Password()
+	if s.database == "" {
+		s.database = s.user
+	}
+	if s.sslMode == "" {
+		s.sslMode = "prefer"
+	}
+	if s.sslMode != "disable" {
+		rootCert := q.Get("sslrootcert")
+		if s.tls, err = clientTLSConfig(rootCert, q.Get("sslcert"), q.Get("sslkey"), s.sslMode != "verify-full"); err != nil {
+			return nil, err
+		}
+		s.tls.ServerName = u.Hostname()
+		// Like libpq, require with a root certificate checks the server's
+		// certificate against it the way verify-ca does
+		if s.sslMode == "verify-ca" || (s.sslMode == "require" && rootCert != "") {
+			s.tls.VerifyConnection = postgresVerifyCA(s.tls.RootCAs)
+		}
+	}
+	return s, nil
+}
+
+// Check the server's certificate was issued by a trusted CA, without caring
+// which host it's for
+func postgresVerifyCA(roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("the server sent no certificate")
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
+func (s *postgresSink) push(ctx context.Context, samples []sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	err := s.insert(ctx, samples)
+	if err != nil && s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *postgresSink) insert(ctx context.Context, samples []sample) error {
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+	} else {
+		s.conn.SetDeadline(time.Time{})
+	}
+
+	for len(samples) > 0 {
+		rows := samples[:min(len(samples), postgresMaxRows)]
+		samples = samples[len(rows):]
+
+		var query strings.Builder
+		fmt.Fprintf(&query, "INSERT INTO %s (time, host, sensor, bus, address, temperature, pressure, humidity, labels) VALUES ", s.table)
+		var params []*string
+		for i, smp := range rows {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(")
+			for j := 1; j <= postgresColumns; j++ {
+				if j > 1 {
+					query.WriteString(", ")
+				}
+				fmt.Fprintf(&query, "$%d", i*postgresColumns+j)
+			}
+			query.WriteString(")")
+
+			var labels *string
+			if len(smp.Labels) > 0 {
+				b, err := json.Marshal(smp.Labels)
+				if err != nil {
+					return err
+				}
+				labels = postgresParam(string(b))
+			}
+			params = append(params,
+				postgresParam(smp.Time.UTC().Format(time.RFC3339Nano)),
+				postgresParam(smp.Sensor.Host),
+				postgresParam(smp.Sensor.Model),
+				postgresParam(strconv.Itoa(smp.Sensor.Bus)),
+				postgresParam(smp.Sensor.Address),
+				postgresFloat(smp.Temperature),
+				postgresFloat(smp.Pressure),
+				postgresFloat(smp.Humidity),
+				labels)
+		}
+		// Readings sent again from the spool are already there
+		query.WriteString(" ON CONFLICT DO NOTHING")
+		if err := s.exec(query.String(), params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func postgresParam(s string) *string {
+	return &s
+}
+
+// A value, or NULL if it couldn't be read
+func postgresFloat(v float64) *string {
+	if math.IsNaN(v) {
+		return nil
+	}
+	return postgresParam(strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+func (s *postgresSink) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	if err := s.startup(ctx); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *postgresSink) startup(ctx context.Context) error {
+	if s.tls != nil {
+		// An SSLRequest, which the server answers with a single S or N
+		if _, err := s.conn.Write([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}); err != nil {
+			return err
+		}
+		answer, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case answer == 'S':
+			tc := tls.Client(s.conn, s.tls)
+			if err := tc.HandshakeContext(ctx); err != nil {
+				return err
+			}
+			s.conn, s.r = tc, bufio.NewReader(tc)
+		case s.sslMode != "prefer":
+			return errors.New("the server doesn't support TLS")
+		}
+	}
+
+	// Protocol 3.0
+	b := binary.BigEndian.AppendUint32(nil, 196608)
+	for _, p := range [][2]string{{"user", s.user}, {"database", s.database}, {"application_name", "bme280-exporter"}} {
+		b = append(append(append(append(b, p[0]...), 0), p[1]...), 0)
+	}
+	b = append(b, 0)
+	if _, err := s.conn.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b)+4))); err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		return err
+	}
+
+	var scram *postgresSCRAM
+	for {
+		typ, body, err := s.read()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'R':
+			if len(body) < 4 {
+				return errors.New("malformed authentication request")
+			}
+			switch code := binary.BigEndian.Uint32(body); code {
+			case 0:
+			case 3:
+				err = s.send('p', append([]byte(s.password), 0))
+			case 5:
+				if len(body) < 8 {
+					return errors.New("malformed MD5 authentication request")
+				}
+				inner := md5.Sum([]byte(s.password + s.user))
+				outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), body[4:8]...))
+				err = s.send('p', append([]byte("md5"+hex.EncodeToString(outer[:])), 0))
+			case 10:
+				if !strings.Contains(string(body[4:]), "SCRAM-SHA-256\x00") {
+					return errors.New("the server wants a SASL mechanism other than SCRAM-SHA-256")
+				}
+				scram = newPostgresSCRAM()
+				first := scram.clientFirst()
+				msg := append([]byte("SCRAM-SHA-256\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(first)))...)
+				err = s.send('p', append(msg, first...))
+			case 11:
+				if scram == nil {
+					return errors.New("unexpected SASL challenge")
+				}
+				var final string
+				if final, err = scram.clientFinal(string(body[4:]), s.password); err == nil {
+					err = s.send('p', []byte(final))
+				}
+			case 12:
+				if scram == nil || !scram.verify(string(body[4:])) {
+					return errors.New("the server's SCRAM signature is wrong")
+				}
+			default:
+				return fmt.Errorf("unsupported authentication method %d", code)
+			}
+			if err != nil {
+				return err
+			}
+		case 'E':
+			return postgresError(body)
+		case 'Z':
+			return s.createTable()
+		}
+		// Anything else, like the server's parameters, can be ignored
+	}
+}
+
+// Create the table if it's not there, with a unique index so readings are
+// only stored once, and make it a hypertable if TimescaleDB is there
+func (s *postgresSink) createTable() error {
+	name := s.table[strings.LastIndex(s.table, ".")+1:]
+	return s.query(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+	time timestamptz NOT NULL,
+	host text NOT NULL,
+	sensor text NOT NULL,
+	bus integer NOT NULL,
+	address text NOT NULL,
+	temperature double precision,
+	pressure double precision,
+	humidity double precision,
+	labels jsonb
+);
+CREATE UNIQUE INDEX IF NOT EXISTS %[2]s_sensor_time ON %[1]s (host, bus, address, time);
+DO $$ BEGIN
+	IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb') THEN
+		PERFORM create_hypertable('%[1]s', 'time', if_not_exists => TRUE, migrate_data => TRUE);
+	END IF;
+END $$;`, s.table, name))
+}
+
+// Run statements with the simple query protocol
+func (s *postgresSink) query(sql string) error {
+	if err := s.send('Q', append([]byte(sql), 0)); err != nil {
+		return err
+	}
+	return s.wait()
+}
+
+// Run a statement with parameters, with nil for NULL, using the extended
+// query protocol
+func (s *postgresSink) exec(sql string, params []*string) error {
+	var b []byte
+	// Parse, into the unnamed statement, leaving the server to work out the
+	// parameters' types
+	parse := append(append([]byte{0}, sql...), 0, 0, 0)
+	b = appendPostgresMessage(b, 'P', parse)
+
+	bind := []byte{0, 0, 0, 0}
+	bind = binary.BigEndian.AppendUint16(bind, uint16(len(params)))
+	for _, p := range params {
+		if p == nil {
+			bind = binary.BigEndian.AppendUint32(bind, math.MaxUint32)
+			continue
+		}
+		bind = binary.BigEndian.AppendUint32(bind, uint32(len(*p)))
+		bind = append(bind, *p...)
+	}
+	bind = append(bind, 0, 0)
+	b = appendPostgresMessage(b, 'B', bind)
+	b = appendPostgresMessage(b, 'E', []byte{0, 0, 0, 0, 0})
+	b = appendPostgresMessage(b, 'S', nil)
+	if _, err := s.conn.Write(b); err != nil {
+		return err
+	}
+	return s.wait()
+}
+
+// Wait for the server to be ready for another query, returning the first error
+func (s *postgresSink) wait() error {
+	var first error
+	for {
+		typ, body, err := s.read()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'E':
+			if first == nil {
+				first = postgresError(body)
+			}
+		case 'Z':
+			return first
+		}
+	}
+}
+
+func appendPostgresMessage(b []byte, typ byte, body []byte) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)+4))
+	return append(b, body...)
+}
+
+func (s *postgresSink) send(typ byte, body []byte) error {
+	_, err := s.conn.Write(appendPostgresMessage(nil, typ, body))
+	return err
+}
+
+func (s *postgresSink) read() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(s.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n < 4 || n > 16<<20 {
+		return 0, nil, fmt.Errorf("unexpected message length %d from Postgres", n)
+	}
+	body := make([]byte, n-4)
+	if _, err := io.ReadFull(s.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// The message in an ErrorResponse, which is made of fields each starting
+// with a byte saying what it is
+func postgresError(body []byte) error {
+	var severity, message string
+	for _, field := range strings.Split(string(body), "\x00") {
+		if field == "" {
+			continue
+		}
+		switch field[0] {
+		case 'S':
+			severity = field[1:]
+		case 'M':
+			message = field[1:]
+		}
+	}
+	return fmt.Errorf("%s: %s", severity, message)
+}
+
+// SCRAM-SHA-256, from RFC 5802 and 7677, without channel binding
+type postgresSCRAM struct {
+	nonce       string
+	clientBare  string
+	authMessage string
+	serverKey   []byte
+}
+
+func newPostgresSCRAM() *postgresSCRAM {
+	var nonce [18]byte
+	rand.Read(nonce[:])
+	// Postgres uses the user name from the startup message instead
+	s := &postgresSCRAM{nonce: base64.StdEncoding.EncodeToString(nonce[:])}
+	s.clientBare = "n=,r=" + s.nonce
+	return s
+}
+
+func (s *postgresSCRAM) clientFirst() string {
+	return "n,," + s.clientBare
+}
+
+func (s *postgresSCRAM) clientFinal(serverFirst, password string) (string, error) {
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		k, v, _ := strings.Cut(attr, "=")
+		switch k {
+		case "r":
+			nonce = v
+		case "s":
+			salt = v
+		case "i":
+			iterations, _ = strconv.Atoi(v)
+		}
+	}
+	if !strings.HasPrefix(nonce, s.nonce) || iterations < 1 {
+		return "", errors.New("unexpected SCRAM challenge")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return "", err
+	}
+	salted := pbkdf2.Key([]byte(password), saltBytes, iterations, sha256.Size, sha256.New)
+	clientKey := postgresHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.clientBare + "," + serverFirst + "," + withoutProof
+	proof := postgresHMAC(storedKey[:], s.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	s.serverKey = postgresHMAC(salted, "Server Key")
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// Whether the server knew the password too
+func (s *postgresSCRAM) verify(serverFinal string) bool {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(serverFinal, "v="))
+	return err == nil && s.serverKey != nil && hmac.Equal(signature, postgresHMAC(s.serverKey, s.authMessage))
+}
+
+func postgresHMAC(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+func (s *postgresSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	// A Terminate, so the server doesn't log the connection as lost
+	s.send('X', nil)
+	return s.conn.Close()
+}
+
+// A table name, optionally with a schema, that's safe to put in SQL as it is
+var postgresTableName = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*\.)?[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func checkPostgresSettings() []configProblem {
+	var problems []configProblem
+	if v := conf.GetString(postgresURL); v != "" {
+		u, err := url.Parse(v)
+		switch {
+		case err != nil || u.Host == "" || (u.Scheme != "postgres" && u.Scheme != "postgresql"):
+			problems = append(problems, configError(postgresURL, "invalid URL %q, use e.g. postgres://bme280:password@db:5432/sensors", v))
+		case u.User.Username() == "":
+			problems = append(problems, configError(postgresURL, "needs a user name"))
+		default:
+			if m := u.Query().Get("sslmode"); m != "" && m != "disable" && m != "prefer" && m != "require" && m != "verify-ca" && m != "verify-full" {
+				problems = append(problems, configError(postgresURL, "unsupported sslmode %q, use disable, prefer, require, verify-ca or verify-full", m))
+			}
+		}
+	}
+	if t := conf.GetString(postgresTable); !postgresTableName.MatchString(t) {
+		problems = append(problems, configError(postgresTable, "invalid table name %q, use letters, digits and underscores, with an optional schema", t))
+	}
+	return problems
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPostgresSCRAM(t *testing.T) {
+	// RFC 7677 section 3, with the user name Postgres leaves out put back
+	const rfcNonce = "rOprNGfwEbeRWgbNEkqO"
+	const rfcServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	tests := []struct {
+		name        string
+		serverFirst string
+		password    string
+		final       string
+		serverFinal string
+		verified    bool
+		err         bool
+	}{
+		{
+			name:        "RFC 7677",
+			serverFirst: rfcServerFirst,
+			password:    "pencil",
+			final:       "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+			verified:    true,
+		},
+		{
+			name:        "wrong server signature",
+			serverFirst: rfcServerFirst,
+			password:    "pencil",
+			final:       "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverFinal: "v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+		{
+			name:        "wrong password",
+			serverFirst: rfcServerFirst,
+			password:    "crayon",
+			serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+		{
+			name:        "someone else's nonce",
+			serverFirst: "r=somethingelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			password:    "pencil",
+			err:         true,
+		},
+		{
+			name:        "no iterations",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==",
+			password:    "pencil",
+			err:         true,
+		},
+		{
+			name:        "salt that isn't base64",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=!!!,i=4096",
+			password:    "pencil",
+			err:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &postgresSCRAM{nonce: rfcNonce, clientBare: "n=user,r=" + rfcNonce}
+			final, err := s.clientFinal(tt.serverFirst, tt.password)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("clientFinal() = %q, want an error", final)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.final == "" {
+				if final == tests[0].final {
+					t.Errorf("clientFinal() gave the right proof for the wrong password")
+				}
+			} else if final != tt.final {
+				t.Errorf("clientFinal() = %q, want %q", final, tt.final)
+			}
+			if got := s.verify(tt.serverFinal); got != tt.verified {
+				t.Errorf("verify(%q) = %v, want %v", tt.serverFinal, got, tt.verified)
+			}
+		})
+	}
+}
+
+func TestPostgresClientFirst(t *testing.T) {
+	s := newPostgresSCRAM()
+	if got, want := s.clientFirst(), "n,,n=,r="+s.nonce; got != want {
+		t.Errorf("clientFirst() = %q, want %q", got, want)
+	}
+	if len(s.nonce) != 24 {
+		t.Errorf("nonce %q is %d characters, want 24", s.nonce, len(s.nonce))
+	}
+}
+
+func TestPostgresError(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"SERROR\x00VERROR\x00C42P01\x00Mrelation \"readings\" does not exist\x00P15\x00\x00", `ERROR: relation "readings" does not exist`},
+		{"SFATAL\x00C28P01\x00Mpassword authentication failed for user \"exporter\"\x00\x00", `FATAL: password authentication failed for user "exporter"`},
+		{"", ": "},
+	}
+	for _, tt := range tests {
+		if got := postgresError([]byte(tt.body)).Error(); got != tt.want {
+			t.Errorf("postgresError(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+// Messages from the backend, for a fake server to send
+func postgresMessages(msgs ...string) []byte {
+	var b []byte
+	for _, m := range msgs {
+		b = appendPostgresMessage(b, m[0], []byte(m[1:]))
+	}
+	return b
+}
+
+func TestPostgresExec(t *testing.T) {
+	tests := []struct {
+		name   string
+		sql    string
+		params []*string
+		want   string
+		reply  []byte
+		err    string
+	}{
+		{
+			name:   "parameters and NULL",
+			sql:    "SELECT $1, $2",
+			params: []*string{postgresParam("a"), nil},
+			want: "P\x00\x00\x00\x15\x00SELECT $1, $2\x00\x00\x00" +
+				"B\x00\x00\x00\x15\x00\x00\x00\x00\x00\x02\x00\x00\x00\x01a\xff\xff\xff\xff\x00\x00" +
+				"E\x00\x00\x00\x09\x00\x00\x00\x00\x00" +
+				"S\x00\x00\x00\x04",
+			reply: postgresMessages("1", "2", "CINSERT 0 1\x00", "ZI"),
+		},
+		{
+			name: "no parameters",
+			sql:  "SELECT 1",
+			want: "P\x00\x00\x00\x10\x00SELECT 1\x00\x00\x00" +
+				"B\x00\x00\x00\x0c\x00\x00\x00\x00\x00\x00\x00\x00" +
+				"E\x00\x00\x00\x09\x00\x00\x00\x00\x00" +
+				"S\x00\x00\x00\x04",
+			reply: postgresMessages("1", "2", "CSELECT 1\x00", "ZI"),
+		},
+		{
+			name:   "the first error",
+			sql:    "INSERT INTO readings VALUES ($1)",
+			params: []*string{postgresParam("")},
+			want: "P\x00\x00\x00\x28\x00INSERT INTO readings VALUES ($1)\x00\x00\x00" +
+				"B\x00\x00\x00\x10\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00" +
+				"E\x00\x00\x00\x09\x00\x00\x00\x00\x00" +
+				"S\x00\x00\x00\x04",
+			reply: postgresMessages("ESERROR\x00Mfirst\x00\x00", "ESERROR\x00Msecond\x00\x00", "ZE"),
+			err:   "ERROR: first",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			got := make(chan []byte, 1)
+			go func() {
+				defer server.Close()
+				b := make([]byte, len(tt.want))
+				io.ReadFull(server, b)
+				got <- b
+				server.Write(tt.reply)
+			}()
+			s := &postgresSink{conn: client, r: bufio.NewReader(client)}
+			err := s.exec(tt.sql, tt.params)
+			if b := <-got; string(b) != tt.want {
+				t.Errorf("sent %q, want %q", b, tt.want)
+			}
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("exec() = %v", err)
+			case tt.err != "" && (err == nil || err.Error() != tt.err):
+				t.Errorf("exec() = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPostgresStartup(t *testing.T) {
+	salt := "\x01\x02\x03\x04"
+	tests := []struct {
+		name     string
+		auth     string
+		password string
+		err      string
+	}{
+		{name: "trust", auth: "R\x00\x00\x00\x00"},
+		{name: "cleartext", auth: "R\x00\x00\x00\x03", password: "hunter2\x00"},
+		{name: "MD5", auth: "R\x00\x00\x00\x05" + salt, password: "md5931b2b4994446ac63bc2686542ff05bf\x00"},
+		{name: "Kerberos", auth: "R\x00\x00\x00\x02", err: "unsupported authentication method 2"},
+		{name: "SASL without SCRAM", auth: "R\x00\x00\x00\x0aSCRAM-SHA-256-PLUS\x00\x00", err: "the server wants a SASL mechanism other than SCRAM-SHA-256"},
+		{name: "challenge before SASL", auth: "R\x00\x00\x00\x0b", err: "unexpected SASL challenge"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			done := make(chan error, 1)
+			go func() {
+				defer server.Close()
+				r := bufio.NewReader(server)
+				// The startup message: length, protocol 3.0, then the parameters
+				var n uint32
+				binary.Read(r, binary.BigEndian, &n)
+				startup := make([]byte, n-4)
+				io.ReadFull(r, startup)
+				want := "\x00\x03\x00\x00user\x00exporter\x00database\x00weather\x00application_name\x00bme280-exporter\x00\x00"
+				if string(startup) != want {
+					t.Errorf("startup message %q, want %q", startup, want)
+				}
+				server.Write(postgresMessages(tt.auth))
+				if tt.password != "" {
+					msg := make([]byte, 5+len(tt.password))
+					io.ReadFull(r, msg)
+					if got := string(msg[5:]); msg[0] != 'p' || got != tt.password {
+						t.Errorf("password message %q, want %q", msg, tt.password)
+					}
+					server.Write(postgresMessages("R\x00\x00\x00\x00"))
+				}
+				if tt.err != "" {
+					return
+				}
+				server.Write(postgresMessages("Sserver_version\x0016.1\x00", "K\x00\x00\x00\x01\x00\x00\x00\x02", "ZI"))
+				// Then the table's created
+				msg, err := r.ReadByte()
+				if err != nil || msg != 'Q' {
+					t.Errorf("got message %q after startup, want Q", msg)
+				}
+				binary.Read(r, binary.BigEndian, &n)
+				query := make([]byte, n-4)
+				io.ReadFull(r, query)
+				if !strings.HasPrefix(string(query), "CREATE TABLE IF NOT EXISTS readings (") {
+					t.Errorf("query %q isn't creating the table", query)
+				}
+				server.Write(postgresMessages("CCREATE TABLE\x00", "ZI"))
+				done <- nil
+			}()
+			s := &postgresSink{user: "exporter", password: "hunter2", database: "weather", table: "readings", conn: client, r: bufio.NewReader(client)}
+			err := s.startup(context.Background())
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("startup() = %v", err)
+			case tt.err != "" && (err == nil || err.Error() != tt.err):
+				t.Fatalf("startup() = %v, want %s", err, tt.err)
+			}
+			if tt.err == "" {
+				<-done
+			}
+		})
+	}
+}
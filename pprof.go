@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// Add the Go profiling endpoints under /debug/pprof. They're registered by
+// hand because importing net/http/pprof for its side effects would put them
+// on the default mux whether we wanted them or not. Like /config, they're
+// only served to users from the web config's basic_auth_users.
+func registerPprof(mux *http.ServeMux) {
+	mux.Handle("/debug/pprof/", requireAuth(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", requireAuth(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", requireAuth(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", requireAuth(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", requireAuth(http.HandlerFunc(pprof.Trace)))
+}
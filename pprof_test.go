@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestPprofNeedsAuth(t *testing.T) {
+	mux := http.NewServeMux()
+	registerPprof(mux)
+	get := func() int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/cmdline", nil))
+		return rec.Code
+	}
+
+	viper.Set(webConfigFile, "")
+	t.Cleanup(func() { viper.Set(webConfigFile, "") })
+	if code := get(); code != http.StatusForbidden {
+		t.Errorf("without a web config got %d, want 403", code)
+	}
+
+	path := filepath.Join(t.TempDir(), "web.yml")
+	if err := os.WriteFile(path, []byte("tls_server_config: {}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set(webConfigFile, path)
+	if code := get(); code != http.StatusForbidden {
+		t.Errorf("without basic_auth_users got %d, want 403", code)
+	}
+
+	// The toolkit checks the password before the handler sees the request
+	if err := os.WriteFile(path, []byte("basic_auth_users:\n  admin: $2y$10$X0h1gDsPszWURQaxFh.zoubFi6DXncSjhoQNJgRrnGs7EsimhC7zG\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(); code != http.StatusOK {
+		t.Errorf("with basic_auth_users got %d, want 200", code)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Dropping root once the I2C device is open, so the exporter doesn't spend
+// its whole life as root just to get at /dev/i2c-N
+
+type credentials struct {
+	name   string
+	uid    int
+	gid    int
+	groups []int
+}
+
+func init() {
+	configChecks = append(configChecks, checkPrivilegeSettings)
+}
+
+// Look up who to run as. The group defaults to the user's primary group.
+func lookupCredentials(userName, groupName string) (*credentials, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return nil, fmt.Errorf("unknown user %q", userName)
+		}
+	}
+	c := &credentials{name: u.Username}
+	if c.uid, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, fmt.Errorf("user %q has a non-numeric uid %q", userName, u.Uid)
+	}
+
+	gid := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return nil, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gid = g.Gid
+	}
+	if c.gid, err = strconv.Atoi(gid); err != nil {
+		return nil, fmt.Errorf("non-numeric gid %q", gid)
+	}
+
+	// Supplementary groups matter, the user is often only allowed at the
+	// device through the i2c group
+	ids, err := u.GroupIds()
+	if err != nil {
+		lg.Warnf("Couldn't look up the groups of %s: %v", u.Username, err)
+	}
+	c.groups = []int{c.gid}
+	for _, id := range ids {
+		if n, err := strconv.Atoi(id); err == nil && n != c.gid {
+			c.groups = append(c.groups, n)
+		}
+	}
+	return c, nil
+}
+
+// Switch the whole process to the user and groups
+func dropPrivileges(c *credentials) error {
+	if os.Geteuid() != 0 {
+		if os.Geteuid() == c.uid {
+			return nil
+		}
+		return fmt.Errorf("only root can switch to user %s", c.name)
+	}
+	if err := syscall.Setgroups(c.groups); err != nil {
+		return fmt.Errorf("setting groups: %w", err)
+	}
+	if err := syscall.Setgid(c.gid); err != nil {
+		return fmt.Errorf("setting group: %w", err)
+	}
+	if err := syscall.Setuid(c.uid); err != nil {
+		return fmt.Errorf("setting user: %w", err)
+	}
+	// Make sure there's no way back
+	if c.uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("still able to become root after dropping privileges")
+	}
+	lg.Infof("Running as user %s (uid %d, gid %d)", c.name, c.uid, c.gid)
+	return nil
+}
+
+func checkPrivilegeSettings() []configProblem {
+	userName, groupName := conf.GetString(runAsUser), conf.GetString(runAsGroup)
+	if userName == "" {
+		if groupName != "" {
+			return []configProblem{configError(runAsGroup, "only works together with --user")}
+		}
+		return nil
+	}
+	if _, err := lookupCredentials(userName, groupName); err != nil {
+		return []configProblem{configError(runAsUser, "%v", err)}
+	}
+	if conf.GetInt(metricsPort) < 1024 && !conf.GetBool(systemdSocket) && !conf.GetBool(webDisable) {
+		return []configProblem{configWarning(metricsPort, "ports below 1024 need root, which is given up before listening")}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/d2r2/go-bsbmp"
+	"github.com/d2r2/go-i2c"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Only one probe talks to the hardware at a time so a burst of them can't flood the bus
+var probeMu sync.Mutex
+
+// How a probe finds out what it's about to talk to
+var probeIdentify = identifySensor
+
+// Presents a reading that has already been taken
+type probeCollector struct {
+	exporter *bmeexporter
+	r        reading
+}
+
+func (c probeCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+}
+
+func (c probeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.collectReading(ch, c.r)
+}
+
+// One-off read of the sensor picked by the bus, address, and model query
+// parameters, for the multi-target exporter pattern
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	bus := conf.GetInt(i2cBus)
+	if v := params.Get("bus"); v != "" {
+		var err error
+		if bus, err = strconv.Atoi(v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid bus %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	v := params.Get("address")
+	if v == "" {
+		http.Error(w, "The address parameter is missing", http.StatusBadRequest)
+		return
+	}
+	b, address, err := parseI2CAddress(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if b >= 0 {
+		bus = b
+	}
+	// Anything else on the bus, like an EEPROM or a PMIC, isn't ours to poke at
+	if !slices.Contains(sensorAddresses, address) {
+		http.Error(w, fmt.Sprintf("No sensor can be at %s, only at 0x76 or 0x77", formatI2CAddress(address)), http.StatusBadRequest)
+		return
+	}
+
+	model := conf.GetString(modelName)
+	if v := params.Get("model"); v != "" {
+		model = v
+	}
+	modelID, err := getSensorID(model)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Whether the sensor could be read",
+	})
+	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "How long the probe took in seconds",
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(probeSuccess, probeDuration)
+
+	ctx, cancel := scrapeContext(r)
+	defer cancel()
+
+	start := time.Now()
+	reading, name, err := probeSensor(ctx, bus, address, modelID)
+	probeDuration.Set(time.Since(start).Seconds())
+	if errors.Is(err, errUnknownChip) {
+		http.Error(w, fmt.Sprintf("There's no sensor on bus %d at %s: %v", bus, formatI2CAddress(address), err), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		lg.With(sensorFields("", bus, address)...).Warnf("Probe failed: %v", err)
+	} else {
+		probeSuccess.Set(1)
+		registry.MustRegister(probeCollector{exporter: newExporter(name, nil), r: reading})
+	}
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// Reads one of the extra sensors from the configuration file when scraped
+type sensorCollector struct {
+	ctx      context.Context
+	config   sensorConfig
+	exporter *bmeexporter
+}
+
+func newSensorCollector(ctx context.Context, s sensorConfig) sensorCollector {
+	labels := configuredLabels()
+	for k, v := range s.Labels {
+		labels[k] = v
+	}
+	labels["sensor"] = s.Name
+	return sensorCollector{ctx: ctx, config: s, exporter: newExporter(s.Model, labels)}
+}
+
+func (c sensorCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+}
+
+func (c sensorCollector) Collect(ch chan<- prometheus.Metric) {
+	r, _, err := probeSensor(c.ctx, c.config.Bus, c.config.address, c.config.modelID)
+	if err != nil {
+		lg.With(sensorFields(c.config.Name, c.config.Bus, c.config.address)...).Warnf("Problem reading sensor: %v", err)
+		c.exporter.collectUp(ch, false)
+		return
+	}
+	c.exporter.collectUp(ch, true)
+	c.exporter.collectReading(ch, r)
+}
+
+// Open the sensor, read it, and close it again
+func probeSensor(ctx context.Context, bus int, address uint8, model bsbmp.SensorType) (r reading, name string, err error) {
+	_, span := startSpan(ctx, "probe", spanKindClient, spanAttr{"bus", bus}, spanAttr{"address", formatI2CAddress(address)})
+	defer func() {
+		span.recordError(err)
+		span.finish()
+	}()
+
+	type result struct {
+		r    reading
+		name string
+		err  error
+	}
+	// Buffered so an abandoned probe can still finish and exit
+	ch := make(chan result, 1)
+
+	go func() {
+		probeMu.Lock()
+		defer probeMu.Unlock()
+
+		// Don't interleave transfers with the exporter's own reads of the same chip
+		if ownBus, ownAddr := currentAddress(); bus == ownBus && address == ownAddr {
+			sensorMu.Lock()
+			mu := sensorBusMu
+			sensorMu.Unlock()
+			mu.Lock()
+			defer mu.Unlock()
+		}
+
+		// Setting up the sensor writes to its control registers, which
+		// mustn't happen to some other chip
+		id, err := probeIdentify(bus, address)
+		if err == nil && sensorNameForID(id) == "unknown" {
+			err = fmt.Errorf("%w 0x%x", errUnknownChip, id)
+		}
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+
+		conn, err := i2c.NewI2C(address, bus)
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		defer conn.Close()
+
+		s, err := bsbmp.NewBMP(model, conn)
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+
+		r := measure(s, lg.With(sensorFields("", bus, address)...))
+		if !r.ok() {
+			err = errors.New("no values could be read")
+		}
+		ch <- result{r: r, name: getSensorName(s), err: err}
+	}()
+
+	select {
+	case res := <-ch:
+		return res.r, res.name, res.err
+	case <-ctx.Done():
+		return reading{}, "", ctx.Err()
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProbeOnlySensors(t *testing.T) {
+	var identified []string
+	chips := map[uint8]uint8{0x76: 0x33}
+	old := probeIdentify
+	probeIdentify = func(bus int, addr uint8) (uint8, error) {
+		identified = append(identified, fmt.Sprintf("%d:0x%x", bus, addr))
+		id, ok := chips[addr]
+		if !ok {
+			return 0, errors.New("remote I/O error")
+		}
+		if sensorNameForID(id) == "unknown" {
+			return 0, fmt.Errorf("%w 0x%x", errUnknownChip, id)
+		}
+		return id, nil
+	}
+	t.Cleanup(func() { probeIdentify = old })
+
+	tests := []struct {
+		query      string
+		code       int
+		identified string
+		body       string
+	}{
+		// Never touched, as no sensor can be there
+		{"bus=3&address=0x50", http.StatusBadRequest, "", "only at 0x76 or 0x77"},
+		{"bus=3&address=104", http.StatusBadRequest, "", "only at 0x76 or 0x77"},
+		// Something answers, but it isn't a sensor
+		{"bus=3&address=0x76", http.StatusBadRequest, "3:0x76", "unrecognised chip ID 0x33"},
+		// Nothing answers, which is a failed probe
+		{"bus=3&address=0x77", http.StatusOK, "3:0x77", "probe_success 0"},
+	}
+	for _, tt := range tests {
+		identified = nil
+		rec := httptest.NewRecorder()
+		probeHandler(rec, httptest.NewRequest("GET", "/probe?"+tt.query, nil))
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("%s: got %d %q, want %d with %q", tt.query, rec.Code, rec.Body, tt.code, tt.body)
+		}
+		if got := strings.Join(identified, " "); got != tt.identified {
+			t.Errorf("%s: identified %q, want %q", tt.query, got, tt.identified)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Pushes the latest reading to a Prometheus Pushgateway, for devices behind
+// NAT that Prometheus can't scrape. See
+// https://github.com/prometheus/pushgateway#api
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "pushgateway",
+		intervalKey: pushgatewayInterval,
+		enabled:     func() bool { return conf.GetString(pushgatewayURL) != "" },
+		open:        openPushgateway,
+		addresses:   func() []string { return urlAddress(conf.GetString(pushgatewayURL), "") },
+	})
+	configChecks = append(configChecks, checkPushgatewaySettings)
+}
+
+type pushgatewaySink struct {
+	// The group's URL, e.g. http://pushgateway:9091/metrics/job/bme280-exporter/instance/raspberrypi
+	url    string
+	delete bool
+	client *http.Client
+}
+
+func openPushgateway() (sink, error) {
+	u, err := url.Parse(conf.GetString(pushgatewayURL))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", conf.GetString(pushgatewayURL))
+	}
+	instance := conf.GetString(pushgatewayInstance)
+	if instance == "" {
+		instance = hostname
+	}
+	return &pushgatewaySink{
+		url:    strings.TrimSuffix(u.String(), "/") + "/metrics/" + groupingPath("job", conf.GetString(pushgatewayJob)) + "/" + groupingPath("instance", instance),
+		delete: conf.GetBool(pushgatewayDelete),
+		client: &http.Client{},
+	}, nil
+}
+
+// A grouping key label in the URL path, base64 encoded if it wouldn't fit otherwise
+func groupingPath(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		if value == "" {
+			return name + "@base64/="
+		}
+		return name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return name + "/" + url.PathEscape(value)
+}
+
+// The Pushgateway only keeps the latest value, so that's all that's sent
+func (s *pushgatewaySink) push(ctx context.Context, samples []sample) error {
+	latest := samples[len(samples)-1]
+	registry := prometheus.NewRegistry()
+	exporter := newExporter(latest.Sensor.Model, latest.Labels)
+	registry.MustRegister(probeCollector{exporter: exporter, r: latest.reading})
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(&body, mf); err != nil {
+			return err
+		}
+	}
+
+	// PUT replaces everything in the group, so values that couldn't be read don't linger
+	return s.do(ctx, http.MethodPut, &body)
+}
+
+func (s *pushgatewaySink) do(ctx context.Context, method string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, method, s.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s %s", method, s.url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Delete the group on the way out if asked to, so the last values don't
+// hang around looking current
+func (s *pushgatewaySink) close() error {
+	if !s.delete {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), conf.GetDuration(sinkTimeout))
+	defer cancel()
+	return s.do(ctx, http.MethodDelete, nil)
+}
+
+func checkPushgatewaySettings() []configProblem {
+	var problems []configProblem
+	if v := conf.GetString(pushgatewayURL); v != "" {
+		if u, err := url.Parse(v); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, configError(pushgatewayURL, "invalid URL %q, use e.g. http://pushgateway:9091", v))
+		}
+	}
+	if conf.GetString(pushgatewayJob) == "" {
+		problems = append(problems, configError(pushgatewayJob, "can't be empty"))
+	}
+	return problems
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/spf13/pflag"
+)
+
+var (
+	readFormat   string
+	readNoHeader bool
+)
+
+func readFlags(fs *pflag.FlagSet) {
+	sensorFlags(fs)
+	fs.StringVarP(&readFormat, "format", "o", "text", "Output format: text, json, csv, or prometheus")
+	fs.BoolVar(&readNoHeader, "no-header", false, "Leave out the CSV header line, e.g. when appending to a file")
+}
+
+// `bme280-exporter read` takes one measurement, prints it, and exits
+func runRead(args []string) int {
+	printers := map[string]func(io.Writer, reading) error{
+		"text":       printReading,
+		"json":       printReadingJSON,
+		"csv":        printReadingCSV,
+		"prometheus": printReadingPrometheus,
+	}
+	print, ok := printers[readFormat]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown format %q, use text, json, csv, or prometheus\n", readFormat)
+		return 2
+	}
+
+	if err := openSensor(); err != nil {
+		fmt.Fprintf(os.Stderr, "Problem opening the sensor: %v\n", err)
+		return 1
+	}
+	defer closeSensor()
+	setCalibration(calibrationFromConfig())
+
+	r := doReadSensor()
+	if !r.ok() {
+		fmt.Fprintln(os.Stderr, "Problem reading the sensor")
+		return 1
+	}
+	if err := print(os.Stdout, r); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func printReading(w io.Writer, r reading) error {
+	if !math.IsNaN(r.Temperature) {
+		fmt.Fprintf(w, "Temperature  %.2f °C\n", r.Temperature)
+	}
+	if !math.IsNaN(r.Pressure) {
+		fmt.Fprintf(w, "Pressure     %.2f hPa\n", r.Pressure/100)
+	}
+	if !math.IsNaN(r.Humidity) {
+		fmt.Fprintf(w, "Humidity     %.2f %%\n", r.Humidity)
+	}
+	return nil
+}
+
+// The same document as /api/v1/readings
+func printReadingJSON(w io.Writer, r reading) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(readingsJSON{
+		Sensor:  currentSensorJSON(),
+		Reading: newReadingJSON(r),
+	})
+}
+
+// Missing values are left empty
+func printReadingCSV(w io.Writer, r reading) error {
+	cw := csv.NewWriter(w)
+	if !readNoHeader {
+		cw.Write([]string{"timestamp", "temperature_celsius", "pressure_pascals", "humidity_percent"})
+	}
+	row := []string{r.Time.UTC().Format("2006-01-02T15:04:05.000Z07:00")}
+	for _, v := range []float64{r.Temperature, r.Pressure, r.Humidity} {
+		if math.IsNaN(v) {
+			row = append(row, "")
+		} else {
+			row = append(row, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+	cw.Write(row)
+	cw.Flush()
+	return cw.Error()
+}
+
+// The same metrics a scrape would get, e.g. for node_exporter's textfile collector
+func printReadingPrometheus(w io.Writer, r reading) error {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(probeCollector{exporter: NewBMEExporter(), r: r})
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/d2r2/go-bsbmp"
+	"github.com/d2r2/go-i2c"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Re-opening the sensor when it stops answering. A glitch on the bus can
+// leave the chip or the kernel's handle for it broken until it's opened
+// again, which used to take a restart. The same goes for a sensor that
+// wasn't there yet when the exporter started.
+
+var (
+	sensorReinits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bme280_exporter_sensor_reinits_total",
+		Help: "Attempts to re-open the sensor after it stopped answering, by result",
+	}, []string{"result"})
+	readTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bme280_exporter_sensor_read_timeouts_total",
+		Help: "Sensor reads that took longer than --recovery.read-timeout and were given up on",
+	})
+	sensorResets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bme280_exporter_sensor_resets_total",
+		Help: "Soft resets of the sensor after it gave stuck or impossible readings, by result",
+	}, []string{"result"})
+
+	// Failed reads in a row, and how long to wait before the next attempt
+	// to re-open the sensor. Both start again after a read that works.
+	recoveryMu    sync.Mutex
+	failedReads   int
+	reinitBackoff time.Duration
+
+	recoveryWake = make(chan struct{}, 1)
+
+	// Readings in a row that were stuck or impossible, and the last one to
+	// compare against
+	badReadings int
+	lastRaw     reading
+)
+
+func init() {
+	prometheus.MustRegister(sensorReinits, sensorResets, readTimeouts)
+	for _, result := range []string{"success", "failure"} {
+		sensorReinits.WithLabelValues(result)
+		sensorResets.WithLabelValues(result)
+	}
+	configChecks = append(configChecks, checkRecoverySettings)
+}
+
+// Keep track of whether the sensor is answering, and wake up recoverSensor
+// once it's failed too many times in a row
+func noteRead(ok bool) {
+	recoveryMu.Lock()
+	defer recoveryMu.Unlock()
+	if ok {
+		failedReads, reinitBackoff = 0, 0
+		return
+	}
+	failedReads++
+	if n := conf.GetInt(recoveryAfterFailures); n > 0 && failedReads >= n {
+		wakeRecovery()
+	}
+}
+
+func wakeRecovery() {
+	select {
+	case recoveryWake <- struct{}{}:
+	default:
+	}
+}
+
+// Re-open the sensor whenever it's asked to, backing off exponentially
+// while that doesn't help, until the context is cancelled
+func recoverSensor(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-recoveryWake:
+		}
+
+		recoveryMu.Lock()
+		wait := reinitBackoff
+		reinitBackoff = min(max(reinitBackoff*2, conf.GetDuration(recoveryBackoff)), conf.GetDuration(recoveryMaxBackoff))
+		recoveryMu.Unlock()
+		if wait > 0 {
+			lg.Debugf("Waiting %s before re-opening the sensor", wait)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		if err := reinitSensor(); err != nil {
+			lg.Warnf("Problem re-opening the sensor: %v", err)
+			// Keep trying, whether or not anything's reading the sensor to notice
+			wakeRecovery()
+		}
+	}
+}
+
+// Read the sensor, giving up if it takes longer than --recovery.read-timeout.
+// I2C drivers can leave a transfer blocked in the kernel forever, so rather
+// than everything waiting on it, a read that overruns is abandoned along with
+// its handle and the sensor is opened again.
+func readWithWatchdog() reading {
+	timeout := conf.GetDuration(recoveryReadTimeout)
+	if timeout <= 0 {
+		return doReadSensor()
+	}
+
+	start := time.Now()
+	ch := make(chan reading, 1)
+	go func() {
+		ch <- doReadSensor()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r
+	case <-timer.C:
+	}
+
+	readTimeouts.Inc()
+	sensorMu.Lock()
+	log := sensorLog
+	if sensorBusMu.TryLock() {
+		// It finished after all, or this was someone else's handle
+		sensorBusMu.Unlock()
+	} else {
+		// New reads fail straight away instead of queueing up behind the stuck one
+		sensor = nil
+	}
+	sensorMu.Unlock()
+	log.Errorf("Giving up on a read that's taken longer than %s, the I2C bus may be stuck", timeout)
+	recordEvent("read", "Gave up on a read that took longer than %s", timeout)
+	if atomic.SwapInt32(&sensorHealthy, 0) == 1 {
+		recordEvent("read", "Reading the sensor failed")
+	}
+	wakeRecovery()
+
+	go func() {
+		<-ch
+		log.Infof("The abandoned read finished after %s", time.Since(start).Round(time.Millisecond))
+	}()
+	return reading{Time: time.Now(), Temperature: math.NaN(), Pressure: math.NaN(), Humidity: math.NaN()}
+}
+
+func reinitSensor() error {
+	lg.Info("Trying to open the sensor again")
+	if err := openSensor(); err != nil {
+		sensorReinits.WithLabelValues("failure").Inc()
+		return err
+	}
+	sensorReinits.WithLabelValues("success").Inc()
+
+	// Give it a few more reads before trying again
+	recoveryMu.Lock()
+	failedReads = 0
+	recoveryMu.Unlock()
+	return nil
+}
+
+// Whether it's time to soft reset the sensor, because it's given too many
+// readings in a row that are exactly the same as the last, or that it
+// couldn't physically have measured. That's what a chip that's lost its
+// settings or calibration data looks like, and it answers just fine so
+// re-opening it doesn't help. Takes the reading before the calibration offsets.
+func checkBadReading(r reading, log logger) bool {
+	if !r.ok() {
+		return false
+	}
+	recoveryMu.Lock()
+	defer recoveryMu.Unlock()
+	var problem error
+	if sameReading(r, lastRaw) {
+		problem = errors.New("it's exactly the same as the last one")
+	} else {
+		problem = checkPlausible(r)
+	}
+	lastRaw = r
+	if problem == nil {
+		badReadings = 0
+		return false
+	}
+
+	badReadings++
+	log.Debugf("Bad reading %d in a row: %v", badReadings, problem)
+	n := conf.GetInt(recoveryResetAfter)
+	if n <= 0 || badReadings < n {
+		return false
+	}
+	badReadings = 0
+	log.Warnf("Resetting the sensor after %d bad readings in a row: %v", n, problem)
+	return true
+}
+
+// Whether two readings have exactly the same values, counting NaN as equal to NaN
+func sameReading(a, b reading) bool {
+	same := func(x, y float64) bool { return x == y || math.IsNaN(x) && math.IsNaN(y) }
+	return same(a.Temperature, b.Temperature) && same(a.Pressure, b.Pressure) && same(a.Humidity, b.Humidity)
+}
+
+// Soft reset the chip, which is the same as power cycling it, and read its
+// calibration data again. Called with the handle's bus lock held.
+func resetSensor(conn *i2c.I2C, log logger) {
+	if err := softReset(conn); err != nil {
+		sensorResets.WithLabelValues("failure").Inc()
+		log.Errorf("Problem resetting the sensor: %v", err)
+		return
+	}
+	sensorResets.WithLabelValues("success").Inc()
+	recordEvent("sensor", "Reset the sensor after too many bad readings in a row")
+}
+
+func softReset(conn *i2c.I2C) error {
+	modelID, err := getSensorID(conf.GetString(modelName))
+	if err != nil {
+		return err
+	}
+	// The reset register and command from the datasheets
+	reg := byte(0xE0)
+	if modelID == bsbmp.BMP388 {
+		reg = 0x7E
+	}
+	if err := conn.WriteRegU8(reg, 0xB6); err != nil {
+		return err
+	}
+	// The datasheets give 2ms for it to start up again
+	time.Sleep(10 * time.Millisecond)
+
+	s, err := bsbmp.NewBMP(modelID, conn)
+	if err != nil {
+		return err
+	}
+	if err := s.IsValidCoefficients(); err != nil {
+		return err
+	}
+
+	// Unless it's been re-opened in the meantime
+	sensorMu.Lock()
+	defer sensorMu.Unlock()
+	if sensorConn == conn {
+		sensor = s
+	}
+	return nil
+}
+
+func checkRecoverySettings() []configProblem {
+	var problems []configProblem
+	if conf.GetInt(recoveryAfterFailures) < 0 {
+		problems = append(problems, configError(recoveryAfterFailures, "can't be negative, use 0 to never re-open the sensor"))
+	}
+	if conf.GetDuration(recoveryReadTimeout) < 0 {
+		problems = append(problems, configError(recoveryReadTimeout, "can't be negative, use 0 to wait as long as reads take"))
+	}
+	if conf.GetInt(recoveryResetAfter) < 0 {
+		problems = append(problems, configError(recoveryResetAfter, "can't be negative, use 0 to never reset the sensor"))
+	}
+	backoff, maxBackoff := conf.GetDuration(recoveryBackoff), conf.GetDuration(recoveryMaxBackoff)
+	if backoff <= 0 {
+		problems = append(problems, configError(recoveryBackoff, "must be more than 0"))
+	}
+	if maxBackoff < backoff {
+		problems = append(problems, configError(recoveryMaxBackoff, "is less than %s (%s)", recoveryBackoff, backoff))
+	}
+	return problems
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Writes readings to RedisTimeSeries with TS.ADD, a series for each value,
+// for small dashboards that already run off Redis. The labels only go on
+// when TS.ADD creates the series, like the retention. See
+// https://redis.io/docs/latest/develop/data-types/timeseries/
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "redis",
+		intervalKey: redisInterval,
+		enabled:     func() bool { return conf.GetString(redisURL) != "" },
+		open:        openRedis,
+		addresses:   func() []string { return urlAddress(conf.GetString(redisURL), "6379") },
+	})
+	configChecks = append(configChecks, checkRedisSettings)
+}
+
+type redisSink struct {
+	address   string
+	tls       *tls.Config
+	user      string
+	password  string
+	db        int
+	key       string
+	retention time.Duration
+
+	// Kept open between pushes, and opened again after anything goes wrong
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func openRedis() (sink, error) {
+	u, err := url.Parse(conf.GetString(redisURL))
+	if err != nil {
+		return nil, err
+	}
+	s := &redisSink{
+		address:   u.Host,
+		key:       conf.GetString(redisKey),
+		retention: conf.GetDuration(redisRetention),
+	}
+	if u.Port() == "" {
+		s.address = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		s.tls = &tls.Config{ServerName: u.Hostname()}
+	}
+	// Without a password, the user name is the password, like redis-cli's
+	// redis://:password@host URLs
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			s.user, s.password = u.User.Username(), p
+		} else {
+			s.password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return s, nil
+}
+
+func (s *redisSink) push(ctx context.Context, samples []sample) error {
+	err := s.add(ctx, samples)
+	if err != nil && s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *redisSink) add(ctx context.Context, samples []sample) error {
+	var commands [][]string
+	for _, smp := range samples {
+		tags := smp.tags()
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, v := range smp.values() {
+			key := strings.NewReplacer("{host}", smp.Sensor.Host, "{metric}", v.name).Replace(s.key)
+			cmd := []string{"TS.ADD", key, strconv.FormatInt(smp.Time.UnixMilli(), 10), strconv.FormatFloat(v.value, 'f', -1, 64)}
+			if s.retention > 0 {
+				cmd = append(cmd, "RETENTION", strconv.FormatInt(s.retention.Milliseconds(), 10))
+			}
+			// A reading sent again from the spool replaces itself rather than
+			// being an error
+			cmd = append(cmd, "ON_DUPLICATE", "LAST", "LABELS", "metric", v.name)
+			for _, k := range keys {
+				if tags[k] != "" {
+					cmd = append(cmd, k, tags[k])
+				}
+			}
+			commands = append(commands, cmd)
+		}
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+	} else {
+		s.conn.SetDeadline(time.Time{})
+	}
+	// Pipelined, so it's one round trip however many there are
+	return s.do(commands...)
+}
+
+func (s *redisSink) connect(ctx context.Context) error {
+	var conn net.Conn
+	var err error
+	if s.tls != nil {
+		d := tls.Dialer{Config: s.tls}
+		conn, err = d.DialContext(ctx, "tcp", s.address)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", s.address)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+
+	var commands [][]string
+	switch {
+	case s.user != "":
+		commands = append(commands, []string{"AUTH", s.user, s.password})
+	case s.password != "":
+		commands = append(commands, []string{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		commands = append(commands, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	if err := s.do(commands...); err != nil {
+		conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Send commands and read their replies, returning the first error
+func (s *redisSink) do(commands ...[]string) error {
+	if len(commands) == 0 {
+		return nil
+	}
+	var b []byte
+	for _, cmd := range commands {
+		b = fmt.Appendf(b, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			b = fmt.Appendf(b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		return err
+	}
+	var first error
+	for _, cmd := range commands {
+		if err := s.readReply(); err != nil {
+			var re redisError
+			if !errors.As(err, &re) {
+				return err
+			}
+			if first == nil {
+				first = fmt.Errorf("%s: %w", cmd[0], err)
+			}
+		}
+	}
+	return first
+}
+
+// An error reply, after which the connection's still usable
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// Read a reply, which only matters if it's an error
+func (s *redisSink) readReply() error {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return errors.New("empty reply from Redis")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		if n >= 0 {
+			_, err = io.CopyN(io.Discard, s.r, int64(n)+2)
+		}
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		for ; n > 0; n-- {
+			if err := s.readReply(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unexpected reply from Redis: %q", line)
+}
+
+func (s *redisSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func checkRedisSettings() []configProblem {
+	var problems []configProblem
+	if v := conf.GetString(redisURL); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || u.Host == "" || (u.Scheme != "redis" && u.Scheme != "rediss") {
+			problems = append(problems, configError(redisURL, "invalid URL %q, use e.g. redis://redis:6379/0, or rediss:// for TLS", v))
+		} else if db := strings.Trim(u.Path, "/"); db != "" {
+			if _, err := strconv.Atoi(db); err != nil {
+				problems = append(problems, configError(redisURL, "invalid database %q, it's a number", db))
+			}
+		}
+	}
+	if !strings.Contains(conf.GetString(redisKey), "{metric}") {
+		problems = append(problems, configError(redisKey, "needs {metric} in it, so each value gets its own series"))
+	}
+	if conf.GetDuration(redisRetention) < 0 {
+		problems = append(problems, configError(redisRetention, "can't be negative"))
+	}
+	return problems
+}
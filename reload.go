@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reloadMu    sync.Mutex
+	reloadHooks []func()
+
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bme280_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful",
+	})
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bme280_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(configReloadSuccess, configReloadSeconds)
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+}
+
+// Register a function that applies some part of the configuration once it's
+// been re-read. The whole file has been checked by then, so hooks can't fail.
+func onReload(hook func()) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadHooks = append(reloadHooks, hook)
+}
+
+// Re-read the configuration, on SIGHUP or a POST to /-/reload
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	before := sinkSettings()
+	if err := conf.reload(); err != nil {
+		configReloadSuccess.Set(0)
+		lg.Errorf("Problem reloading the configuration: %v", err)
+		recordEvent("reload", "Reloading the configuration failed: %v", err)
+		return err
+	}
+	for _, hook := range reloadHooks {
+		hook()
+	}
+
+	// The sinks keep the settings they were opened with
+	after := sinkSettings()
+	for _, st := range sinkTypes {
+		if !reflect.DeepEqual(before[st.name], after[st.name]) {
+			lg.Warnf("Changes to the %s settings need a restart", st.name)
+			recordEvent("reload", "Changes to the %s settings need a restart", st.name)
+		}
+	}
+
+	configReloadSuccess.Set(1)
+	configReloadSeconds.Set(float64(time.Now().Unix()))
+	lg.Info("Reloaded the configuration")
+	recordEvent("reload", "Reloaded the configuration")
+	return nil
+}
+
+// Each sink's settings, which are the ones under its interval's section
+func sinkSettings() map[string]map[string]interface{} {
+	keys := conf.AllKeys()
+	settings := make(map[string]map[string]interface{}, len(sinkTypes))
+	for _, st := range sinkTypes {
+		prefix := strings.TrimSuffix(st.intervalKey, "interval")
+		s := make(map[string]interface{})
+		for _, k := range keys {
+			if strings.HasPrefix(k, prefix) {
+				s[k] = conf.Get(k)
+			}
+		}
+		settings[st.name] = s
+	}
+	return settings
+}
+
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		http.Error(w, "Failed to reload config: "+err.Error(), http.StatusInternalServerError)
+	}
+}
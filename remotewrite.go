@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sends readings with Prometheus's remote write protocol, to Prometheus
+// itself, Mimir, VictoriaMetrics and so on, so nothing has to be able to
+// scrape the exporter. The WriteRequest is encoded by hand like the gRPC
+// messages, see
+// https://prometheus.io/docs/concepts/remote_write_spec/
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "remote-write",
+		intervalKey: remoteWriteInterval,
+		enabled:     func() bool { return conf.GetString(remoteWriteURL) != "" },
+		open:        openRemoteWrite,
+		addresses:   func() []string { return urlAddress(conf.GetString(remoteWriteURL), "") },
+	})
+	configChecks = append(configChecks, checkRemoteWriteSettings)
+}
+
+type remoteWriteSink struct {
+	url       string
+	tokenFile string
+	headers   map[string]string
+	// Labels added to every series, since there's no scrape to add them
+	target prometheus.Labels
+	client *http.Client
+}
+
+func openRemoteWrite() (sink, error) {
+	instance := conf.GetString(remoteWriteInstance)
+	if instance == "" {
+		instance = hostname
+	}
+	s := &remoteWriteSink{
+		url:       conf.GetString(remoteWriteURL),
+		tokenFile: conf.GetString(remoteWriteTokenFile),
+		headers:   conf.GetStringMapString(remoteWriteHeaders),
+		target:    prometheus.Labels{"job": conf.GetString(remoteWriteJob), "instance": instance},
+		client:    &http.Client{},
+	}
+	if s.tokenFile != "" {
+		if _, err := s.token(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Read each time so a rotated token gets picked up
+func (s *remoteWriteSink) token() (string, error) {
+	b, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("bearer token: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (s *remoteWriteSink) push(ctx context.Context, samples []sample) error {
+	body, err := s.encode(samples)
+	if err != nil {
+		return err
+	}
+	body = snappyEncode(body)
+
+	// Keep trying until the sink timeout runs out, as long as it's worth it
+	backoff := 250 * time.Millisecond
+	for {
+		retry, err := s.post(ctx, body)
+		if err == nil || !retry {
+			return err
+		}
+		lg.Debugf("Retrying remote write in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Send the request once, and say whether it's worth trying again if it failed
+func (s *remoteWriteSink) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	if s.tokenFile != "" {
+		token, err := s.token()
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	// Per the spec, only server errors and rate limiting are worth retrying,
+	// anything else will fail the same way again
+	retry := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+type remoteWriteSeries struct {
+	labels  []*remoteWriteLabel
+	samples []byte
+}
+
+type remoteWriteLabel struct {
+	name, value string
+}
+
+// Encode the readings as a WriteRequest, one series per metric with every
+// reading in the batch as a sample
+func (s *remoteWriteSink) encode(samples []sample) ([]byte, error) {
+	series := make(map[string]*remoteWriteSeries)
+	var order []string
+	for _, smp := range samples {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(probeCollector{exporter: newExporter(smp.Sensor.Model, smp.Labels), r: smp.reading})
+		families, err := registry.Gather()
+		if err != nil {
+			return nil, err
+		}
+		for _, mf := range families {
+			for _, m := range mf.Metric {
+				labels := []*remoteWriteLabel{{"__name__", mf.GetName()}}
+				seen := make(map[string]bool)
+				for _, lp := range m.Label {
+					labels = append(labels, &remoteWriteLabel{lp.GetName(), lp.GetValue()})
+					seen[lp.GetName()] = true
+				}
+				// Configured labels win
+				for name, value := range s.target {
+					if !seen[name] {
+						labels = append(labels, &remoteWriteLabel{name, value})
+					}
+				}
+				// The spec wants them sorted by name
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				var key strings.Builder
+				for _, l := range labels {
+					key.WriteString(l.name + "\xff" + l.value + "\xff")
+				}
+
+				ts := series[key.String()]
+				if ts == nil {
+					ts = &remoteWriteSeries{labels: labels}
+					series[key.String()] = ts
+					order = append(order, key.String())
+				}
+				var sm []byte
+				sm = protowire.AppendTag(sm, 1, protowire.Fixed64Type)
+				sm = protowire.AppendFixed64(sm, math.Float64bits(m.GetGauge().GetValue()))
+				sm = protowire.AppendTag(sm, 2, protowire.VarintType)
+				sm = protowire.AppendVarint(sm, uint64(smp.Time.UnixMilli()))
+				ts.samples = protowire.AppendTag(ts.samples, 2, protowire.BytesType)
+				ts.samples = protowire.AppendBytes(ts.samples, sm)
+			}
+		}
+	}
+
+	var b []byte
+	for _, key := range order {
+		ts := series[key]
+		var tb []byte
+		for _, l := range ts.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+			tb = protowire.AppendTag(tb, 1, protowire.BytesType)
+			tb = protowire.AppendBytes(tb, lb)
+		}
+		tb = append(tb, ts.samples...)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, tb)
+	}
+	return b, nil
+}
+
+func (s *remoteWriteSink) close() error {
+	return nil
+}
+
+// Snappy's block format without any actual compression, just the length and
+// literals, which every decoder accepts. The requests are small enough that
+// it isn't worth a dependency. See
+// https://github.com/google/snappy/blob/main/format_description.txt
+func snappyEncode(src []byte) []byte {
+	dst := protowire.AppendVarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		n := min(len(src), 1<<16)
+		switch {
+		case n <= 60:
+			dst = append(dst, byte(n-1)<<2)
+		case n <= 1<<8:
+			dst = append(dst, 60<<2, byte(n-1))
+		default:
+			dst = append(dst, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
+
+func checkRemoteWriteSettings() []configProblem {
+	var problems []configProblem
+	v := conf.GetString(remoteWriteURL)
+	if v == "" {
+		return nil
+	}
+	if u, err := url.Parse(v); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		problems = append(problems, configError(remoteWriteURL, "invalid URL %q, use e.g. http://prometheus:9090/api/v1/write", v))
+	}
+	if f := conf.GetString(remoteWriteTokenFile); f != "" {
+		if _, err := os.Stat(f); err != nil {
+			problems = append(problems, configError(remoteWriteTokenFile, "%v", err))
+		}
+	}
+	if conf.GetString(remoteWriteJob) == "" {
+		problems = append(problems, configError(remoteWriteJob, "can't be empty"))
+	}
+	return problems
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/klauspost/compress/s2"
+)
+
+func TestSnappyEncode(t *testing.T) {
+	x := func(n int) string { return string(bytes.Repeat([]byte("x"), n)) }
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"empty", "", "\x00"},
+		{"one byte", "a", "\x01\x00a"},
+		{"short", "hello", "\x05\x10hello"},
+		{"the most in the tag", x(60), "\x3c\xec" + x(60)},
+		{"one byte length", x(61), "\x3d\xf0\x3c" + x(61)},
+		{"longest one byte length", x(256), "\x80\x02\xf0\xff" + x(256)},
+		{"two byte length", x(257), "\x81\x02\xf4\x00\x01" + x(257)},
+		{"one literal", x(1 << 16), "\x80\x80\x04\xf4\xff\xff" + x(1<<16)},
+		{"two literals", x(1<<16 + 1), "\x81\x80\x04\xf4\xff\xff" + x(1<<16) + "\x00x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := snappyEncode([]byte(tt.src))
+			if string(got) != tt.want {
+				t.Errorf("snappyEncode(%d bytes) starts % x, want % x", len(tt.src), got[:min(len(got), 8)], tt.want[:min(len(tt.want), 8)])
+			}
+			// Any Snappy decoder has to take it
+			decoded, err := s2.Decode(nil, got)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if string(decoded) != tt.src {
+				t.Errorf("decoded %d bytes, want %d", len(decoded), len(tt.src))
+			}
+		})
+	}
+}
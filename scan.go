@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/d2r2/go-i2c"
+	"github.com/spf13/pflag"
+)
+
+// The only addresses the Bosch sensors can be strapped to
+var sensorAddresses = []uint8{0x76, 0x77}
+
+var scanBuses []int
+
+func scanFlags(fs *pflag.FlagSet) {
+	fs.IntSliceVar(&scanBuses, "bus", nil, "Only scan these buses (default is every bus)")
+}
+
+// `bme280-exporter scan` looks for sensors on the I2C buses
+func runScan(args []string) int {
+	buses := scanBuses
+	if len(buses) == 0 {
+		var err error
+		if buses, err = i2cBuses(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BUS\tADDRESS\tCHIP ID\tMODEL")
+	found := 0
+	for _, bus := range buses {
+		for _, addr := range sensorAddresses {
+			id, err := identifySensor(bus, addr)
+			if err != nil {
+				lg.Debugf("Nothing at 0x%x on bus %d: %v", addr, bus, err)
+				continue
+			}
+			fmt.Fprintf(tw, "%d\t0x%x\t0x%x\t%s\n", bus, addr, id, sensorNameForID(id))
+			found++
+		}
+	}
+	if found == 0 {
+		fmt.Fprintf(os.Stderr, "No sensors found at 0x76 or 0x77 on %s\n", describeBuses(buses))
+		return 1
+	}
+	tw.Flush()
+	return 0
+}
+
+// The I2C buses the kernel knows about
+func i2cBuses() ([]int, error) {
+	paths, _ := filepath.Glob("/dev/i2c-*")
+	var buses []int
+	for _, p := range paths {
+		if n, err := strconv.Atoi(strings.TrimPrefix(p, "/dev/i2c-")); err == nil {
+			buses = append(buses, n)
+		}
+	}
+	if len(buses) == 0 {
+		return nil, fmt.Errorf("no I2C buses found, is I2C enabled? (e.g. with raspi-config)")
+	}
+	sort.Ints(buses)
+	return buses, nil
+}
+
+// What identifySensor gives when something answers that isn't one of ours
+var errUnknownChip = errors.New("unrecognised chip ID")
+
+// Read the chip ID of whatever is at the address. The BMP388 keeps its ID
+// in a different register to the rest.
+func identifySensor(bus int, addr uint8) (uint8, error) {
+	conn, err := i2c.NewI2C(addr, bus)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	id, err := conn.ReadRegU8(0xd0)
+	if err == nil && sensorNameForID(id) != "unknown" {
+		return id, nil
+	}
+	if id, err := conn.ReadRegU8(0x00); err == nil && sensorNameForID(id) != "unknown" {
+		return id, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%w 0x%x", errUnknownChip, id)
+}
+
+func describeBuses(buses []int) string {
+	s := make([]string, len(buses))
+	for i, b := range buses {
+		s[i] = strconv.Itoa(b)
+	}
+	if len(s) == 1 {
+		return "bus " + s[0]
+	}
+	return "buses " + strings.Join(s, ", ")
+}
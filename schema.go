@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// A JSON Schema for the configuration file, built from the settings' defaults
+// and flag descriptions so it can't fall behind as settings are added
+
+const schemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// Settings whose defaults don't say enough about what's allowed
+var schemaOverrides = map[string]map[string]interface{}{
+	i2cAddress: addressSchema(),
+	modelName:  {"type": "string", "enum": sensorModels},
+	metricsPort: {
+		"type":    "integer",
+		"minimum": 1,
+		"maximum": 65535,
+	},
+}
+
+func addressSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string", "examples": []string{"0x76", "0x77"}},
+			map[string]interface{}{"type": "integer", "minimum": 0x03, "maximum": 0x77},
+		},
+	}
+}
+
+// Guess a setting's schema from the type of its default
+func settingSchema(def interface{}) map[string]interface{} {
+	switch def.(type) {
+	case bool:
+		return map[string]interface{}{"type": "boolean"}
+	case int:
+		return map[string]interface{}{"type": "integer"}
+	case float64:
+		return map[string]interface{}{"type": "number"}
+	case time.Duration:
+		return map[string]interface{}{
+			"type":    "string",
+			"pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$|^0$`,
+		}
+	case []string:
+		// Lists can also be written as one comma or space separated string
+		return map[string]interface{}{
+			"oneOf": []interface{}{
+				map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+				map[string]interface{}{"type": "string"},
+			},
+		}
+	case map[string]string:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": map[string]interface{}{"type": "string"},
+		}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+func objectSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           map[string]interface{}{},
+		"additionalProperties": false,
+	}
+}
+
+func labelsSchema(description string) map[string]interface{} {
+	var reserved []string
+	for name := range reservedLabels {
+		reserved = append(reserved, name)
+	}
+	sort.Strings(reserved)
+	return map[string]interface{}{
+		"description": description,
+		"type":        "object",
+		"propertyNames": map[string]interface{}{
+			"pattern": "^[a-zA-Z_][a-zA-Z0-9_]*$",
+			"not":     map[string]interface{}{"enum": reserved},
+		},
+		"additionalProperties": map[string]interface{}{"type": "string"},
+	}
+}
+
+func configSchema() map[string]interface{} {
+	descriptions := pflag.NewFlagSet("schema", pflag.ContinueOnError)
+	allFlags(descriptions)
+
+	root := objectSchema()
+	root["$schema"] = schemaDraft
+	root["title"] = "bme280-exporter configuration"
+
+	for key, def := range configDefaults {
+		// Walk down to the object holding this setting, making any that are missing
+		parent := root
+		parts := strings.Split(key, ".")
+		for _, part := range parts[:len(parts)-1] {
+			props := parent["properties"].(map[string]interface{})
+			child, ok := props[part].(map[string]interface{})
+			if !ok {
+				child = objectSchema()
+				props[part] = child
+			}
+			parent = child
+		}
+
+		s, ok := schemaOverrides[key]
+		if !ok {
+			s = settingSchema(def)
+		}
+		prop := map[string]interface{}{"default": schemaDefault(def)}
+		for k, v := range s {
+			prop[k] = v
+		}
+		if f := descriptions.Lookup(key); f != nil {
+			prop["description"] = f.Usage
+		}
+		parent["properties"].(map[string]interface{})[parts[len(parts)-1]] = prop
+	}
+
+	props := root["properties"].(map[string]interface{})
+	props[extraLabels] = labelsSchema("Labels added to all of the exporter's metrics")
+	props[extraSensors] = map[string]interface{}{
+		"description": "More sensors to read on every scrape",
+		"type":        "array",
+		"items": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"name", "address"},
+			"properties": map[string]interface{}{
+				"name":    map[string]interface{}{"type": "string", "minLength": 1, "description": "The sensor label for this sensor's metrics"},
+				"bus":     map[string]interface{}{"type": "integer", "minimum": 0, "description": "The I2C bus ID"},
+				"address": addressSchema(),
+				"model":   map[string]interface{}{"type": "string", "enum": sensorModels, "description": "Defaults to the main sensor's model"},
+				"labels":  labelsSchema("Labels added to this sensor's metrics"),
+			},
+			"additionalProperties": false,
+		},
+	}
+	return root
+}
+
+// Defaults as they'd be written in the file
+func schemaDefault(def interface{}) interface{} {
+	if d, ok := def.(time.Duration); ok {
+		return d.String()
+	}
+	return def
+}
+
+// `bme280-exporter config-schema` prints a JSON Schema for the configuration
+// file, for editors and CI to check it against
+func runConfigSchema(args []string) int {
+	b, err := json.MarshalIndent(configSchema(), "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s\n", b)
+	return 0
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// What the sensors can physically measure, per the datasheets. Anything
+// outside these is a wiring, power, or calibration data problem.
+const (
+	minPlausibleTemperature = -40.0
+	maxPlausibleTemperature = 85.0
+	minPlausiblePressure    = 30000.0
+	maxPlausiblePressure    = 110000.0
+
+	// Readings at different accuracy levels taken a moment apart shouldn't
+	// disagree by more than this
+	maxTemperatureSpread = 1.0
+	maxPressureSpread    = 100.0
+	maxHumiditySpread    = 5.0
+)
+
+// `bme280-exporter test` checks everything about the sensor support usually
+// has to ask about: that the bus opens, the chip is the model we expect with
+// sane calibration data, and it gives believable readings at every accuracy level
+func runSelfTest(args []string) int {
+	failed := false
+	report := func(name string, err error, detail string) {
+		if err != nil {
+			failed = true
+			fmt.Printf("FAIL  %s: %s\n", name, strings.ReplaceAll(err.Error(), "\n", "; "))
+			return
+		}
+		fmt.Printf("PASS  %s: %s\n", name, detail)
+	}
+
+	err := openSensor()
+	bus, addr := currentAddress()
+	report("open", err, fmt.Sprintf("bus %d at %s, valid calibration coefficients", bus, formatI2CAddress(addr)))
+	if err != nil {
+		return 1
+	}
+	defer closeSensor()
+
+	model := conf.GetString(modelName)
+	modelID, _ := getSensorID(model)
+	id := currentChipID()
+	found := sensorNameForID(id)
+	if found != model {
+		err = fmt.Errorf("chip ID 0x%x is a %s, but the model is set to %s", id, found, model)
+	}
+	report("chip ID", err, fmt.Sprintf("0x%x, a %s", id, found))
+
+	var readings []reading
+	for _, level := range accuracyLevels(modelID) {
+		start := time.Now()
+		r, err := measureAt(sensor, level.mode)
+		took := time.Since(start)
+		if err == nil {
+			err = checkPlausible(r)
+		}
+		if err == nil {
+			readings = append(readings, r)
+		}
+		report("read "+level.name, err, fmt.Sprintf("%s in %s", formatReading(r), took.Round(time.Millisecond)))
+	}
+
+	if len(readings) > 1 {
+		report("consistency", checkConsistent(readings), "readings agree across accuracy levels")
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func formatReading(r reading) string {
+	s := fmt.Sprintf("%.2f °C, %.2f hPa", r.Temperature, r.Pressure/100)
+	if !math.IsNaN(r.Humidity) {
+		s += fmt.Sprintf(", %.2f %%", r.Humidity)
+	}
+	return s
+}
+
+// Check a reading is something the sensor could actually have measured
+func checkPlausible(r reading) error {
+	var errs []error
+	if r.Temperature < minPlausibleTemperature || r.Temperature > maxPlausibleTemperature {
+		errs = append(errs, fmt.Errorf("temperature %.2f °C is outside %g to %g °C", r.Temperature, minPlausibleTemperature, maxPlausibleTemperature))
+	}
+	if r.Pressure < minPlausiblePressure || r.Pressure > maxPlausiblePressure {
+		errs = append(errs, fmt.Errorf("pressure %.2f hPa is outside %g to %g hPa", r.Pressure/100, minPlausiblePressure/100, maxPlausiblePressure/100))
+	}
+	if !math.IsNaN(r.Humidity) && (r.Humidity < 0 || r.Humidity > 100) {
+		errs = append(errs, fmt.Errorf("humidity %.2f %% is outside 0 to 100 %%", r.Humidity))
+	}
+	return errors.Join(errs...)
+}
+
+func checkConsistent(readings []reading) error {
+	spread := func(value func(reading) float64) float64 {
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, r := range readings {
+			v := value(r)
+			if math.IsNaN(v) {
+				continue
+			}
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+		if hi < lo {
+			return 0
+		}
+		return hi - lo
+	}
+
+	var errs []error
+	if s := spread(func(r reading) float64 { return r.Temperature }); s > maxTemperatureSpread {
+		errs = append(errs, fmt.Errorf("temperatures vary by %.2f °C", s))
+	}
+	if s := spread(func(r reading) float64 { return r.Pressure }); s > maxPressureSpread {
+		errs = append(errs, fmt.Errorf("pressures vary by %.2f hPa", s/100))
+	}
+	if s := spread(func(r reading) float64 { return r.Humidity }); s > maxHumiditySpread {
+		errs = append(errs, fmt.Errorf("humidities vary by %.2f %%", s))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/d2r2/go-bsbmp"
+	"github.com/d2r2/go-i2c"
+)
+
+var (
+	// Scrapes and the background poller share the one I2C handle
+	sensorMu   sync.Mutex
+	sensorConn *i2c.I2C
+	sensorBus  int
+	sensorAddr uint8
+	// Held while talking to the chip. Each handle gets its own, so a read
+	// that's wedged in the kernel doesn't hold up a freshly opened one.
+	sensorBusMu = new(sync.Mutex)
+	// Logs about the sensor with its model, bus, and address
+	sensorLog = lg
+
+	// Added to every reading from the sensor to correct for its placement
+	calibrationMu sync.Mutex
+	calibration   offsets
+
+	// The read currently in progress, if any
+	inflightMu sync.Mutex
+	inflight   *readCall
+
+	// Set to 1 while the most recent read worked, for the readiness check
+	sensorHealthy int32 = 1
+)
+
+type offsets struct {
+	Temperature float64 `json:"temperature"`
+	Pressure    float64 `json:"pressure"`
+	Humidity    float64 `json:"humidity"`
+}
+
+func currentCalibration() offsets {
+	calibrationMu.Lock()
+	defer calibrationMu.Unlock()
+	return calibration
+}
+
+func setCalibration(o offsets) {
+	calibrationMu.Lock()
+	defer calibrationMu.Unlock()
+	calibration = o
+}
+
+// The calibration offsets from the configuration
+func calibrationFromConfig() offsets {
+	return offsets{
+		Temperature: conf.GetFloat64(temperatureOffset),
+		Pressure:    conf.GetFloat64(pressureOffset),
+		Humidity:    conf.GetFloat64(humidityOffset),
+	}
+}
+
+// Parse a 7-bit I2C address in hex (0x76) or decimal (118), optionally with
+// the bus in front as a number (1:0x76) or device (/dev/i2c-1:0x76). The bus
+// is -1 if there isn't one.
+func parseI2CAddress(s string) (int, uint8, error) {
+	bus := -1
+	v := strings.TrimSpace(s)
+	if i := strings.LastIndexByte(v, ':'); i >= 0 {
+		b, err := strconv.Atoi(strings.TrimPrefix(v[:i], "/dev/i2c-"))
+		if err != nil || b < 0 {
+			return 0, 0, fmt.Errorf("invalid I2C address %q, the bus should be a number or /dev/i2c-N", s)
+		}
+		bus, v = b, v[i+1:]
+	}
+
+	// Leading zeros mean octal to ParseUint, which nobody wants here
+	base := 10
+	if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+		base, v = 16, v[2:]
+	}
+	addr, err := strconv.ParseUint(v, base, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid I2C address %q, use hex like 0x76 or decimal like 118", s)
+	}
+	if addr < 0x03 || addr > 0x77 {
+		return 0, 0, fmt.Errorf("invalid I2C address %q, it should be between 0x03 and 0x77", s)
+	}
+	return bus, uint8(addr), nil
+}
+
+// The configured sensor's bus and address. A bus given with the address wins
+// over --i2cbus.
+func configuredAddress() (int, uint8, error) {
+	bus, addr, err := parseI2CAddress(conf.GetString(i2cAddress))
+	if err != nil {
+		return 0, 0, err
+	}
+	if bus < 0 {
+		bus = conf.GetInt(i2cBus)
+	}
+	return bus, addr, nil
+}
+
+// The chip ID of the sensor we have open, or that was open last
+func currentChipID() uint8 {
+	sensorMu.Lock()
+	defer sensorMu.Unlock()
+	return chipID
+}
+
+// Where the sensor we have open is, or where it's going to be if it hasn't
+// been opened yet
+func currentAddress() (int, uint8) {
+	sensorMu.Lock()
+	defer sensorMu.Unlock()
+	if sensor == nil {
+		if bus, addr, err := configuredAddress(); err == nil {
+			return bus, addr
+		}
+	}
+	return sensorBus, sensorAddr
+}
+
+func formatI2CAddress(addr uint8) string {
+	return fmt.Sprintf("0x%02x", addr)
+}
+
+// Open the configured sensor and check it's usable, replacing the one we
+// already have if any. On failure the old sensor is left alone.
+func openSensor() error {
+	bus, addr, err := configuredAddress()
+	if err != nil {
+		return err
+	}
+	conn, err := i2c.NewI2C(addr, bus)
+	if err != nil {
+		return err
+	}
+
+	modelID, err := getSensorID(conf.GetString(modelName))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s, err := bsbmp.NewBMP(modelID, conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	id, err := s.ReadSensorID()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	log := lg.With(sensorFields(sensorNameForID(id), bus, addr)...)
+	log.Infof("This Bosch Sensortec sensor has signature: 0x%x", id)
+
+	if err := s.IsValidCoefficients(); err != nil {
+		conn.Close()
+		return err
+	}
+	recordEvent("sensor", "Opened %s (0x%x) on bus %d at %s", sensorNameForID(id), id, bus, formatI2CAddress(addr))
+
+	sensorMu.Lock()
+	defer sensorMu.Unlock()
+	if sensorConn != nil {
+		// Once whatever's using the old handle is done with it
+		go func(conn *i2c.I2C, mu *sync.Mutex) {
+			mu.Lock()
+			defer mu.Unlock()
+			conn.Close()
+		}(sensorConn, sensorBusMu)
+	}
+	sensorConn, sensor, chipID = conn, s, id
+	sensorBus, sensorAddr = bus, addr
+	sensorBusMu = new(sync.Mutex)
+	sensorLog = log
+	return nil
+}
+
+func closeSensor() {
+	sensorMu.Lock()
+	conn, mu, abandoned := sensorConn, sensorBusMu, sensor == nil
+	sensorConn, sensor = nil, nil
+	sensorMu.Unlock()
+	if conn == nil {
+		return
+	}
+	// Let a read that's in progress finish, unless it's wedged and been given up on
+	if !abandoned {
+		mu.Lock()
+		defer mu.Unlock()
+	}
+	conn.Close()
+}
+
+// A read that other callers can wait on instead of starting their own
+type readCall struct {
+	done chan struct{}
+	r    reading
+}
+
+// A single measurement. Values that couldn't be read are NaN.
+type reading struct {
+	Time        time.Time
+	Temperature float64
+	Pressure    float64
+	Humidity    float64
+}
+
+// True if at least one value was read successfully
+func (r reading) ok() bool {
+	return !math.IsNaN(r.Temperature) || !math.IsNaN(r.Pressure) || !math.IsNaN(r.Humidity)
+}
+
+func round2(v float32) float64 {
+	return math.Round(float64(v)*100) / 100
+}
+
+// Take a measurement, waiting however long it takes
+func readSensor() reading {
+	r, _ := readSensorContext(context.Background())
+	return r
+}
+
+// Take a measurement, giving up when the context is done. The I2C transfer
+// itself can't be interrupted, so an abandoned read carries on in the
+// background and whoever asks next gets its result.
+func readSensorContext(ctx context.Context) (reading, error) {
+	ctx, span := startSpan(ctx, "read", spanKindInternal)
+	defer span.finish()
+
+	c, shared := startRead(ctx)
+	span.setAttr("shared", shared)
+	select {
+	case <-c.done:
+		if !c.r.ok() {
+			span.recordError(errors.New("problem reading the sensor"))
+		}
+		return c.r, nil
+	case <-ctx.Done():
+		span.recordError(ctx.Err())
+		return reading{}, ctx.Err()
+	}
+}
+
+// Start a read, unless one is already in progress in which case that one is
+// shared rather than queueing up another trip to the sensor. Only the caller
+// that started the read gets the sensor's span in its trace.
+func startRead(ctx context.Context) (*readCall, bool) {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+	if inflight != nil {
+		return inflight, true
+	}
+
+	c := &readCall{done: make(chan struct{})}
+	inflight = c
+	// The read outlives an impatient caller, so its span has to as well
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		bus, addr := currentAddress()
+		_, span := startSpan(ctx, "sensor.measure", spanKindClient,
+			spanAttr{"model", conf.GetString(modelName)},
+			spanAttr{"bus", bus},
+			spanAttr{"address", formatI2CAddress(addr)})
+		c.r = readWithWatchdog()
+		if !c.r.ok() {
+			span.recordError(errors.New("no values could be read"))
+		}
+		span.finish()
+		inflightMu.Lock()
+		inflight = nil
+		inflightMu.Unlock()
+		close(c.done)
+	}()
+	return c, false
+}
+
+func doReadSensor() reading {
+	sensorMu.Lock()
+	s, conn, busMu, log := sensor, sensorConn, sensorBusMu, sensorLog
+	sensorMu.Unlock()
+
+	r := reading{Time: time.Now(), Temperature: math.NaN(), Pressure: math.NaN(), Humidity: math.NaN()}
+	if s != nil {
+		busMu.Lock()
+		r = measure(s, log)
+		if checkBadReading(r, log) {
+			resetSensor(conn, log)
+		}
+		busMu.Unlock()
+	} else {
+		log.Debugf("The sensor isn't open")
+	}
+
+	o := currentCalibration()
+	r.Temperature += o.Temperature
+	r.Pressure += o.Pressure
+	r.Humidity = math.Min(math.Max(r.Humidity+o.Humidity, 0), 100)
+	noteRead(r.ok())
+
+	// Only changes are interesting, a dead sensor would fill the event log otherwise
+	if r.ok() {
+		if atomic.SwapInt32(&sensorHealthy, 1) == 0 {
+			recordEvent("read", "The sensor is answering again")
+		}
+	} else {
+		if atomic.SwapInt32(&sensorHealthy, 0) == 1 {
+			recordEvent("read", "Reading the sensor failed")
+		}
+	}
+	return r
+}
+
+// The oversampling settings a model supports, from fastest to most accurate
+type accuracyLevel struct {
+	name string
+	mode bsbmp.AccuracyMode
+}
+
+func accuracyLevels(model bsbmp.SensorType) []accuracyLevel {
+	levels := []accuracyLevel{
+		{"ultra-low", bsbmp.ACCURACY_ULTRA_LOW},
+		{"low", bsbmp.ACCURACY_LOW},
+		{"standard", bsbmp.ACCURACY_STANDARD},
+		{"high", bsbmp.ACCURACY_HIGH},
+		{"ultra-high", bsbmp.ACCURACY_ULTRA_HIGH},
+	}
+	if model == bsbmp.BMP388 {
+		levels = append(levels, accuracyLevel{"highest", bsbmp.ACCURACY_HIGHEST})
+	}
+	return levels
+}
+
+// Read everything the sensor has at one accuracy level without any
+// calibration offsets, giving up on the first error
+func measureAt(s *bsbmp.BMP, accuracy bsbmp.AccuracyMode) (reading, error) {
+	r := reading{Time: time.Now(), Humidity: math.NaN()}
+	t, err := s.ReadTemperatureC(accuracy)
+	if err != nil {
+		return r, fmt.Errorf("reading temperature: %w", err)
+	}
+	r.Temperature = round2(t)
+	p, err := s.ReadPressurePa(accuracy)
+	if err != nil {
+		return r, fmt.Errorf("reading pressure: %w", err)
+	}
+	r.Pressure = round2(p)
+	supported, h, err := s.ReadHumidityRH(accuracy)
+	if supported {
+		if err != nil {
+			return r, fmt.Errorf("reading humidity: %w", err)
+		}
+		r.Humidity = round2(h)
+	}
+	return r, nil
+}
+
+// Actually talk to a sensor, logging anything that goes wrong
+func measure(s *bsbmp.BMP, log logger) reading {
+	r := reading{
+		Time:        time.Now(),
+		Temperature: math.NaN(),
+		Pressure:    math.NaN(),
+		Humidity:    math.NaN(),
+	}
+
+	t, err := s.ReadTemperatureC(bsbmp.ACCURACY_HIGH)
+	if err != nil {
+		log.Errorf("Problem reading temperature: %v", err)
+	} else {
+		r.Temperature = round2(t)
+	}
+
+	// Read atmospheric pressure in pascal
+	p, err := s.ReadPressurePa(bsbmp.ACCURACY_HIGH)
+	if err != nil {
+		log.Errorf("Problem reading pressure: %v", err)
+	} else {
+		r.Pressure = round2(p)
+	}
+
+	supported, h1, err := s.ReadHumidityRH(bsbmp.ACCURACY_HIGH)
+	if supported {
+		if err != nil {
+			log.Errorf("Problem reading humidity: %v", err)
+		} else {
+			r.Humidity = round2(h1)
+		}
+	} else {
+		log.Debugf("Humidity isn't supported on this sensor")
+	}
+	return r
+}
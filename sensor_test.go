@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestParseI2CAddress(t *testing.T) {
+	tests := []struct {
+		s    string
+		bus  int
+		addr uint8
+	}{
+		{"0x76", -1, 0x76},
+		{"0x77", -1, 0x77},
+		{"0X77", -1, 0x77},
+		{"118", -1, 0x76},
+		{"119", -1, 0x77},
+		{"076", -1, 0x4c},
+		{" 0x76 ", -1, 0x76},
+		{"0x03", -1, 0x03},
+		{"1:0x76", 1, 0x76},
+		{"0:118", 0, 0x76},
+		{"/dev/i2c-3:0x77", 3, 0x77},
+	}
+	for _, tt := range tests {
+		bus, addr, err := parseI2CAddress(tt.s)
+		if err != nil || bus != tt.bus || addr != tt.addr {
+			t.Errorf("parseI2CAddress(%q) = %d, 0x%02x, %v, want %d, 0x%02x", tt.s, bus, addr, err, tt.bus, tt.addr)
+		}
+	}
+
+	for _, s := range []string{
+		"", "0x", "x76", "0x7g", "bme280", "0x76.0", "-118",
+		// Reserved, or more than 7 bits
+		"0x00", "0x02", "2", "0x78", "120", "0x7f", "0xff", "255", "256", "0x100",
+		// Bad buses
+		":0x76", "a:0x76", "-1:0x76", "/dev/i2c-:0x76", "/dev/i2c-1:", "1:2:0x76",
+	} {
+		if bus, addr, err := parseI2CAddress(s); err == nil {
+			t.Errorf("parseI2CAddress(%q) = %d, 0x%02x, want an error", s, bus, addr)
+		}
+	}
+}
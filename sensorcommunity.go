@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pushes the latest reading to sensor.community (once Luftdaten) the way the
+// airrohr firmware does, so the sensor shows up on their map. Madavi, which
+// keeps graphs of each sensor, takes the same values with the sensor's name
+// in front and no pin. See https://github.com/opendata-stuttgart/meta/wiki/APIs
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "sensorcommunity",
+		intervalKey: sensorCommunityInterval,
+		enabled:     func() bool { return conf.GetString(sensorCommunitySensorID) != "" },
+		open:        openSensorCommunity,
+		addresses: func() []string {
+			addresses := urlAddress(conf.GetString(sensorCommunityURL), "")
+			if conf.GetBool(sensorCommunityMadavi) {
+				addresses = append(addresses, urlAddress(conf.GetString(sensorCommunityMadaviURL), "")...)
+			}
+			return addresses
+		},
+	})
+	configChecks = append(configChecks, checkSensorCommunitySettings)
+}
+
+// The X-Pin that says what kind of sensor the values are from
+const (
+	sensorCommunityPinBMP280 = "3"
+	sensorCommunityPinBME280 = "11"
+)
+
+// What the airrohr firmware sends the sensor's ID as
+var sensorCommunityIDRe = regexp.MustCompile(`^(esp8266|esp32|raspi)-[0-9A-Za-z]+$`)
+
+type sensorCommunityValue struct {
+	ValueType string `json:"value_type"`
+	Value     string `json:"value"`
+}
+
+type sensorCommunitySink struct {
+	sensorID  string
+	url       string
+	madaviURL string
+	client    *http.Client
+}
+
+func openSensorCommunity() (sink, error) {
+	s := &sensorCommunitySink{
+		sensorID: conf.GetString(sensorCommunitySensorID),
+		url:      conf.GetString(sensorCommunityURL),
+		client:   &http.Client{},
+	}
+	if conf.GetBool(sensorCommunityMadavi) {
+		s.madaviURL = conf.GetString(sensorCommunityMadaviURL)
+	}
+	return s, nil
+}
+
+func (s *sensorCommunitySink) push(ctx context.Context, samples []sample) error {
+	r := samples[len(samples)-1].reading
+	var values []sensorCommunityValue
+	if !math.IsNaN(r.Temperature) {
+		values = append(values, sensorCommunityValue{"temperature", strconv.FormatFloat(r.Temperature, 'f', 2, 64)})
+	}
+	if !math.IsNaN(r.Pressure) {
+		values = append(values, sensorCommunityValue{"pressure", strconv.FormatFloat(r.Pressure, 'f', 2, 64)})
+	}
+	// A BMP280 has no humidity, and goes on a pin of its own
+	pin, name := sensorCommunityPinBMP280, "BMP280_"
+	if !math.IsNaN(r.Humidity) {
+		values = append(values, sensorCommunityValue{"humidity", strconv.FormatFloat(r.Humidity, 'f', 2, 64)})
+		pin, name = sensorCommunityPinBME280, "BME280_"
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	if err := s.post(ctx, s.url, pin, values); err != nil {
+		return err
+	}
+	if s.madaviURL == "" {
+		return nil
+	}
+	for i := range values {
+		values[i].ValueType = name + values[i].ValueType
+	}
+	return s.post(ctx, s.madaviURL, "", values)
+}
+
+func (s *sensorCommunitySink) post(ctx context.Context, u, pin string, values []sensorCommunityValue) error {
+	body, err := json.Marshal(map[string]any{
+		"software_version": "bme280-exporter " + version,
+		"sensordatavalues": values,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	req.Header.Set("X-Sensor", s.sensorID)
+	if pin != "" {
+		req.Header.Set("X-Pin", pin)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *sensorCommunitySink) close() error {
+	return nil
+}
+
+func checkSensorCommunitySettings() []configProblem {
+	id := conf.GetString(sensorCommunitySensorID)
+	if id == "" {
+		return nil
+	}
+	var problems []configProblem
+	if !sensorCommunityIDRe.MatchString(id) {
+		problems = append(problems, configError(sensorCommunitySensorID, "%q doesn't look like a sensor.community ID, like raspi-0000000012345678", id))
+	}
+	keys := []string{sensorCommunityURL}
+	if conf.GetBool(sensorCommunityMadavi) {
+		keys = append(keys, sensorCommunityMadaviURL)
+	}
+	for _, key := range keys {
+		if u, err := url.Parse(conf.GetString(key)); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, configError(key, "invalid URL %q", conf.GetString(key)))
+		}
+	}
+	if i := conf.GetDuration(sensorCommunityInterval); i < time.Minute {
+		problems = append(problems, configWarning(sensorCommunityInterval, "is much more often than the airrohr firmware sends, which is every 145s"))
+	}
+	return problems
+}
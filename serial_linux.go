@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var serialBaudRates = map[int]uint32{
+	4800:   unix.B4800,
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+}
+
+// Open a serial port raw, 8N1 at the baud rate. It's non-blocking underneath
+// so closing it stops a read that's waiting.
+func openSerial(path string, baud int) (*os.File, error) {
+	speed, ok := serialBaudRates[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var ioctlErr error
+	err = rc.Control(func(fd uintptr) {
+		var t *unix.Termios
+		if t, ioctlErr = unix.IoctlGetTermios(int(fd), unix.TCGETS); ioctlErr != nil {
+			return
+		}
+		t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		t.Oflag &^= unix.OPOST
+		t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		t.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CBAUD
+		t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | speed
+		t.Ispeed, t.Ospeed = speed, speed
+		t.Cc[unix.VMIN], t.Cc[unix.VTIME] = 1, 0
+		ioctlErr = unix.IoctlSetTermios(int(fd), unix.TCSETS, t)
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("problem setting up %s: %w", path, err)
+	}
+	return f, nil
+}
+
+func validSerialBaudRate(baud int) bool {
+	_, ok := serialBaudRates[baud]
+	return ok
+}
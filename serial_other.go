@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openSerial(path string, baud int) (*os.File, error) {
+	return nil, errors.New("serial ports are only supported on Linux")
+}
+
+func validSerialBaudRate(baud int) bool {
+	return true
+}
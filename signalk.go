@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sends readings to a Signal K server as deltas, for boats, where a BME280's
+// a cheap way to watch the cabin or the weather. Deltas go over the server's
+// WebSocket stream, or by UDP to a Signal K UDP data connection. Values are
+// in Signal K's SI units: kelvin, pascals, and humidity as a ratio. See
+// https://signalk.org/specification/1.7.0/doc/data_model.html
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "signalk",
+		intervalKey: signalkInterval,
+		enabled:     func() bool { return conf.GetString(signalkURL) != "" },
+		open:        openSignalK,
+		addresses:   func() []string { return urlAddress(conf.GetString(signalkURL), "") },
+	})
+	configChecks = append(configChecks, checkSignalKSettings)
+}
+
+// From RFC 6455, for working out the Sec-WebSocket-Accept the server should send
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+)
+
+type signalkDelta struct {
+	Context string          `json:"context"`
+	Updates []signalkUpdate `json:"updates"`
+}
+
+type signalkUpdate struct {
+	Source    signalkSource  `json:"source"`
+	Timestamp string         `json:"timestamp"`
+	Values    []signalkValue `json:"values"`
+}
+
+type signalkSource struct {
+	Label string `json:"label"`
+	Type  string `json:"type"`
+}
+
+type signalkValue struct {
+	Path  string  `json:"path"`
+	Value float64 `json:"value"`
+}
+
+type signalkSink struct {
+	url     *url.URL
+	token   string
+	tls     *tls.Config
+	context string
+	source  string
+	paths   map[string]string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func openSignalK() (sink, error) {
+	u, err := url.Parse(conf.GetString(signalkURL))
+	if err != nil {
+		return nil, err
+	}
+	s := &signalkSink{
+		url:     u,
+		context: conf.GetString(signalkContext),
+		source:  conf.GetString(signalkSourceLabel),
+		paths:   conf.GetStringMapString(signalkPaths),
+	}
+	if f := conf.GetString(signalkTokenFile); f != "" {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		s.token = strings.TrimSpace(string(b))
+	}
+	if u.Scheme == "wss" {
+		if s.tls, err = clientTLSConfig(conf.GetString(signalkCAFile), "", "", false); err != nil {
+			return nil, err
+		}
+		s.tls.ServerName = u.Hostname()
+	}
+	return s, nil
+}
+
+// An update for a reading, with the values in SI units
+func (s *signalkSink) update(smp sample) signalkUpdate {
+	u := signalkUpdate{
+		Source:    signalkSource{Label: s.source, Type: "BME280"},
+		Timestamp: smp.Time.UTC().Format("2006-01-02T15:04:05.000Z"),
+	}
+	for _, v := range smp.values() {
+		path := s.paths[v.name]
+		if path == "" {
+			continue
+		}
+		value := v.value
+		switch v.name {
+		case temperatureMetric:
+			value += 273.15
+		case humidityMetric:
+			value /= 100
+		}
+		u.Values = append(u.Values, signalkValue{path, value})
+	}
+	return u
+}
+
+func (s *signalkSink) push(ctx context.Context, samples []sample) error {
+	var updates []signalkUpdate
+	for _, smp := range samples {
+		if u := s.update(smp); len(u.Values) > 0 {
+			updates = append(updates, u)
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	if s.url.Scheme == "udp" {
+		return s.pushUDP(ctx, updates)
+	}
+
+	msg, err := json.Marshal(signalkDelta{s.context, updates})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The connection's kept open between pushes, and opened again after anything goes wrong
+	if s.conn == nil {
+		conn, err := s.dial(ctx)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+		go s.read(conn)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	if err := wsWriteFrame(s.conn, wsText, msg); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// One delta per datagram, so each stays well under the MTU
+func (s *signalkSink) pushUDP(ctx context.Context, updates []signalkUpdate) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.url.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, u := range updates {
+		msg, err := json.Marshal(signalkDelta{s.context, []signalkUpdate{u}})
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Connect and upgrade to a WebSocket, asking the server not to send us
+// anything, since we only publish
+func (s *signalkSink) dial(ctx context.Context) (net.Conn, error) {
+	host := s.url.Host
+	if s.url.Port() == "" {
+		port := "80"
+		if s.tls != nil {
+			port = "443"
+		}
+		host = net.JoinHostPort(s.url.Hostname(), port)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if s.tls != nil {
+		tc := tls.Client(conn, s.tls)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	u := *s.url
+	q := u.Query()
+	q.Set("subscribe", "none")
+	u.RawQuery = q.Encode()
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := "GET " + u.RequestURI() + " HTTP/1.1\r\n" +
+		"Host: " + s.url.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"User-Agent: bme280-exporter/" + version + "\r\n"
+	if s.token != "" {
+		req += "Authorization: Bearer " + s.token + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("the Signal K server turned us away with %s, is %s set?", resp.Status, signalkTokenFile)
+		}
+		return nil, fmt.Errorf("the Signal K server answered %s instead of upgrading to a WebSocket", resp.Status)
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		conn.Close()
+		return nil, errors.New("the Signal K server's Sec-WebSocket-Accept is wrong")
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// Whatever came after the upgrade needs reading first
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Read what the server sends, which is its hello and the odd ping, until the
+// connection goes
+func (s *signalkSink) read(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn.Close()
+			s.conn = nil
+		}
+		s.mu.Unlock()
+	}()
+	for {
+		op, payload, err := wsReadFrame(conn)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				lg.Debugf("Signal K connection closed: %v", err)
+			}
+			return
+		}
+		switch op {
+		case wsPing:
+			s.mu.Lock()
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			wsWriteFrame(conn, wsPong, payload)
+			s.mu.Unlock()
+		case wsClose:
+			return
+		}
+	}
+}
+
+// A whole frame from the client, which has to be masked
+func wsWriteFrame(w io.Writer, op byte, payload []byte) error {
+	b := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, 0x80|byte(n))
+	case n <= 0xffff:
+		b = binary.BigEndian.AppendUint16(append(b, 0x80|126), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, 0x80|127), uint64(n))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// A frame from the server, which isn't masked. Fragments are returned as they
+// come, since we don't look at what's in them.
+func wsReadFrame(r io.Reader) (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if h[1]&0x80 != 0 {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	if n > 1<<20 {
+		return 0, nil, fmt.Errorf("WebSocket frame of %d bytes is too big", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if h[1]&0x80 != 0 {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return h[0] & 0x0f, payload, nil
+}
+
+func (s *signalkSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	wsWriteFrame(s.conn, wsClose, binary.BigEndian.AppendUint16(nil, 1000))
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func checkSignalKSettings() []configProblem {
+	raw := conf.GetString(signalkURL)
+	if raw == "" {
+		return nil
+	}
+	var problems []configProblem
+	u, err := url.Parse(raw)
+	switch {
+	case err != nil:
+		problems = append(problems, configError(signalkURL, "%v", err))
+	case u.Scheme != "ws" && u.Scheme != "wss" && u.Scheme != "udp":
+		problems = append(problems, configError(signalkURL, "must be a ws://, wss:// or udp:// URL"))
+	case u.Host == "":
+		problems = append(problems, configError(signalkURL, "has no host"))
+	case u.Scheme == "udp" && u.Port() == "":
+		problems = append(problems, configError(signalkURL, "needs the port of the server's UDP data connection"))
+	case u.Scheme == "udp" && conf.GetString(signalkTokenFile) != "":
+		problems = append(problems, configWarning(signalkTokenFile, "isn't used over UDP"))
+	}
+	for metric := range conf.GetStringMapString(signalkPaths) {
+		if metric != temperatureMetric && metric != pressureMetric && metric != humidityMetric {
+			problems = append(problems, configError(signalkPaths, "unknown metric %q, use temperature, pressure or humidity", metric))
+		}
+	}
+	if conf.GetString(signalkContext) == "" {
+		problems = append(problems, configError(signalkContext, "can't be empty"))
+	}
+	return problems
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sinks are the places readings get sent to, like an MQTT broker or a
+// database. The background poller feeds every enabled sink, and each runs on
+// its own with its own interval, so a slow or unreachable one doesn't hold up
+// the others. Prometheus is the odd one out, since it comes to us, but with
+// the poller running scrapes are served from the same readings.
+
+// How many readings a sink can fall behind by before new ones are dropped
+const sinkQueueSize = 1000
+
+// A reading and where it came from, as handed to the sinks
+type sample struct {
+	reading
+	Sensor sensorJSON
+	Labels map[string]string
+}
+
+// The JSON for a reading that sinks publish as a message of its own, flat so
+// it's easy to pick values out of
+type sampleJSON struct {
+	Time        time.Time         `json:"time"`
+	Temperature *float64          `json:"temperature,omitempty"`
+	Pressure    *float64          `json:"pressure,omitempty"`
+	Humidity    *float64          `json:"humidity,omitempty"`
+	Sensor      sensorJSON        `json:"sensor"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+func (s sample) json() sampleJSON {
+	return sampleJSON{
+		Time:        s.Time.UTC(),
+		Temperature: spoolValue(s.Temperature),
+		Pressure:    spoolValue(s.Pressure),
+		Humidity:    spoolValue(s.Humidity),
+		Sensor:      s.Sensor,
+		Labels:      s.Labels,
+	}
+}
+
+// A value that was read, named like the Prometheus metric
+type sampleValue struct {
+	name  string
+	value float64
+}
+
+// The values that were read, leaving out any that couldn't be
+func (s sample) values() []sampleValue {
+	var values []sampleValue
+	for _, v := range []sampleValue{
+		{temperatureMetric, s.Temperature},
+		{pressureMetric, s.Pressure},
+		{humidityMetric, s.Humidity},
+	} {
+		if !math.IsNaN(v.value) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// The same labels Prometheus would see
+func (s sample) tags() map[string]string {
+	tags := map[string]string{"host": s.Sensor.Host, "sensor_type": s.Sensor.Model}
+	for k, v := range s.Labels {
+		tags[k] = v
+	}
+	return tags
+}
+
+type sink interface {
+	// Send the readings, oldest first. Either they all arrived or there's an error.
+	push(ctx context.Context, samples []sample) error
+	close() error
+}
+
+// Sinks that act on the poller, like taking commands, are handed it once
+// they're open
+type pollerSink interface {
+	setPoller(p *poller)
+}
+
+// A kind of sink, which the file implementing it registers in its init()
+type sinkType struct {
+	name string
+	// The setting for how often to push, 0 to push every reading as it comes
+	intervalKey string
+	enabled     func() bool
+	open        func() (sink, error)
+	// Where it connects to over TCP, as host:port, for check-config
+	// --check.connect to try. Nil for sinks that only write locally or use UDP.
+	addresses func() []string
+}
+
+var (
+	sinkTypes []sinkType
+
+	sinkPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bme280_exporter_sink_pushes_total",
+		Help: "Attempts to send readings to each sink, by result",
+	}, []string{"sink", "result"})
+	sinkDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bme280_exporter_sink_dropped_samples_total",
+		Help: "Readings that never made it to each sink",
+	}, []string{"sink"})
+	sinkLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bme280_exporter_sink_last_success_timestamp_seconds",
+		Help: "When readings were last sent to each sink successfully",
+	}, []string{"sink"})
+	sinkSpooled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bme280_exporter_sink_spooled_samples",
+		Help: "Readings kept on disk until each sink can be reached again",
+	}, []string{"sink"})
+)
+
+// How many spooled readings to send at once when catching up
+const spoolBatchSize = 500
+
+func init() {
+	prometheus.MustRegister(sinkPushes, sinkDropped, sinkLastSuccess, sinkSpooled)
+	configChecks = append(configChecks, checkSinkSettings)
+}
+
+type sinkRunner struct {
+	name     string
+	sink     sink
+	interval time.Duration
+	queue    chan sample
+	done     chan struct{}
+	// Where readings wait while the sink can't be reached, if anywhere
+	spool *spool
+}
+
+// The running sinks
+type sinks struct {
+	runners []*sinkRunner
+}
+
+// Open every enabled sink and start feeding it the poller's readings until
+// the context is cancelled
+func startSinks(ctx context.Context, p *poller) (*sinks, error) {
+	s := &sinks{}
+	for _, t := range sinkTypes {
+		if !t.enabled() {
+			continue
+		}
+		if p == nil {
+			s.close()
+			return nil, fmt.Errorf("the %s output needs the background poller, see --%s", t.name, pollInterval)
+		}
+		snk, err := t.open()
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("%s: %w", t.name, err)
+		}
+		if ps, ok := snk.(pollerSink); ok {
+			ps.setPoller(p)
+		}
+		r := &sinkRunner{
+			name:     t.name,
+			sink:     snk,
+			interval: conf.GetDuration(t.intervalKey),
+			queue:    make(chan sample, sinkQueueSize),
+			done:     make(chan struct{}),
+		}
+		sinkPushes.WithLabelValues(r.name, "success")
+		sinkPushes.WithLabelValues(r.name, "failure")
+		sinkDropped.WithLabelValues(r.name)
+		s.runners = append(s.runners, r)
+
+		if dir := conf.GetString(sinkSpoolDirectory); dir != "" {
+			if r.spool, err = openSpool(filepath.Join(dir, t.name), int64(conf.GetInt(sinkSpoolMaxSize))<<20); err != nil {
+				s.close()
+				return nil, fmt.Errorf("%s spool: %w", t.name, err)
+			}
+			sinkSpooled.WithLabelValues(r.name).Set(float64(r.spool.count))
+			if !r.spool.empty() {
+				lg.Infof("%d readings for %s are waiting in the spool", r.spool.count, r.name)
+			}
+		}
+	}
+	if len(s.runners) == 0 {
+		return s, nil
+	}
+
+	for _, r := range s.runners {
+		go r.run(ctx)
+		if r.interval > 0 {
+			lg.Infof("Sending readings to %s every %s", r.name, r.interval)
+		} else {
+			lg.Infof("Sending readings to %s", r.name)
+		}
+	}
+	p.onReading(s.send)
+	return s, nil
+}
+
+// Hand a reading to every sink without waiting for any of them
+func (s *sinks) send(r reading) {
+	if !r.ok() {
+		return
+	}
+	smp := sample{reading: r, Sensor: currentSensorJSON(), Labels: configuredLabels()}
+	for _, runner := range s.runners {
+		select {
+		case runner.queue <- smp:
+		default:
+			sinkDropped.WithLabelValues(runner.name).Inc()
+			lg.Warnf("Dropping a reading for %s, it's too far behind", runner.name)
+		}
+	}
+}
+
+// Wait for the sinks to send what they have left and close, after the
+// context has been cancelled
+func (s *sinks) wait() {
+	for _, r := range s.runners {
+		<-r.done
+	}
+}
+
+// Close sinks that never got started
+func (s *sinks) close() {
+	for _, r := range s.runners {
+		r.sink.close()
+	}
+}
+
+func (r *sinkRunner) run(ctx context.Context) {
+	defer close(r.done)
+	defer func() {
+		if err := r.sink.close(); err != nil {
+			lg.Warnf("Problem closing %s: %v", r.name, err)
+		}
+	}()
+
+	var tick <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var batch []sample
+	for {
+		select {
+		case smp := <-r.queue:
+			batch = append(batch, smp)
+			if tick == nil {
+				r.push(batch)
+				batch = batch[:0]
+			}
+		case <-tick:
+			r.push(batch)
+			batch = batch[:0]
+		case <-ctx.Done():
+			// One last try with whatever's left
+			for len(r.queue) > 0 {
+				batch = append(batch, <-r.queue)
+			}
+			if r.spool != nil && !r.spool.empty() {
+				// Catching up could take a while, it can wait for next time
+				if len(batch) > 0 {
+					r.spoolBatch(batch)
+				}
+				return
+			}
+			r.push(batch)
+			return
+		}
+	}
+}
+
+// Send a batch, spooling it if that doesn't work and there's a spool.
+// Readings only go straight out when nothing's waiting in the spool, so
+// they always arrive in order.
+func (r *sinkRunner) push(batch []sample) {
+	if r.spool == nil {
+		if len(batch) > 0 && r.send(batch) != nil {
+			sinkDropped.WithLabelValues(r.name).Add(float64(len(batch)))
+		}
+		return
+	}
+	defer func() {
+		sinkSpooled.WithLabelValues(r.name).Set(float64(r.spool.count))
+	}()
+
+	if r.spool.empty() {
+		if len(batch) == 0 || r.send(batch) == nil {
+			return
+		}
+		r.spoolBatch(batch)
+		return
+	}
+	if len(batch) > 0 {
+		r.spoolBatch(batch)
+	}
+	r.replay()
+}
+
+func (r *sinkRunner) spoolBatch(batch []sample) {
+	dropped, err := r.spool.append(batch)
+	if err != nil {
+		lg.Errorf("Problem spooling readings for %s: %v", r.name, err)
+		sinkDropped.WithLabelValues(r.name).Add(float64(len(batch)))
+	}
+	if dropped > 0 {
+		lg.Warnf("The spool for %s is full, dropped the oldest %d readings", r.name, dropped)
+		sinkDropped.WithLabelValues(r.name).Add(float64(dropped))
+	}
+}
+
+// Send spooled readings, oldest first, until they're all gone or the sink fails again
+func (r *sinkRunner) replay() {
+	sent := 0
+	for !r.spool.empty() {
+		samples, lines, used, err := r.spool.peek(spoolBatchSize)
+		if err != nil {
+			lg.Errorf("Problem reading the spool for %s: %v", r.name, err)
+			return
+		}
+		if lines == 0 {
+			break
+		}
+		if len(samples) > 0 && r.send(samples) != nil {
+			break
+		}
+		if err := r.spool.consume(lines, used); err != nil {
+			lg.Errorf("Problem updating the spool for %s: %v", r.name, err)
+			return
+		}
+		sent += len(samples)
+	}
+	if sent > 0 {
+		lg.Infof("Sent %d spooled readings to %s, %d still waiting", sent, r.name, r.spool.count)
+	}
+}
+
+// Try sending readings once
+func (r *sinkRunner) send(batch []sample) error {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.GetDuration(sinkTimeout))
+	defer cancel()
+	ctx, span := startSpan(ctx, "sink.push", spanKindClient, spanAttr{"sink", r.name}, spanAttr{"samples", len(batch)})
+	defer span.finish()
+
+	err := r.sink.push(ctx, batch)
+	span.recordError(err)
+	if err != nil {
+		sinkPushes.WithLabelValues(r.name, "failure").Inc()
+		lg.Warnf("Problem sending %d readings to %s: %v", len(batch), r.name, err)
+		return err
+	}
+	sinkPushes.WithLabelValues(r.name, "success").Inc()
+	sinkLastSuccess.WithLabelValues(r.name).SetToCurrentTime()
+	return nil
+}
+
+// TLS settings for connecting to a sink, with the CA to check its certificate
+// against and a client certificate, if there are any
+func clientTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Functions for the templates sinks' payloads and topics can be made from
+var sinkTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"round": func(v float64, places int) float64 {
+		p := math.Pow(10, float64(places))
+		return math.Round(v*p) / p
+	},
+}
+
+// Parse a payload or topic template from a setting
+func parseSinkTemplate(key, text string) (*template.Template, error) {
+	return template.New(key).Funcs(sinkTemplateFuncs).Parse(text)
+}
+
+func executeSinkTemplate(t *template.Template, data any) ([]byte, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// The sinks that are turned on, by name
+func enabledSinks() []string {
+	var names []string
+	for _, t := range sinkTypes {
+		if t.enabled() {
+			names = append(names, t.name)
+		}
+	}
+	return names
+}
+
+func checkSinkSettings() []configProblem {
+	var problems []configProblem
+	if conf.GetDuration(sinkTimeout) <= 0 {
+		problems = append(problems, configError(sinkTimeout, "must be more than 0"))
+	}
+	if conf.GetString(sinkSpoolDirectory) != "" && conf.GetInt(sinkSpoolMaxSize) < 1 {
+		problems = append(problems, configError(sinkSpoolMaxSize, "must be at least 1 (megabyte)"))
+	}
+	for _, t := range sinkTypes {
+		if conf.GetDuration(t.intervalKey) < 0 {
+			problems = append(problems, configError(t.intervalKey, "can't be negative"))
+		}
+	}
+	if names := enabledSinks(); len(names) > 0 && configuredPollInterval() <= 0 {
+		problems = append(problems, configError(pollInterval, "has to be set for the background poller to feed %s", strings.Join(names, ", ")))
+	}
+	return problems
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A read-only SNMPv1/v2c agent for the readings, for building management
+// and network monitoring systems that don't speak anything else. It answers
+// for the system group and the scalars in mibs/BME280-EXPORTER-MIB.txt, with
+// the BER encoded by hand like the gRPC messages. See RFC 3416.
+
+func init() {
+	configChecks = append(configChecks, checkSNMPSettings)
+}
+
+// ASN.1 and SNMP tags
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+	snmpGauge32    = 0x42
+	snmpTimeTicks  = 0x43
+
+	snmpGetRequest     = 0xa0
+	snmpGetNextRequest = 0xa1
+	snmpResponse       = 0xa2
+	snmpSetRequest     = 0xa3
+	snmpGetBulkRequest = 0xa5
+
+	snmpNoSuchObject   = 0x80
+	snmpNoSuchInstance = 0x81
+	snmpEndOfMibView   = 0x82
+)
+
+// Error statuses
+const (
+	snmpNoError     = 0
+	snmpNoSuchName  = 2
+	snmpNotWritable = 17
+)
+
+const (
+	snmpV1  = 0
+	snmpV2c = 1
+)
+
+// GetBulk asks for as many as it likes, but there's not much to give
+const snmpMaxRepetitions = 64
+
+type snmpOID []uint32
+
+func parseSNMPOID(s string) (snmpOID, error) {
+	var oid snmpOID
+	for _, part := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid = append(oid, uint32(n))
+	}
+	if len(oid) < 2 || oid[0] > 2 || (oid[0] < 2 && oid[1] >= 40) {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return oid, nil
+}
+
+func (o snmpOID) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (o snmpOID) compare(other snmpOID) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] != other[i] {
+			if o[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(o) - len(other)
+}
+
+func (o snmpOID) append(sub ...uint32) snmpOID {
+	return append(append(snmpOID{}, o...), sub...)
+}
+
+// An object the agent answers for, and how to get its value from a
+// reading. A nil value means there isn't one right now.
+type snmpObject struct {
+	oid   snmpOID
+	value func(r reading) []byte
+}
+
+type snmpAgent struct {
+	community string
+	objects   []snmpObject
+	poller    *poller
+	allowlist *allowlistHandler
+	started   time.Time
+}
+
+func newSNMPAgent(p *poller) (*snmpAgent, error) {
+	base, err := parseSNMPOID(conf.GetString(snmpBaseOID))
+	if err != nil {
+		return nil, err
+	}
+	a := &snmpAgent{community: conf.GetString(snmpCommunity), poller: p, started: time.Now()}
+	if cidrs := getStringList(allowedCIDRs); len(cidrs) > 0 {
+		if a.allowlist, err = newAllowlistHandler(cidrs, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	system := snmpOID{1, 3, 6, 1, 2, 1, 1}
+	text := func(s string) func(reading) []byte {
+		return func(reading) []byte { return berTLV(berOctetString, []byte(s)) }
+	}
+	// Hundredths, since SNMP doesn't do floats
+	scaled := func(tag byte, scale float64, get func(reading) float64) func(reading) []byte {
+		return func(r reading) []byte {
+			v := get(r)
+			if math.IsNaN(v) {
+				return nil
+			}
+			return berTLV(tag, berInt(int64(math.Round(v*scale))))
+		}
+	}
+	a.objects = []snmpObject{
+		{system.append(1, 0), text(fmt.Sprintf("bme280-exporter %s reading a %s", version, conf.GetString(modelName)))},
+		{system.append(2, 0), func(reading) []byte { return berTLV(berOID, berOIDBytes(base)) }},
+		{system.append(3, 0), func(reading) []byte {
+			return berTLV(snmpTimeTicks, berInt(time.Since(a.started).Milliseconds()/10%(1<<32)))
+		}},
+		{system.append(4, 0), text(conf.GetString(snmpContact))},
+		{system.append(5, 0), text(hostname)},
+		{system.append(6, 0), text(conf.GetString(snmpLocation))},
+		{base.append(1, 1, 0), scaled(berInteger, 100, func(r reading) float64 { return r.Temperature })},
+		{base.append(1, 2, 0), scaled(snmpGauge32, 1, func(r reading) float64 { return r.Pressure })},
+		{base.append(1, 3, 0), scaled(snmpGauge32, 100, func(r reading) float64 { return r.Humidity })},
+		{base.append(1, 4, 0), text(conf.GetString(modelName))},
+		{base.append(1, 5, 0), func(r reading) []byte {
+			if r.Time.IsZero() {
+				return nil
+			}
+			return berTLV(snmpGauge32, berInt(int64(max(time.Since(r.Time), 0)/time.Second)))
+		}},
+		// TruthValue, true(1) or false(2)
+		{base.append(1, 6, 0), func(r reading) []byte {
+			if r.ok() {
+				return berTLV(berInteger, berInt(1))
+			}
+			return berTLV(berInteger, berInt(2))
+		}},
+	}
+	sort.Slice(a.objects, func(i, j int) bool { return a.objects[i].oid.compare(a.objects[j].oid) < 0 })
+	return a, nil
+}
+
+// Serve SNMP until the context is cancelled
+func serveSNMP(ctx context.Context, addr string, p *poller) error {
+	a, err := newSNMPAgent(p)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	lg.Infof("Serving SNMP on %s", conn.LocalAddr())
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if a.allowlist != nil && !a.allowlist.allowed(from.String()) {
+			continue
+		}
+		resp, err := a.handle(ctx, buf[:n])
+		if err != nil {
+			lg.Debugf("Ignoring SNMP request from %s: %v", from, err)
+			continue
+		}
+		if _, err := conn.WriteTo(resp, from); err != nil {
+			lg.Debugf("Problem answering SNMP request from %s: %v", from, err)
+		}
+	}
+}
+
+type snmpVarBind struct {
+	oid   snmpOID
+	value []byte
+}
+
+// Answer a request, or give an error for one that should be dropped
+func (a *snmpAgent) handle(ctx context.Context, msg []byte) ([]byte, error) {
+	tag, body, _, err := berRead(msg)
+	if err != nil || tag != berSequence {
+		return nil, errors.New("not an SNMP message")
+	}
+	var fields [][]byte
+	var pduTag byte
+	for i := 0; i < 3 && len(body) > 0; i++ {
+		var t byte
+		var v []byte
+		if t, v, body, err = berRead(body); err != nil {
+			return nil, err
+		}
+		fields = append(fields, v)
+		pduTag = t
+	}
+	if len(fields) != 3 {
+		return nil, errors.New("truncated message")
+	}
+	version, err := berParseInt(fields[0])
+	if err != nil || (version != snmpV1 && version != snmpV2c) {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	// Wrong communities are dropped without a word, like any agent does
+	if string(fields[1]) != a.community {
+		return nil, errors.New("wrong community")
+	}
+
+	// request-id, error-status/non-repeaters, error-index/max-repetitions, varbinds
+	pdu := fields[2]
+	var ints [3]int64
+	for i := range ints {
+		var v []byte
+		if _, v, pdu, err = berRead(pdu); err != nil {
+			return nil, err
+		}
+		if ints[i], err = berParseInt(v); err != nil {
+			return nil, err
+		}
+	}
+	_, list, _, err := berRead(pdu)
+	if err != nil {
+		return nil, err
+	}
+	var oids []snmpOID
+	for len(list) > 0 {
+		var vb, o []byte
+		if _, vb, list, err = berRead(list); err != nil {
+			return nil, err
+		}
+		if _, o, _, err = berRead(vb); err != nil {
+			return nil, err
+		}
+		oid, err := berParseOID(o)
+		if err != nil {
+			return nil, err
+		}
+		oids = append(oids, oid)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	r, err := currentReading(ctx, a.poller)
+	if err != nil {
+		r = reading{Temperature: math.NaN(), Pressure: math.NaN(), Humidity: math.NaN()}
+	}
+
+	status, index := int64(snmpNoError), int64(0)
+	var binds []snmpVarBind
+	switch pduTag {
+	case snmpGetRequest:
+		for _, oid := range oids {
+			binds = append(binds, a.get(oid, r))
+		}
+	case snmpGetNextRequest:
+		for _, oid := range oids {
+			binds = append(binds, a.next(oid, r))
+		}
+	case snmpGetBulkRequest:
+		if version == snmpV1 {
+			return nil, errors.New("GetBulk in SNMPv1")
+		}
+		nonRepeaters := min(max(ints[1], 0), int64(len(oids)))
+		for _, oid := range oids[:nonRepeaters] {
+			binds = append(binds, a.next(oid, r))
+		}
+		repeaters := oids[nonRepeaters:]
+		for n := int64(0); n < min(ints[2], snmpMaxRepetitions) && len(repeaters) > 0; n++ {
+			done := true
+			for i, oid := range repeaters {
+				vb := a.next(oid, r)
+				binds = append(binds, vb)
+				repeaters[i] = vb.oid
+				if vb.value[0] != snmpEndOfMibView {
+					done = false
+				}
+			}
+			if done {
+				break
+			}
+		}
+	case snmpSetRequest:
+		status, index = snmpNotWritable, 1
+		for _, oid := range oids {
+			binds = append(binds, snmpVarBind{oid, berTLV(berNull, nil)})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PDU type 0x%x", pduTag)
+	}
+
+	// SNMPv1 has errors instead of exceptions, and the request's varbinds go back with them
+	if version == snmpV1 {
+		if status == snmpNotWritable {
+			status = snmpNoSuchName
+		}
+		for i, vb := range binds {
+			if vb.value[0]&0xf0 == 0x80 {
+				status, index = snmpNoSuchName, int64(i+1)
+				break
+			}
+		}
+		if status != snmpNoError {
+			binds = binds[:0]
+			for _, oid := range oids {
+				binds = append(binds, snmpVarBind{oid, berTLV(berNull, nil)})
+			}
+		}
+	}
+
+	var vbs []byte
+	for _, vb := range binds {
+		vbs = append(vbs, berTLV(berSequence, append(berTLV(berOID, berOIDBytes(vb.oid)), vb.value...))...)
+	}
+	resp := berTLV(berInteger, berInt(ints[0]))
+	resp = append(resp, berTLV(berInteger, berInt(status))...)
+	resp = append(resp, berTLV(berInteger, berInt(index))...)
+	resp = append(resp, berTLV(berSequence, vbs)...)
+
+	out := berTLV(berInteger, berInt(version))
+	out = append(out, berTLV(berOctetString, fields[1])...)
+	out = append(out, berTLV(snmpResponse, resp)...)
+	return berTLV(berSequence, out), nil
+}
+
+func (a *snmpAgent) get(oid snmpOID, r reading) snmpVarBind {
+	i := sort.Search(len(a.objects), func(i int) bool { return a.objects[i].oid.compare(oid) >= 0 })
+	if i < len(a.objects) && a.objects[i].oid.compare(oid) == 0 {
+		if v := a.objects[i].value(r); v != nil {
+			return snmpVarBind{oid, v}
+		}
+		return snmpVarBind{oid, berTLV(snmpNoSuchInstance, nil)}
+	}
+	return snmpVarBind{oid, berTLV(snmpNoSuchObject, nil)}
+}
+
+// The first object after the OID that has a value
+func (a *snmpAgent) next(oid snmpOID, r reading) snmpVarBind {
+	i := sort.Search(len(a.objects), func(i int) bool { return a.objects[i].oid.compare(oid) > 0 })
+	for ; i < len(a.objects); i++ {
+		if v := a.objects[i].value(r); v != nil {
+			return snmpVarBind{a.objects[i].oid, v}
+		}
+	}
+	return snmpVarBind{oid, berTLV(snmpEndOfMibView, nil)}
+}
+
+// A tag, length and value
+func berTLV(tag byte, value []byte) []byte {
+	b := []byte{tag}
+	switch n := len(value); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, value...)
+}
+
+// Split off the first TLV, returning its tag and value and what's left
+func berRead(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("truncated BER")
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		octets := n & 0x7f
+		if octets == 0 || octets > 3 || len(b) < octets {
+			return 0, nil, nil, errors.New("bad BER length")
+		}
+		n = 0
+		for _, c := range b[:octets] {
+			n = n<<8 | int(c)
+		}
+		b = b[octets:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, errors.New("truncated BER")
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// The shortest two's complement encoding
+func berInt(v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if (v == 0 && b[0]&0x80 == 0) || (v == -1 && b[0]&0x80 != 0) {
+			return b
+		}
+	}
+}
+
+func berParseInt(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, errors.New("bad BER integer")
+	}
+	v := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v, nil
+}
+
+func berOIDBytes(oid snmpOID) []byte {
+	b := []byte{byte(oid[0]*40 + oid[1])}
+	for _, n := range oid[2:] {
+		var sub []byte
+		sub = append(sub, byte(n&0x7f))
+		for n >>= 7; n > 0; n >>= 7 {
+			sub = append([]byte{byte(n&0x7f) | 0x80}, sub...)
+		}
+		b = append(b, sub...)
+	}
+	return b
+}
+
+func berParseOID(b []byte) (snmpOID, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty OID")
+	}
+	oid := snmpOID{uint32(min(b[0]/40, 2)), uint32(b[0]) - 40*uint32(min(b[0]/40, 2))}
+	var n uint64
+	for i, c := range b[1:] {
+		n = n<<7 | uint64(c&0x7f)
+		if n > math.MaxUint32 {
+			return nil, errors.New("OID arc too large")
+		}
+		if c&0x80 == 0 {
+			oid = append(oid, uint32(n))
+			n = 0
+		} else if i == len(b)-2 {
+			return nil, errors.New("truncated OID")
+		}
+	}
+	if len(oid) > 128 {
+		return nil, errors.New("OID too long")
+	}
+	return oid, nil
+}
+
+func checkSNMPSettings() []configProblem {
+	addr := conf.GetString(snmpListenAddress)
+	if addr == "" {
+		return nil
+	}
+	var problems []configProblem
+	if _, port, err := net.SplitHostPort(addr); err != nil {
+		problems = append(problems, configError(snmpListenAddress, "%v, use e.g. :161", err))
+	} else if n, _ := strconv.Atoi(port); n < 1024 && conf.GetString(runAsUser) != "" {
+		problems = append(problems, configWarning(snmpListenAddress, "ports below 1024 need root, which is given up before listening"))
+	}
+	if _, err := parseSNMPOID(conf.GetString(snmpBaseOID)); err != nil {
+		problems = append(problems, configError(snmpBaseOID, "%v", err))
+	}
+	switch c := conf.GetString(snmpCommunity); c {
+	case "":
+		problems = append(problems, configError(snmpCommunity, "can't be empty"))
+	case "public":
+		problems = append(problems, configWarning(snmpCommunity, "anyone who can reach the agent can read it with the default community"))
+	}
+	return problems
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestBERRead(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		tag   byte
+		value string
+		rest  string
+		err   bool
+	}{
+		{name: "short length", in: "02 01 05 ff", tag: berInteger, value: "05", rest: "ff"},
+		{name: "empty value", in: "05 00", tag: berNull},
+		{name: "one length octet", in: "04 81 01 61", tag: berOctetString, value: "61"},
+		{name: "two length octets", in: "30 82 00 02 05 00", tag: berSequence, value: "05 00"},
+		{name: "truncated", in: "02", err: true},
+		{name: "value cut short", in: "04 03 61 62", err: true},
+		{name: "indefinite length", in: "30 80 05 00 00 00", err: true},
+		{name: "too many length octets", in: "04 84 00 00 00 01 61", err: true},
+		{name: "length octets missing", in: "04 82 00", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tag, value, rest, err := berRead(unhex(t, tt.in))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("berRead(%s) = %x, %x, want an error", tt.in, value, rest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tag != tt.tag || !bytes.Equal(value, unhex(t, tt.value)) || !bytes.Equal(rest, unhex(t, tt.rest)) {
+				t.Errorf("berRead(%s) = %02x, % x, % x, want %02x, %s, %s", tt.in, tag, value, rest, tt.tag, tt.value, tt.rest)
+			}
+		})
+	}
+}
+
+func TestBERTLV(t *testing.T) {
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "04 00"},
+		{0x7f, "04 7f"},
+		{0x80, "04 81 80"},
+		{0xff, "04 81 ff"},
+		{0x100, "04 82 01 00"},
+	}
+	for _, tt := range tests {
+		got := berTLV(berOctetString, make([]byte, tt.n))
+		if want := unhex(t, tt.want); !bytes.Equal(got[:len(want)], want) || len(got) != len(want)+tt.n {
+			t.Errorf("berTLV(%d bytes) starts % x, want %s", tt.n, got[:min(len(got), 4)], tt.want)
+		}
+	}
+}
+
+func TestBERInt(t *testing.T) {
+	tests := []struct {
+		v    int64
+		want string
+	}{
+		{0, "00"},
+		{1, "01"},
+		{127, "7f"},
+		{128, "00 80"},
+		{256, "01 00"},
+		{2137, "08 59"},
+		{101325, "01 8b cd"},
+		{-1, "ff"},
+		{-128, "80"},
+		{-129, "ff 7f"},
+		{math.MaxInt64, "7f ff ff ff ff ff ff ff"},
+		{math.MinInt64, "80 00 00 00 00 00 00 00"},
+	}
+	for _, tt := range tests {
+		want := unhex(t, tt.want)
+		if got := berInt(tt.v); !bytes.Equal(got, want) {
+			t.Errorf("berInt(%d) = % x, want %s", tt.v, got, tt.want)
+		}
+		if got, err := berParseInt(want); err != nil || got != tt.v {
+			t.Errorf("berParseInt(%s) = %d, %v, want %d", tt.want, got, err, tt.v)
+		}
+	}
+	for _, in := range []string{"", "01 02 03 04 05 06 07 08 09"} {
+		if _, err := berParseInt(unhex(t, in)); err == nil {
+			t.Errorf("berParseInt(%s) didn't fail", in)
+		}
+	}
+}
+
+func TestBEROID(t *testing.T) {
+	tests := []struct {
+		oid  string
+		want string
+	}{
+		{"1.3.6.1.2.1.1.1.0", "2b 06 01 02 01 01 01 00"},
+		{"1.3.6.1.4.1.311", "2b 06 01 04 01 82 37"},
+		{"1.3.6.1.4.1.8072.9999.9999.280", "2b 06 01 04 01 bf 08 ce 0f ce 0f 82 18"},
+		{"0.0", "00"},
+		{"2.5.4.3", "55 04 03"},
+		{"1.2.4294967295", "2a 8f ff ff ff 7f"},
+	}
+	for _, tt := range tests {
+		oid, err := parseSNMPOID(tt.oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := unhex(t, tt.want)
+		if got := berOIDBytes(oid); !bytes.Equal(got, want) {
+			t.Errorf("berOIDBytes(%s) = % x, want %s", tt.oid, got, tt.want)
+		}
+		if got, err := berParseOID(want); err != nil || got.String() != tt.oid {
+			t.Errorf("berParseOID(%s) = %s, %v, want %s", tt.want, got, err, tt.oid)
+		}
+	}
+
+	for _, in := range []string{"", "2b 86", "2b 90 80 80 80 80 00"} {
+		if oid, err := berParseOID(unhex(t, in)); err == nil {
+			t.Errorf("berParseOID(%s) = %s, want an error", in, oid)
+		}
+	}
+}
+
+func TestParseSNMPOID(t *testing.T) {
+	for _, s := range []string{"", "1", "3.1", "1.40", "1.3.x", "1..3", "1.3.4294967296"} {
+		if oid, err := parseSNMPOID(s); err == nil {
+			t.Errorf("parseSNMPOID(%q) = %s, want an error", s, oid)
+		}
+	}
+	if oid, err := parseSNMPOID(".1.3.6"); err != nil || oid.String() != "1.3.6" {
+		t.Errorf("parseSNMPOID(.1.3.6) = %s, %v", oid, err)
+	}
+}
+
+// Requests as net-snmp's snmpget and friends send them, for the temperature,
+// 1.3.6.1.4.1.8072.9999.9999.280.1.1.0, with request ID 0x12345678
+func TestSNMPHandle(t *testing.T) {
+	const temperatureOID = "06 10 2b 06 01 04 01 bf 08 ce 0f ce 0f 82 18 01 01 00"
+	const pressureOID = "06 10 2b 06 01 04 01 bf 08 ce 0f ce 0f 82 18 01 02 00"
+	const unknownOID = "06 10 2b 06 01 04 01 bf 08 ce 0f ce 0f 82 18 01 09 00"
+	tests := []struct {
+		name string
+		req  string
+		want string
+	}{
+		{
+			name: "v2c get",
+			req:  "30 31 02 01 01 04 06 70 75 62 6c 69 63 a0 24 02 04 12 34 56 78 02 01 00 02 01 00 30 16 30 14" + temperatureOID + "05 00",
+			want: "30 33 02 01 01 04 06 70 75 62 6c 69 63 a2 26 02 04 12 34 56 78 02 01 00 02 01 00 30 18 30 16" + temperatureOID + "02 02 08 59",
+		},
+		{
+			name: "v2c get-next",
+			req:  "30 31 02 01 01 04 06 70 75 62 6c 69 63 a1 24 02 04 12 34 56 78 02 01 00 02 01 00 30 16 30 14" + temperatureOID + "05 00",
+			want: "30 34 02 01 01 04 06 70 75 62 6c 69 63 a2 27 02 04 12 34 56 78 02 01 00 02 01 00 30 19 30 17" + pressureOID + "42 03 01 8b cd",
+		},
+		{
+			name: "v2c get of something that isn't there",
+			req:  "30 31 02 01 01 04 06 70 75 62 6c 69 63 a0 24 02 04 12 34 56 78 02 01 00 02 01 00 30 16 30 14" + unknownOID + "05 00",
+			want: "30 31 02 01 01 04 06 70 75 62 6c 69 63 a2 24 02 04 12 34 56 78 02 01 00 02 01 00 30 16 30 14" + unknownOID + "80 00",
+		},
+		{
+			name: "v1 get of something that isn't there",
+			req:  "30 31 02 01 00 04 06 70 75 62 6c 69 63 a0 24 02 04 12 34 56 78 02 01 00 02 01 00 30 16 30 14" + unknownOID + "05 00",
+			want: "30 31 02 01 00 04 06 70 75 62 6c 69 63 a2 24 02 04 12 34 56 78 02 01 02 02 01 01 30 16 30 14" + unknownOID + "05 00",
+		},
+		{
+			name: "v2c get-bulk",
+			req:  "30 31 02 01 01 04 06 70 75 62 6c 69 63 a5 24 02 04 12 34 56 78 02 01 00 02 01 01 30 16 30 14" + temperatureOID + "05 00",
+			want: "30 34 02 01 01 04 06 70 75 62 6c 69 63 a2 27 02 04 12 34 56 78 02 01 00 02 01 00 30 19 30 17" + pressureOID + "42 03 01 8b cd",
+		},
+		{
+			name: "v2c set",
+			req:  "30 33 02 01 01 04 06 70 75 62 6c 69 63 a3 26 02 04 12 34 56 78 02 01 00 02 01 00 30 18 30 16" + temperatureOID + "02 02 00 00",
+			want: "30 31 02 01 01 04 06 70 75 62 6c 69 63 a2 24 02 04 12 34 56 78 02 01 11 02 01 01 30 16 30 14" + temperatureOID + "05 00",
+		},
+		{
+			name: "wrong community",
+			req:  "30 31 02 01 01 04 06 70 72 69 76 61 74 65 a0 24 02 04 12 34 56 78 02 01 00 02 01 00 30 16 30 14" + temperatureOID + "05 00",
+		},
+		{
+			name: "v1 get-bulk",
+			req:  "30 31 02 01 00 04 06 70 75 62 6c 69 63 a5 24 02 04 12 34 56 78 02 01 00 02 01 01 30 16 30 14" + temperatureOID + "05 00",
+		},
+		{
+			name: "v3",
+			req:  "30 31 02 01 03 04 06 70 75 62 6c 69 63 a0 24 02 04 12 34 56 78 02 01 00 02 01 00 30 16 30 14" + temperatureOID + "05 00",
+		},
+		{
+			name: "truncated",
+			req:  "30 31 02 01 01 04 06 70 75 62 6c 69 63 a0 24 02 04 12 34",
+		},
+	}
+	a, err := newSNMPAgent(testPoller(reading{Temperature: 21.37, Pressure: 101325, Humidity: 45.2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.handle(context.Background(), unhex(t, tt.req))
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("handle() = % x, want it dropped", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := unhex(t, tt.want); !bytes.Equal(got, want) {
+				t.Errorf("handle() =\n% x\nwant\n% x", got, want)
+			}
+		})
+	}
+}
+
+// Walking from the start visits everything in order, then ends
+func TestSNMPWalk(t *testing.T) {
+	a, err := newSNMPAgent(testPoller(reading{Temperature: 21.37, Pressure: 101325, Humidity: 45.2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := a.poller.Latest()
+	var oids []snmpOID
+	for vb := a.next(snmpOID{1, 3}, r); vb.value[0] != snmpEndOfMibView; vb = a.next(vb.oid, r) {
+		oids = append(oids, vb.oid)
+	}
+	if len(oids) != len(a.objects) {
+		t.Errorf("walked %d objects, want %d", len(oids), len(a.objects))
+	}
+	if !slices.IsSortedFunc(oids, snmpOID.compare) {
+		t.Errorf("walked out of order: %v", oids)
+	}
+}
+
+func FuzzBERRead(f *testing.F) {
+	for _, s := range []string{"02 01 05", "04 81 01 61", "30 82 00 02 05 00", "30 80", "04 84 00 00 00 01"} {
+		f.Add(unhex(f, s))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		tag, value, rest, err := berRead(b)
+		if err != nil {
+			return
+		}
+		if len(value)+len(rest) > len(b) {
+			t.Fatalf("berRead(% x) gave back more than it was given", b)
+		}
+		// Reading it again as the agent would write it gives the same value
+		tag2, value2, rest2, err := berRead(berTLV(tag, value))
+		if err != nil || tag2 != tag || !bytes.Equal(value2, value) || len(rest2) != 0 {
+			t.Fatalf("berTLV(%02x, % x) doesn't read back: %v", tag, value, err)
+		}
+	})
+}
+
+func FuzzBERParseOID(f *testing.F) {
+	for _, s := range []string{"2b 06 01 02 01 01 01 00", "2b 06 01 04 01 82 37", "2b 86", "2a 8f ff ff ff 7f", "ff"} {
+		f.Add(unhex(f, s))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		oid, err := berParseOID(b)
+		if err != nil {
+			return
+		}
+		if len(oid) < 2 {
+			t.Fatalf("berParseOID(% x) = %s, too short", b, oid)
+		}
+		again, err := berParseOID(berOIDBytes(oid))
+		if err != nil || again.compare(oid) != 0 {
+			t.Fatalf("berParseOID(berOIDBytes(%s)) = %s, %v", oid, again, err)
+		}
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B, for SCADA systems like Ignition, where the exporter is an edge
+// node. It announces its metrics with an NBIRTH each time it connects, sends
+// readings as NDATA using the metrics' aliases, and has an NDEATH as its will.
+// The payloads are org.eclipse.tahu.protobuf.Payload, encoded by hand. See
+// https://sparkplug.eclipse.org/specification/
+
+const sparkplugNamespace = "spBv1.0"
+
+// Sparkplug data types
+const (
+	sparkplugInt64   = 4
+	sparkplugDouble  = 10
+	sparkplugBoolean = 11
+	sparkplugString  = 12
+)
+
+const sparkplugRebirth = "Node Control/Rebirth"
+
+// The node's metrics for readings, with the aliases NDATA uses for them
+var sparkplugMetrics = []struct {
+	metric, name, unit string
+	alias              uint64
+}{
+	{temperatureMetric, "Temperature", "°C", 1},
+	{pressureMetric, "Pressure", "Pa", 2},
+	{humidityMetric, "Humidity", "%", 3},
+}
+
+type sparkplugNode struct {
+	group, node string
+
+	mu sync.Mutex
+	// Which connection this is, so the host can tell a stale NDEATH from the
+	// current one. It wraps at 256 too.
+	bdSeq uint64
+	// The sequence number of the last message, which wraps at 256
+	seq byte
+}
+
+func (n *sparkplugNode) topic(typ string) string {
+	return sparkplugNamespace + "/" + n.group + "/" + typ + "/" + n.node
+}
+
+// The will for a new connection, which is its NDEATH
+func (n *sparkplugNode) will() *mqttMessage {
+	n.mu.Lock()
+	n.bdSeq = (n.bdSeq + 1) % 256
+	n.mu.Unlock()
+	return n.death()
+}
+
+// The NDEATH for the current connection
+func (n *sparkplugNode) death() *mqttMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	b := appendSparkplugTimestamp(nil, time.Now())
+	b = appendSparkplugMetric(b, sparkplugMetric{name: "bdSeq", datatype: sparkplugInt64, long: n.bdSeq})
+	return &mqttMessage{topic: n.topic("NDEATH"), payload: b, qos: 1}
+}
+
+// The NBIRTH, which starts the sequence again
+func (n *sparkplugNode) birth(sensor sensorJSON) []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq = 0
+	b := appendSparkplugTimestamp(nil, time.Now())
+	b = appendSparkplugMetric(b, sparkplugMetric{name: "bdSeq", datatype: sparkplugInt64, long: n.bdSeq})
+	b = appendSparkplugMetric(b, sparkplugMetric{name: sparkplugRebirth, datatype: sparkplugBoolean})
+	for _, m := range sparkplugMetrics {
+		// Only the BME280 measures humidity
+		if m.metric == humidityMetric && !strings.EqualFold(sensor.Model, "BME280") {
+			continue
+		}
+		// The value comes with the first NDATA
+		b = appendSparkplugMetric(b, sparkplugMetric{name: m.name, alias: m.alias, datatype: sparkplugDouble, null: true, unit: m.unit})
+	}
+	for _, p := range [][2]string{{"Model", sensor.Model}, {"Address", sensor.Address}, {"Exporter Version", version}} {
+		b = appendSparkplugMetric(b, sparkplugMetric{name: "Properties/" + p[0], datatype: sparkplugString, str: p[1]})
+	}
+	return protowire.AppendVarint(protowire.AppendTag(b, 3, protowire.VarintType), 0)
+}
+
+// An NDATA with a reading's values
+func (n *sparkplugNode) data(smp sample) []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+	b := appendSparkplugTimestamp(nil, smp.Time)
+	for _, v := range smp.values() {
+		for _, m := range sparkplugMetrics {
+			if m.metric == v.name {
+				b = appendSparkplugMetric(b, sparkplugMetric{alias: m.alias, timestamp: smp.Time, datatype: sparkplugDouble, double: v.value})
+			}
+		}
+	}
+	return protowire.AppendVarint(protowire.AppendTag(b, 3, protowire.VarintType), uint64(n.seq))
+}
+
+type sparkplugMetric struct {
+	name      string
+	alias     uint64
+	timestamp time.Time
+	datatype  uint64
+	null      bool
+	unit      string
+
+	long   uint64
+	double float64
+	str    string
+}
+
+func appendSparkplugTimestamp(b []byte, t time.Time) []byte {
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(t.UnixMilli()))
+}
+
+// A Metric in a Payload
+func appendSparkplugMetric(b []byte, m sparkplugMetric) []byte {
+	var mb []byte
+	if m.name != "" {
+		mb = protowire.AppendTag(mb, 1, protowire.BytesType)
+		mb = protowire.AppendString(mb, m.name)
+	}
+	if m.alias != 0 {
+		mb = protowire.AppendTag(mb, 2, protowire.VarintType)
+		mb = protowire.AppendVarint(mb, m.alias)
+	}
+	if !m.timestamp.IsZero() {
+		mb = protowire.AppendTag(mb, 3, protowire.VarintType)
+		mb = protowire.AppendVarint(mb, uint64(m.timestamp.UnixMilli()))
+	}
+	mb = protowire.AppendTag(mb, 4, protowire.VarintType)
+	mb = protowire.AppendVarint(mb, m.datatype)
+	if m.unit != "" {
+		// A PropertySet with the engineering unit, which is what Ignition calls it
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.VarintType)
+		value = protowire.AppendVarint(value, sparkplugString)
+		value = protowire.AppendTag(value, 8, protowire.BytesType)
+		value = protowire.AppendString(value, m.unit)
+		var props []byte
+		props = protowire.AppendTag(props, 1, protowire.BytesType)
+		props = protowire.AppendString(props, "engUnit")
+		props = protowire.AppendTag(props, 2, protowire.BytesType)
+		props = protowire.AppendBytes(props, value)
+		mb = protowire.AppendTag(mb, 9, protowire.BytesType)
+		mb = protowire.AppendBytes(mb, props)
+	}
+	switch {
+	case m.null:
+		mb = protowire.AppendTag(mb, 7, protowire.VarintType)
+		mb = protowire.AppendVarint(mb, 1)
+	case m.datatype == sparkplugInt64:
+		mb = protowire.AppendTag(mb, 11, protowire.VarintType)
+		mb = protowire.AppendVarint(mb, m.long)
+	case m.datatype == sparkplugDouble:
+		mb = protowire.AppendTag(mb, 13, protowire.Fixed64Type)
+		mb = protowire.AppendFixed64(mb, math.Float64bits(m.double))
+	case m.datatype == sparkplugBoolean:
+		mb = protowire.AppendTag(mb, 14, protowire.VarintType)
+		mb = protowire.AppendVarint(mb, protowire.EncodeBool(m.long != 0))
+	case m.datatype == sparkplugString:
+		mb = protowire.AppendTag(mb, 15, protowire.BytesType)
+		mb = protowire.AppendString(mb, m.str)
+	}
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, mb)
+}
+
+// Publish the NBIRTH again, when the host asks for it
+func (s *mqttSink) rebirth() {
+	ctx, cancel := context.WithTimeout(s.ctx, conf.GetDuration(sinkTimeout))
+	defer cancel()
+	c, err := s.current(ctx)
+	if err == nil {
+		err = c.publish(ctx, s.sparkplug.topic("NBIRTH"), s.sparkplug.birth(currentSensorJSON()), 0, false)
+	}
+	if err != nil {
+		lg.Warnf("Problem publishing the Sparkplug NBIRTH the host asked for: %v", err)
+	}
+}
+
+// Whether an NCMD payload asks for a rebirth, which is the only command an
+// edge node has to support
+func sparkplugWantsRebirth(b []byte) bool {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return false
+		}
+		b = b[n:]
+		if num == 2 && typ == protowire.BytesType {
+			m, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return false
+			}
+			if sparkplugIsRebirth(m) {
+				return true
+			}
+			b = b[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return false
+		}
+		b = b[n:]
+	}
+	return false
+}
+
+func sparkplugIsRebirth(m []byte) bool {
+	var name string
+	var value bool
+	for len(m) > 0 {
+		num, typ, n := protowire.ConsumeTag(m)
+		if n < 0 {
+			return false
+		}
+		m = m[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			s, n := protowire.ConsumeString(m)
+			if n < 0 {
+				return false
+			}
+			name = s
+		case num == 14 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(m)
+			if n < 0 {
+				return false
+			}
+			value = protowire.DecodeBool(v)
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, m); n < 0 {
+			return false
+		}
+		m = m[n:]
+	}
+	return name == sparkplugRebirth && value
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Sends readings to a Splunk HTTP Event Collector as metric events, one for
+// each reading with all its values, for a metrics index. The configured
+// labels are dimensions. See
+// https://docs.splunk.com/Documentation/Splunk/latest/Metrics/GetMetricsInOther#Example_of_sending_metrics_using_HEC
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "splunk",
+		intervalKey: splunkInterval,
+		enabled:     func() bool { return conf.GetString(splunkURL) != "" },
+		open:        openSplunk,
+		addresses:   func() []string { return urlAddress(conf.GetString(splunkURL), "") },
+	})
+	configChecks = append(configChecks, checkSplunkSettings)
+}
+
+type splunkEvent struct {
+	Time       float64        `json:"time"`
+	Event      string         `json:"event"`
+	Host       string         `json:"host"`
+	Source     string         `json:"source,omitempty"`
+	Sourcetype string         `json:"sourcetype,omitempty"`
+	Index      string         `json:"index,omitempty"`
+	Fields     map[string]any `json:"fields"`
+}
+
+type splunkSink struct {
+	url        string
+	tokenFile  string
+	index      string
+	source     string
+	sourcetype string
+	prefix     string
+	client     *http.Client
+}
+
+func openSplunk() (sink, error) {
+	u, err := url.Parse(conf.GetString(splunkURL))
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/services/collector"
+	}
+	s := &splunkSink{
+		url:        u.String(),
+		tokenFile:  conf.GetString(splunkTokenFile),
+		index:      conf.GetString(splunkIndex),
+		source:     conf.GetString(splunkSource),
+		sourcetype: conf.GetString(splunkSourcetype),
+		prefix:     conf.GetString(splunkPrefix),
+		client:     &http.Client{},
+	}
+	if u.Scheme == "https" {
+		cfg, err := clientTLSConfig(conf.GetString(splunkCAFile), "", "", conf.GetBool(splunkInsecureSkipVerify))
+		if err != nil {
+			return nil, err
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = cfg
+		s.client.Transport = t
+	}
+	return s, nil
+}
+
+func (s *splunkSink) push(ctx context.Context, samples []sample) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, smp := range samples {
+		values := smp.values()
+		if len(values) == 0 {
+			continue
+		}
+		fields := make(map[string]any)
+		for k, v := range smp.tags() {
+			if k != "host" {
+				fields[k] = v
+			}
+		}
+		for _, v := range values {
+			name := v.name
+			if s.prefix != "" {
+				name = s.prefix + "." + name
+			}
+			fields["metric_name:"+name] = v.value
+		}
+		if err := enc.Encode(splunkEvent{
+			Time:       float64(smp.Time.UnixMilli()) / 1000,
+			Event:      "metric",
+			Host:       smp.Sensor.Host,
+			Source:     s.source,
+			Sourcetype: s.sourcetype,
+			Index:      s.index,
+			Fields:     fields,
+		}); err != nil {
+			return err
+		}
+	}
+	if body.Len() == 0 {
+		return nil
+	}
+
+	// Read each time so a rotated token gets picked up
+	token, err := os.ReadFile(s.tokenFile)
+	if err != nil {
+		return fmt.Errorf("HEC token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	req.Header.Set("Authorization", "Splunk "+strings.TrimSpace(string(token)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		var result struct {
+			Text string `json:"text"`
+		}
+		if json.Unmarshal(msg, &result) == nil && result.Text != "" {
+			return fmt.Errorf("%s: %s", resp.Status, result.Text)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *splunkSink) close() error {
+	return nil
+}
+
+func checkSplunkSettings() []configProblem {
+	v := conf.GetString(splunkURL)
+	if v == "" {
+		return nil
+	}
+	var problems []configProblem
+	if u, err := url.Parse(v); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		problems = append(problems, configError(splunkURL, "invalid URL %q, use e.g. https://splunk:8088", v))
+	}
+	if conf.GetString(splunkTokenFile) == "" {
+		problems = append(problems, configError(splunkTokenFile, "is needed to send to Splunk"))
+	}
+	for _, key := range []string{splunkTokenFile, splunkCAFile} {
+		if f := conf.GetString(key); f != "" {
+			if _, err := os.Stat(f); err != nil {
+				problems = append(problems, configError(key, "%v", err))
+			}
+		}
+	}
+	if conf.GetBool(splunkInsecureSkipVerify) {
+		problems = append(problems, configWarning(splunkInsecureSkipVerify, "Splunk's certificate isn't checked"))
+	}
+	return problems
+}
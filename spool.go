@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Readings that couldn't be sent yet, kept on disk so they survive the
+// destination being away for hours, or the exporter restarting. They're in
+// numbered segment files of JSON lines, oldest first, so the oldest can be
+// thrown away when the spool gets too big without rewriting anything.
+
+const spoolSegmentSize = 1 << 20
+
+type spoolRecord struct {
+	Time        time.Time         `json:"time"`
+	Temperature *float64          `json:"temperature,omitempty"`
+	Pressure    *float64          `json:"pressure,omitempty"`
+	Humidity    *float64          `json:"humidity,omitempty"`
+	Sensor      sensorJSON        `json:"sensor"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+type spool struct {
+	dir     string
+	maxSize int64
+
+	// Segment numbers, oldest first
+	segments []int
+	size     int64
+	// How far into the oldest segment has been sent already
+	offset int64
+	// How many readings are waiting
+	count int
+}
+
+func openSpool(dir string, maxSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, maxSize: maxSize}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".jsonl"))
+		if err != nil || !strings.HasSuffix(e.Name(), ".jsonl") {
+			continue
+		}
+		s.segments = append(s.segments, n)
+	}
+	sort.Ints(s.segments)
+
+	if b, err := os.ReadFile(filepath.Join(dir, "offset")); err == nil {
+		s.offset, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	}
+	for i, n := range s.segments {
+		content, err := os.ReadFile(s.segmentPath(n))
+		if err != nil {
+			return nil, err
+		}
+		s.size += int64(len(content))
+		if i == 0 {
+			if s.offset > int64(len(content)) {
+				s.offset = 0
+			}
+			content = content[s.offset:]
+		}
+		s.count += bytes.Count(content, []byte("\n"))
+	}
+	return s, nil
+}
+
+func (s *spool) segmentPath(n int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d.jsonl", n))
+}
+
+func (s *spool) empty() bool {
+	return s.count == 0
+}
+
+// Add readings to the end, throwing away the oldest if that makes the spool
+// too big. Returns how many were thrown away.
+func (s *spool) append(samples []sample) (int, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, smp := range samples {
+		rec := spoolRecord{
+			Time:        smp.Time,
+			Temperature: spoolValue(smp.Temperature),
+			Pressure:    spoolValue(smp.Pressure),
+			Humidity:    spoolValue(smp.Humidity),
+			Sensor:      smp.Sensor,
+			Labels:      smp.Labels,
+		}
+		if err := enc.Encode(rec); err != nil {
+			return 0, err
+		}
+	}
+
+	last := 0
+	if len(s.segments) > 0 {
+		last = s.segments[len(s.segments)-1]
+	}
+	if fi, err := os.Stat(s.segmentPath(last)); len(s.segments) == 0 || err != nil || fi.Size()+int64(buf.Len()) > spoolSegmentSize {
+		last++
+		s.segments = append(s.segments, last)
+	}
+	f, err := os.OpenFile(s.segmentPath(last), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	s.size += int64(buf.Len())
+	s.count += len(samples)
+
+	dropped := 0
+	for s.size > s.maxSize && len(s.segments) > 1 {
+		n, err := s.dropOldest()
+		if err != nil {
+			return dropped, err
+		}
+		dropped += n
+	}
+	return dropped, nil
+}
+
+func spoolValue(v float64) *float64 {
+	if math.IsNaN(v) {
+		return nil
+	}
+	return &v
+}
+
+// Throw away the oldest segment, returning how many unsent readings were in it
+func (s *spool) dropOldest() (int, error) {
+	content, err := os.ReadFile(s.segmentPath(s.segments[0]))
+	if err != nil {
+		return 0, err
+	}
+	n := bytes.Count(content[min(s.offset, int64(len(content))):], []byte("\n"))
+	s.count -= n
+	return n, s.removeOldest()
+}
+
+func (s *spool) removeOldest() error {
+	path := s.segmentPath(s.segments[0])
+	if fi, err := os.Stat(path); err == nil {
+		s.size -= fi.Size()
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.segments = s.segments[1:]
+	return s.setOffset(0)
+}
+
+// Up to max of the oldest readings, plus how many lines and bytes of the
+// spool they take up to pass to consume once they've been sent
+func (s *spool) peek(max int) ([]sample, int, int64, error) {
+	for len(s.segments) > 0 {
+		samples, lines, used, err := s.read(s.segmentPath(s.segments[0]), max)
+		if err != nil || lines > 0 {
+			return samples, lines, used, err
+		}
+		// Everything in the oldest segment has been sent. The newest is
+		// still being added to, so it stays.
+		if len(s.segments) == 1 {
+			break
+		}
+		if err := s.removeOldest(); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return nil, 0, 0, nil
+}
+
+func (s *spool) read(path string, max int) ([]sample, int, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(s.offset, 0); err != nil {
+		return nil, 0, 0, err
+	}
+
+	var samples []sample
+	var lines int
+	var used int64
+	br := bufio.NewReader(f)
+	for lines < max {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			// Anything left is a partial line from a crash
+			break
+		}
+		lines++
+		used += int64(len(line))
+		var rec spoolRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			lg.Warnf("Skipping a corrupt reading in %s: %v", path, err)
+			continue
+		}
+		smp := sample{
+			reading: reading{Time: rec.Time, Temperature: math.NaN(), Pressure: math.NaN(), Humidity: math.NaN()},
+			Sensor:  rec.Sensor,
+			Labels:  rec.Labels,
+		}
+		if rec.Temperature != nil {
+			smp.Temperature = *rec.Temperature
+		}
+		if rec.Pressure != nil {
+			smp.Pressure = *rec.Pressure
+		}
+		if rec.Humidity != nil {
+			smp.Humidity = *rec.Humidity
+		}
+		samples = append(samples, smp)
+	}
+	return samples, lines, used, nil
+}
+
+// Forget readings that have been sent, with what peek said they took up
+func (s *spool) consume(lines int, used int64) error {
+	s.count -= lines
+	return s.setOffset(s.offset + used)
+}
+
+func (s *spool) setOffset(offset int64) error {
+	s.offset = offset
+	tmp := filepath.Join(s.dir, "offset.tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, "offset"))
+}
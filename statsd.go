@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sends readings as StatsD gauges over UDP or a Unix socket, optionally with
+// DogStatsD tags, for a Datadog agent or Telegraf's statsd input. See
+// https://github.com/statsd/statsd/blob/master/docs/metric_types.md and
+// https://docs.datadoghq.com/developers/dogstatsd/datagram_shell/
+
+// The usual limits on how much to put in one datagram, to stay under the
+// MTU over UDP and within what the Datadog agent reads from its socket
+const (
+	statsdUDPPacketSize  = 1432
+	statsdUnixPacketSize = 8192
+)
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "statsd",
+		intervalKey: statsdInterval,
+		enabled:     func() bool { return conf.GetString(statsdAddress) != "" },
+		open:        openStatsd,
+	})
+	configChecks = append(configChecks, checkStatsdSettings)
+}
+
+type statsdSink struct {
+	prefix     string
+	tagged     bool
+	network    string
+	address    string
+	packetSize int
+	conn       net.Conn
+}
+
+func openStatsd() (sink, error) {
+	s := &statsdSink{
+		prefix:     conf.GetString(statsdPrefix),
+		tagged:     conf.GetBool(statsdDogStatsD),
+		network:    "udp",
+		address:    conf.GetString(statsdAddress),
+		packetSize: statsdUDPPacketSize,
+	}
+	if path, ok := strings.CutPrefix(s.address, "unix://"); ok {
+		s.network, s.address, s.packetSize = "unixgram", path, statsdUnixPacketSize
+	}
+	return s, nil
+}
+
+func (s *statsdSink) push(ctx context.Context, samples []sample) error {
+	// Connected when first needed, and again after an error, since the
+	// agent's socket may not be there yet or may be recreated when it restarts
+	if s.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, s.network, s.address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if err := s.write(ctx, samples); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *statsdSink) write(ctx context.Context, samples []sample) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	var packet []byte
+	for _, smp := range samples {
+		var tags string
+		if s.tagged {
+			tags = statsdTagString(smp.tags())
+		}
+		for _, v := range smp.values() {
+			name := v.name
+			if s.prefix != "" {
+				name = s.prefix + "." + name
+			}
+			line := fmt.Sprintf("%s:%s|g%s", name, strconv.FormatFloat(v.value, 'f', -1, 64), tags)
+			if v.value < 0 {
+				// Most StatsD servers take a sign to mean change the gauge by
+				// that much, so it has to be zeroed first. It's harmless to
+				// the ones that don't.
+				line = fmt.Sprintf("%s:0|g%s\n%s", name, tags, line)
+			}
+
+			if len(packet) > 0 && len(packet)+1+len(line) > s.packetSize {
+				if _, err := s.conn.Write(packet); err != nil {
+					return err
+				}
+				packet = packet[:0]
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		}
+	}
+	if len(packet) > 0 {
+		_, err := s.conn.Write(packet)
+		return err
+	}
+	return nil
+}
+
+// DogStatsD's tags, like |#host:pi,sensor_type:bme280
+func statsdTagString(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		if tags[k] == "" {
+			continue
+		}
+		if b.Len() == 0 {
+			b.WriteString("|#")
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(statsdTagReplacer.Replace(k) + ":" + statsdTagReplacer.Replace(tags[k]))
+	}
+	return b.String()
+}
+
+var statsdTagReplacer = strings.NewReplacer(",", "_", "|", "_", "\n", "_", "#", "_")
+
+func (s *statsdSink) close() error {
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+func checkStatsdSettings() []configProblem {
+	v := conf.GetString(statsdAddress)
+	if v == "" || strings.HasPrefix(v, "unix://") {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(v); err != nil {
+		return []configProblem{configError(statsdAddress, "%v, use e.g. localhost:8125 or unix:///var/run/datadog/dsd.socket", err)}
+	}
+	return nil
+}
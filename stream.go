@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How often to send a comment on an idle stream so proxies don't drop it
+const streamKeepalive = 15 * time.Second
+
+// Push each reading from the background poller as a server-sent event
+func streamHandler(p *poller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p == nil {
+			http.Error(w, "Streaming needs the background poller, see --poll.interval", http.StatusServiceUnavailable)
+			return
+		}
+
+		// The server's write timeout is meant for ordinary requests, not this
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			lg.Debugf("Couldn't clear the write deadline for the stream: %v", err)
+		}
+
+		readings := p.subscribe()
+		defer p.unsubscribe(readings)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		send := func(rd reading) error {
+			data, err := json.Marshal(newReadingJSON(rd))
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: reading\nid: %d\ndata: %s\n\n", rd.Time.UnixNano()/int64(time.Millisecond), data); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+
+		// Start off with what we already have
+		if latest := p.Latest(); latest.ok() {
+			if err := send(latest); err != nil {
+				return
+			}
+		} else if err := rc.Flush(); err != nil {
+			return
+		}
+
+		keepalive := time.NewTicker(streamKeepalive)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case rd, ok := <-readings:
+				if !ok {
+					return
+				}
+				if !rd.ok() {
+					continue
+				}
+				if err := send(rd); err != nil {
+					return
+				}
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Writes the latest reading to a .prom file for node_exporter's textfile
+// collector, so a host that already runs node_exporter doesn't need another
+// port scraped. See
+// https://github.com/prometheus/node_exporter#textfile-collector
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "textfile",
+		intervalKey: textfileInterval,
+		enabled:     func() bool { return conf.GetString(textfileDirectory) != "" },
+		open:        openTextfile,
+	})
+	configChecks = append(configChecks, checkTextfileSettings)
+}
+
+type textfileSink struct {
+	path   string
+	remove bool
+}
+
+func openTextfile() (sink, error) {
+	return &textfileSink{
+		path:   filepath.Join(conf.GetString(textfileDirectory), conf.GetString(textfileName)),
+		remove: conf.GetBool(textfileRemove),
+	}, nil
+}
+
+// The file only has the latest values, like a scrape would. node_exporter
+// won't take timestamps, it has the file's mtime instead.
+func (s *textfileSink) push(ctx context.Context, samples []sample) error {
+	latest := samples[len(samples)-1]
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(probeCollector{exporter: newExporter(latest.Sensor.Model, latest.Labels), r: latest.reading})
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(&body, mf); err != nil {
+			return err
+		}
+	}
+
+	// Write it next to the file and rename it over, so node_exporter never
+	// sees half of it
+	f, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(body.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// Remove the file on the way out if asked to, so the last values don't hang
+// around looking current
+func (s *textfileSink) close() error {
+	if !s.remove {
+		return nil
+	}
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func checkTextfileSettings() []configProblem {
+	dir := conf.GetString(textfileDirectory)
+	if dir == "" {
+		return nil
+	}
+	var problems []configProblem
+	if fi, err := os.Stat(dir); err != nil {
+		problems = append(problems, configError(textfileDirectory, "%v", err))
+	} else if !fi.IsDir() {
+		problems = append(problems, configError(textfileDirectory, "%s isn't a directory", dir))
+	}
+	// node_exporter only reads *.prom, and skips dotfiles like the temporary ones
+	name := conf.GetString(textfileName)
+	if !strings.HasSuffix(name, ".prom") || strings.HasPrefix(name, ".") || strings.ContainsRune(name, filepath.Separator) {
+		problems = append(problems, configError(textfileName, "invalid name %q, use a file name ending in .prom, e.g. bme280.prom", name))
+	}
+	return problems
+}
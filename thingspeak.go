@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uploads readings to a ThingSpeak channel with its bulk update API, each
+// value in the channel field it's mapped to. See
+// https://www.mathworks.com/help/thingspeak/bulkwritejsondata.html
+
+const (
+	// Free accounts can't update a channel more often than this
+	thingSpeakMinGap = 15 * time.Second
+	// The most entries a free account can send in one bulk update
+	thingSpeakBatchSize = 960
+)
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "thingspeak",
+		intervalKey: thingSpeakInterval,
+		enabled:     func() bool { return conf.GetString(thingSpeakChannel) != "" },
+		open:        openThingSpeak,
+		addresses:   func() []string { return urlAddress(conf.GetString(thingSpeakURL), "") },
+	})
+	configChecks = append(configChecks, checkThingSpeakSettings)
+}
+
+type thingSpeakSink struct {
+	url          string
+	writeKeyFile string
+	// The channel field number for each metric
+	fields map[string]string
+	client *http.Client
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func openThingSpeak() (sink, error) {
+	u := strings.TrimSuffix(conf.GetString(thingSpeakURL), "/") + "/channels/" + url.PathEscape(conf.GetString(thingSpeakChannel)) + "/bulk_update.json"
+	return &thingSpeakSink{
+		url:          u,
+		writeKeyFile: conf.GetString(thingSpeakWriteKeyFile),
+		fields:       conf.GetStringMapString(thingSpeakFields),
+		client:       &http.Client{},
+	}, nil
+}
+
+func (s *thingSpeakSink) push(ctx context.Context, samples []sample) error {
+	for start := 0; start < len(samples); start += thingSpeakBatchSize {
+		if err := s.update(ctx, samples[start:min(start+thingSpeakBatchSize, len(samples))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *thingSpeakSink) update(ctx context.Context, samples []sample) error {
+	var updates []map[string]any
+	for _, smp := range samples {
+		u := map[string]any{"created_at": smp.Time.UTC().Format(time.RFC3339)}
+		for _, v := range smp.values() {
+			if n := s.fields[v.name]; n != "" {
+				u["field"+n] = v.value
+			}
+		}
+		if len(u) > 1 {
+			updates = append(updates, u)
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	// Read each time so a new key gets picked up
+	key, err := os.ReadFile(s.writeKeyFile)
+	if err != nil {
+		return fmt.Errorf("write API key: %w", err)
+	}
+	body, err := json.Marshal(map[string]any{
+		"write_api_key": strings.TrimSpace(string(key)),
+		"updates":       updates,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Going over the rate limit just gets the update turned down, so wait
+	// for it, as long as there's time, or leave the readings for next time
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if wait := time.Until(s.last.Add(thingSpeakMinGap)); wait > 0 {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return fmt.Errorf("ThingSpeak takes an update every %v at most, waiting until next time", thingSpeakMinGap)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+
+	resp, err := s.client.Do(req)
+	s.last = time.Now()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(msg, &e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Error.Message)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *thingSpeakSink) close() error {
+	return nil
+}
+
+func checkThingSpeakSettings() []configProblem {
+	channel := conf.GetString(thingSpeakChannel)
+	if channel == "" {
+		return nil
+	}
+	var problems []configProblem
+	if _, err := strconv.ParseUint(channel, 10, 64); err != nil {
+		problems = append(problems, configError(thingSpeakChannel, "invalid channel ID %q, it's a number", channel))
+	}
+	if f := conf.GetString(thingSpeakWriteKeyFile); f == "" {
+		problems = append(problems, configError(thingSpeakWriteKeyFile, "is needed to upload to ThingSpeak"))
+	} else if _, err := os.Stat(f); err != nil {
+		problems = append(problems, configError(thingSpeakWriteKeyFile, "%v", err))
+	}
+	if u, err := url.Parse(conf.GetString(thingSpeakURL)); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		problems = append(problems, configError(thingSpeakURL, "invalid URL %q", conf.GetString(thingSpeakURL)))
+	}
+	fields := conf.GetStringMapString(thingSpeakFields)
+	if len(fields) == 0 {
+		problems = append(problems, configError(thingSpeakFields, "no metrics are mapped to fields"))
+	}
+	used := make(map[string]string)
+	for metric, n := range fields {
+		if metric != temperatureMetric && metric != pressureMetric && metric != humidityMetric {
+			problems = append(problems, configError(thingSpeakFields, "unknown metric %q, use temperature, pressure or humidity", metric))
+		}
+		if i, err := strconv.Atoi(n); err != nil || i < 1 || i > 8 {
+			problems = append(problems, configError(thingSpeakFields, "invalid field %q for %s, use 1 to 8", n, metric))
+		} else if other, ok := used[n]; ok {
+			problems = append(problems, configError(thingSpeakFields, "%s and %s are both in field %s", other, metric, n))
+		}
+		used[n] = metric
+	}
+	if i := conf.GetDuration(thingSpeakInterval); i < thingSpeakMinGap {
+		problems = append(problems, configWarning(thingSpeakInterval, "free ThingSpeak accounts take an update every %v at most, so readings will wait for the next push", thingSpeakMinGap))
+	}
+	return problems
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writes readings to Amazon Timestream for LiveAnalytics, each as one
+// multi-measure record with the sensor's labels as dimensions. Timestream
+// takes the same record again without storing it twice, so readings sent
+// again from the spool are fine. See
+// https://docs.aws.amazon.com/timestream/latest/developerguide/API_WriteRecords.html
+
+// The most records one WriteRecords can take
+const timestreamBatchSize = 100
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "timestream",
+		intervalKey: timestreamInterval,
+		enabled:     func() bool { return conf.GetString(timestreamDatabase) != "" },
+		open:        openTimestream,
+		addresses: func() []string {
+			if u := conf.GetString(timestreamEndpoint); u != "" {
+				return urlAddress(u, "")
+			}
+			return []string{"ingest.timestream." + awsRegionName() + ".amazonaws.com:443"}
+		},
+	})
+	configChecks = append(configChecks, checkTimestreamSettings)
+}
+
+type timestreamRecord struct {
+	Dimensions       []timestreamDimension `json:"Dimensions"`
+	MeasureName      string                `json:"MeasureName"`
+	MeasureValueType string                `json:"MeasureValueType"`
+	MeasureValues    []timestreamMeasure   `json:"MeasureValues"`
+	Time             string                `json:"Time"`
+	TimeUnit         string                `json:"TimeUnit"`
+}
+
+type timestreamDimension struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type timestreamMeasure struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+	Type  string `json:"Type"`
+}
+
+type timestreamSink struct {
+	database string
+	table    string
+	measure  string
+	region   string
+	creds    *awsCredentialSource
+	client   *http.Client
+
+	// The endpoint to write to, as given or found with DescribeEndpoints,
+	// and when a found one needs looking up again
+	mu       sync.Mutex
+	endpoint string
+	fixed    bool
+	expires  time.Time
+}
+
+func openTimestream() (sink, error) {
+	creds, err := newAWSCredentialSource()
+	if err != nil {
+		return nil, err
+	}
+	s := &timestreamSink{
+		database: conf.GetString(timestreamDatabase),
+		table:    conf.GetString(timestreamTable),
+		measure:  conf.GetString(timestreamMeasureName),
+		region:   awsRegionName(),
+		creds:    creds,
+		client:   &http.Client{},
+		endpoint: conf.GetString(timestreamEndpoint),
+	}
+	s.fixed = s.endpoint != ""
+	return s, nil
+}
+
+func (s *timestreamSink) push(ctx context.Context, samples []sample) error {
+	var records []timestreamRecord
+	for _, smp := range samples {
+		values := smp.values()
+		if len(values) == 0 {
+			continue
+		}
+		r := timestreamRecord{
+			MeasureName:      s.measure,
+			MeasureValueType: "MULTI",
+			Time:             strconv.FormatInt(smp.Time.UnixMilli(), 10),
+			TimeUnit:         "MILLISECONDS",
+		}
+		tags := smp.tags()
+		for k, v := range tags {
+			r.Dimensions = append(r.Dimensions, timestreamDimension{Name: k, Value: v})
+		}
+		sort.Slice(r.Dimensions, func(i, j int) bool { return r.Dimensions[i].Name < r.Dimensions[j].Name })
+		for _, v := range values {
+			r.MeasureValues = append(r.MeasureValues, timestreamMeasure{Name: v.name, Value: strconv.FormatFloat(v.value, 'g', -1, 64), Type: "DOUBLE"})
+		}
+		records = append(records, r)
+	}
+	for start := 0; start < len(records); start += timestreamBatchSize {
+		if err := s.write(ctx, records[start:min(start+timestreamBatchSize, len(records))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *timestreamSink) write(ctx context.Context, records []timestreamRecord) error {
+	endpoint, err := s.ingestEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]any{
+		"DatabaseName": s.database,
+		"TableName":    s.table,
+		"Records":      records,
+	})
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Type            string `json:"__type"`
+		Message         string `json:"message"`
+		RejectedRecords []struct {
+			RecordIndex int    `json:"RecordIndex"`
+			Reason      string `json:"Reason"`
+		} `json:"RejectedRecords"`
+	}
+	status, resp, err := s.call(ctx, endpoint, "WriteRecords", body)
+	if err != nil {
+		return err
+	}
+	if status/100 == 2 {
+		return nil
+	}
+	if json.Unmarshal(resp, &result) != nil {
+		return fmt.Errorf("%d: %s", status, strings.TrimSpace(string(resp)))
+	}
+	// Like com.amazonaws.timestream.v20181101#ValidationException
+	typ := result.Type[strings.LastIndex(result.Type, "#")+1:]
+	// The rest of the records are written, and the rejected ones, like those
+	// older than the memory store keeps, would be turned down the same way
+	// every time they were sent from the spool
+	if typ == "RejectedRecordsException" {
+		for _, r := range result.RejectedRecords {
+			lg.Warnf("Timestream turned down the reading from %s: %s", timestreamTime(records, r.RecordIndex), r.Reason)
+		}
+		return nil
+	}
+	// Found endpoints can move
+	if status == http.StatusNotFound || typ == "InvalidEndpointException" {
+		s.mu.Lock()
+		if !s.fixed {
+			s.endpoint = ""
+		}
+		s.mu.Unlock()
+	}
+	return fmt.Errorf("%s: %s", typ, result.Message)
+}
+
+func timestreamTime(records []timestreamRecord, i int) string {
+	if i < 0 || i >= len(records) {
+		return "?"
+	}
+	ms, _ := strconv.ParseInt(records[i].Time, 10, 64)
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339)
+}
+
+// Where to write to. Timestream says which cell to use for the account with
+// DescribeEndpoints, and for how long.
+func (s *timestreamSink) ingestEndpoint(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fixed || (s.endpoint != "" && time.Now().Before(s.expires)) {
+		return s.endpoint, nil
+	}
+	status, resp, err := s.call(ctx, "https://ingest.timestream."+s.region+".amazonaws.com", "DescribeEndpoints", []byte("{}"))
+	if err != nil {
+		return "", err
+	}
+	if status/100 != 2 {
+		return "", fmt.Errorf("DescribeEndpoints: %d: %s", status, strings.TrimSpace(string(resp)))
+	}
+	var result struct {
+		Endpoints []struct {
+			Address              string `json:"Address"`
+			CachePeriodInMinutes int    `json:"CachePeriodInMinutes"`
+		} `json:"Endpoints"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return "", err
+	}
+	if len(result.Endpoints) == 0 {
+		return "", errors.New("DescribeEndpoints gave no endpoints")
+	}
+	e := result.Endpoints[0]
+	s.endpoint = "https://" + e.Address
+	s.expires = time.Now().Add(time.Duration(e.CachePeriodInMinutes) * time.Minute)
+	return s.endpoint, nil
+}
+
+// Call an action of the Timestream write API, returning the status and body
+func (s *timestreamSink) call(ctx context.Context, endpoint, action string, body []byte) (int, []byte, error) {
+	creds, err := s.creds.get(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "Timestream_20181101."+action)
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	signAWS(req, body, creds, s.region, "timestream", time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return resp.StatusCode, b, err
+}
+
+func (s *timestreamSink) close() error {
+	return nil
+}
+
+func checkTimestreamSettings() []configProblem {
+	if conf.GetString(timestreamDatabase) == "" {
+		return nil
+	}
+	var problems []configProblem
+	if awsRegionName() == "" {
+		problems = append(problems, configError(awsRegion, "is needed for Timestream, or set AWS_REGION"))
+	}
+	if conf.GetString(timestreamTable) == "" {
+		problems = append(problems, configError(timestreamTable, "can't be empty"))
+	}
+	if conf.GetString(timestreamMeasureName) == "" {
+		problems = append(problems, configError(timestreamMeasureName, "can't be empty"))
+	}
+	if v := conf.GetString(timestreamEndpoint); v != "" {
+		if u, err := url.Parse(v); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, configError(timestreamEndpoint, "invalid URL %q", v))
+		}
+	}
+	for name := range conf.GetStringMapString(extraLabels) {
+		if name == conf.GetString(timestreamMeasureName) || name == temperatureMetric || name == pressureMetric || name == humidityMetric {
+			problems = append(problems, configError(extraLabels, "Timestream can't have a dimension called %s as well as a measure", name))
+		}
+	}
+	return problems
+}
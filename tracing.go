@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Tracing of scrapes, sensor reads, and pushes, exported over OTLP/HTTP to
+// Tempo, Jaeger, or an OpenTelemetry collector. Like the gRPC server, the
+// protobuf messages are encoded by hand rather than pulling in the whole SDK.
+// Spans are nil when tracing is off, and all their methods do nothing then.
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusOK    = 1
+	spanStatusError = 2
+
+	traceBatchSize     = 512
+	traceQueueSize     = 2048
+	traceFlushInterval = 5 * time.Second
+)
+
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttr
+	err      error
+	// Only carries the IDs of a span from the caller's traceparent
+	remote bool
+}
+
+type spanAttr struct {
+	key   string
+	value interface{}
+}
+
+type spanKey struct{}
+
+type tracer struct {
+	endpoint string
+	ratio    float64
+	client   *http.Client
+
+	spans chan *span
+	done  chan struct{}
+
+	mu      sync.Mutex
+	dropped int
+}
+
+var activeTracer *tracer
+
+func init() {
+	configChecks = append(configChecks, checkTracingSettings)
+}
+
+// Start exporting spans if an endpoint is configured, until the context is cancelled
+func startTracing(ctx context.Context) (*tracer, error) {
+	endpoint := conf.GetString(tracingEndpoint)
+	if endpoint == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid tracing endpoint %q, use e.g. http://tempo:4318", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	t := &tracer{
+		endpoint: u.String(),
+		ratio:    conf.GetFloat64(tracingSampleRatio),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, traceQueueSize),
+		done:     make(chan struct{}),
+	}
+	activeTracer = t
+	go t.run(ctx)
+	lg.Infof("Sending traces to %s", t.endpoint)
+	return t, nil
+}
+
+// Wait for the last spans to be sent after the context has been cancelled
+func (t *tracer) wait() {
+	<-t.done
+}
+
+func (t *tracer) run(ctx context.Context) {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			lg.Warnf("Problem sending %d spans: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			// Finish off whatever has been queued already
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *tracer) export(spans []*span) error {
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(encodeTraceRequest(spans)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Start a span as a child of whatever span is in the context, or a new
+// trace if there isn't one and it's picked by the sample ratio
+func startSpan(ctx context.Context, name string, kind int, attrs ...spanAttr) (context.Context, *span) {
+	t := activeTracer
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		if parent == nil {
+			// Part of a trace that isn't being sampled
+			return ctx, nil
+		}
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		if mathrand.Float64() >= t.ratio {
+			return ctx, nil
+		}
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Continue the trace from a W3C traceparent header, if the caller sent one
+// and sampled it. See https://www.w3.org/TR/trace-context/
+func contextFromTraceparent(ctx context.Context, header string) context.Context {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	s := &span{remote: true}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || s.traceID == [16]byte{} || s.spanID == [8]byte{} {
+		return ctx
+	}
+	if flags[0]&1 == 0 {
+		// The caller decided not to trace this one, so neither do we
+		return context.WithValue(ctx, spanKey{}, (*span)(nil))
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// The traceparent header for calls made within the span
+func (s *span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	if s != nil {
+		s.attrs = append(s.attrs, spanAttr{key, value})
+	}
+}
+
+// Mark the span as failed, if there was an error
+func (s *span) recordError(err error) {
+	if s != nil && err != nil {
+		s.err = err
+	}
+}
+
+// Finish the span and queue it for sending
+func (s *span) finish() {
+	t := activeTracer
+	if s == nil || t == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case t.spans <- s:
+	default:
+		t.mu.Lock()
+		t.dropped++
+		dropped := t.dropped
+		t.mu.Unlock()
+		lg.Debugf("Dropped a span, the queue is full (%d so far)", dropped)
+	}
+}
+
+// opentelemetry.proto.collector.trace.v1.ExportTraceServiceRequest
+func encodeTraceRequest(spans []*span) []byte {
+	var resource []byte
+	for _, a := range []spanAttr{
+		{"service.name", "bme280-exporter"},
+		{"service.version", version},
+		{"host.name", hostname},
+	} {
+		resource = protowire.AppendTag(resource, 1, protowire.BytesType)
+		resource = protowire.AppendBytes(resource, encodeKeyValue(a))
+	}
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "github.com/jaevans/bme280-exporter")
+	scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+	scope = protowire.AppendString(scope, version)
+
+	var scopeSpans []byte
+	scopeSpans = protowire.AppendTag(scopeSpans, 1, protowire.BytesType)
+	scopeSpans = protowire.AppendBytes(scopeSpans, scope)
+	for _, s := range spans {
+		scopeSpans = protowire.AppendTag(scopeSpans, 2, protowire.BytesType)
+		scopeSpans = protowire.AppendBytes(scopeSpans, encodeSpan(s))
+	}
+
+	var resourceSpans []byte
+	resourceSpans = protowire.AppendTag(resourceSpans, 1, protowire.BytesType)
+	resourceSpans = protowire.AppendBytes(resourceSpans, resource)
+	resourceSpans = protowire.AppendTag(resourceSpans, 2, protowire.BytesType)
+	resourceSpans = protowire.AppendBytes(resourceSpans, scopeSpans)
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, resourceSpans)
+}
+
+// opentelemetry.proto.trace.v1.Span
+func encodeSpan(s *span) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, s.traceID[:])
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, s.spanID[:])
+	if s.parentID != [8]byte{} {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, s.parentID[:])
+	}
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendString(b, s.name)
+	b = protowire.AppendTag(b, 6, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(s.kind))
+	b = protowire.AppendTag(b, 7, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(s.start.UnixNano()))
+	b = protowire.AppendTag(b, 8, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, uint64(s.end.UnixNano()))
+	for _, a := range s.attrs {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeKeyValue(a))
+	}
+
+	var status []byte
+	if s.err != nil {
+		status = protowire.AppendTag(status, 2, protowire.BytesType)
+		status = protowire.AppendString(status, s.err.Error())
+		status = protowire.AppendTag(status, 3, protowire.VarintType)
+		status = protowire.AppendVarint(status, spanStatusError)
+	} else {
+		status = protowire.AppendTag(status, 3, protowire.VarintType)
+		status = protowire.AppendVarint(status, spanStatusOK)
+	}
+	b = protowire.AppendTag(b, 15, protowire.BytesType)
+	return protowire.AppendBytes(b, status)
+}
+
+// opentelemetry.proto.common.v1.KeyValue
+func encodeKeyValue(a spanAttr) []byte {
+	var v []byte
+	switch x := a.value.(type) {
+	case bool:
+		v = protowire.AppendTag(v, 2, protowire.VarintType)
+		v = protowire.AppendVarint(v, protowire.EncodeBool(x))
+	case int:
+		v = protowire.AppendTag(v, 3, protowire.VarintType)
+		v = protowire.AppendVarint(v, uint64(x))
+	case float64:
+		v = protowire.AppendTag(v, 4, protowire.Fixed64Type)
+		v = protowire.AppendFixed64(v, math.Float64bits(x))
+	default:
+		v = protowire.AppendTag(v, 1, protowire.BytesType)
+		v = protowire.AppendString(v, fmt.Sprint(x))
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, a.key)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func checkTracingSettings() []configProblem {
+	var problems []configProblem
+	if endpoint := conf.GetString(tracingEndpoint); endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, configError(tracingEndpoint, "invalid endpoint %q, use e.g. http://tempo:4318", endpoint))
+		}
+	}
+	if r := conf.GetFloat64(tracingSampleRatio); r < 0 || r > 1 {
+		problems = append(problems, configError(tracingSampleRatio, "must be between 0 and 1"))
+	}
+	return problems
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	watchInterval time.Duration
+	watchHistory  int
+)
+
+func watchFlags(fs *pflag.FlagSet) {
+	sensorFlags(fs)
+	fs.DurationVar(&watchInterval, "interval", 2*time.Second, "How often to read the sensor")
+	fs.IntVar(&watchHistory, "history", 60, "How many readings to show in the sparklines")
+}
+
+// `bme280-exporter watch` shows live readings in the terminal, for when
+// you're moving a sensor around or checking its calibration
+func runWatch(args []string) int {
+	if watchInterval <= 0 || watchHistory < 2 {
+		fmt.Fprintln(os.Stderr, "The interval must be positive and the history at least 2")
+		return 2
+	}
+	if err := openSensor(); err != nil {
+		fmt.Fprintf(os.Stderr, "Problem opening the sensor: %v\n", err)
+		return 1
+	}
+	defer closeSensor()
+	setCalibration(calibrationFromConfig())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	p := newPoller(watchInterval, watchHistory)
+	readings := p.subscribe()
+	p.start(ctx)
+
+	// Hide the cursor while we're redrawing, and put it back however we exit
+	fmt.Print("\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\n")
+	for range readings {
+		drawWatch(os.Stdout, p.Recent())
+	}
+	p.wait()
+	return 0
+}
+
+func drawWatch(w io.Writer, recent []reading) {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	latest := recent[len(recent)-1]
+	bus, addr := currentAddress()
+	fmt.Fprintf(&b, "%s on bus %d at %s, every %s    %s\n\n",
+		sensorNameForID(currentChipID()), bus, formatI2CAddress(addr), watchInterval,
+		latest.Time.Format("15:04:05"))
+
+	metrics := []struct {
+		name  string
+		unit  string
+		value func(reading) float64
+	}{
+		{"Temperature", "°C", func(r reading) float64 { return r.Temperature }},
+		{"Pressure", "hPa", func(r reading) float64 { return r.Pressure / 100 }},
+		{"Humidity", "%", func(r reading) float64 { return r.Humidity }},
+	}
+	for _, m := range metrics {
+		values := make([]float64, len(recent))
+		for i, r := range recent {
+			values[i] = m.value(r)
+		}
+		if allNaN(values) {
+			continue
+		}
+
+		current := "n/a"
+		if v := values[len(values)-1]; !math.IsNaN(v) {
+			current = fmt.Sprintf("%.2f", v)
+		}
+		lo, hi := valueRange(values)
+		fmt.Fprintf(&b, "%-12s %9s %-3s  %s  min %.2f  max %.2f\n", m.name, current, m.unit, trend(values), lo, hi)
+		fmt.Fprintf(&b, "%-12s %s\n\n", "", sparkline(values))
+	}
+	b.WriteString("Press Ctrl+C to quit")
+	io.WriteString(w, b.String())
+}
+
+// Which way the value has moved over the readings shown
+func trend(values []float64) string {
+	first, last := math.NaN(), math.NaN()
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			if math.IsNaN(first) {
+				first = v
+			}
+			last = v
+		}
+	}
+	delta := last - first
+	switch {
+	case math.IsNaN(delta):
+		return "       "
+	case delta >= 0.01:
+		return fmt.Sprintf("↑ %+.2f", delta)
+	case delta <= -0.01:
+		return fmt.Sprintf("↓ %+.2f", delta)
+	}
+	return "→  0.00"
+}
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// One block character per value, scaled between the smallest and largest.
+// Missing values are left blank.
+func sparkline(values []float64) string {
+	lo, hi := valueRange(values)
+	var b strings.Builder
+	for _, v := range values {
+		switch {
+		case math.IsNaN(v):
+			b.WriteRune(' ')
+		case hi == lo:
+			b.WriteRune(sparkBlocks[len(sparkBlocks)/2])
+		default:
+			i := int((v - lo) / (hi - lo) * float64(len(sparkBlocks)-1))
+			b.WriteRune(sparkBlocks[i])
+		}
+	}
+	return b.String()
+}
+
+func valueRange(values []float64) (float64, float64) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+	}
+	return lo, hi
+}
+
+func allNaN(values []float64) bool {
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"gopkg.in/yaml.v2"
+)
+
+// TLS and basic auth come from the --web.config.file format shared by
+// node_exporter and the rest of the Prometheus exporters, handled by the
+// exporter-toolkit, see
+// https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md
+
+// What the toolkit wants to know. It rereads the file on every request and TLS
+// handshake, so changes to users, headers and certificates need no restart.
+func toolkitFlags() *web.FlagConfig {
+	path := conf.GetString(webConfigFile)
+	return &web.FlagConfig{WebConfigFile: &path}
+}
+
+// Read the web config file the way the toolkit does, for the things it
+// doesn't tell us about. Returns nil if there isn't one.
+func readWebConfig() (*web.Config, error) {
+	path := conf.GetString(webConfigFile)
+	if path == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &web.Config{
+		TLSConfig:  web.TLSConfig{MinVersion: web.TLSVersion(tls.VersionTLS12)},
+		HTTPConfig: web.HTTPConfig{HTTP2: true},
+	}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return nil, err
+	}
+	c.TLSConfig.SetDirectory(filepath.Dir(path))
+	return c, nil
+}
+
+// Only serve requests that logged in with the web config's basic auth, for
+// endpoints that mustn't be left open even when the rest of the exporter is.
+// The toolkit has already checked the password by the time we get here.
+func requireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := readWebConfig()
+		if err != nil || c == nil || len(c.Users) == 0 {
+			http.Error(w, "This endpoint needs basic_auth_users in the web config", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Whether the web config file turns on TLS, as a URL scheme
+func webScheme() string {
+	if c, err := readWebConfig(); err == nil && c != nil {
+		if _, err := web.ConfigToTLSConfig(&c.TLSConfig); err == nil {
+			return "https"
+		}
+	}
+	return "http"
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// POSTs readings as JSON to any URL, each reading on its own or a batch of
+// them as an array, for whatever else wants them. Failed requests are tried
+// again like remote writes are.
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "webhook",
+		intervalKey: webhookInterval,
+		enabled:     func() bool { return conf.GetString(webhookURL) != "" },
+		open:        openWebhook,
+		addresses:   func() []string { return urlAddress(conf.GetString(webhookURL), "") },
+	})
+	configChecks = append(configChecks, checkWebhookSettings)
+}
+
+type webhookSink struct {
+	url       string
+	tokenFile string
+	headers   map[string]string
+	batch     bool
+	client    *http.Client
+}
+
+func openWebhook() (sink, error) {
+	s := &webhookSink{
+		url:       conf.GetString(webhookURL),
+		tokenFile: conf.GetString(webhookTokenFile),
+		headers:   conf.GetStringMapString(webhookHeaders),
+		batch:     conf.GetBool(webhookBatch),
+		client:    &http.Client{},
+	}
+	if strings.HasPrefix(s.url, "https:") {
+		cfg, err := clientTLSConfig(conf.GetString(webhookCAFile), "", "", conf.GetBool(webhookInsecureSkipVerify))
+		if err != nil {
+			return nil, err
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = cfg
+		s.client.Transport = t
+	}
+	return s, nil
+}
+
+func (s *webhookSink) push(ctx context.Context, samples []sample) error {
+	if s.batch {
+		body := make([]sampleJSON, len(samples))
+		for i, smp := range samples {
+			body[i] = smp.json()
+		}
+		return s.send(ctx, body)
+	}
+	// One at a time, so if one fails the ones before it get sent again too
+	for _, smp := range samples {
+		if err := s.send(ctx, smp.json()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *webhookSink) send(ctx context.Context, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// Keep trying until the sink timeout runs out, as long as it's worth it
+	backoff := 250 * time.Millisecond
+	for {
+		retry, err := s.post(ctx, body)
+		if err == nil || !retry {
+			return err
+		}
+		lg.Debugf("Retrying the webhook in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Send the request once, and say whether it's worth trying again if it failed
+func (s *webhookSink) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	if s.tokenFile != "" {
+		// Read each time so a rotated token gets picked up
+		token, err := os.ReadFile(s.tokenFile)
+		if err != nil {
+			return false, fmt.Errorf("bearer token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	// Anything else is most likely something wrong with the request, which
+	// won't get any better by sending it again right away
+	retry := resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return retry, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (s *webhookSink) close() error {
+	return nil
+}
+
+func checkWebhookSettings() []configProblem {
+	v := conf.GetString(webhookURL)
+	if v == "" {
+		return nil
+	}
+	var problems []configProblem
+	if u, err := url.Parse(v); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		problems = append(problems, configError(webhookURL, "invalid URL %q", v))
+	}
+	for _, key := range []string{webhookTokenFile, webhookCAFile} {
+		if f := conf.GetString(key); f != "" {
+			if _, err := os.Stat(f); err != nil {
+				problems = append(problems, configError(key, "%v", err))
+			}
+		}
+	}
+	for k := range conf.GetStringMapString(webhookHeaders) {
+		if strings.EqualFold(k, "Authorization") && conf.GetString(webhookTokenFile) != "" {
+			problems = append(problems, configWarning(webhookHeaders, "the Authorization header is replaced by the bearer token"))
+		}
+	}
+	if conf.GetBool(webhookInsecureSkipVerify) {
+		problems = append(problems, configWarning(webhookInsecureSkipVerify, "the webhook's certificate isn't checked"))
+	}
+	return problems
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Uploads the latest reading to Windy's personal weather station API, which
+// puts it on the map's community stations layer. See
+// https://community.windy.com/topic/8168/report-your-weather-station-data-to-windy
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "windy",
+		intervalKey: windyInterval,
+		enabled:     func() bool { return conf.GetString(windyAPIKeyFile) != "" },
+		open:        openWindy,
+		addresses:   func() []string { return urlAddress(conf.GetString(windyURL), "") },
+	})
+	configChecks = append(configChecks, checkWindySettings)
+}
+
+// Windy turns down updates that come more often than this
+const windyMinInterval = 5 * time.Minute
+
+type windySink struct {
+	url        string
+	apiKeyFile string
+	station    int
+	altitude   float64
+	client     *http.Client
+}
+
+func openWindy() (sink, error) {
+	return &windySink{
+		url:        strings.TrimSuffix(conf.GetString(windyURL), "/"),
+		apiKeyFile: conf.GetString(windyAPIKeyFile),
+		station:    conf.GetInt(windyStation),
+		altitude:   conf.GetFloat64(windyAltitude),
+		client:     &http.Client{},
+	}, nil
+}
+
+func (s *windySink) push(ctx context.Context, samples []sample) error {
+	latest := samples[len(samples)-1].reading
+	q := url.Values{}
+	q.Set("station", strconv.Itoa(s.station))
+	q.Set("ts", strconv.FormatInt(latest.Time.Unix(), 10))
+	if !math.IsNaN(latest.Temperature) {
+		q.Set("temp", strconv.FormatFloat(latest.Temperature, 'f', 1, 64))
+	}
+	if !math.IsNaN(latest.Humidity) {
+		q.Set("humidity", strconv.FormatFloat(latest.Humidity, 'f', 0, 64))
+		if !math.IsNaN(latest.Temperature) && latest.Humidity > 0 {
+			q.Set("dewpoint", strconv.FormatFloat(dewPoint(latest.Temperature, latest.Humidity), 'f', 1, 64))
+		}
+	}
+	if !math.IsNaN(latest.Pressure) {
+		p := latest.Pressure
+		if s.altitude != 0 && !math.IsNaN(latest.Temperature) {
+			p = seaLevelPressure(p, latest.Temperature, s.altitude)
+		}
+		q.Set("pressure", strconv.FormatFloat(p, 'f', 0, 64))
+	}
+	// Nothing but the station and time
+	if len(q) == 2 {
+		return nil
+	}
+
+	// Read each time so a new key gets picked up
+	key, err := os.ReadFile(s.apiKeyFile)
+	if err != nil {
+		return fmt.Errorf("API key: %w", err)
+	}
+	u := s.url + "/" + url.PathEscape(strings.TrimSpace(string(key))) + "?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "bme280-exporter/"+version)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// The URL has the key in it
+		if ue, ok := err.(*url.Error); ok {
+			return ue.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *windySink) close() error {
+	return nil
+}
+
+func checkWindySettings() []configProblem {
+	f := conf.GetString(windyAPIKeyFile)
+	if f == "" {
+		return nil
+	}
+	var problems []configProblem
+	if _, err := os.Stat(f); err != nil {
+		problems = append(problems, configError(windyAPIKeyFile, "%v", err))
+	}
+	if u, err := url.Parse(conf.GetString(windyURL)); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		problems = append(problems, configError(windyURL, "invalid URL %q", conf.GetString(windyURL)))
+	}
+	if n := conf.GetInt(windyStation); n < 0 {
+		problems = append(problems, configError(windyStation, "can't be negative"))
+	}
+	if i := conf.GetDuration(windyInterval); i < windyMinInterval {
+		problems = append(problems, configWarning(windyInterval, "Windy turns down updates more often than every %v", windyMinInterval))
+	}
+	return problems
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Sends readings to Zabbix trapper items with the same protocol as
+// zabbix_sender, to the server or a proxy. The items have to be made in
+// Zabbix first, with the type Zabbix trapper. See
+// https://www.zabbix.com/documentation/current/en/manual/appendix/protocols/zabbix_sender
+
+// The most values in a request, the same as zabbix_sender
+const zabbixBatchSize = 250
+
+func init() {
+	sinkTypes = append(sinkTypes, sinkType{
+		name:        "zabbix",
+		intervalKey: zabbixInterval,
+		enabled:     func() bool { return conf.GetString(zabbixServer) != "" },
+		open:        openZabbix,
+		addresses:   func() []string { return hostAddress(conf.GetString(zabbixServer), "10051") },
+	})
+	configChecks = append(configChecks, checkZabbixSettings)
+}
+
+type zabbixValue struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+	NS    int    `json:"ns"`
+}
+
+type zabbixSink struct {
+	address string
+	host    string
+	// The item key for each metric
+	keys map[string]string
+	tls  *tls.Config
+}
+
+func openZabbix() (sink, error) {
+	s := &zabbixSink{
+		address: conf.GetString(zabbixServer),
+		host:    conf.GetString(zabbixHost),
+		keys:    conf.GetStringMapString(zabbixKeys),
+	}
+	if _, _, err := net.SplitHostPort(s.address); err != nil {
+		s.address = net.JoinHostPort(s.address, "10051")
+	}
+	if s.host == "" {
+		s.host = hostname
+	}
+	if cert := conf.GetString(zabbixCertFile); cert != "" {
+		cfg, err := clientTLSConfig(conf.GetString(zabbixCAFile), cert, conf.GetString(zabbixKeyFile), false)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServerName = conf.GetString(zabbixServerName)
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(s.address)
+		}
+		s.tls = cfg
+	}
+	return s, nil
+}
+
+func (s *zabbixSink) push(ctx context.Context, samples []sample) error {
+	var values []zabbixValue
+	for _, smp := range samples {
+		for _, v := range smp.values() {
+			if key := s.keys[v.name]; key != "" {
+				values = append(values, zabbixValue{
+					Host:  s.host,
+					Key:   key,
+					Value: strconv.FormatFloat(v.value, 'f', -1, 64),
+					Clock: smp.Time.Unix(),
+					NS:    smp.Time.Nanosecond(),
+				})
+			}
+		}
+	}
+	for start := 0; start < len(values); start += zabbixBatchSize {
+		if err := s.send(ctx, values[start:min(start+zabbixBatchSize, len(values))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *zabbixSink) send(ctx context.Context, values []zabbixValue) error {
+	now := time.Now()
+	body, err := json.Marshal(map[string]any{
+		"request": "sender data",
+		"data":    values,
+		"clock":   now.Unix(),
+		"ns":      now.Nanosecond(),
+	})
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return err
+	}
+	if s.tls != nil {
+		conn = tls.Client(conn, s.tls)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(zabbixPacket(body)); err != nil {
+		return err
+	}
+	resp, err := readZabbixPacket(conn)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		Response string `json:"response"`
+		Info     string `json:"info"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return fmt.Errorf("unexpected response %q", resp)
+	}
+	if result.Response != "success" {
+		return fmt.Errorf("%s: %s", result.Response, result.Info)
+	}
+	// Values for items that don't exist, or aren't trapper items, are turned
+	// down the same way every time, so they're not worth sending again
+	if m := zabbixFailedRe.FindStringSubmatch(result.Info); m != nil && m[1] != "0" {
+		lg.Warnf("Zabbix turned down %s of %d values, check the items for host %s are Zabbix trapper items: %s", m[1], len(values), s.host, result.Info)
+	}
+	return nil
+}
+
+// Like "processed: 2; failed: 1; total: 3; seconds spent: 0.000055"
+var zabbixFailedRe = regexp.MustCompile(`failed: (\d+)`)
+
+// The header's flags
+const (
+	zabbixProtocol   = 0x01
+	zabbixCompressed = 0x02
+	zabbixLarge      = 0x04
+)
+
+// A message with the header: ZBXD, the flags, and the length of the data and
+// of it uncompressed, which isn't
+func zabbixPacket(data []byte) []byte {
+	b := append([]byte("ZBXD"), zabbixProtocol)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	return append(b, data...)
+}
+
+func readZabbixPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:4], []byte("ZBXD")) {
+		return nil, errors.New("not a Zabbix response")
+	}
+	flags := header[4]
+	var length, reserved uint64
+	if flags&zabbixLarge != 0 {
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		length, reserved = binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint64(b[8:])
+	} else {
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		length, reserved = uint64(binary.LittleEndian.Uint32(b)), uint64(binary.LittleEndian.Uint32(b[4:]))
+	}
+	if length > 1<<20 || reserved > 1<<20 {
+		return nil, fmt.Errorf("Zabbix response too large: %d bytes", max(length, reserved))
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if flags&zabbixCompressed == 0 {
+		return data, nil
+	}
+	// The reserved field is the uncompressed length
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(io.LimitReader(zr, int64(reserved)))
+}
+
+func (s *zabbixSink) close() error {
+	return nil
+}
+
+func checkZabbixSettings() []configProblem {
+	if conf.GetString(zabbixServer) == "" {
+		return nil
+	}
+	var problems []configProblem
+	keys := conf.GetStringMapString(zabbixKeys)
+	if len(keys) == 0 {
+		problems = append(problems, configError(zabbixKeys, "no metrics are mapped to item keys"))
+	}
+	for metric := range keys {
+		if metric != temperatureMetric && metric != pressureMetric && metric != humidityMetric {
+			problems = append(problems, configError(zabbixKeys, "unknown metric %q, use temperature, pressure or humidity", metric))
+		}
+	}
+	cert, key := conf.GetString(zabbixCertFile), conf.GetString(zabbixKeyFile)
+	if (cert == "") != (key == "") {
+		problems = append(problems, configError(zabbixCertFile, "%s and %s go together", zabbixCertFile, zabbixKeyFile))
+	}
+	if cert == "" && conf.GetString(zabbixCAFile) != "" {
+		problems = append(problems, configWarning(zabbixCAFile, "TLS is only used with a certificate, set %s too", zabbixCertFile))
+	}
+	for _, k := range []string{zabbixCAFile, zabbixCertFile, zabbixKeyFile} {
+		if f := conf.GetString(k); f != "" {
+			if _, err := os.Stat(f); err != nil {
+				problems = append(problems, configError(k, "%v", err))
+			}
+		}
+	}
+	return problems
+}